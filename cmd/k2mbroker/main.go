@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
 	"strings"
@@ -14,7 +15,8 @@ import (
 
 var (
 	// General flags
-	configFile  = flag.String("config", "", "Path to configuration file (JSON)")
+	configFile  = flag.String("config", "", "Path to configuration file (JSON or YAML)")
+	printConfig = flag.Bool("print-config", false, "Print the effective configuration with secrets redacted and exit")
 	logFilename = flag.String("log-file", "-", "Log file path (default: stdout)")
 	logLevel    = flag.Int("log-level", 1, "Log verbosity level (0=quiet, 1=info, 2=debug)")
 	pidFile     = flag.String("pid", "", "PID file path")
@@ -29,9 +31,11 @@ var (
 	mqttBroker   = flag.String("mqtt-broker", "tcp://localhost:1883", "MQTT broker URL")
 	mqttClientID = flag.String("mqtt-client-id", "k2m-broker", "MQTT client ID")
 	mqttUsername = flag.String("mqtt-username", "", "MQTT username")
-	mqttPassword = flag.String("mqtt-password", "", "MQTT password")
+	mqttPassword = flag.String("mqtt-password", "", "MQTT password or secret reference (file:/path, env:NAME)")
 	mqttQoS      = flag.Int("mqtt-qos", 1, "MQTT QoS level (0, 1, or 2)")
 	mqttRetained = flag.Bool("mqtt-retained", false, "Publish MQTT messages as retained")
+	mqttPoolSize = flag.Int("mqtt-pool-size", 1, "Number of MQTT connections, messages are sharded by topic")
+	mqttInFlight = flag.Int("mqtt-max-inflight", 0, "Asynchronous publishes per MQTT connection waiting for acknowledgement (0 waits for every publish)")
 
 	// Topic mapping flags
 	topicMappings    = flag.String("topic-mappings", "test-topic=mqtt/test", "Comma-separated topic mappings (kafka-topic=mqtt-topic)")
@@ -47,19 +51,21 @@ var (
 	httpPort    = flag.Int("http-port", 8080, "HTTP server port")
 )
 
+// envPrefix is the prefix of the environment variables that override flags,
+// e.g. K2M_MQTT_BROKER for -mqtt-broker.
+const envPrefix = "K2M_"
+
 func main() {
 	flag.Parse()
 
+	// Environment variables apply to the flags not given on the command line
+	envErr := applyEnvironment(flag.CommandLine)
+
 	// Create logger
 	logger := createLogger()
-
-	// Write PID file
-	if *pidFile != "" {
-		if err := writePIDFile(*pidFile); err != nil {
-			logger.Errorf("Failed to write PID file: %v", err)
-			os.Exit(1)
-		}
-		defer removePIDFile(*pidFile)
+	if envErr != nil {
+		logger.Errorf("Failed to apply environment: %v", envErr)
+		os.Exit(1)
 	}
 
 	// Load configuration
@@ -71,6 +77,29 @@ func main() {
 	// Override with command line flags
 	applyCommandLineFlags(config)
 
+	if *printConfig {
+		if err := writeConfig(os.Stdout, config.Redacted()); err != nil {
+			logger.Errorf("Failed to print configuration: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Resolve secret references
+	if err := config.ResolveSecrets(); err != nil {
+		logger.Errorf("Failed to resolve secrets: %v", err)
+		os.Exit(1)
+	}
+
+	// Write PID file
+	if *pidFile != "" {
+		if err := writePIDFile(*pidFile); err != nil {
+			logger.Errorf("Failed to write PID file: %v", err)
+			os.Exit(1)
+		}
+		defer removePIDFile(*pidFile)
+	}
+
 	// Create and start the broker
 	broker, err := k2m.NewK2MBroker(config, logger)
 	if err != nil {
@@ -110,83 +139,121 @@ func createLogger() *util.Log {
 }
 
 func loadConfiguration(configFile string) (*k2m.K2MConfig, error) {
-	var config *k2m.K2MConfig
-
 	// Load from file if specified
 	if configFile != "" {
-		configData, err := os.ReadFile(configFile)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read config file: %w", err)
-		}
+		return k2m.LoadConfig(configFile)
+	}
+	// Use default config and override with command line flags
+	return k2m.DefaultConfig(), nil
+}
 
-		config = &k2m.K2MConfig{}
-		if err := json.Unmarshal(configData, config); err != nil {
-			return nil, fmt.Errorf("failed to parse config file: %w", err)
+// writeConfig writes the configuration as indented JSON
+func writeConfig(w io.Writer, config *k2m.K2MConfig) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(config)
+}
+
+// envName returns the environment variable name of the flag
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// applyEnvironment sets the flags that were not given on the command line
+// from the K2M_* environment variables.
+// Command line flags take precedence over the environment.
+func applyEnvironment(fs *flag.FlagSet) error {
+	given := setFlags(fs)
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || given[f.Name] {
+			return
 		}
-	} else {
-		// Use default config and override with command line flags
-		config = k2m.DefaultConfig()
-	}
+		if value, ok := os.LookupEnv(envName(f.Name)); ok {
+			if e := fs.Set(f.Name, value); e != nil {
+				err = fmt.Errorf("invalid value %q for %s: %w", value, envName(f.Name), e)
+			}
+		}
+	})
+	return err
+}
 
-	return config, nil
+// setFlags returns the names of the flags that have been set,
+// either on the command line or by applyEnvironment.
+func setFlags(fs *flag.FlagSet) map[string]bool {
+	ret := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		ret[f.Name] = true
+	})
+	return ret
 }
 
+// applyCommandLineFlags overrides the configuration with the flags that have been set.
+// The precedence is: command line flags > K2M_* environment > config file > defaults.
 func applyCommandLineFlags(config *k2m.K2MConfig) {
+	isSet := setFlags(flag.CommandLine)
+
 	// Kafka configuration
-	if flag.Lookup("kafka-brokers").Value.String() != flag.Lookup("kafka-brokers").DefValue {
+	if isSet["kafka-brokers"] {
 		config.KafkaConfig.Brokers = strings.Split(*kafkaBrokers, ",")
 	}
-	if flag.Lookup("kafka-topics").Value.String() != flag.Lookup("kafka-topics").DefValue {
+	if isSet["kafka-topics"] {
 		config.KafkaConfig.Topics = strings.Split(*kafkaTopics, ",")
 	}
-	if flag.Lookup("consumer-group").Value.String() != flag.Lookup("consumer-group").DefValue {
+	if isSet["consumer-group"] {
 		config.KafkaConfig.ConsumerGroup = *consumerGroup
 	}
-	if flag.Lookup("offset-oldest").Value.String() != flag.Lookup("offset-oldest").DefValue {
+	if isSet["offset-oldest"] {
 		config.KafkaConfig.OffsetOldest = *offsetOldest
 	}
 
 	// MQTT configuration
-	if flag.Lookup("mqtt-broker").Value.String() != flag.Lookup("mqtt-broker").DefValue {
+	if isSet["mqtt-broker"] {
 		config.MQTTConfig.Broker = *mqttBroker
 	}
-	if flag.Lookup("mqtt-client-id").Value.String() != flag.Lookup("mqtt-client-id").DefValue {
+	if isSet["mqtt-client-id"] {
 		config.MQTTConfig.ClientID = *mqttClientID
 	}
-	if *mqttUsername != "" {
+	if isSet["mqtt-username"] {
 		config.MQTTConfig.Username = *mqttUsername
 	}
-	if *mqttPassword != "" {
+	if isSet["mqtt-password"] {
 		config.MQTTConfig.Password = *mqttPassword
 	}
-	if flag.Lookup("mqtt-qos").Value.String() != flag.Lookup("mqtt-qos").DefValue {
+	if isSet["mqtt-qos"] {
 		config.MQTTConfig.QoS = byte(*mqttQoS)
 	}
-	if flag.Lookup("mqtt-retained").Value.String() != flag.Lookup("mqtt-retained").DefValue {
+	if isSet["mqtt-retained"] {
 		config.MQTTConfig.Retained = *mqttRetained
 	}
+	if isSet["mqtt-pool-size"] {
+		config.MQTTConfig.PoolSize = *mqttPoolSize
+	}
+	if isSet["mqtt-max-inflight"] {
+		config.MQTTConfig.MaxInFlight = *mqttInFlight
+	}
 
 	// Topic mappings
-	if flag.Lookup("topic-mappings").Value.String() != flag.Lookup("topic-mappings").DefValue {
+	if isSet["topic-mappings"] {
 		config.TopicMappings = parseTopicMappings(*topicMappings, *messageTransform)
 	}
 
 	// Worker configuration
-	if flag.Lookup("workers").Value.String() != flag.Lookup("workers").DefValue {
+	if isSet["workers"] {
 		config.WorkerCount = *workerCount
 	}
-	if flag.Lookup("buffer-size").Value.String() != flag.Lookup("buffer-size").DefValue {
+	if isSet["buffer-size"] {
 		config.BufferSize = *bufferSize
 	}
 
 	// Health check configuration
-	if flag.Lookup("http-enabled").Value.String() != flag.Lookup("http-enabled").DefValue {
+	if isSet["http-enabled"] {
 		config.HttpConfig.Enabled = *httpEnabled
 	}
-	if flag.Lookup("http-host").Value.String() != flag.Lookup("http-host").DefValue && *httpHost != "" {
+	if isSet["http-host"] && *httpHost != "" {
 		config.HttpConfig.Host = *httpHost
 	}
-	if flag.Lookup("http-port").Value.String() != flag.Lookup("http-port").DefValue {
+	if isSet["http-port"] {
 		config.HttpConfig.Port = *httpPort
 	}
 }
@@ -395,3 +395,44 @@ func BenchmarkLoadConfigurationFromFile(b *testing.B) {
 		loadConfiguration(tmpFile.Name())
 	}
 }
+
+func TestApplyEnvironment(t *testing.T) {
+	fs := flag.NewFlagSet("k2mbroker", flag.ContinueOnError)
+	broker := fs.String("mqtt-broker", "tcp://localhost:1883", "MQTT broker URL")
+	workers := fs.Int("workers", 5, "Number of message processing workers")
+	clientID := fs.String("mqtt-client-id", "k2m-broker", "MQTT client ID")
+	require.NoError(t, fs.Parse([]string{"-workers", "7"}))
+
+	t.Setenv("K2M_MQTT_BROKER", "tcp://env:1883")
+	t.Setenv("K2M_WORKERS", "9")
+
+	require.NoError(t, applyEnvironment(fs))
+
+	// environment applies to flags not given on the command line
+	assert.Equal(t, "tcp://env:1883", *broker)
+	// command line takes precedence over the environment
+	assert.Equal(t, 7, *workers)
+	assert.Equal(t, "k2m-broker", *clientID)
+
+	isSet := setFlags(fs)
+	assert.True(t, isSet["mqtt-broker"])
+	assert.True(t, isSet["workers"])
+	assert.False(t, isSet["mqtt-client-id"])
+
+	assert.Equal(t, "K2M_MQTT_CLIENT_ID", envName("mqtt-client-id"))
+
+	fs2 := flag.NewFlagSet("k2mbroker", flag.ContinueOnError)
+	fs2.Int("workers", 5, "")
+	t.Setenv("K2M_WORKERS", "many")
+	assert.ErrorContains(t, applyEnvironment(fs2), "K2M_WORKERS")
+}
+
+func TestWriteConfigRedacted(t *testing.T) {
+	config := k2m.DefaultConfig()
+	config.MQTTConfig.Password = "plain-secret"
+
+	var sb strings.Builder
+	require.NoError(t, writeConfig(&sb, config.Redacted()))
+	assert.NotContains(t, sb.String(), "plain-secret")
+	assert.Contains(t, sb.String(), `"password": "******"`)
+}
@@ -0,0 +1,201 @@
+package k2m
+
+import (
+	"actsvr/util"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// AuditConfig holds settings of the structured audit log
+type AuditConfig struct {
+	Enabled bool `json:"enabled"`
+	// Filename of the JSONL audit log, "-" for stdout
+	Filename   string `json:"filename"`
+	MaxSize    int    `json:"maxSize,omitempty"`    // megabytes
+	MaxBackups int    `json:"maxBackups,omitempty"` // number of rotated files to keep
+	MaxAge     int    `json:"maxAge,omitempty"`     // days
+	Compress   bool   `json:"compress,omitempty"`
+	// SampleRate is the fraction of messages to record (0.0 to 1.0), default 1.0
+	SampleRate *float64 `json:"sampleRate,omitempty"`
+	// Routes limits the audit log to the named routes.
+	// Empty means all routes, including messages that match no route.
+	Routes []string `json:"routes,omitempty"`
+}
+
+// Audit outcomes
+const (
+	AuditOutcomePublished       = "published"
+	AuditOutcomeNoRoute         = "no_route"
+	AuditOutcomeSchemaInvalid   = "schema_invalid"
+	AuditOutcomeDeadLettered    = "dead_lettered"
+	AuditOutcomeTombstoneClear  = "tombstone_cleared"
+	AuditOutcomeTombstoneDrop   = "tombstone_dropped"
+	AuditOutcomeTransformError  = "transform_error"
+	AuditOutcomePublishTimeout  = "publish_timeout"
+	AuditOutcomePublishError    = "publish_error"
+	AuditOutcomeSinkQueued      = "sink_queued"
+	AuditOutcomeSinkError       = "sink_error"
+	AuditOutcomeDuplicate       = "duplicate"
+	AuditOutcomeDecompressError = "decompress_error"
+)
+
+// FilterResult is the result of a single filter evaluated by the router
+type FilterResult struct {
+	Route   string `json:"route"`
+	Filter  string `json:"filter"`
+	Type    string `json:"type"`
+	Matched bool   `json:"matched"`
+}
+
+// AuditEvent is a single line of the audit log
+type AuditEvent struct {
+	Time        time.Time      `json:"time"`
+	Source      string         `json:"source,omitempty"`
+	Topic       string         `json:"topic"`
+	Partition   int32          `json:"partition"`
+	Offset      int64          `json:"offset"`
+	KeyHash     string         `json:"keyHash,omitempty"`
+	Route       string         `json:"route,omitempty"`
+	Filters     []FilterResult `json:"filters,omitempty"`
+	MQTTTopic   string         `json:"mqttTopic,omitempty"`
+	PayloadSize int            `json:"payloadSize"`
+	LatencyUs   int64          `json:"latencyUs"`
+	Outcome     string         `json:"outcome"`
+	Error       string         `json:"error,omitempty"`
+}
+
+func newAuditEvent(message *sarama.ConsumerMessage) *AuditEvent {
+	return &AuditEvent{
+		Time:        time.Now(),
+		Topic:       message.Topic,
+		Partition:   message.Partition,
+		Offset:      message.Offset,
+		KeyHash:     hashKey(message.Key),
+		PayloadSize: len(message.Value),
+	}
+}
+
+// setOutcome sets the outcome of the event, it is a no-op on a nil event
+func (e *AuditEvent) setOutcome(outcome string, err error) {
+	if e == nil {
+		return
+	}
+	e.Outcome = outcome
+	if err != nil {
+		e.Error = err.Error()
+	}
+}
+
+// hashKey returns a short hash of the message key so that keys
+// can be correlated without writing them to the audit log.
+func hashKey(key []byte) string {
+	if len(key) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Auditor writes AuditEvents as JSON lines.
+// A nil *Auditor is valid and records nothing.
+type Auditor struct {
+	w          io.Writer
+	mu         sync.Mutex
+	sampleRate float64
+	routes     map[string]bool
+}
+
+// NewAuditor creates an auditor, it returns nil if the audit log is disabled
+func NewAuditor(config AuditConfig) (*Auditor, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+	if config.Filename == "" {
+		return nil, fmt.Errorf("audit log requires a filename")
+	}
+	sampleRate := 1.0
+	if config.SampleRate != nil {
+		sampleRate = *config.SampleRate
+		if sampleRate < 0 || sampleRate > 1 {
+			return nil, fmt.Errorf("audit sampleRate must be between 0 and 1, got %v", sampleRate)
+		}
+	}
+
+	logConf := util.DefaultLogConfig()
+	logConf.Filename = config.Filename
+	logConf.Append = true
+	if config.MaxSize > 0 {
+		logConf.MaxSize = config.MaxSize
+	}
+	if config.MaxBackups > 0 {
+		logConf.MaxBackups = config.MaxBackups
+	}
+	if config.MaxAge > 0 {
+		logConf.MaxAge = config.MaxAge
+	}
+	logConf.Compress = config.Compress
+
+	a := &Auditor{
+		w:          util.NewLog(logConf).LogOutput()[0],
+		sampleRate: sampleRate,
+	}
+	if len(config.Routes) > 0 {
+		a.routes = make(map[string]bool, len(config.Routes))
+		for _, r := range config.Routes {
+			a.routes[r] = true
+		}
+	}
+	return a, nil
+}
+
+// Sample reports whether the current message should be recorded
+func (a *Auditor) Sample() bool {
+	if a == nil || a.sampleRate <= 0 {
+		return false
+	}
+	return a.sampleRate >= 1 || rand.Float64() < a.sampleRate
+}
+
+// Record writes the event if its route is enabled
+func (a *Auditor) Record(event *AuditEvent, latency time.Duration) error {
+	if a == nil || event == nil {
+		return nil
+	}
+	if a.routes != nil && !a.routes[event.Route] {
+		return nil
+	}
+	event.LatencyUs = latency.Microseconds()
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err = a.w.Write(line)
+	return err
+}
+
+// Close closes the underlying log file
+func (a *Auditor) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	// only the rotating file writer is closed, never stdout
+	if lj, ok := a.w.(*lumberjack.Logger); ok {
+		return lj.Close()
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package k2m
+
+import (
+	"actsvr/util"
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readAuditEvents(t *testing.T, filename string) []AuditEvent {
+	f, err := os.Open(filename)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var events []AuditEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var ev AuditEvent
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &ev))
+		events = append(events, ev)
+	}
+	require.NoError(t, scanner.Err())
+	return events
+}
+
+func newAuditTestBroker(t *testing.T, audit AuditConfig) *K2MBroker {
+	config := DefaultConfig()
+	config.TopicMappings = nil
+	config.Routes = []RouteConfig{
+		{
+			Name:     "alerts",
+			Priority: 10,
+			Filters: []FilterConfig{
+				{Type: "topic", Config: map[string]interface{}{"pattern": "^alerts$"}},
+				{Type: "key", Config: map[string]interface{}{"pattern": "^critical"}},
+			},
+			Mapping: TopicMapping{KafkaTopic: "alerts", MQTTTopic: "alerts/{key}", Transform: "none"},
+		},
+		{
+			Name:     "sensors",
+			Priority: 1,
+			Filters: []FilterConfig{
+				{Type: "topic", Config: map[string]interface{}{"pattern": "^sensors$"}},
+			},
+			Mapping: TopicMapping{KafkaTopic: "sensors", MQTTTopic: "sensors/{partition}", Transform: "none"},
+		},
+	}
+	config.Audit = audit
+	broker, err := NewK2MBroker(config, util.NewLog(util.DefaultLogConfig()))
+	require.NoError(t, err)
+	broker.mqttClient = NewMockMQTTClient()
+	return broker
+}
+
+func TestAuditLogRecordsRoutingDecisions(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.jsonl")
+	broker := newAuditTestBroker(t, AuditConfig{Enabled: true, Filename: filename})
+	worker := &MessageWorker{id: 1, broker: broker, messageCh: broker.messageCh}
+
+	worker.processMessage(&sarama.ConsumerMessage{
+		Topic: "alerts", Partition: 1, Offset: 7, Key: []byte("critical-1"), Value: []byte("boom"), Timestamp: time.Now(),
+	})
+	worker.processMessage(&sarama.ConsumerMessage{
+		Topic: "sensors", Partition: 3, Offset: 8, Key: []byte("dev-1"), Value: []byte("21.5"), Timestamp: time.Now(),
+	})
+	worker.processMessage(&sarama.ConsumerMessage{
+		Topic: "other", Partition: 0, Offset: 9, Value: []byte("x"), Timestamp: time.Now(),
+	})
+	require.NoError(t, broker.auditor.Close())
+
+	events := readAuditEvents(t, filename)
+	require.Len(t, events, 3)
+
+	assert.Equal(t, "alerts", events[0].Route)
+	assert.Equal(t, "alerts/critical-1", events[0].MQTTTopic)
+	assert.Equal(t, AuditOutcomePublished, events[0].Outcome)
+	assert.Equal(t, int32(1), events[0].Partition)
+	assert.Equal(t, int64(7), events[0].Offset)
+	assert.Equal(t, 4, events[0].PayloadSize)
+	assert.Equal(t, hashKey([]byte("critical-1")), events[0].KeyHash)
+	assert.Len(t, events[0].Filters, 2)
+
+	assert.Equal(t, "sensors", events[1].Route)
+	assert.Equal(t, "sensors/3", events[1].MQTTTopic)
+	// alerts topic filter failed, then sensors topic filter matched
+	require.Len(t, events[1].Filters, 2)
+	assert.Equal(t, FilterResult{Route: "alerts", Filter: "topic_filter", Type: "topic", Matched: false}, events[1].Filters[0])
+	assert.Equal(t, FilterResult{Route: "sensors", Filter: "topic_filter", Type: "topic", Matched: true}, events[1].Filters[1])
+
+	assert.Equal(t, "", events[2].Route)
+	assert.Equal(t, AuditOutcomeNoRoute, events[2].Outcome)
+	assert.NotEmpty(t, events[2].Error)
+	assert.Empty(t, events[2].KeyHash)
+}
+
+func TestAuditLogRouteSelectionAndSampling(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.jsonl")
+	broker := newAuditTestBroker(t, AuditConfig{Enabled: true, Filename: filename, Routes: []string{"sensors"}})
+	worker := &MessageWorker{id: 1, broker: broker, messageCh: broker.messageCh}
+
+	worker.processMessage(&sarama.ConsumerMessage{Topic: "alerts", Key: []byte("critical"), Value: []byte("a")})
+	worker.processMessage(&sarama.ConsumerMessage{Topic: "sensors", Value: []byte("b")})
+	worker.processMessage(&sarama.ConsumerMessage{Topic: "other", Value: []byte("c")})
+	require.NoError(t, broker.auditor.Close())
+
+	events := readAuditEvents(t, filename)
+	require.Len(t, events, 1)
+	assert.Equal(t, "sensors", events[0].Route)
+
+	zero := 0.0
+	auditor, err := NewAuditor(AuditConfig{Enabled: true, Filename: filename, SampleRate: &zero})
+	require.NoError(t, err)
+	assert.False(t, auditor.Sample())
+
+	invalid := 1.5
+	_, err = NewAuditor(AuditConfig{Enabled: true, Filename: filename, SampleRate: &invalid})
+	assert.Error(t, err)
+
+	disabled, err := NewAuditor(AuditConfig{})
+	require.NoError(t, err)
+	assert.Nil(t, disabled)
+	assert.False(t, disabled.Sample())
+	assert.NoError(t, disabled.Close())
+}
@@ -0,0 +1,271 @@
+package k2m
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// CacheConfig configures the last-value cache served by the HTTP server
+type CacheConfig struct {
+	Enabled bool `json:"enabled"`
+	// KeyBy selects the cache key: "topic" (default) keeps the last value
+	// of every MQTT topic, "key" the last value of every Kafka message key
+	KeyBy string `json:"keyBy,omitempty"`
+	// MaxEntries bounds the cache, the least recently updated entries are evicted
+	MaxEntries int `json:"maxEntries,omitempty"`
+	// TTL expires entries that were not updated for this duration, 0 keeps them
+	TTL Duration `json:"ttl,omitempty"`
+}
+
+const (
+	CacheKeyByTopic = "topic"
+	CacheKeyByKey   = "key"
+
+	defaultCacheMaxEntries = 10000
+)
+
+// CacheEntry is the last value of a topic or key.
+// JSON payloads are kept as is in Payload, others as a string in Value.
+type CacheEntry struct {
+	Key        string          `json:"key,omitempty"`
+	Route      string          `json:"route"`
+	MQTTTopic  string          `json:"mqttTopic,omitempty"`
+	KafkaTopic string          `json:"kafkaTopic"`
+	KafkaKey   string          `json:"kafkaKey,omitempty"`
+	Partition  int32           `json:"partition"`
+	Offset     int64           `json:"offset"`
+	Payload    json.RawMessage `json:"payload,omitempty"`
+	Value      string          `json:"value,omitempty"`
+	Timestamp  time.Time       `json:"timestamp"`
+	Updated    time.Time       `json:"updated"`
+}
+
+// newCacheEntry creates the entry of a routed message
+func newCacheEntry(route string, message *sarama.ConsumerMessage, mqttTopic string, payload []byte) *CacheEntry {
+	entry := &CacheEntry{
+		Route:      route,
+		MQTTTopic:  mqttTopic,
+		KafkaTopic: message.Topic,
+		KafkaKey:   string(message.Key),
+		Partition:  message.Partition,
+		Offset:     message.Offset,
+		Timestamp:  message.Timestamp,
+		Updated:    time.Now(),
+	}
+	if len(payload) > 0 && json.Valid(payload) {
+		entry.Payload = append(json.RawMessage(nil), payload...)
+	} else {
+		entry.Value = string(payload)
+	}
+	return entry
+}
+
+// LastValueCache keeps the last value per MQTT topic or Kafka key with LRU and TTL eviction.
+// A nil cache is disabled.
+type LastValueCache struct {
+	keyBy      string
+	maxEntries int
+	ttl        time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // front is the most recently updated
+	now     func() time.Time
+}
+
+// NewLastValueCache returns nil if the cache is disabled
+func NewLastValueCache(cfg CacheConfig) (*LastValueCache, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	switch cfg.KeyBy {
+	case "", CacheKeyByTopic, CacheKeyByKey:
+	default:
+		return nil, fmt.Errorf("unknown cache keyBy: %s", cfg.KeyBy)
+	}
+	c := &LastValueCache{
+		keyBy:      cfg.KeyBy,
+		maxEntries: cfg.MaxEntries,
+		ttl:        time.Duration(cfg.TTL),
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+		now:        time.Now,
+	}
+	if c.keyBy == "" {
+		c.keyBy = CacheKeyByTopic
+	}
+	if c.maxEntries <= 0 {
+		c.maxEntries = defaultCacheMaxEntries
+	}
+	return c, nil
+}
+
+// Put stores the entry as the last value of its key
+func (c *LastValueCache) Put(entry *CacheEntry) {
+	if c == nil {
+		return
+	}
+	key := entry.MQTTTopic
+	if c.keyBy == CacheKeyByKey {
+		key = entry.KafkaKey
+	}
+	if key == "" {
+		return
+	}
+	entry.Key = key
+	entry.Updated = c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		el.Value = entry
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.maxEntries {
+		c.removeLocked(c.lru.Back())
+	}
+}
+
+// Delete removes the last value of the MQTT topic or Kafka key, e.g. when its retained message is cleared
+func (c *LastValueCache) Delete(mqttTopic, kafkaKey string) {
+	if c == nil {
+		return
+	}
+	key := mqttTopic
+	if c.keyBy == CacheKeyByKey {
+		key = kafkaKey
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.removeLocked(el)
+	}
+}
+
+// Get returns the last value of the key
+func (c *LastValueCache) Get(key string) (*CacheEntry, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if c.expiredLocked(el) {
+		c.removeLocked(el)
+		return nil, false
+	}
+	entry := *el.Value.(*CacheEntry)
+	return &entry, true
+}
+
+// Query returns the last values of the keys matching the MQTT topic filter,
+// which may contain the '+' and '#' wildcards, sorted by key.
+func (c *LastValueCache) Query(filter string) []CacheEntry {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ret := []CacheEntry{}
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		if c.expiredLocked(el) {
+			c.removeLocked(el)
+		} else if entry := el.Value.(*CacheEntry); mqttTopicMatch(filter, entry.Key) {
+			ret = append(ret, *entry)
+		}
+		el = next
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Key < ret[j].Key })
+	return ret
+}
+
+// Len returns the number of cached entries, including expired ones not evicted yet
+func (c *LastValueCache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+func (c *LastValueCache) expiredLocked(el *list.Element) bool {
+	return c.ttl > 0 && c.now().Sub(el.Value.(*CacheEntry).Updated) > c.ttl
+}
+
+func (c *LastValueCache) removeLocked(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*CacheEntry).Key)
+}
+
+// streamHub fans out routed messages to the live stream subscribers
+type streamHub struct {
+	mu          sync.Mutex
+	subscribers map[*streamSubscriber]struct{}
+}
+
+type streamSubscriber struct {
+	routes map[string]bool // nil for all routes
+	ch     chan *CacheEntry
+}
+
+func newStreamHub() *streamHub {
+	return &streamHub{subscribers: make(map[*streamSubscriber]struct{})}
+}
+
+// Subscribe registers a subscriber of the routes, all routes if none is given
+func (h *streamHub) Subscribe(routes []string, buffer int) *streamSubscriber {
+	sub := &streamSubscriber{ch: make(chan *CacheEntry, buffer)}
+	if len(routes) > 0 {
+		sub.routes = make(map[string]bool, len(routes))
+		for _, r := range routes {
+			sub.routes[r] = true
+		}
+	}
+	h.mu.Lock()
+	h.subscribers[sub] = struct{}{}
+	h.mu.Unlock()
+	return sub
+}
+
+// Unsubscribe removes the subscriber
+func (h *streamHub) Unsubscribe(sub *streamSubscriber) {
+	h.mu.Lock()
+	delete(h.subscribers, sub)
+	h.mu.Unlock()
+}
+
+// Publish sends the entry to the subscribers of its route.
+// Messages are dropped for subscribers that do not keep up.
+func (h *streamHub) Publish(entry *CacheEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subscribers {
+		if sub.routes != nil && !sub.routes[entry.Route] {
+			continue
+		}
+		select {
+		case sub.ch <- entry:
+		default:
+		}
+	}
+}
+
+// Len returns the number of subscribers
+func (h *streamHub) Len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subscribers)
+}
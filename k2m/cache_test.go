@@ -0,0 +1,147 @@
+package k2m
+
+import (
+	"actsvr/util"
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func cacheMessage(key, value string) *sarama.ConsumerMessage {
+	return &sarama.ConsumerMessage{Topic: "sensors", Key: []byte(key), Value: []byte(value)}
+}
+
+func TestLastValueCacheLRU(t *testing.T) {
+	cache, err := NewLastValueCache(CacheConfig{Enabled: true, MaxEntries: 2})
+	require.NoError(t, err)
+
+	cache.Put(newCacheEntry("r", cacheMessage("a", "1"), "iot/a/temp", []byte("1")))
+	cache.Put(newCacheEntry("r", cacheMessage("b", "2"), "iot/b/temp", []byte("2")))
+	cache.Put(newCacheEntry("r", cacheMessage("a", "on"), "iot/a/temp", []byte("on")))
+	cache.Put(newCacheEntry("r", cacheMessage("c", "4"), "iot/c/temp", []byte(`{"t":4}`)))
+
+	// iot/b/temp is the least recently updated
+	assert.Equal(t, 2, cache.Len())
+	_, ok := cache.Get("iot/b/temp")
+	assert.False(t, ok)
+
+	entry, ok := cache.Get("iot/a/temp")
+	require.True(t, ok)
+	assert.Equal(t, "on", entry.Value)
+	entry, ok = cache.Get("iot/c/temp")
+	require.True(t, ok)
+	assert.JSONEq(t, `{"t":4}`, string(entry.Payload))
+
+	cache.Delete("iot/a/temp", "a")
+	_, ok = cache.Get("iot/a/temp")
+	assert.False(t, ok)
+}
+
+func TestLastValueCacheTTLAndQuery(t *testing.T) {
+	cache, err := NewLastValueCache(CacheConfig{Enabled: true, TTL: Duration(time.Minute)})
+	require.NoError(t, err)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	cache.Put(newCacheEntry("r", cacheMessage("a", "1"), "iot/a/temp", []byte("1")))
+	cache.Put(newCacheEntry("r", cacheMessage("a", "1"), "iot/a/hum", []byte("1")))
+	now = now.Add(2 * time.Minute)
+	cache.Put(newCacheEntry("r", cacheMessage("b", "2"), "iot/b/temp", []byte("2")))
+	cache.Put(newCacheEntry("r", cacheMessage("c", "3"), "iot/c/temp", []byte("3")))
+
+	entries := cache.Query("iot/+/temp")
+	require.Len(t, entries, 2, "iot/a/temp is expired")
+	assert.Equal(t, "iot/b/temp", entries[0].Key)
+	assert.Equal(t, "iot/c/temp", entries[1].Key)
+	assert.Len(t, cache.Query("#"), 2)
+	assert.Equal(t, 2, cache.Len(), "expired entries are evicted by the query")
+}
+
+func TestLastValueCacheKeyByKey(t *testing.T) {
+	cache, err := NewLastValueCache(CacheConfig{Enabled: true, KeyBy: CacheKeyByKey})
+	require.NoError(t, err)
+	cache.Put(newCacheEntry("r", cacheMessage("dev-1", "1"), "iot/x", []byte("1")))
+	cache.Put(newCacheEntry("r", cacheMessage("dev-1", "2"), "iot/y", []byte("2")))
+
+	entry, ok := cache.Get("dev-1")
+	require.True(t, ok)
+	assert.Equal(t, "iot/y", entry.MQTTTopic)
+
+	_, err = NewLastValueCache(CacheConfig{Enabled: true, KeyBy: "partition"})
+	assert.ErrorContains(t, err, "unknown cache keyBy")
+
+	disabled, err := NewLastValueCache(CacheConfig{})
+	require.NoError(t, err)
+	assert.Nil(t, disabled)
+	disabled.Put(newCacheEntry("r", cacheMessage("dev-1", "1"), "iot/x", []byte("1")))
+	assert.Equal(t, 0, disabled.Len())
+}
+
+func TestCacheAndStreamHandlers(t *testing.T) {
+	config := DefaultConfig()
+	config.TopicMappings = nil
+	config.Cache = CacheConfig{Enabled: true}
+	broker, err := NewK2MBroker(config, util.NewLog(util.DefaultLogConfig()))
+	require.NoError(t, err)
+	broker.mqttClient = NewMockMQTTClient()
+	worker := &MessageWorker{id: 1, broker: broker, messageCh: broker.messageCh}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cache", broker.healthChecker.cacheHandler)
+	mux.HandleFunc("/stream", broker.healthChecker.streamHandler)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/stream?route=default", nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	require.Eventually(t, func() bool { return broker.stream.Len() == 1 }, time.Second, 10*time.Millisecond)
+
+	worker.processMessage(&sarama.ConsumerMessage{Topic: "sensor-data", Key: []byte("dev-1"), Value: []byte(`{"t":21.5}`)})
+
+	// the stream receives the routed message
+	reader := bufio.NewReader(resp.Body)
+	var data string
+	for data == "" {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		data, _ = strings.CutPrefix(strings.TrimSpace(line), "data: ")
+		if strings.HasPrefix(line, "event:") {
+			data = ""
+		}
+	}
+	var streamed CacheEntry
+	require.NoError(t, json.Unmarshal([]byte(data), &streamed))
+	assert.Equal(t, "default", streamed.Route)
+	assert.Equal(t, "dev-1", streamed.KafkaKey)
+
+	// the cache holds the last value of the MQTT topic
+	rec := httptest.NewRecorder()
+	broker.healthChecker.cacheHandler(rec, httptest.NewRequest(http.MethodGet, "/cache?topic=mqtt/%23", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var result struct {
+		Count   int          `json:"count"`
+		Entries []CacheEntry `json:"entries"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &result))
+	require.Equal(t, 1, result.Count)
+	assert.Equal(t, streamed.MQTTTopic, result.Entries[0].Key)
+
+	rec = httptest.NewRecorder()
+	broker.healthChecker.cacheHandler(rec, httptest.NewRequest(http.MethodGet, "/cache?key=none", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -0,0 +1,190 @@
+package k2m
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/IBM/sarama"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Compression codecs of the message value
+const (
+	CodecNone   = "none"
+	CodecAuto   = "auto"
+	CodecGzip   = "gzip"
+	CodecSnappy = "snappy"
+	CodecLZ4    = "lz4"
+	CodecZstd   = "zstd"
+)
+
+// DefaultMaxDecompressedSize is the default limit of a decompressed value, 16 MiB
+const DefaultMaxDecompressedSize = 16 << 20
+
+// CompressionConfig declares the application-level compression of the values of a route.
+// The value is decompressed before the filters, the schema and the transform see it.
+type CompressionConfig struct {
+	// Codec is "gzip", "snappy", "lz4", "zstd" or "auto".
+	// "auto" detects gzip, zstd, lz4 frames and framed snappy by their magic bytes
+	// and passes other values through unchanged.
+	Codec string `json:"codec"`
+	// MaxSize is the maximum decompressed size in bytes, larger values are rejected
+	MaxSize int64 `json:"maxSize,omitempty"`
+	// Recompress is the codec of the published MQTT payload, "none" by default
+	Recompress string `json:"recompress,omitempty"`
+}
+
+var (
+	magicGzip         = []byte{0x1f, 0x8b}
+	magicZstd         = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	magicLZ4          = []byte{0x04, 0x22, 0x4d, 0x18}
+	magicSnappyFramed = []byte("\xff\x06\x00\x00sNaPpY")
+)
+
+func validateCompression(cfg *CompressionConfig, mapping *TopicMapping) error {
+	if cfg == nil {
+		return nil
+	}
+	switch cfg.Codec {
+	case CodecAuto, CodecGzip, CodecSnappy, CodecLZ4, CodecZstd:
+	default:
+		return fmt.Errorf("unknown compression codec: %q", cfg.Codec)
+	}
+	if cfg.MaxSize < 0 {
+		return fmt.Errorf("compression maxSize cannot be negative")
+	}
+	switch cfg.Recompress {
+	case "", CodecNone:
+	case CodecGzip, CodecSnappy, CodecLZ4, CodecZstd:
+		if mapping.Transform == TransformSparkplug {
+			return fmt.Errorf("sparkplug payloads cannot be recompressed")
+		}
+	default:
+		return fmt.Errorf("unknown recompress codec: %q", cfg.Recompress)
+	}
+	return nil
+}
+
+// detectCodec returns the codec of the value by its magic bytes, CodecNone if unknown
+func detectCodec(value []byte) string {
+	switch {
+	case bytes.HasPrefix(value, magicGzip):
+		return CodecGzip
+	case bytes.HasPrefix(value, magicZstd):
+		return CodecZstd
+	case bytes.HasPrefix(value, magicLZ4):
+		return CodecLZ4
+	case bytes.HasPrefix(value, magicSnappyFramed):
+		return CodecSnappy
+	}
+	return CodecNone
+}
+
+// decompressMessage returns a copy of the message with the value decompressed.
+// Tombstones and values that "auto" does not recognize are returned as is.
+func decompressMessage(cfg *CompressionConfig, message *sarama.ConsumerMessage) (*sarama.ConsumerMessage, error) {
+	if cfg == nil || message.Value == nil {
+		return message, nil
+	}
+	codec := cfg.Codec
+	if codec == CodecAuto {
+		codec = detectCodec(message.Value)
+		if codec == CodecNone {
+			return message, nil
+		}
+	}
+	maxSize := cfg.MaxSize
+	if maxSize == 0 {
+		maxSize = DefaultMaxDecompressedSize
+	}
+	value, err := decompress(codec, message.Value, maxSize)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", codec, err)
+	}
+	decoded := *message
+	decoded.Value = value
+	return &decoded, nil
+}
+
+// decompress decodes the value, reading at most maxSize bytes of output
+func decompress(codec string, value []byte, maxSize int64) ([]byte, error) {
+	switch codec {
+	case CodecGzip:
+		r, err := gzip.NewReader(bytes.NewReader(value))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return readLimited(r, maxSize)
+	case CodecZstd:
+		r, err := zstd.NewReader(bytes.NewReader(value), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return readLimited(r, maxSize)
+	case CodecLZ4:
+		return readLimited(lz4.NewReader(bytes.NewReader(value)), maxSize)
+	case CodecSnappy:
+		if bytes.HasPrefix(value, magicSnappyFramed) {
+			return readLimited(snappy.NewReader(bytes.NewReader(value)), maxSize)
+		}
+		// the block format starts with the decoded length
+		n, err := snappy.DecodedLen(value)
+		if err != nil {
+			return nil, err
+		}
+		if int64(n) > maxSize {
+			return nil, fmt.Errorf("decompressed value exceeds %d bytes", maxSize)
+		}
+		return snappy.Decode(nil, value)
+	}
+	return nil, fmt.Errorf("unknown compression codec: %q", codec)
+}
+
+// readLimited reads r to the end, failing if it has more than maxSize bytes
+func readLimited(r io.Reader, maxSize int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("decompressed value exceeds %d bytes", maxSize)
+	}
+	return data, nil
+}
+
+// compress encodes the payload with the codec, snappy uses the block format
+func compress(codec string, payload []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch codec {
+	case "", CodecNone:
+		return payload, nil
+	case CodecSnappy:
+		return snappy.Encode(nil, payload), nil
+	case CodecGzip:
+		w = gzip.NewWriter(&buf)
+	case CodecLZ4:
+		w = lz4.NewWriter(&buf)
+	case CodecZstd:
+		zw, err := zstd.NewWriter(&buf)
+		if err != nil {
+			return nil, err
+		}
+		w = zw
+	default:
+		return nil, fmt.Errorf("unknown compression codec: %q", codec)
+	}
+	if _, err := w.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
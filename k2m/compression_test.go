@@ -0,0 +1,177 @@
+package k2m
+
+import (
+	"actsvr/util"
+	"bytes"
+	"testing"
+
+	"github.com/IBM/sarama"
+	"github.com/klauspost/compress/snappy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressionCodecs(t *testing.T) {
+	payload := []byte(`{"device":"dev-1","temperature":21.5}`)
+	for _, codec := range []string{CodecGzip, CodecSnappy, CodecLZ4, CodecZstd} {
+		compressed, err := compress(codec, payload)
+		require.NoError(t, err, codec)
+		assert.NotEqual(t, payload, compressed, codec)
+
+		message := &sarama.ConsumerMessage{Topic: "sensors", Value: compressed}
+		decoded, err := decompressMessage(&CompressionConfig{Codec: codec}, message)
+		require.NoError(t, err, codec)
+		assert.Equal(t, payload, decoded.Value, codec)
+		assert.Equal(t, compressed, message.Value, "the consumed message is not modified")
+
+		if codec != CodecSnappy {
+			// the snappy block format has no magic bytes
+			assert.Equal(t, codec, detectCodec(compressed))
+			decoded, err = decompressMessage(&CompressionConfig{Codec: CodecAuto}, message)
+			require.NoError(t, err, codec)
+			assert.Equal(t, payload, decoded.Value, codec)
+		}
+	}
+
+	var framed bytes.Buffer
+	w := snappy.NewBufferedWriter(&framed)
+	w.Write(payload)
+	w.Close()
+	assert.Equal(t, CodecSnappy, detectCodec(framed.Bytes()))
+	decoded, err := decompressMessage(&CompressionConfig{Codec: CodecAuto}, &sarama.ConsumerMessage{Value: framed.Bytes()})
+	require.NoError(t, err)
+	assert.Equal(t, payload, decoded.Value)
+
+	// auto passes uncompressed values and tombstones through
+	plain := &sarama.ConsumerMessage{Value: payload}
+	decoded, err = decompressMessage(&CompressionConfig{Codec: CodecAuto}, plain)
+	require.NoError(t, err)
+	assert.Same(t, plain, decoded)
+	tombstone := &sarama.ConsumerMessage{}
+	decoded, err = decompressMessage(&CompressionConfig{Codec: CodecGzip}, tombstone)
+	require.NoError(t, err)
+	assert.Same(t, tombstone, decoded)
+
+	_, err = decompressMessage(&CompressionConfig{Codec: CodecGzip}, plain)
+	assert.ErrorContains(t, err, "gzip")
+}
+
+func TestDecompressionLimit(t *testing.T) {
+	bomb := make([]byte, 1<<20)
+	for _, codec := range []string{CodecGzip, CodecSnappy, CodecLZ4, CodecZstd} {
+		compressed, err := compress(codec, bomb)
+		require.NoError(t, err, codec)
+		require.Less(t, len(compressed), 64<<10, codec)
+
+		_, err = decompressMessage(&CompressionConfig{Codec: codec, MaxSize: 64 << 10}, &sarama.ConsumerMessage{Value: compressed})
+		assert.ErrorContains(t, err, "exceeds 65536 bytes", codec)
+
+		decoded, err := decompressMessage(&CompressionConfig{Codec: codec}, &sarama.ConsumerMessage{Value: compressed})
+		require.NoError(t, err, codec)
+		assert.Len(t, decoded.Value, len(bomb), codec)
+	}
+}
+
+func TestValidateCompression(t *testing.T) {
+	mapping := &TopicMapping{Transform: "json"}
+	assert.NoError(t, validateCompression(nil, mapping))
+	assert.NoError(t, validateCompression(&CompressionConfig{Codec: CodecAuto, Recompress: CodecZstd}, mapping))
+	assert.ErrorContains(t, validateCompression(&CompressionConfig{Codec: "brotli"}, mapping), "unknown compression codec")
+	assert.ErrorContains(t, validateCompression(&CompressionConfig{Codec: CodecGzip, Recompress: CodecAuto}, mapping), "unknown recompress codec")
+	assert.ErrorContains(t, validateCompression(&CompressionConfig{Codec: CodecGzip, MaxSize: -1}, mapping), "cannot be negative")
+	assert.ErrorContains(t, validateCompression(&CompressionConfig{Codec: CodecGzip, Recompress: CodecGzip},
+		&TopicMapping{Transform: TransformSparkplug}), "cannot be recompressed")
+}
+
+func TestRouteCompressedValues(t *testing.T) {
+	config := DefaultConfig()
+	config.TopicMappings = nil
+	config.Routes = []RouteConfig{
+		{
+			Name:        "alarms",
+			Priority:    10,
+			Filters:     []FilterConfig{{Type: "value", Config: map[string]interface{}{"pattern": `"level":"alarm"`}}},
+			Mapping:     TopicMapping{KafkaTopic: "{kafkaTopic}", MQTTTopic: "alarms/{key}", Transform: "none"},
+			Compression: &CompressionConfig{Codec: CodecAuto, Recompress: CodecGzip},
+		},
+		{
+			Name:        "default",
+			Mapping:     TopicMapping{KafkaTopic: "{kafkaTopic}", MQTTTopic: "events/{key}", Transform: "none"},
+			Compression: &CompressionConfig{Codec: CodecAuto, MaxSize: 1024},
+		},
+	}
+	broker, err := NewK2MBroker(config, util.NewLog(util.DefaultLogConfig()))
+	require.NoError(t, err)
+	client := NewMockMQTTClient()
+	broker.mqttClient = client
+	worker := &MessageWorker{id: 1, broker: broker, messageCh: broker.messageCh}
+
+	message := func(offset int64, value []byte) *sarama.ConsumerMessage {
+		return &sarama.ConsumerMessage{Topic: "sensors", Key: []byte("dev-1"), Offset: offset, Value: value}
+	}
+	alarm, _ := compress(CodecZstd, []byte(`{"level":"alarm"}`))
+	info, _ := compress(CodecLZ4, []byte(`{"level":"info"}`))
+	bomb, _ := compress(CodecGzip, make([]byte, 4096))
+
+	// the value filter sees the decompressed value
+	route, routeMessage, _, err := broker.router.RouteMessage(DefaultSourceName, message(1, alarm), false)
+	require.NoError(t, err)
+	assert.Equal(t, "alarms", route.Name)
+	assert.Equal(t, `{"level":"alarm"}`, string(routeMessage.Value))
+
+	worker.processMessage(message(1, alarm))
+	worker.processMessage(message(2, info))
+	worker.processMessage(message(3, bomb))
+
+	published := client.GetMessages()
+	require.Len(t, published, 2)
+	assert.Equal(t, "alarms/dev-1", published[0].Topic)
+	recompressed, err := decompress(CodecGzip, published[0].Payload, DefaultMaxDecompressedSize)
+	require.NoError(t, err)
+	assert.Equal(t, `{"level":"alarm"}`, string(recompressed))
+	assert.Equal(t, "events/dev-1", published[1].Topic)
+	assert.Equal(t, `{"level":"info"}`, string(published[1].Payload))
+
+	metrics := broker.GetMetrics()
+	assert.Equal(t, int64(1), metrics.DecompressErrors)
+	assert.Equal(t, int64(1), metrics.MessagesFailed)
+}
+
+func TestRouteCompressedTopic(t *testing.T) {
+	router, err := NewMessageRouter([]RouteConfig{
+		{
+			Name:     "plain",
+			Priority: 0,
+			Filters:  []FilterConfig{{Type: "value", Config: map[string]interface{}{"pattern": `"device"`}}},
+			Mapping:  TopicMapping{KafkaTopic: "{kafkaTopic}", MQTTTopic: "plain/{key}", Transform: "none"},
+		},
+		{
+			Name:        "gz",
+			Priority:    10,
+			Filters:     []FilterConfig{{Type: "topic", Config: map[string]interface{}{"pattern": "^a$"}}},
+			Mapping:     TopicMapping{KafkaTopic: "{kafkaTopic}", MQTTTopic: "gz/{key}", Transform: "none"},
+			Compression: &CompressionConfig{Codec: CodecGzip},
+		},
+	})
+	require.NoError(t, err)
+
+	// the topic filter of the compressed route rejects the plain value before it is decompressed
+	plain := &sarama.ConsumerMessage{Topic: "b", Value: []byte(`{"device":"dev-1"}`)}
+	route, routeMessage, results, err := router.RouteMessage(DefaultSourceName, plain, true)
+	require.NoError(t, err)
+	assert.Equal(t, "plain", route.Name)
+	assert.Equal(t, plain, routeMessage)
+	require.Len(t, results, 2)
+	assert.Equal(t, FilterResult{Route: "gz", Filter: "topic_filter", Type: "topic", Matched: false}, results[0])
+
+	gzipped, _ := compress(CodecGzip, []byte(`{"device":"dev-2"}`))
+	route, routeMessage, _, err = router.RouteMessage(DefaultSourceName, &sarama.ConsumerMessage{Topic: "a", Value: gzipped}, false)
+	require.NoError(t, err)
+	assert.Equal(t, "gz", route.Name)
+	assert.Equal(t, `{"device":"dev-2"}`, string(routeMessage.Value))
+
+	// a matching message that cannot be decompressed fails with its route
+	route, _, _, err = router.RouteMessage(DefaultSourceName, &sarama.ConsumerMessage{Topic: "a", Value: []byte(`{}`)}, false)
+	assert.Error(t, err)
+	assert.Equal(t, "gz", route.Name)
+}
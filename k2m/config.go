@@ -0,0 +1,287 @@
+package k2m
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Secret reference prefixes.
+// A secret value like "file:/run/secrets/mqtt" is replaced by the content of the file,
+// and "env:MQTT_PASSWORD" by the value of the environment variable.
+const (
+	SecretRefFile = "file:"
+	SecretRefEnv  = "env:"
+
+	redactedValue = "******"
+)
+
+// envPattern matches ${VAR} and ${VAR:-default}
+var envPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// LoadConfig loads the configuration from a JSON or YAML file.
+// Files with the extension .yaml or .yml are parsed as YAML, others as JSON.
+// ${VAR} and ${VAR:-default} references in the string values are replaced with
+// environment variables after parsing. Secret references are not resolved, see ResolveSecrets.
+func LoadConfig(filename string) (*K2MConfig, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	return ParseConfig(data, strings.ToLower(filepath.Ext(filename)))
+}
+
+// ParseConfig parses the configuration data in the format given by the
+// file extension (".json", ".yaml" or ".yml").
+// The environment references are expanded in the parsed string values, so that a value
+// with quotes or line breaks stays a single value of the file.
+func ParseConfig(data []byte, ext string) (*K2MConfig, error) {
+	var undefined []string
+	var doc interface{}
+	if ext == ".yaml" || ext == ".yml" {
+		// YAML is converted to JSON, so that the json tags and
+		// the Duration unmarshaler apply to both formats.
+		var root yaml.Node
+		if err := yaml.Unmarshal(data, &root); err != nil {
+			return nil, fmt.Errorf("failed to parse config file: %w", err)
+		}
+		expandNode(&root, &undefined)
+		if root.Kind != 0 {
+			if err := root.Decode(&doc); err != nil {
+				return nil, fmt.Errorf("failed to parse config file: %w", err)
+			}
+		}
+		if doc == nil {
+			doc = map[string]interface{}{}
+		}
+	} else {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil {
+			return nil, fmt.Errorf("failed to parse config file: %w", err)
+		}
+		if _, err := dec.Token(); err != io.EOF {
+			return nil, fmt.Errorf("failed to parse config file: invalid data after the configuration")
+		}
+		doc = expandValue(doc, &undefined)
+	}
+	if len(undefined) > 0 {
+		return nil, fmt.Errorf("failed to parse config file: undefined environment variable: %s", strings.Join(undefined, ", "))
+	}
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+	config := &K2MConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+	return config, nil
+}
+
+// expandNode expands the environment references of the scalar values of the YAML node.
+// An expanded plain scalar is resolved again, e.g. "qos: ${MQTT_QOS}" is a number,
+// a quoted one stays a string.
+func expandNode(node *yaml.Node, undefined *[]string) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		value := expandEnv(node.Value, undefined)
+		if value != node.Value {
+			node.Value = value
+			if node.Style == 0 {
+				node.Tag = ""
+			}
+		}
+	case yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			expandNode(node.Content[i], undefined)
+		}
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, child := range node.Content {
+			expandNode(child, undefined)
+		}
+	}
+}
+
+// expandValue expands the environment references of the strings of the JSON value
+func expandValue(v interface{}, undefined *[]string) interface{} {
+	switch v := v.(type) {
+	case string:
+		return expandEnv(v, undefined)
+	case map[string]interface{}:
+		for k, child := range v {
+			v[k] = expandValue(child, undefined)
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = expandValue(child, undefined)
+		}
+	}
+	return v
+}
+
+// ExpandEnv replaces ${VAR} and ${VAR:-default} with the values of the environment variables.
+// It returns an error if a variable without default is not set.
+func ExpandEnv(data []byte) ([]byte, error) {
+	var undefined []string
+	ret := expandEnv(string(data), &undefined)
+	if len(undefined) > 0 {
+		return nil, fmt.Errorf("undefined environment variable: %s", strings.Join(undefined, ", "))
+	}
+	return []byte(ret), nil
+}
+
+// expandEnv replaces the environment references of s,
+// the variables without default that are not set are added to undefined.
+func expandEnv(s string, undefined *[]string) string {
+	return envPattern.ReplaceAllStringFunc(s, func(m string) string {
+		sub := envPattern.FindStringSubmatch(m)
+		name := sub[1]
+		if value, ok := os.LookupEnv(name); ok && (value != "" || sub[2] == "") {
+			return value
+		}
+		if sub[2] != "" {
+			return sub[3]
+		}
+		*undefined = append(*undefined, name)
+		return m
+	})
+}
+
+// ResolveSecret returns the value of a secret reference,
+// or the value itself if it is not a reference.
+func ResolveSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, SecretRefFile):
+		path := strings.TrimPrefix(value, SecretRefFile)
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read secret file: %w", err)
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	case strings.HasPrefix(value, SecretRefEnv):
+		name := strings.TrimPrefix(value, SecretRefEnv)
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("secret environment variable %s is not set", name)
+		}
+		return v, nil
+	default:
+		return value, nil
+	}
+}
+
+// isSecretRef reports whether the value is a secret reference
+func isSecretRef(value string) bool {
+	return strings.HasPrefix(value, SecretRefFile) || strings.HasPrefix(value, SecretRefEnv)
+}
+
+// ResolveSecrets replaces the secret references of the configuration with their values
+func (c *K2MConfig) ResolveSecrets() error {
+	password, err := ResolveSecret(c.MQTTConfig.Password)
+	if err != nil {
+		return fmt.Errorf("mqtt password: %w", err)
+	}
+	c.MQTTConfig.Password = password
+
+	for k, v := range c.Tracing.Headers {
+		resolved, err := ResolveSecret(v)
+		if err != nil {
+			return fmt.Errorf("tracing header %s: %w", k, err)
+		}
+		c.Tracing.Headers[k] = resolved
+	}
+
+	if err := c.KafkaConfig.resolveSecrets(); err != nil {
+		return fmt.Errorf("kafka %w", err)
+	}
+	for i := range c.Sources {
+		if err := c.Sources[i].resolveSecrets(); err != nil {
+			return fmt.Errorf("source %s %w", c.Sources[i].Name, err)
+		}
+	}
+
+	for _, route := range c.Routes {
+		if route.Sink == nil || route.Sink.Machbase == nil {
+			continue
+		}
+		password, err := ResolveSecret(route.Sink.Machbase.Password)
+		if err != nil {
+			return fmt.Errorf("route %s sink password: %w", route.Name, err)
+		}
+		route.Sink.Machbase.Password = password
+	}
+	return nil
+}
+
+// resolveSecrets resolves the SASL password of the Kafka cluster
+func (k *KafkaConfig) resolveSecrets() error {
+	if k.Security == nil || k.Security.SASL == nil {
+		return nil
+	}
+	password, err := ResolveSecret(k.Security.SASL.Password)
+	if err != nil {
+		return fmt.Errorf("sasl password: %w", err)
+	}
+	k.Security.SASL.Password = password
+	return nil
+}
+
+// Redacted returns a copy of the configuration with the secrets masked.
+// Secret references are kept, since they do not reveal the secret.
+func (c *K2MConfig) Redacted() *K2MConfig {
+	redact := func(v string) string {
+		if v == "" || isSecretRef(v) {
+			return v
+		}
+		return redactedValue
+	}
+
+	ret := *c
+	ret.MQTTConfig.Password = redact(c.MQTTConfig.Password)
+	redactKafka := func(k KafkaConfig) KafkaConfig {
+		if k.Security != nil && k.Security.SASL != nil {
+			security := *k.Security
+			sasl := *security.SASL
+			sasl.Password = redact(sasl.Password)
+			security.SASL = &sasl
+			k.Security = &security
+		}
+		return k
+	}
+	ret.KafkaConfig = redactKafka(c.KafkaConfig)
+	if c.Sources != nil {
+		ret.Sources = make([]KafkaConfig, len(c.Sources))
+		for i, source := range c.Sources {
+			ret.Sources[i] = redactKafka(source)
+		}
+	}
+	if c.Tracing.Headers != nil {
+		ret.Tracing.Headers = make(map[string]string, len(c.Tracing.Headers))
+		for k, v := range c.Tracing.Headers {
+			ret.Tracing.Headers[k] = redact(v)
+		}
+	}
+	if c.Routes != nil {
+		ret.Routes = make([]RouteConfig, len(c.Routes))
+		for i, route := range c.Routes {
+			if route.Sink != nil && route.Sink.Machbase != nil {
+				sink := *route.Sink
+				machbase := *sink.Machbase
+				machbase.Password = redact(machbase.Password)
+				sink.Machbase = &machbase
+				route.Sink = &sink
+			}
+			ret.Routes[i] = route
+		}
+	}
+	return &ret
+}
@@ -0,0 +1,155 @@
+package k2m
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfigYAML(t *testing.T) {
+	t.Setenv("K2M_TEST_KAFKA", "kafka1:9092")
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "k2m.yaml")
+	require.NoError(t, os.WriteFile(filename, []byte(`
+kafka:
+  brokers: ["${K2M_TEST_KAFKA}"]
+  topics: [sensor-data]
+  consumerGroup: ${K2M_TEST_GROUP:-k2m-group}
+  sessionTimeout: 15s
+mqtt:
+  broker: tcp://mqtt:1883
+  password: file:/run/secrets/mqtt
+  qos: 2
+routes:
+  - name: sensors
+    priority: 1
+    filters:
+      - type: topic
+        config:
+          pattern: sensor-.*
+    mapping:
+      kafkaTopic: sensor-data
+      mqttTopic: iot/{key}
+      transform: json
+workerCount: 3
+`), 0644))
+
+	config, err := LoadConfig(filename)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"kafka1:9092"}, config.KafkaConfig.Brokers)
+	assert.Equal(t, "k2m-group", config.KafkaConfig.ConsumerGroup)
+	assert.Equal(t, Duration(15*time.Second), config.KafkaConfig.SessionTimeout)
+	assert.Equal(t, "file:/run/secrets/mqtt", config.MQTTConfig.Password)
+	assert.Equal(t, byte(2), config.MQTTConfig.QoS)
+	require.Len(t, config.Routes, 1)
+	assert.Equal(t, "sensor-.*", config.Routes[0].Filters[0].Config["pattern"])
+	assert.Equal(t, "iot/{key}", config.Routes[0].Mapping.MQTTTopic)
+	assert.Equal(t, 3, config.WorkerCount)
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	_, err := LoadConfig("/non/existent/k2m.yaml")
+	assert.ErrorContains(t, err, "failed to read config file")
+
+	_, err = ParseConfig([]byte("kafka: [unclosed"), ".yml")
+	assert.ErrorContains(t, err, "failed to parse config file")
+
+	_, err = ParseConfig([]byte(`{"mqtt":{"broker":"${K2M_TEST_UNDEFINED}"}}`), ".json")
+	assert.ErrorContains(t, err, "K2M_TEST_UNDEFINED")
+}
+
+func TestParseConfigEnvValues(t *testing.T) {
+	t.Setenv("K2M_TEST_WORKERS", "4")
+	t.Setenv("K2M_TEST_PASSWORD", "p\"a\\s\ns: 1\"")
+	t.Setenv("K2M_TEST_INJECT", `x","qos":2,"clientId":"evil`)
+
+	// a value is a single string of the file, whatever its characters
+	config, err := ParseConfig([]byte(`
+mqtt:
+  password: ${K2M_TEST_PASSWORD}
+  clientId: "${K2M_TEST_INJECT}"
+workerCount: ${K2M_TEST_WORKERS}
+# ${K2M_TEST_IN_COMMENT}
+`), ".yaml")
+	require.NoError(t, err)
+	assert.Equal(t, "p\"a\\s\ns: 1\"", config.MQTTConfig.Password)
+	assert.Equal(t, `x","qos":2,"clientId":"evil`, config.MQTTConfig.ClientID)
+	assert.Equal(t, byte(0), config.MQTTConfig.QoS)
+	assert.Equal(t, 4, config.WorkerCount, "a plain scalar is resolved after the expansion")
+
+	config, err = ParseConfig([]byte(`{"mqtt":{"password":"${K2M_TEST_PASSWORD}","clientId":"${K2M_TEST_INJECT}"},"workerCount":2}`), ".json")
+	require.NoError(t, err)
+	assert.Equal(t, "p\"a\\s\ns: 1\"", config.MQTTConfig.Password)
+	assert.Equal(t, `x","qos":2,"clientId":"evil`, config.MQTTConfig.ClientID)
+	assert.Equal(t, byte(0), config.MQTTConfig.QoS)
+	assert.Equal(t, 2, config.WorkerCount)
+
+	_, err = ParseConfig([]byte(`{"workerCount":2} {}`), ".json")
+	assert.ErrorContains(t, err, "failed to parse config file")
+}
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("K2M_TEST_SET", "value")
+	t.Setenv("K2M_TEST_EMPTY", "")
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"${K2M_TEST_SET}", "value"},
+		{"a-${K2M_TEST_SET}-b", "a-value-b"},
+		{"${K2M_TEST_EMPTY}", ""},
+		{"${K2M_TEST_EMPTY:-def}", "def"},
+		{"${K2M_TEST_UNSET:-def}", "def"},
+		{"${K2M_TEST_UNSET:-}", ""},
+		{"$K2M_TEST_SET", "$K2M_TEST_SET"},
+	}
+	for _, tt := range tests {
+		out, err := ExpandEnv([]byte(tt.input))
+		require.NoError(t, err, tt.input)
+		assert.Equal(t, tt.expected, string(out), tt.input)
+	}
+}
+
+func TestResolveSecrets(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "mqtt")
+	require.NoError(t, os.WriteFile(secretFile, []byte("s3cret\n"), 0600))
+	t.Setenv("K2M_TEST_TOKEN", "Bearer abc")
+
+	config := DefaultConfig()
+	config.MQTTConfig.Password = "file:" + secretFile
+	config.Tracing.Headers = map[string]string{"authorization": "env:K2M_TEST_TOKEN"}
+	config.Routes = []RouteConfig{sinkRoute(0)}
+	config.Routes[0].Sink.Machbase.Password = "env:K2M_TEST_TOKEN"
+	config.Sources = []KafkaConfig{{
+		Name:     "plant-a",
+		Security: &KafkaSecurityConfig{SASL: &KafkaSASLConfig{Username: "k2m", Password: "file:" + secretFile}},
+	}}
+
+	redacted := config.Redacted()
+	assert.Equal(t, "file:"+secretFile, redacted.MQTTConfig.Password)
+
+	require.NoError(t, config.ResolveSecrets())
+	assert.Equal(t, "s3cret", config.MQTTConfig.Password)
+	assert.Equal(t, "Bearer abc", config.Tracing.Headers["authorization"])
+
+	redacted = config.Redacted()
+	assert.Equal(t, redactedValue, redacted.MQTTConfig.Password)
+	assert.Equal(t, redactedValue, redacted.Tracing.Headers["authorization"])
+	assert.Equal(t, redactedValue, redacted.Routes[0].Sink.Machbase.Password)
+	assert.Equal(t, redactedValue, redacted.Sources[0].Security.SASL.Password)
+	// the original is not modified
+	assert.Equal(t, "s3cret", config.Sources[0].Security.SASL.Password)
+	assert.Equal(t, "s3cret", config.MQTTConfig.Password)
+	assert.Equal(t, "Bearer abc", config.Routes[0].Sink.Machbase.Password)
+	assert.Equal(t, "Bearer abc", config.Tracing.Headers["authorization"])
+
+	config.MQTTConfig.Password = "env:K2M_TEST_NOT_SET"
+	assert.Error(t, config.ResolveSecrets())
+	config.MQTTConfig.Password = "file:/non/existent/secret"
+	assert.Error(t, config.ResolveSecrets())
+}
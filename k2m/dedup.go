@@ -0,0 +1,287 @@
+package k2m
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// DedupConfig configures the deduplication of redelivered Kafka messages
+type DedupConfig struct {
+	Enabled bool `json:"enabled"`
+	// KeyBy selects the message ID: "offset" (default) is topic/partition/offset,
+	// "header" the value of the Kafka header, "field" the value of the JSON field
+	KeyBy string `json:"keyBy,omitempty"`
+	// Header is the Kafka header of the ID with keyBy "header"
+	Header string `json:"header,omitempty"`
+	// Field is the dotted path of the JSON field of the ID with keyBy "field"
+	Field string `json:"field,omitempty"`
+	// Window is how long a seen ID is remembered, default 10m
+	Window Duration `json:"window,omitempty"`
+	// MaxEntries bounds the seen-set, the oldest IDs are forgotten first, default 100000
+	MaxEntries int `json:"maxEntries,omitempty"`
+	// File persists the seen-set so it survives restarts, empty keeps it in memory
+	File string `json:"file,omitempty"`
+	// SaveInterval is how often the seen-set is written to File, default 5s
+	SaveInterval Duration `json:"saveInterval,omitempty"`
+}
+
+const (
+	DedupKeyByOffset = "offset"
+	DedupKeyByHeader = "header"
+	DedupKeyByField  = "field"
+
+	defaultDedupWindow       = 10 * time.Minute
+	defaultDedupMaxEntries   = 100000
+	defaultDedupSaveInterval = 5 * time.Second
+)
+
+// Deduplicator remembers the IDs of the processed messages within a time window.
+// A nil Deduplicator is disabled.
+type Deduplicator struct {
+	keyBy        string
+	header       string
+	field        string
+	window       time.Duration
+	maxEntries   int
+	file         string
+	saveInterval time.Duration
+
+	mu    sync.Mutex
+	seen  map[string]*list.Element
+	order *list.List // front is the oldest
+	dirty bool
+	now   func() time.Time
+}
+
+// seenID is an ID of the seen-set, also the persisted form
+type seenID struct {
+	ID   string    `json:"id"`
+	Seen time.Time `json:"seen"`
+}
+
+// NewDeduplicator creates the deduplicator of the configuration and loads the persisted seen-set.
+// It returns nil if deduplication is disabled.
+func NewDeduplicator(cfg DedupConfig) (*Deduplicator, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	d := &Deduplicator{
+		keyBy:        cfg.KeyBy,
+		header:       cfg.Header,
+		field:        cfg.Field,
+		window:       time.Duration(cfg.Window),
+		maxEntries:   cfg.MaxEntries,
+		file:         cfg.File,
+		saveInterval: time.Duration(cfg.SaveInterval),
+		seen:         make(map[string]*list.Element),
+		order:        list.New(),
+		now:          time.Now,
+	}
+	switch d.keyBy {
+	case "":
+		d.keyBy = DedupKeyByOffset
+	case DedupKeyByOffset:
+	case DedupKeyByHeader:
+		if d.header == "" {
+			return nil, fmt.Errorf("dedup keyBy %q requires header", DedupKeyByHeader)
+		}
+	case DedupKeyByField:
+		if d.field == "" {
+			return nil, fmt.Errorf("dedup keyBy %q requires field", DedupKeyByField)
+		}
+	default:
+		return nil, fmt.Errorf("unknown dedup keyBy: %s", d.keyBy)
+	}
+	if d.window <= 0 {
+		d.window = defaultDedupWindow
+	}
+	if d.maxEntries <= 0 {
+		d.maxEntries = defaultDedupMaxEntries
+	}
+	if d.saveInterval <= 0 {
+		d.saveInterval = defaultDedupSaveInterval
+	}
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// ID returns the ID of the message consumed from the source, empty if the message does not have one.
+// Offset IDs of a source other than the default one are prefixed with the source name.
+func (d *Deduplicator) ID(source string, message *sarama.ConsumerMessage) string {
+	switch d.keyBy {
+	case DedupKeyByHeader:
+		for _, h := range message.Headers {
+			if string(h.Key) == d.header {
+				return string(h.Value)
+			}
+		}
+		return ""
+	case DedupKeyByField:
+		dec := json.NewDecoder(bytes.NewReader(message.Value))
+		dec.UseNumber()
+		var doc any
+		if err := dec.Decode(&doc); err != nil {
+			return ""
+		}
+		v, _ := sinkFieldValue(message, doc, d.field)
+		switch v := v.(type) {
+		case nil:
+			return ""
+		case string:
+			return v
+		default:
+			return fmt.Sprint(v)
+		}
+	default:
+		id := fmt.Sprintf("%s/%d/%d", message.Topic, message.Partition, message.Offset)
+		if source != DefaultSourceName {
+			id = source + "/" + id
+		}
+		return id
+	}
+}
+
+// Seen reports whether the ID was seen within the window
+func (d *Deduplicator) Seen(id string) bool {
+	if d == nil || id == "" {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.expireLocked()
+	_, ok := d.seen[id]
+	return ok
+}
+
+// Add remembers the ID of a processed message
+func (d *Deduplicator) Add(id string) {
+	if d == nil || id == "" {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.addLocked(seenID{ID: id, Seen: d.now()})
+	d.expireLocked()
+	d.dirty = true
+}
+
+func (d *Deduplicator) addLocked(s seenID) {
+	if elem, ok := d.seen[s.ID]; ok {
+		elem.Value = s
+		d.order.MoveToBack(elem)
+	} else {
+		d.seen[s.ID] = d.order.PushBack(s)
+	}
+	for d.order.Len() > d.maxEntries {
+		oldest := d.order.Front()
+		d.order.Remove(oldest)
+		delete(d.seen, oldest.Value.(seenID).ID)
+	}
+}
+
+// expireLocked forgets the IDs older than the window
+func (d *Deduplicator) expireLocked() {
+	deadline := d.now().Add(-d.window)
+	for elem := d.order.Front(); elem != nil; elem = d.order.Front() {
+		s := elem.Value.(seenID)
+		if s.Seen.After(deadline) {
+			return
+		}
+		d.order.Remove(elem)
+		delete(d.seen, s.ID)
+		d.dirty = true
+	}
+}
+
+// Len returns the number of remembered IDs
+func (d *Deduplicator) Len() int {
+	if d == nil {
+		return 0
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.order.Len()
+}
+
+// load reads the persisted seen-set, a missing file is an empty set
+func (d *Deduplicator) load() error {
+	if d.file == "" {
+		return nil
+	}
+	b, err := os.ReadFile(d.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read dedup file: %w", err)
+	}
+	var ids []seenID
+	if err := json.Unmarshal(b, &ids); err != nil {
+		return fmt.Errorf("invalid dedup file %s: %w", d.file, err)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, s := range ids {
+		d.addLocked(s)
+	}
+	d.expireLocked()
+	return nil
+}
+
+// Save writes the seen-set to the file if it changed since the last save
+func (d *Deduplicator) Save() error {
+	if d == nil || d.file == "" {
+		return nil
+	}
+	d.mu.Lock()
+	if !d.dirty {
+		d.mu.Unlock()
+		return nil
+	}
+	ids := make([]seenID, 0, d.order.Len())
+	for elem := d.order.Front(); elem != nil; elem = elem.Next() {
+		ids = append(ids, elem.Value.(seenID))
+	}
+	d.dirty = false
+	d.mu.Unlock()
+
+	if err := writeFileAtomic(d.file, ids); err != nil {
+		d.mu.Lock()
+		d.dirty = true
+		d.mu.Unlock()
+		return fmt.Errorf("failed to save dedup file: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes v as JSON to a temporary file renamed to the file,
+// so a crash never leaves a truncated file
+func writeFileAtomic(file string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
@@ -0,0 +1,111 @@
+package k2m
+
+import (
+	"actsvr/util"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeduplicatorID(t *testing.T) {
+	message := &sarama.ConsumerMessage{
+		Topic:     "orders",
+		Partition: 2,
+		Offset:    42,
+		Headers:   []*sarama.RecordHeader{{Key: []byte("message-id"), Value: []byte("m-1")}},
+		Value:     []byte(`{"order":{"id":1001}}`),
+	}
+
+	d, err := NewDeduplicator(DedupConfig{Enabled: true})
+	require.NoError(t, err)
+	assert.Equal(t, "orders/2/42", d.ID(DefaultSourceName, message))
+
+	d, err = NewDeduplicator(DedupConfig{Enabled: true, KeyBy: DedupKeyByHeader, Header: "message-id"})
+	require.NoError(t, err)
+	assert.Equal(t, "m-1", d.ID(DefaultSourceName, message))
+	assert.Empty(t, d.ID(DefaultSourceName, &sarama.ConsumerMessage{}))
+
+	d, err = NewDeduplicator(DedupConfig{Enabled: true, KeyBy: DedupKeyByField, Field: "order.id"})
+	require.NoError(t, err)
+	assert.Equal(t, "1001", d.ID(DefaultSourceName, message))
+	assert.Empty(t, d.ID(DefaultSourceName, &sarama.ConsumerMessage{Value: []byte("not json")}))
+
+	_, err = NewDeduplicator(DedupConfig{Enabled: true, KeyBy: DedupKeyByHeader})
+	assert.ErrorContains(t, err, "requires header")
+	_, err = NewDeduplicator(DedupConfig{Enabled: true, KeyBy: "uuid"})
+	assert.ErrorContains(t, err, "unknown dedup keyBy")
+
+	disabled, err := NewDeduplicator(DedupConfig{})
+	require.NoError(t, err)
+	assert.Nil(t, disabled)
+	disabled.Add("a")
+	assert.False(t, disabled.Seen("a"))
+}
+
+func TestDeduplicatorWindowAndPersistence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "dedup.json")
+	cfg := DedupConfig{Enabled: true, Window: Duration(time.Minute), MaxEntries: 3, File: file}
+	d, err := NewDeduplicator(cfg)
+	require.NoError(t, err)
+	now := time.Now()
+	d.now = func() time.Time { return now }
+
+	d.Add("a")
+	now = now.Add(30 * time.Second)
+	d.Add("b")
+	d.Add("c")
+	assert.True(t, d.Seen("a"))
+	assert.False(t, d.Seen(""))
+
+	// IDs beyond the window or the size bound are forgotten
+	d.Add("d")
+	assert.False(t, d.Seen("a"), "evicted by maxEntries")
+	now = now.Add(90 * time.Second)
+	d.Add("e")
+	assert.False(t, d.Seen("b"), "expired")
+	assert.True(t, d.Seen("e"))
+	assert.Equal(t, 1, d.Len())
+
+	// the seen-set survives a restart
+	d.Add("f")
+	require.NoError(t, d.Save())
+	restarted, err := NewDeduplicator(cfg)
+	require.NoError(t, err)
+	assert.True(t, restarted.Seen("e"))
+	assert.True(t, restarted.Seen("f"))
+	assert.False(t, restarted.Seen("d"))
+}
+
+func TestProcessMessageSkipsDuplicates(t *testing.T) {
+	config := DefaultConfig()
+	config.TopicMappings = nil
+	config.Dedup = DedupConfig{Enabled: true, File: filepath.Join(t.TempDir(), "dedup.json")}
+	broker, err := NewK2MBroker(config, util.NewLog(util.DefaultLogConfig()))
+	require.NoError(t, err)
+	client := NewMockMQTTClient()
+	broker.mqttClient = client
+	worker := &MessageWorker{id: 1, broker: broker, messageCh: broker.messageCh}
+
+	message := func(offset int64) *sarama.ConsumerMessage {
+		return &sarama.ConsumerMessage{Topic: "sensors", Offset: offset, Value: []byte(`{"t":1}`)}
+	}
+	worker.processMessage(message(1))
+	worker.processMessage(message(2))
+	// redelivered after a rebalance
+	worker.processMessage(message(1))
+
+	assert.Len(t, client.GetMessages(), 2)
+	metrics := broker.GetMetrics()
+	assert.Equal(t, int64(1), metrics.DuplicatesSkipped)
+	assert.Equal(t, int64(2), metrics.MessagesPublished)
+
+	// the seen-set is saved on stop and loaded by the next process
+	require.NoError(t, broker.dedup.Save())
+	restarted, err := NewK2MBroker(config, util.NewLog(util.DefaultLogConfig()))
+	require.NoError(t, err)
+	assert.True(t, restarted.dedup.Seen("sensors/0/2"))
+}
@@ -0,0 +1,243 @@
+package k2m
+
+import (
+	"actsvr/feature"
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/tochemey/goakt/v3/actor"
+)
+
+// BrokerActorName is the name of the actor of the broker in the actor system
+const BrokerActorName = "k2m-broker"
+
+const (
+	// processTimeout is how long a worker waits for its actor to process a message
+	processTimeout = 30 * time.Second
+	// restartBackoff is how long a worker waits for its actor to restart
+	restartBackoff = 10 * time.Millisecond
+)
+
+// Feature runs a K2MBroker inside the actor system of a server.Server.
+// The message workers are actors supervised by the broker actor,
+// a worker that panics is restarted instead of crashing the process.
+// The metrics are queried by asking the broker actor with GetMetrics.
+type Feature struct {
+	broker  *K2MBroker
+	pid     *actor.PID
+	workers []*actor.PID
+
+	// inflight holds the messages handed to the worker actors by id
+	inflight sync.Map
+	seq      atomic.Uint64
+
+	// process processes a message in a worker actor, nil is processSourceMessage of the worker
+	process func(w *MessageWorker, source *kafkaSource, message *sarama.ConsumerMessage)
+}
+
+var _ feature.Feature = (*Feature)(nil)
+var _ actor.Actor = (*brokerActor)(nil)
+var _ actor.Actor = (*workerActor)(nil)
+
+// NewFeature returns the feature of the broker, the broker is started with the feature
+func NewFeature(broker *K2MBroker) *Feature {
+	return &Feature{broker: broker}
+}
+
+func (f *Feature) Featured() {
+	feature.Add(f)
+}
+
+// Broker returns the broker of the feature
+func (f *Feature) Broker() *K2MBroker {
+	return f.broker
+}
+
+// PID returns the broker actor, nil before the feature is started
+func (f *Feature) PID() *actor.PID {
+	return f.pid
+}
+
+// feature.Feature interface implementation
+func (f *Feature) Start(ctx context.Context, actorSystem actor.ActorSystem) error {
+	if err := f.spawn(ctx, actorSystem); err != nil {
+		return err
+	}
+	// a broker that fails to start stops what it started, the actors are stopped here
+	if err := f.broker.Start(); err != nil {
+		f.shutdown(ctx)
+		return err
+	}
+	return nil
+}
+
+// feature.Feature interface implementation
+func (f *Feature) Stop(ctx context.Context) error {
+	if err := f.broker.Stop(); err != nil {
+		return err
+	}
+	if f.pid == nil {
+		return nil
+	}
+	return f.pid.Shutdown(ctx)
+}
+
+// shutdown stops the broker actor and its worker actors, so that the feature can be started again
+func (f *Feature) shutdown(ctx context.Context) {
+	f.broker.dispatch = nil
+	if f.pid != nil {
+		if err := f.pid.Shutdown(ctx); err != nil {
+			f.broker.logger.Warnf("Failed to stop %s: %v", BrokerActorName, err)
+		}
+	}
+	f.pid, f.workers = nil, nil
+}
+
+// spawn spawns the broker actor and its worker actors,
+// and makes the workers of the broker dispatch the messages to them
+func (f *Feature) spawn(ctx context.Context, actorSystem actor.ActorSystem) error {
+	pid, err := actorSystem.Spawn(ctx, BrokerActorName, &brokerActor{broker: f.broker}, actor.WithLongLived())
+	if err != nil {
+		return err
+	}
+	f.pid = pid
+
+	process := f.process
+	if process == nil {
+		process = (*MessageWorker).processSourceMessage
+	}
+	f.workers = make([]*actor.PID, f.broker.config.WorkerCount)
+	for i := range f.workers {
+		worker := &workerActor{
+			worker:   &MessageWorker{id: i, broker: f.broker},
+			inflight: &f.inflight,
+			process:  process,
+		}
+		name := fmt.Sprintf("%s-worker-%d", BrokerActorName, i)
+		wpid, err := pid.SpawnChild(ctx, name, worker,
+			actor.WithLongLived(),
+			actor.WithSupervisor(
+				actor.NewSupervisor(
+					actor.WithStrategy(actor.OneForOneStrategy),
+					actor.WithAnyErrorDirective(actor.RestartDirective),
+				),
+			),
+		)
+		if err != nil {
+			f.shutdown(ctx)
+			return err
+		}
+		f.workers[i] = wpid
+	}
+	f.broker.dispatch = f.dispatch
+	return nil
+}
+
+// dispatch hands the message to the actor of the worker and waits until it is processed.
+// If the actor is restarting, the message is handed again once it is back.
+func (f *Feature) dispatch(worker int, consumed consumedMessage) {
+	id := f.seq.Add(1)
+	f.inflight.Store(id, consumed)
+	req := &ProcessMessage{
+		Id:        id,
+		Source:    consumed.source.name,
+		Topic:     consumed.message.Topic,
+		Partition: consumed.message.Partition,
+		Offset:    consumed.message.Offset,
+	}
+	pid := f.workers[worker%len(f.workers)]
+	for {
+		_, err := actor.Ask(f.broker.ctx, pid, req, processTimeout)
+		if _, pending := f.inflight.LoadAndDelete(id); !pending {
+			// the actor took the message, even if it failed processing it
+			if err != nil {
+				f.broker.logger.Warnf("Worker actor %s: %v", pid.Name(), err)
+			}
+			return
+		}
+		if f.broker.ctx.Err() != nil {
+			// not processed, the message is redelivered after the restart
+			return
+		}
+		time.Sleep(restartBackoff)
+		f.inflight.Store(id, consumed)
+	}
+}
+
+// brokerActor supervises the worker actors and answers the metrics queries
+type brokerActor struct {
+	broker *K2MBroker
+}
+
+func (a *brokerActor) PreStart(ctx *actor.Context) error {
+	return nil
+}
+
+func (a *brokerActor) PostStop(ctx *actor.Context) error {
+	return nil
+}
+
+func (a *brokerActor) Receive(ctx *actor.ReceiveContext) {
+	switch ctx.Message().(type) {
+	case *GetMetrics:
+		ctx.Response(a.metricsReply(ctx.Self().Children()))
+	default:
+		ctx.Unhandled()
+	}
+}
+
+func (a *brokerActor) metricsReply(workers []*actor.PID) *MetricsReply {
+	m := a.broker.GetMetrics()
+	reply := &MetricsReply{
+		MessagesReceived:  m.MessagesReceived,
+		MessagesProcessed: m.MessagesProcessed,
+		MessagesPublished: m.MessagesPublished,
+		MessagesFailed:    m.MessagesFailed,
+		MessagesDropped:   m.MessagesDropped,
+		DuplicatesSkipped: m.DuplicatesSkipped,
+		KafkaConnected:    m.KafkaConnected,
+		MqttConnected:     m.MQTTConnected,
+	}
+	for _, pid := range workers {
+		if pid.IsRunning() {
+			reply.ActiveWorkers++
+		}
+		reply.WorkerRestarts += int64(pid.RestartCount())
+	}
+	return reply
+}
+
+// workerActor processes the messages dispatched by a worker of the broker
+type workerActor struct {
+	worker   *MessageWorker
+	inflight *sync.Map
+	process  func(w *MessageWorker, source *kafkaSource, message *sarama.ConsumerMessage)
+}
+
+func (a *workerActor) PreStart(ctx *actor.Context) error {
+	return nil
+}
+
+func (a *workerActor) PostStop(ctx *actor.Context) error {
+	return nil
+}
+
+func (a *workerActor) Receive(ctx *actor.ReceiveContext) {
+	switch msg := ctx.Message().(type) {
+	case *ProcessMessage:
+		// reply even if processing panics, the supervisor restarts the actor
+		defer ctx.Response(&Processed{Id: msg.Id})
+		v, ok := a.inflight.LoadAndDelete(msg.Id)
+		if !ok {
+			return
+		}
+		consumed := v.(consumedMessage)
+		a.process(a.worker, consumed.source, consumed.message)
+	default:
+		ctx.Unhandled()
+	}
+}
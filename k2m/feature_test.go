@@ -0,0 +1,70 @@
+package k2m
+
+import (
+	"actsvr/util"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tochemey/goakt/v3/actor"
+)
+
+func TestFeatureWorkerActors(t *testing.T) {
+	ctx := context.Background()
+	logger := util.NewLog(util.DefaultLogConfig())
+	actorSystem, err := actor.NewActorSystem("k2m-feature-test", actor.WithLogger(logger))
+	require.NoError(t, err)
+	require.NoError(t, actorSystem.Start(ctx))
+	defer actorSystem.Stop(ctx)
+
+	config := DefaultConfig()
+	config.TopicMappings = nil
+	config.WorkerCount = 2
+	broker, err := NewK2MBroker(config, logger)
+	require.NoError(t, err)
+	broker.mqttClient = NewMockMQTTClient()
+	f := NewFeature(broker)
+	f.process = func(w *MessageWorker, source *kafkaSource, message *sarama.ConsumerMessage) {
+		if message.Offset == 1 {
+			panic("processing failed")
+		}
+		w.processSourceMessage(source, message)
+	}
+	require.NoError(t, f.spawn(ctx, actorSystem))
+	require.Len(t, f.workers, 2)
+
+	consumed := func(offset int64) consumedMessage {
+		return consumedMessage{
+			source:  broker.sources[0],
+			message: &sarama.ConsumerMessage{Topic: "sensors", Offset: offset, Value: []byte(`{"t":1}`)},
+		}
+	}
+
+	// the worker that panics is restarted by its supervisor
+	f.dispatch(0, consumed(1))
+	require.Eventually(t, func() bool {
+		return f.workers[0].IsRunning() && f.workers[0].RestartCount() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	client := broker.mqttClient.(*MockMQTTClient)
+	f.dispatch(0, consumed(2))
+	f.dispatch(1, consumed(3))
+	assert.Len(t, client.GetMessages(), 2)
+
+	reply, err := actor.Ask(ctx, f.PID(), &GetMetrics{}, time.Second)
+	require.NoError(t, err)
+	metrics := reply.(*MetricsReply)
+	assert.Equal(t, int64(2), metrics.MessagesPublished)
+	assert.Equal(t, int64(2), metrics.ActiveWorkers)
+	assert.Equal(t, int64(1), metrics.WorkerRestarts)
+
+	// the actors are stopped, e.g. when the broker fails to start, so they can be spawned again
+	f.shutdown(ctx)
+	assert.Nil(t, f.PID())
+	assert.Nil(t, broker.dispatch)
+	require.NoError(t, f.spawn(ctx, actorSystem))
+	require.NoError(t, f.PID().Shutdown(ctx))
+}
@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -59,6 +61,8 @@ func (hc *HealthChecker) Start() error {
 	mux.HandleFunc("/healthz", hc.healthHandler)
 	mux.HandleFunc("/metrics", hc.metricsHandler)
 	mux.HandleFunc("/status", hc.statusHandler)
+	mux.HandleFunc("/cache", hc.cacheHandler)
+	mux.HandleFunc("/stream", hc.streamHandler)
 
 	addr := fmt.Sprintf("%s:%d", hc.config.Host, hc.config.Port)
 	hc.server = &http.Server{
@@ -92,7 +96,7 @@ func (hc *HealthChecker) healthHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Set HTTP status based on overall health
 	statusCode := http.StatusOK
-	if health.Status != "healthy" {
+	if health.Status == "unhealthy" {
 		statusCode = http.StatusServiceUnavailable
 	}
 
@@ -127,6 +131,84 @@ func (hc *HealthChecker) statusHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(status)
 }
 
+// cacheHandler returns the last values matching the topic filter, e.g. /cache?topic=iot/+/temperature.
+// Without a filter all last values are returned.
+func (hc *HealthChecker) cacheHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if hc.broker.cache == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "last-value cache is not enabled"})
+		return
+	}
+
+	if key := r.URL.Query().Get("key"); key != "" {
+		entry, ok := hc.broker.cache.Get(key)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "not found"})
+			return
+		}
+		json.NewEncoder(w).Encode(entry)
+		return
+	}
+
+	filter := r.URL.Query().Get("topic")
+	if filter == "" {
+		filter = "#"
+	}
+	entries := hc.broker.cache.Query(filter)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"filter":  filter,
+		"count":   len(entries),
+		"entries": entries,
+	})
+}
+
+// streamHandler streams the routed messages as Server-Sent Events.
+// The routes are selected with /stream?route=a,b, all routes by default.
+func (hc *HealthChecker) streamHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	var routes []string
+	if v := r.URL.Query().Get("route"); v != "" {
+		routes = strings.Split(v, ",")
+	}
+	sub := hc.broker.stream.Subscribe(routes, 100)
+	defer hc.broker.stream.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case entry := <-sub.ch:
+			data, err := json.Marshal(entry)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: message\ndata: %s\n\n", data)
+			flusher.Flush()
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-hc.broker.ctx.Done():
+			return
+		}
+	}
+}
+
 // performAllHealthChecks performs all health checks and returns the overall status
 func (hc *HealthChecker) performAllHealthChecks() *HealthStatus {
 	checks := make(map[string]ComponentCheck)
@@ -135,6 +217,13 @@ func (hc *HealthChecker) performAllHealthChecks() *HealthStatus {
 	kafkaCheck := hc.checkKafkaHealth()
 	checks["kafka"] = kafkaCheck
 
+	// Check each named Kafka source
+	if len(hc.broker.config.Sources) > 0 {
+		for _, src := range hc.broker.sources {
+			checks["kafka:"+src.name] = hc.checkSourceHealth(src)
+		}
+	}
+
 	// Check MQTT connection
 	mqttCheck := hc.checkMQTTHealth()
 	checks["mqtt"] = mqttCheck
@@ -147,13 +236,21 @@ func (hc *HealthChecker) performAllHealthChecks() *HealthStatus {
 	bufferCheck := hc.checkBufferHealth()
 	checks["buffer"] = bufferCheck
 
-	// Determine overall status
+	// Check the latency SLO
+	if hc.broker.config.Latency.P99Target > 0 {
+		checks["latency"] = hc.checkLatencyHealth()
+	}
+
+	// Determine overall status, a degraded component does not make the broker unhealthy
 	overallStatus := "healthy"
 	for _, check := range checks {
-		if check.Status != "healthy" {
+		if check.Status == "unhealthy" {
 			overallStatus = "unhealthy"
 			break
 		}
+		if check.Status == "degraded" {
+			overallStatus = "degraded"
+		}
 	}
 
 	return &HealthStatus{
@@ -178,14 +275,49 @@ func (hc *HealthChecker) checkKafkaHealth() ComponentCheck {
 		lastMessage = &hc.broker.metrics.LastMessageTime
 	}
 
+	details := map[string]interface{}{
+		"brokers":       hc.broker.config.KafkaConfig.Brokers,
+		"topics":        hc.broker.config.KafkaConfig.Topics,
+		"consumerGroup": hc.broker.config.KafkaConfig.ConsumerGroup,
+	}
+	if len(hc.broker.config.Sources) > 0 {
+		// the sources are checked one by one
+		names := make([]string, 0, len(hc.broker.sources))
+		for _, src := range hc.broker.sources {
+			names = append(names, src.name)
+		}
+		details = map[string]interface{}{"sources": names}
+	}
+
 	return ComponentCheck{
 		Status:      status,
 		Connected:   connected,
 		LastMessage: lastMessage,
+		Details:     details,
+	}
+}
+
+// checkSourceHealth checks the health of the connection to a Kafka source
+func (hc *HealthChecker) checkSourceHealth(src *kafkaSource) ComponentCheck {
+	metrics := hc.broker.metrics.GetSnapshot().Sources[src.name]
+	if metrics == nil {
+		metrics = &SourceMetrics{}
+	}
+	status := "healthy"
+	if !metrics.Connected {
+		status = "unhealthy"
+	}
+
+	return ComponentCheck{
+		Status:    status,
+		Connected: metrics.Connected,
 		Details: map[string]interface{}{
-			"brokers":       hc.broker.config.KafkaConfig.Brokers,
-			"topics":        hc.broker.config.KafkaConfig.Topics,
-			"consumerGroup": hc.broker.config.KafkaConfig.ConsumerGroup,
+			"brokers":          src.config.Brokers,
+			"topics":           src.config.Topics,
+			"consumerGroup":    src.config.ConsumerGroup,
+			"messagesReceived": metrics.MessagesReceived,
+			"errors":           metrics.Errors,
+			"lag":              metrics.Lag,
 		},
 	}
 }
@@ -254,6 +386,36 @@ func (hc *HealthChecker) checkBufferHealth() ComponentCheck {
 	}
 }
 
+// checkLatencyHealth checks the p99 end-to-end latency of every route against the SLO.
+// Routes with fewer samples than minSamples in the window are not checked.
+func (hc *HealthChecker) checkLatencyHealth() ComponentCheck {
+	cfg := hc.broker.config.Latency
+	target := time.Duration(cfg.P99Target)
+	minSamples := cfg.MinSamples
+	if minSamples == 0 {
+		minSamples = defaultLatencyMinSamples
+	}
+
+	status := "healthy"
+	var breached []string
+	for route, p := range hc.broker.metrics.GetSnapshot().RouteLatency {
+		if p.Count >= minSamples && time.Duration(p.P99)*time.Microsecond > target {
+			status = "degraded"
+			breached = append(breached, route)
+		}
+	}
+	sort.Strings(breached)
+
+	return ComponentCheck{
+		Status: status,
+		Details: map[string]interface{}{
+			"p99Target":  target.String(),
+			"minSamples": minSamples,
+			"breached":   breached,
+		},
+	}
+}
+
 // GetHealthStatus returns the current health status (for testing)
 func (hc *HealthChecker) GetHealthStatus() *HealthStatus {
 	return hc.performAllHealthChecks()
@@ -276,7 +438,7 @@ func (hc *HealthChecker) handleHealthCheck(w http.ResponseWriter, r *http.Reques
 
 	// Set HTTP status based on overall health
 	statusCode := http.StatusOK
-	if health.Status != "healthy" {
+	if health.Status == "unhealthy" {
 		statusCode = http.StatusServiceUnavailable
 	}
 
@@ -309,7 +471,7 @@ func (hc *HealthChecker) handleStatus(w http.ResponseWriter, r *http.Request) {
 
 	// Set HTTP status based on overall health
 	statusCode := http.StatusOK
-	if health.Status != "healthy" {
+	if health.Status == "unhealthy" {
 		statusCode = http.StatusServiceUnavailable
 	}
 
@@ -1,9 +1,11 @@
 package k2m
 
 import (
+	"actsvr/k2m/sparkplug"
 	"actsvr/util"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 	"sync"
@@ -11,12 +13,21 @@ import (
 
 	"github.com/IBM/sarama"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// publishTimeout is how long a publish waits for its acknowledgement, a variable for the tests
+var publishTimeout = 5 * time.Second
+
 // K2MConfig holds configuration for the Kafka to MQTT broker
 type K2MConfig struct {
 	// Kafka consumer configuration
 	KafkaConfig KafkaConfig `json:"kafka"`
+	// Named Kafka sources, each consumed by its own consumer group.
+	// When set, they replace the kafka configuration.
+	Sources []KafkaConfig `json:"sources,omitempty"`
 	// MQTT publisher configuration
 	MQTTConfig MQTTConfig `json:"mqtt"`
 	// Topic mapping configuration (deprecated, use Routes instead)
@@ -28,10 +39,24 @@ type K2MConfig struct {
 	BufferSize  int `json:"bufferSize"`
 	// Health check configuration
 	HttpConfig HttpConfig `json:"http"`
+	// Distributed tracing configuration
+	Tracing TracingConfig `json:"tracing"`
+	// Structured audit log configuration
+	Audit AuditConfig `json:"audit"`
+	// Last-value cache served by the HTTP server
+	Cache CacheConfig `json:"cache"`
+	// Sparkplug B edge node of the routes using the "sparkplug" transform
+	Sparkplug *SparkplugConfig `json:"sparkplug,omitempty"`
+	// Deduplication of redelivered messages
+	Dedup DedupConfig `json:"dedup"`
+	// End-to-end latency tracking and its SLO
+	Latency LatencyConfig `json:"latency"`
 }
 
 // KafkaConfig holds Kafka consumer settings
 type KafkaConfig struct {
+	// Name of the source, used by the source filter and the {source} placeholder
+	Name          string   `json:"name,omitempty"`
 	Brokers       []string `json:"brokers"`
 	Topics        []string `json:"topics"`
 	ConsumerGroup string   `json:"consumerGroup"`
@@ -40,6 +65,8 @@ type KafkaConfig struct {
 	OffsetOldest      bool     `json:"offsetOldest"`
 	SessionTimeout    Duration `json:"sessionTimeout"`
 	HeartbeatInterval Duration `json:"heartbeatInterval"`
+	// TLS and SASL settings of the cluster
+	Security *KafkaSecurityConfig `json:"security,omitempty"`
 }
 
 // MQTTConfig holds MQTT publisher settings
@@ -50,19 +77,32 @@ type MQTTConfig struct {
 	Password string `json:"password"`
 	QoS      byte   `json:"qos"`
 	Retained bool   `json:"retained"`
+	// ProtocolVersion selects the MQTT protocol: 3 (3.1), 4 (3.1.1) or 5.
+	// MQTT v5 is required to propagate trace context as user properties.
+	ProtocolVersion uint `json:"protocolVersion,omitempty"`
 	// Connection configuration
 	KeepAlive            Duration `json:"keepAlive"`
 	PingTimeout          Duration `json:"pingTimeout"`
 	ConnectTimeout       Duration `json:"connectTimeout"`
 	ConnectRetry         bool     `json:"connectRetry"`
 	MaxReconnectInterval Duration `json:"maxReconnectInterval"`
+	// PoolSize is the number of connections, messages are sharded by MQTT topic (default 1)
+	PoolSize int `json:"poolSize,omitempty"`
+	// MaxInFlight makes publishing asynchronous with at most MaxInFlight publishes
+	// per connection waiting for their acknowledgement, 0 waits for every publish
+	MaxInFlight int `json:"maxInFlight,omitempty"`
 }
 
 // TopicMapping defines how to map Kafka topics to MQTT topics
 type TopicMapping struct {
 	KafkaTopic string `json:"kafkaTopic"`
 	MQTTTopic  string `json:"mqttTopic"`
-	Transform  string `json:"transform"` // "none", "json", "custom"
+	Transform  string `json:"transform"` // "none", "json", "custom", "sparkplug"
+	// TopicMode selects how the MQTT topic is built: "template" (default) expands
+	// MQTTTopic, "sparkplug" publishes to the Sparkplug B DDATA topic of the device.
+	TopicMode string `json:"topicMode,omitempty"`
+	// Sparkplug maps the payload to Sparkplug B metrics, used by the "sparkplug" transform
+	Sparkplug *SparkplugMapping `json:"sparkplug,omitempty"`
 }
 
 type Duration time.Duration
@@ -95,42 +135,70 @@ type K2MBroker struct {
 	config *K2MConfig
 	logger *util.Log
 
-	// Kafka components
-	consumerGroup sarama.ConsumerGroup
-	consumer      *Consumer
+	// Kafka sources, each with its own consumer group
+	sources []*kafkaSource
 
-	// MQTT components
+	// MQTT components, mqttClient is the primary connection of the pool
 	mqttClient mqtt.Client
+	pool       *mqttPool
 
 	// Control channels
 	ctx    context.Context
 	cancel context.CancelFunc
 	ready  chan bool
 	wg     sync.WaitGroup
+	// stopOnce makes Stop safe after a failed Start, which stops the broker itself
+	stopOnce sync.Once
 
 	// Message processing
-	messageCh chan *sarama.ConsumerMessage
+	messageCh chan consumedMessage
 	workers   []*MessageWorker
 
+	// dispatch hands the messages of the workers to worker actors,
+	// nil if the workers process the messages themselves
+	dispatch func(worker int, consumed consumedMessage)
+
+	// Route sinks by route name
+	sinks map[string]sink
+
 	// Routing system
 	router *MessageRouter
 
 	// Metrics and monitoring
 	metrics       *Metrics
 	healthChecker *HealthChecker
+	tracer        *Tracer
+	auditor       *Auditor
+
+	// Last values and live stream of the routed messages
+	cache  *LastValueCache
+	stream *streamHub
+
+	// Sparkplug B edge node, nil if no route uses the sparkplug transform
+	sparkplug *sparkplugNode
+
+	// Seen-set of the processed messages, nil if deduplication is disabled
+	dedup *Deduplicator
 }
 
-// Consumer represents the Sarama consumer group consumer
+// Consumer represents the Sarama consumer group consumer of a source
 type Consumer struct {
 	ready  chan bool
 	broker *K2MBroker
+	source *kafkaSource
+}
+
+// consumedMessage is a Kafka message with the source it was consumed from
+type consumedMessage struct {
+	source  *kafkaSource
+	message *sarama.ConsumerMessage
 }
 
 // MessageWorker processes messages from Kafka and publishes to MQTT
 type MessageWorker struct {
 	id        int
 	broker    *K2MBroker
-	messageCh <-chan *sarama.ConsumerMessage
+	messageCh <-chan consumedMessage
 }
 
 // DefaultConfig returns a default configuration for the K2M broker
@@ -179,8 +247,30 @@ func DefaultConfig() *K2MConfig {
 	}
 }
 
+// Option configures the K2MBroker
+type Option func(*K2MBroker)
+
+// WithConsumerGroup makes the broker consume from the given consumer group
+// instead of connecting to the Kafka brokers of the configuration.
+// With several sources, it replaces the consumer group of the first one.
+func WithConsumerGroup(consumerGroup sarama.ConsumerGroup) Option {
+	return func(b *K2MBroker) {
+		b.sources[0].consumerGroup = consumerGroup
+	}
+}
+
+// WithSourceConsumerGroup makes the named source consume from the given consumer group.
+// It is ignored if there is no such source.
+func WithSourceConsumerGroup(source string, consumerGroup sarama.ConsumerGroup) Option {
+	return func(b *K2MBroker) {
+		if src := b.source(source); src != nil {
+			src.consumerGroup = consumerGroup
+		}
+	}
+}
+
 // NewK2MBroker creates a new Kafka to MQTT broker instance
-func NewK2MBroker(config *K2MConfig, logger *util.Log) (*K2MBroker, error) {
+func NewK2MBroker(config *K2MConfig, logger *util.Log, opts ...Option) (*K2MBroker, error) {
 	if config == nil {
 		config = DefaultConfig()
 	}
@@ -197,10 +287,28 @@ func NewK2MBroker(config *K2MConfig, logger *util.Log) (*K2MBroker, error) {
 		ctx:       ctx,
 		cancel:    cancel,
 		ready:     make(chan bool),
-		messageCh: make(chan *sarama.ConsumerMessage, config.BufferSize),
+		messageCh: make(chan consumedMessage, config.BufferSize),
+		sinks:     make(map[string]sink),
 		metrics:   NewMetrics(),
+		stream:    newStreamHub(),
 	}
 
+	// Initialize Kafka sources
+	sources, err := newKafkaSources(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source configuration: %w", err)
+	}
+	broker.sources = sources
+
+	if err := validateMQTTPool(config.MQTTConfig); err != nil {
+		return nil, fmt.Errorf("invalid MQTT configuration: %w", err)
+	}
+
+	if err := validateLatency(config.Latency); err != nil {
+		return nil, fmt.Errorf("invalid latency configuration: %w", err)
+	}
+	broker.metrics.SetLatencyWindow(time.Duration(config.Latency.Window))
+
 	// Initialize routing system
 	routes := config.Routes
 	if len(config.TopicMappings) > 0 {
@@ -235,14 +343,80 @@ func NewK2MBroker(config *K2MConfig, logger *util.Log) (*K2MBroker, error) {
 	}
 	broker.router = router
 
+	// Initialize route sinks, connected on Start
+	for _, route := range routes {
+		if route.Sink == nil {
+			continue
+		}
+		s, err := newSink(route.Name, route.Sink, logger, broker.metrics)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create sink of route %s: %w", route.Name, err)
+		}
+		broker.sinks[route.Name] = s
+	}
+
+	// Initialize the Sparkplug B edge node
+	for _, route := range routes {
+		if route.Mapping.Transform != TransformSparkplug {
+			continue
+		}
+		node, err := newSparkplugNode(config.Sparkplug)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %w", route.Name, err)
+		}
+		broker.sparkplug = node
+		break
+	}
+
+	// Initialize tracing
+	tracer, err := NewTracer(ctx, config.Tracing)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tracer: %w", err)
+	}
+	broker.tracer = tracer
+
+	// Initialize audit log
+	auditor, err := NewAuditor(config.Audit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create audit log: %w", err)
+	}
+	broker.auditor = auditor
+
+	// Initialize last-value cache
+	cache, err := NewLastValueCache(config.Cache)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create last-value cache: %w", err)
+	}
+	broker.cache = cache
+
+	// Initialize deduplication
+	dedup, err := NewDeduplicator(config.Dedup)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create deduplicator: %w", err)
+	}
+	broker.dedup = dedup
+
 	// Initialize health checker
 	broker.healthChecker = NewHealthChecker(broker, config.HttpConfig)
 
+	for _, opt := range opts {
+		opt(broker)
+	}
+
 	return broker, nil
 }
 
 // Start starts the K2M broker
 func (b *K2MBroker) Start() error {
+	if err := b.start(); err != nil {
+		// stop the connections, consumers and workers started before the error
+		b.Stop()
+		return err
+	}
+	return nil
+}
+
+func (b *K2MBroker) start() error {
 	b.logger.Infof("Starting K2M Broker")
 
 	// Initialize MQTT client
@@ -251,9 +425,18 @@ func (b *K2MBroker) Start() error {
 	}
 	b.logger.Infof("init mqtt client")
 
-	// Initialize Kafka consumer
-	if err := b.initKafkaConsumer(); err != nil {
-		return fmt.Errorf("failed to initialize Kafka consumer: %w", err)
+	// Open route sinks
+	for name, s := range b.sinks {
+		if err := s.Open(b.ctx); err != nil {
+			return fmt.Errorf("failed to open sink of route %s: %w", name, err)
+		}
+	}
+
+	// Initialize Kafka consumers
+	for _, src := range b.sources {
+		if err := b.initKafkaConsumer(src); err != nil {
+			return fmt.Errorf("failed to initialize Kafka consumer of source %s: %w", src.name, err)
+		}
 	}
 	b.logger.Infof("init kafka client")
 
@@ -262,29 +445,24 @@ func (b *K2MBroker) Start() error {
 	b.logger.Infof("start workers")
 
 	// Start consuming from Kafka
-	b.wg.Add(1)
-	go func() {
-		defer b.wg.Done()
-		for {
-			if err := b.consumerGroup.Consume(b.ctx, b.config.KafkaConfig.Topics, b.consumer); err != nil {
-				if err == sarama.ErrClosedConsumerGroup {
-					return
-				}
-				b.logger.Errorf("Error from consumer: %v", err)
-			}
-			if b.ctx.Err() != nil {
-				return
-			}
-			b.consumer.ready = make(chan bool)
-		}
-	}()
-
-	<-b.consumer.ready
+	for _, src := range b.sources {
+		b.wg.Add(1)
+		go b.consume(src)
+	}
+	for _, src := range b.sources {
+		<-src.consumer.ready
+	}
 
 	// Start metrics update routine
 	b.wg.Add(1)
 	go b.metricsUpdateLoop()
 
+	// Start saving the dedup seen-set
+	if b.dedup != nil {
+		b.wg.Add(1)
+		go b.dedupSaveLoop()
+	}
+
 	// Start health check server
 	if err := b.healthChecker.Start(); err != nil {
 		return fmt.Errorf("failed to start health check server: %w", err)
@@ -294,8 +472,13 @@ func (b *K2MBroker) Start() error {
 	return nil
 }
 
-// Stop stops the K2M broker
+// Stop stops the K2M broker, it does nothing if the broker is already stopped
 func (b *K2MBroker) Stop() error {
+	b.stopOnce.Do(b.stop)
+	return nil
+}
+
+func (b *K2MBroker) stop() {
 	b.logger.Infof("Stopping K2M Broker")
 
 	// Cancel context to stop all goroutines
@@ -308,35 +491,124 @@ func (b *K2MBroker) Stop() error {
 		}
 	}
 
-	// Close Kafka consumer
-	if b.consumerGroup != nil {
-		if err := b.consumerGroup.Close(); err != nil {
-			b.logger.Errorf("Error closing consumer group: %v", err)
+	// Close Kafka consumers
+	for _, src := range b.sources {
+		if src.consumerGroup == nil {
+			continue
+		}
+		if err := src.consumerGroup.Close(); err != nil {
+			b.logger.Errorf("Error closing consumer group of source %s: %v", src.name, err)
 		}
-		b.metrics.SetKafkaConnected(false)
+		b.metrics.SetSourceConnected(src.name, false)
 	}
 
-	// Close MQTT client
-	if b.mqttClient != nil && b.mqttClient.IsConnected() {
+	// Close message channel
+	close(b.messageCh)
+
+	// Wait for all goroutines to finish, including the pending asynchronous publishes
+	b.wg.Wait()
+
+	// Close MQTT connections
+	if b.mqttClient != nil && b.mqttClient.IsConnected() && b.sparkplug != nil {
+		if err := b.sparkplug.Death(b.mqttClient); err != nil {
+			b.logger.Errorf("Error publishing Sparkplug NDEATH: %v", err)
+		}
+	}
+	if b.pool != nil {
+		for _, conn := range b.pool.conns {
+			if conn.client.IsConnected() {
+				conn.client.Disconnect(250)
+			}
+			b.metrics.SetMQTTConnectionConnected(conn.clientID, false)
+		}
+	} else if b.mqttClient != nil && b.mqttClient.IsConnected() {
 		b.mqttClient.Disconnect(250)
 		b.metrics.SetMQTTConnected(false)
 	}
 
-	// Close message channel
-	close(b.messageCh)
+	// Flush and close route sinks
+	for name, s := range b.sinks {
+		if err := s.Close(); err != nil {
+			b.logger.Errorf("Error closing sink of route %s: %v", name, err)
+		}
+	}
 
-	// Wait for all goroutines to finish
-	b.wg.Wait()
+	if err := b.dedup.Save(); err != nil {
+		b.logger.Errorf("Error saving dedup seen-set: %v", err)
+	}
+
+	// Flush pending spans
+	if b.tracer != nil {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := b.tracer.Shutdown(shutdownCtx); err != nil {
+			b.logger.Errorf("Error shutting down tracer: %v", err)
+		}
+	}
+
+	if err := b.auditor.Close(); err != nil {
+		b.logger.Errorf("Error closing audit log: %v", err)
+	}
 
 	b.logger.Infof("K2M Broker stopped")
-	return nil
 }
 
-// initMQTTClient initializes the MQTT client
+// initMQTTClient initializes and connects the MQTT connections of the pool
 func (b *K2MBroker) initMQTTClient() error {
+	size := b.config.MQTTConfig.PoolSize
+	if size < 1 {
+		size = 1
+	}
+	b.pool = &mqttPool{}
+	b.metrics.SetMQTTPoolSize(size)
+	for i := 0; i < size; i++ {
+		clientID := poolClientID(b.config.MQTTConfig.ClientID, i)
+		client, err := b.newMQTTClient(clientID, i == 0)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			b.mqttClient = client
+		}
+		b.pool.conns = append(b.pool.conns, newMQTTConn(clientID, client, b.config.MQTTConfig.MaxInFlight))
+		if err := b.connectMQTTClient(client, clientID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newMQTTClient creates the client of a connection of the pool,
+// the Sparkplug B certificates use the primary connection
+func (b *K2MBroker) newMQTTClient(clientID string, primary bool) (mqtt.Client, error) {
+	sparkplug := primary && b.sparkplug != nil
+
+	if b.config.MQTTConfig.ProtocolVersion == 5 {
+		hooks := mqttV5Hooks{
+			OnConnect: func() {
+				b.logger.Infof("Connected to MQTT broker: %s as %s", b.config.MQTTConfig.Broker, clientID)
+				b.metrics.SetMQTTConnectionConnected(clientID, true)
+				if sparkplug {
+					go b.sparkplugBirth()
+				}
+			},
+			OnConnectionLost: func(err error) {
+				b.logger.Errorf("Connection %s to MQTT broker lost: %v", clientID, err)
+				b.metrics.SetMQTTConnectionConnected(clientID, false)
+				b.metrics.IncrementMQTTErrors()
+			},
+		}
+		if sparkplug {
+			hooks.Will = b.sparkplug.Will
+		}
+		config := b.config.MQTTConfig
+		config.ClientID = clientID
+		return newMQTTV5Client(config, hooks)
+	}
+
 	opts := mqtt.NewClientOptions()
 	opts.AddBroker(b.config.MQTTConfig.Broker)
-	opts.SetClientID(b.config.MQTTConfig.ClientID)
+	opts.SetClientID(clientID)
 
 	if b.config.MQTTConfig.Username != "" {
 		opts.SetUsername(b.config.MQTTConfig.Username)
@@ -345,6 +617,9 @@ func (b *K2MBroker) initMQTTClient() error {
 		opts.SetPassword(b.config.MQTTConfig.Password)
 	}
 
+	if v := b.config.MQTTConfig.ProtocolVersion; v == 3 || v == 4 {
+		opts.SetProtocolVersion(v)
+	}
 	opts.SetKeepAlive(time.Duration(b.config.MQTTConfig.KeepAlive))
 	opts.SetPingTimeout(time.Duration(b.config.MQTTConfig.PingTimeout))
 	opts.SetConnectRetry(b.config.MQTTConfig.ConnectRetry)
@@ -355,64 +630,122 @@ func (b *K2MBroker) initMQTTClient() error {
 	})
 
 	opts.SetOnConnectHandler(func(client mqtt.Client) {
-		b.logger.Infof("Connected to MQTT broker: %s", b.config.MQTTConfig.Broker)
-		b.metrics.SetMQTTConnected(true)
+		b.logger.Infof("Connected to MQTT broker: %s as %s", b.config.MQTTConfig.Broker, clientID)
+		b.metrics.SetMQTTConnectionConnected(clientID, true)
+		if sparkplug {
+			b.sparkplugBirth()
+		}
 	})
 
+	// The NDEATH certificate is the last will, renewed with the bdSeq of every connection
+	if sparkplug {
+		topic, payload := b.sparkplug.Will()
+		opts.SetBinaryWill(topic, payload, 1, false)
+		opts.SetReconnectingHandler(func(client mqtt.Client, opts *mqtt.ClientOptions) {
+			topic, payload := b.sparkplug.Will()
+			opts.SetBinaryWill(topic, payload, 1, false)
+		})
+	}
+
 	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
-		b.logger.Errorf("Connection to MQTT broker lost: %v", err)
-		b.metrics.SetMQTTConnected(false)
+		b.logger.Errorf("Connection %s to MQTT broker lost: %v", clientID, err)
+		b.metrics.SetMQTTConnectionConnected(clientID, false)
 		b.metrics.IncrementMQTTErrors()
 	})
 
-	b.mqttClient = mqtt.NewClient(opts)
+	return mqtt.NewClient(opts), nil
+}
 
-	token := b.mqttClient.Connect()
+// sparkplugBirth subscribes to the node commands and publishes the birth certificates
+func (b *K2MBroker) sparkplugBirth() {
+	token := b.mqttClient.Subscribe(b.sparkplug.CommandTopic(), 1, func(client mqtt.Client, msg mqtt.Message) {
+		if err := b.sparkplug.HandleCommand(client, msg); err != nil {
+			b.logger.Errorf("Failed to handle Sparkplug command: %v", err)
+		}
+	})
+	if token.WaitTimeout(5*time.Second) && token.Error() != nil {
+		b.logger.Errorf("Failed to subscribe to %s: %v", b.sparkplug.CommandTopic(), token.Error())
+	}
+	if err := b.sparkplug.Birth(b.mqttClient); err != nil {
+		b.logger.Errorf("Failed to publish Sparkplug birth certificates: %v", err)
+	}
+}
+
+// connectMQTTClient connects a client of the pool and waits for the connection
+func (b *K2MBroker) connectMQTTClient(client mqtt.Client, clientID string) error {
+	token := client.Connect()
 	if token.WaitTimeout(time.Duration(b.config.MQTTConfig.ConnectTimeout)) && token.Error() != nil {
-		b.metrics.SetMQTTConnected(false)
-		return fmt.Errorf("failed to connect to MQTT broker: %w", token.Error())
+		b.metrics.SetMQTTConnectionConnected(clientID, false)
+		return fmt.Errorf("failed to connect to MQTT broker as %s: %w", clientID, token.Error())
 	}
 
-	b.metrics.SetMQTTConnected(true)
-	b.logger.Infof("Connected to MQTT broker: %s", b.config.MQTTConfig.Broker)
+	b.metrics.SetMQTTConnectionConnected(clientID, true)
+	b.logger.Infof("Connected to MQTT broker: %s as %s", b.config.MQTTConfig.Broker, clientID)
 	return nil
 }
 
-// initKafkaConsumer initializes the Kafka consumer
-func (b *K2MBroker) initKafkaConsumer() error {
-	config := sarama.NewConfig()
-	config.Version = sarama.V2_6_0_0
-	config.Consumer.Group.Session.Timeout = time.Duration(b.config.KafkaConfig.SessionTimeout)
-	config.Consumer.Group.Heartbeat.Interval = time.Duration(b.config.KafkaConfig.HeartbeatInterval)
-	config.Consumer.Return.Errors = b.config.KafkaConfig.ReturnErrors
-
-	if b.config.KafkaConfig.OffsetOldest {
-		config.Consumer.Offsets.Initial = sarama.OffsetOldest
-	}
-
-	consumerGroup, err := sarama.NewConsumerGroup(b.config.KafkaConfig.Brokers, b.config.KafkaConfig.ConsumerGroup, config)
-	if err != nil {
-		return fmt.Errorf("error creating consumer group client: %w", err)
+// initKafkaConsumer initializes the Kafka consumer of the source
+func (b *K2MBroker) initKafkaConsumer(src *kafkaSource) error {
+	// The consumer group may be given by WithConsumerGroup
+	if src.consumerGroup == nil {
+		config, err := src.saramaConfig()
+		if err != nil {
+			return err
+		}
+		consumerGroup, err := sarama.NewConsumerGroup(src.config.Brokers, src.config.ConsumerGroup, config)
+		if err != nil {
+			return fmt.Errorf("error creating consumer group client: %w", err)
+		}
+		src.consumerGroup = consumerGroup
 	}
 
-	b.consumerGroup = consumerGroup
-	b.consumer = &Consumer{
+	src.consumer = &Consumer{
 		ready:  make(chan bool),
 		broker: b,
+		source: src,
 	}
 
 	// Track errors
 	b.wg.Add(1)
 	go func() {
 		defer b.wg.Done()
-		for err := range b.consumerGroup.Errors() {
-			b.logger.Errorf("Consumer error: %v", err)
+		for err := range src.consumerGroup.Errors() {
+			b.logger.Errorf("Consumer error of source %s: %v", src.name, err)
 			b.metrics.IncrementKafkaErrors()
+			b.metrics.IncrementSourceErrors(src.name)
 		}
 	}()
 
-	b.metrics.SetKafkaConnected(true)
-	b.logger.Infof("Kafka consumer initialized for topics: %v", b.config.KafkaConfig.Topics)
+	b.metrics.SetSourceConnected(src.name, true)
+	b.logger.Infof("Kafka consumer of source %s initialized for topics: %v", src.name, src.config.Topics)
+	return nil
+}
+
+// consume consumes the topics of the source until the broker stops
+func (b *K2MBroker) consume(src *kafkaSource) {
+	defer b.wg.Done()
+	for {
+		if err := src.consumerGroup.Consume(b.ctx, src.config.Topics, src.consumer); err != nil {
+			if err == sarama.ErrClosedConsumerGroup {
+				return
+			}
+			b.logger.Errorf("Error from consumer of source %s: %v", src.name, err)
+			b.metrics.IncrementSourceErrors(src.name)
+		}
+		if b.ctx.Err() != nil {
+			return
+		}
+		src.consumer.ready = make(chan bool)
+	}
+}
+
+// source returns the named source, nil if there is no such source
+func (b *K2MBroker) source(name string) *kafkaSource {
+	for _, src := range b.sources {
+		if src.name == name {
+			return src
+		}
+	}
 	return nil
 }
 
@@ -437,7 +770,8 @@ func (b *K2MBroker) startMessageWorkers() {
 }
 
 // Setup is run at the beginning of a new session, before ConsumeClaim
-func (consumer *Consumer) Setup(sarama.ConsumerGroupSession) error {
+func (consumer *Consumer) Setup(session sarama.ConsumerGroupSession) error {
+	consumer.source.offsets.Reset(session)
 	close(consumer.ready)
 	return nil
 }
@@ -461,22 +795,25 @@ func (consumer *Consumer) ConsumeClaim(session sarama.ConsumerGroupSession, clai
 			}
 
 			// Track message received
+			src := consumer.source
 			consumer.broker.metrics.IncrementMessagesReceived()
+			consumer.broker.metrics.IncrementSourceReceived(src.name)
+			consumer.broker.metrics.SetSourceLag(src.name, src.recordLag(message, claim.HighWaterMarkOffset()))
 
-			// Send message to workers for processing
+			// Send message to workers for processing,
+			// the offset is marked once the worker is done with it
+			src.offsets.Add(message)
 			select {
-			case consumer.broker.messageCh <- message:
+			case consumer.broker.messageCh <- consumedMessage{source: src, message: message}:
 				// Message sent to worker
 			case <-consumer.broker.ctx.Done():
 				return nil
 			default:
 				consumer.broker.logger.Warnf("Message buffer full, dropping message from topic %s", message.Topic)
 				consumer.broker.metrics.IncrementMessagesDropped()
+				src.offsets.Done(message)
 			}
 
-			// Mark message as processed
-			session.MarkMessage(message, "")
-
 		case <-consumer.broker.ctx.Done():
 			return nil
 		}
@@ -490,12 +827,16 @@ func (w *MessageWorker) start() {
 
 	for {
 		select {
-		case message, ok := <-w.messageCh:
+		case consumed, ok := <-w.messageCh:
 			if !ok {
 				w.broker.logger.Infof("Message worker %d stopped", w.id)
 				return
 			}
-			w.processMessage(message)
+			if w.broker.dispatch != nil {
+				w.broker.dispatch(w.id, consumed)
+				continue
+			}
+			w.processSourceMessage(consumed.source, consumed.message)
 
 		case <-w.broker.ctx.Done():
 			w.broker.logger.Infof("Message worker %d stopped", w.id)
@@ -504,28 +845,145 @@ func (w *MessageWorker) start() {
 	}
 }
 
-// processMessage processes a Kafka message and publishes it to MQTT
+// processMessage processes a Kafka message of the first source and publishes it to MQTT
 func (w *MessageWorker) processMessage(message *sarama.ConsumerMessage) {
+	w.processSourceMessage(w.broker.sources[0], message)
+}
+
+// processSourceMessage processes a Kafka message consumed from the source and publishes it to MQTT
+func (w *MessageWorker) processSourceMessage(source *kafkaSource, message *sarama.ConsumerMessage) {
 	startTime := time.Now()
+	tracer := w.broker.tracer
+
+	ctx, span := tracer.StartConsume(w.broker.ctx, message)
+	defer span.End()
+
+	// Mark the offset when done, unless a sink marks it after appending.
+	// The consumed message is tracked, message may become its decompressed copy.
+	consumed := message
+	pending := false
+	defer func() {
+		if !pending {
+			source.offsets.Done(consumed)
+		}
+	}()
+
+	// Audit event of the routing decision, nil if not sampled
+	// An asynchronous publish records the event once it is acknowledged.
+	var event *AuditEvent
+	async := false
+	if w.broker.auditor.Sample() {
+		event = newAuditEvent(message)
+		event.Source = source.name
+		defer func() {
+			if !async {
+				w.recordAudit(event, startTime)
+			}
+		}()
+	}
 
 	// Find matching route using the router
-	route := w.broker.router.FindRoute(message)
+	_, routeSpan := tracer.Start(ctx, "route")
+	route, routeMessage, filters, err := w.broker.router.RouteMessage(source.name, message, event != nil)
+	if event != nil {
+		event.Filters = filters
+	}
+	if err != nil {
+		recordError(routeSpan, err)
+		routeSpan.End()
+		err = fmt.Errorf("failed to decompress value for route %s: %w", route.Name, err)
+		w.broker.logger.Warnf("%v (topic %s, partition %d, offset %d)", err, message.Topic, message.Partition, message.Offset)
+		w.broker.metrics.IncrementDecompressErrors()
+		w.broker.metrics.IncrementMessagesFailed()
+		recordError(span, err)
+		if event != nil {
+			event.Route = route.Name
+		}
+		event.setOutcome(AuditOutcomeDecompressError, err)
+		return
+	}
+	message = routeMessage
 	if route == nil {
+		routeSpan.End()
+		err := fmt.Errorf("no route found for Kafka topic %s", message.Topic)
 		w.broker.logger.Warnf("No route found for Kafka topic: %s", message.Topic)
 		w.broker.metrics.IncrementMessagesFailed()
+		recordError(span, err)
+		event.setOutcome(AuditOutcomeNoRoute, err)
+		return
+	}
+	routeSpan.SetAttributes(attribute.String("k2m.route", route.Name))
+	routeSpan.End()
+	if event != nil {
+		event.Route = route.Name
+	}
+
+	// Skip messages already processed, e.g. redelivered after a rebalance
+	var dedupID string
+	if w.broker.dedup != nil {
+		dedupID = w.broker.dedup.ID(source.name, message)
+		if w.broker.dedup.Seen(dedupID) {
+			w.broker.metrics.IncrementDuplicatesSkipped()
+			event.setOutcome(AuditOutcomeDuplicate, nil)
+			w.broker.logger.Debugf("Skipped duplicate message %s from topic %s, partition %d, offset %d",
+				dedupID, message.Topic, message.Partition, message.Offset)
+			return
+		}
+	}
+
+	// Tombstones of compacted topics
+	if IsTombstone(message) && route.Tombstones != "" && route.Tombstones != TombstoneForward {
+		w.handleTombstone(ctx, source, message, route, event)
+		return
+	}
+
+	// Validate payload against the schema of the route
+	if route.Schema != nil {
+		_, validateSpan := tracer.Start(ctx, "validate", attribute.String("k2m.schema", route.Schema.File))
+		if err := w.broker.router.ValidatePayload(route, message); err != nil {
+			recordError(validateSpan, err)
+			validateSpan.End()
+			recordError(span, err)
+			w.handleInvalidPayload(source, message, route, err, event)
+			return
+		}
+		validateSpan.End()
+	}
+
+	// Write to the sink of the route instead of MQTT
+	if route.Sink != nil {
+		pending = w.writeSink(ctx, source, consumed, message, route, dedupID, event)
 		return
 	}
 
 	mapping := &route.Mapping
 
+	// Trace context forwarded to the MQTT subscribers
+	traceContext := tracer.Inject(ctx)
+
 	// Transform message payload
-	payload, err := w.transformMessage(message, mapping)
+	_, transformSpan := tracer.Start(ctx, "transform", attribute.String("k2m.transform", mapping.Transform))
+	var payload []byte
+	var metrics []*sparkplug.Payload_Metric
+	if mapping.Transform == TransformSparkplug {
+		metrics, err = sparkplugMetrics(message, mapping.Sparkplug)
+	} else {
+		payload, err = w.transformMessageWithTrace(message, mapping, traceContext)
+		if err == nil && route.Compression != nil {
+			payload, err = compress(route.Compression.Recompress, payload)
+		}
+	}
 	if err != nil {
+		recordError(transformSpan, err)
+		transformSpan.End()
 		w.broker.logger.Errorf("Failed to transform message: %v", err)
 		w.broker.metrics.IncrementTransformErrors()
 		w.broker.metrics.IncrementMessagesFailed()
+		recordError(span, err)
+		event.setOutcome(AuditOutcomeTransformError, err)
 		return
 	}
+	transformSpan.End()
 
 	// Record processing latency
 	processTime := time.Since(startTime)
@@ -534,19 +992,79 @@ func (w *MessageWorker) processMessage(message *sarama.ConsumerMessage) {
 
 	// Publish to MQTT
 	publishStart := time.Now()
-	mqttTopic := w.resolveMQTTTopic(mapping.MQTTTopic, message)
-	token := w.broker.mqttClient.Publish(
-		mqttTopic,
-		w.broker.config.MQTTConfig.QoS,
-		w.broker.config.MQTTConfig.Retained,
-		payload,
-	)
+	mqttTopic := w.resolveSourceTopic(mapping.MQTTTopic, source.name, message)
+	var device string
+	if mapping.Transform == TransformSparkplug {
+		device = w.resolveSourceTopic(mapping.Sparkplug.DeviceID, source.name, message)
+		if mapping.TopicMode == TopicModeSparkplug {
+			mqttTopic = w.broker.sparkplug.DataTopic(device)
+		}
+	}
+	if event != nil {
+		event.MQTTTopic = mqttTopic
+	}
+	_, publishSpan := tracer.StartPublish(ctx, mqttTopic, len(payload))
+	var token mqtt.Token
+	var conn *mqttConn
+	if mapping.Transform == TransformSparkplug {
+		// Sparkplug B messages carry the sequence number of the edge node
+		payload, token, err = w.broker.sparkplug.PublishData(w.broker.mqttClient, mqttTopic, device, metrics)
+		if err != nil {
+			w.broker.logger.Errorf("Sparkplug publish failed: %v", err)
+			w.broker.metrics.IncrementMQTTErrors()
+			w.broker.metrics.IncrementMessagesFailed()
+			recordError(publishSpan, err)
+			publishSpan.End()
+			event.setOutcome(AuditOutcomePublishError, err)
+			return
+		}
+		publishSpan.SetAttributes(semconv.MessagingMessageBodySize(len(payload)))
+	} else {
+		conn = w.broker.pool.conn(mqttTopic)
+		if conn.Async() {
+			if !conn.Acquire(w.broker.ctx) {
+				// stopping, the message is redelivered after the restart
+				pending = true
+				publishSpan.End()
+				return
+			}
+			w.broker.metrics.AddMQTTInFlight(conn.clientID, 1)
+		}
+		token = w.publish(conn, mqttTopic, payload, w.broker.config.MQTTConfig.Retained, traceContext)
+	}
+
+	if !conn.Async() {
+		w.completePublish(token, publishSpan, publishStart, route, message, mqttTopic, payload, dedupID, event)
+		return
+	}
+
+	// The worker goes on with the next message, the offset is marked once acknowledged
+	pending = true
+	async = true
+	w.broker.wg.Add(1)
+	go func() {
+		defer w.broker.wg.Done()
+		w.completePublish(token, publishSpan, publishStart, route, message, mqttTopic, payload, dedupID, event)
+		conn.Release()
+		w.broker.metrics.AddMQTTInFlight(conn.clientID, -1)
+		source.offsets.Done(consumed)
+		w.recordAudit(event, startTime)
+	}()
+}
+
+// completePublish waits for the acknowledgement of a publish and records its outcome
+func (w *MessageWorker) completePublish(token mqtt.Token, publishSpan trace.Span, publishStart time.Time, route *RouteConfig,
+	message *sarama.ConsumerMessage, mqttTopic string, payload []byte, dedupID string, event *AuditEvent) {
+	defer publishSpan.End()
 
 	// Wait for publish to complete or timeout
-	if !token.WaitTimeout(5 * time.Second) {
+	if !token.WaitTimeout(publishTimeout) {
 		w.broker.logger.Errorf("MQTT publish timeout for topic: %s", mqttTopic)
 		w.broker.metrics.IncrementPublishTimeouts()
 		w.broker.metrics.IncrementMessagesFailed()
+		err := fmt.Errorf("publish timeout for topic %s", mqttTopic)
+		recordError(publishSpan, err)
+		event.setOutcome(AuditOutcomePublishTimeout, err)
 		return
 	}
 
@@ -554,19 +1072,198 @@ func (w *MessageWorker) processMessage(message *sarama.ConsumerMessage) {
 		w.broker.logger.Errorf("MQTT publish failed: %v", token.Error())
 		w.broker.metrics.IncrementMQTTErrors()
 		w.broker.metrics.IncrementMessagesFailed()
+		recordError(publishSpan, token.Error())
+		event.setOutcome(AuditOutcomePublishError, token.Error())
 		return
 	}
 
 	// Record publish latency and success
 	publishTime := time.Since(publishStart)
 	w.broker.metrics.RecordPublishLatency(publishTime)
+	if !message.Timestamp.IsZero() {
+		w.broker.metrics.RecordEndToEndLatency(route.Name, time.Since(message.Timestamp))
+	}
 	w.broker.metrics.IncrementMessagesPublished()
+	event.setOutcome(AuditOutcomePublished, nil)
+	w.broker.dedup.Add(dedupID)
+	w.observe(route, message, mqttTopic, payload)
 
 	w.broker.logger.Debugf("Published message to MQTT topic: %s", mqttTopic)
 }
 
+// recordAudit writes the audit event of a message processed since startTime
+func (w *MessageWorker) recordAudit(event *AuditEvent, startTime time.Time) {
+	if err := w.broker.auditor.Record(event, time.Since(startTime)); err != nil {
+		w.broker.logger.Errorf("Failed to write audit log: %v", err)
+	}
+}
+
+// handleInvalidPayload rejects or dead-letters a message that does not match the schema of its route
+func (w *MessageWorker) handleInvalidPayload(source *kafkaSource, message *sarama.ConsumerMessage, route *RouteConfig, cause error, event *AuditEvent) {
+	w.broker.metrics.IncrementSchemaInvalid(route.Name, route.Schema.File)
+	w.broker.logger.Warnf("Invalid payload for route %s (topic %s, partition %d, offset %d): %v",
+		route.Name, message.Topic, message.Partition, message.Offset, cause)
+
+	if route.Schema.OnInvalid != SchemaOnInvalidDeadLetter {
+		w.broker.metrics.IncrementMessagesFailed()
+		event.setOutcome(AuditOutcomeSchemaInvalid, cause)
+		return
+	}
+
+	mqttTopic, err := w.deadLetter(source, message, route, cause)
+	if event != nil {
+		event.MQTTTopic = mqttTopic
+	}
+	if err != nil {
+		w.broker.logger.Errorf("Failed to dead-letter message to %s: %v", mqttTopic, err)
+		w.broker.metrics.IncrementMQTTErrors()
+		w.broker.metrics.IncrementMessagesFailed()
+		event.setOutcome(AuditOutcomePublishError, err)
+		return
+	}
+	w.broker.metrics.IncrementDeadLettered()
+	event.setOutcome(AuditOutcomeDeadLettered, cause)
+}
+
+// handleTombstone clears the retained MQTT message of the route's topic or drops the tombstone
+func (w *MessageWorker) handleTombstone(ctx context.Context, source *kafkaSource, message *sarama.ConsumerMessage, route *RouteConfig, event *AuditEvent) {
+	if route.Tombstones == TombstoneDrop {
+		w.broker.metrics.IncrementTombstonesDropped()
+		event.setOutcome(AuditOutcomeTombstoneDrop, nil)
+		w.broker.logger.Debugf("Dropped tombstone from topic %s, partition %d, offset %d",
+			message.Topic, message.Partition, message.Offset)
+		return
+	}
+
+	// A zero-length retained message removes the retained message of the topic
+	mqttTopic := w.resolveSourceTopic(route.Mapping.MQTTTopic, source.name, message)
+	if event != nil {
+		event.MQTTTopic = mqttTopic
+	}
+	_, publishSpan := w.broker.tracer.StartPublish(ctx, mqttTopic, 0)
+	defer publishSpan.End()
+	// the connection of the topic, so that the clear follows the pending publishes
+	token := w.publish(w.broker.pool.conn(mqttTopic), mqttTopic, []byte{}, true, w.broker.tracer.Inject(ctx))
+	if !token.WaitTimeout(publishTimeout) {
+		err := fmt.Errorf("publish timeout for topic %s", mqttTopic)
+		w.broker.logger.Errorf("MQTT publish timeout for topic: %s", mqttTopic)
+		w.broker.metrics.IncrementPublishTimeouts()
+		recordError(publishSpan, err)
+		event.setOutcome(AuditOutcomePublishTimeout, err)
+		return
+	}
+	if err := token.Error(); err != nil {
+		w.broker.logger.Errorf("MQTT publish failed: %v", err)
+		w.broker.metrics.IncrementMQTTErrors()
+		w.broker.metrics.IncrementMessagesFailed()
+		recordError(publishSpan, err)
+		event.setOutcome(AuditOutcomePublishError, err)
+		return
+	}
+	w.broker.cache.Delete(mqttTopic, string(message.Key))
+	w.broker.metrics.IncrementTombstonesCleared()
+	w.broker.metrics.IncrementMessagesPublished()
+	event.setOutcome(AuditOutcomeTombstoneClear, nil)
+	w.broker.logger.Debugf("Cleared retained MQTT topic: %s", mqttTopic)
+}
+
+// writeSink queues the message to the sink of the route, the offset of the consumed message
+// is marked once it is appended. The message is the consumed one as the route sees it.
+// It returns true if the offset is left to the sink, or to the retries while the sink is unavailable.
+func (w *MessageWorker) writeSink(ctx context.Context, source *kafkaSource, consumed, message *sarama.ConsumerMessage, route *RouteConfig, dedupID string, event *AuditEvent) bool {
+	_, sinkSpan := w.broker.tracer.Start(ctx, "sink", attribute.String("k2m.sink", route.Sink.Type))
+	defer sinkSpan.End()
+
+	stored := func() {
+		w.broker.dedup.Add(dedupID)
+		source.offsets.Done(consumed)
+	}
+	err := w.broker.sinks[route.Name].Write(message, stored)
+	if err != nil {
+		w.broker.logger.Errorf("Failed to write message to sink of route %s: %v", route.Name, err)
+		w.broker.metrics.AddSinkRowsFailed(1)
+		w.broker.metrics.IncrementMessagesFailed()
+		recordError(sinkSpan, err)
+		event.setOutcome(AuditOutcomeSinkError, err)
+		if errors.Is(err, errSinkUnavailable) {
+			w.retrySink(source, consumed, message, route, stored)
+			return true
+		}
+		return false
+	}
+	w.broker.metrics.IncrementMessagesProcessed()
+	event.setOutcome(AuditOutcomeSinkQueued, nil)
+	w.observe(route, message, "", message.Value)
+	return true
+}
+
+// retrySink writes the message to the unavailable sink of the route again, with a growing delay,
+// until it is queued or the broker stops. The partition of the message is paused meanwhile,
+// so that the consumer does not run ahead of the offset that cannot be committed.
+func (w *MessageWorker) retrySink(source *kafkaSource, consumed, message *sarama.ConsumerMessage, route *RouteConfig, stored func()) {
+	source.pause(consumed)
+	w.broker.wg.Add(1)
+	go func() {
+		defer w.broker.wg.Done()
+		defer source.resume(consumed)
+		backoff := sinkRetryBackoff
+		for {
+			select {
+			case <-w.broker.ctx.Done():
+				return // the offset is not marked, the message is redelivered after the restart
+			case <-time.After(backoff):
+			}
+			err := w.broker.sinks[route.Name].Write(message, stored)
+			if err == nil {
+				w.broker.logger.Infof("Wrote message to sink of route %s after retrying (topic %s, partition %d, offset %d)",
+					route.Name, message.Topic, message.Partition, message.Offset)
+				w.broker.metrics.IncrementMessagesProcessed()
+				return
+			}
+			if !errors.Is(err, errSinkUnavailable) {
+				w.broker.logger.Errorf("Failed to write message to sink of route %s: %v", route.Name, err)
+				source.offsets.Done(consumed)
+				return
+			}
+			backoff = min(2*backoff, maxSinkRetryBackoff)
+		}
+	}()
+}
+
+// observe updates the last-value cache and the live stream with a routed message
+func (w *MessageWorker) observe(route *RouteConfig, message *sarama.ConsumerMessage, mqttTopic string, payload []byte) {
+	if w.broker.cache == nil && w.broker.stream.Len() == 0 {
+		return
+	}
+	entry := newCacheEntry(route.Name, message, mqttTopic, payload)
+	w.broker.cache.Put(entry)
+	w.broker.stream.Publish(entry)
+}
+
+// publish publishes the payload to MQTT on the connection, or on the primary client if conn is nil.
+// The trace context is attached as user properties if the client supports MQTT v5.
+func (w *MessageWorker) publish(conn *mqttConn, mqttTopic string, payload []byte, retained bool, traceContext map[string]string) mqtt.Token {
+	client := w.broker.mqttClient
+	if conn != nil {
+		client = conn.client
+	}
+	qos := w.broker.config.MQTTConfig.QoS
+	if len(traceContext) > 0 {
+		if pp, ok := client.(propertyPublisher); ok {
+			return pp.PublishWithProperties(mqttTopic, qos, retained, payload, traceContext)
+		}
+	}
+	return client.Publish(mqttTopic, qos, retained, payload)
+}
+
 // transformMessage transforms the Kafka message according to the mapping configuration
 func (w *MessageWorker) transformMessage(message *sarama.ConsumerMessage, mapping *TopicMapping) ([]byte, error) {
+	return w.transformMessageWithTrace(message, mapping, nil)
+}
+
+// transformMessageWithTrace transforms the Kafka message and, for the json transform,
+// adds the trace context to the envelope.
+func (w *MessageWorker) transformMessageWithTrace(message *sarama.ConsumerMessage, mapping *TopicMapping, traceContext map[string]string) ([]byte, error) {
 	switch mapping.Transform {
 	case "none":
 		return message.Value, nil
@@ -581,6 +1278,9 @@ func (w *MessageWorker) transformMessage(message *sarama.ConsumerMessage, mappin
 			"key":            string(message.Key),
 			"value":          string(message.Value),
 		}
+		if len(traceContext) > 0 {
+			envelope["traceContext"] = traceContext
+		}
 		return json.Marshal(envelope)
 
 	default:
@@ -589,9 +1289,15 @@ func (w *MessageWorker) transformMessage(message *sarama.ConsumerMessage, mappin
 	}
 }
 
-// resolveMQTTTopic resolves the MQTT topic, supporting simple templating
+// resolveMQTTTopic resolves the MQTT topic of a message of the default source
 func (w *MessageWorker) resolveMQTTTopic(template string, message *sarama.ConsumerMessage) string {
+	return w.resolveSourceTopic(template, DefaultSourceName, message)
+}
+
+// resolveSourceTopic resolves the MQTT topic, supporting simple templating
+func (w *MessageWorker) resolveSourceTopic(template string, source string, message *sarama.ConsumerMessage) string {
 	topic := template
+	topic = strings.ReplaceAll(topic, "{source}", source)
 	topic = strings.ReplaceAll(topic, "{kafkaTopic}", message.Topic)
 	topic = strings.ReplaceAll(topic, "{partition}", fmt.Sprintf("%d", message.Partition))
 	topic = strings.ReplaceAll(topic, "{key}", string(message.Key))
@@ -608,6 +1314,25 @@ func (b *K2MBroker) IsHealthy() bool {
 	return b.metrics.IsHealthy()
 }
 
+// dedupSaveLoop periodically persists the dedup seen-set
+func (b *K2MBroker) dedupSaveLoop() {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(b.dedup.saveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := b.dedup.Save(); err != nil {
+				b.logger.Errorf("Error saving dedup seen-set: %v", err)
+			}
+		case <-b.ctx.Done():
+			return
+		}
+	}
+}
+
 // metricsUpdateLoop periodically updates metrics rates and buffer utilization
 func (b *K2MBroker) metricsUpdateLoop() {
 	defer b.wg.Done()
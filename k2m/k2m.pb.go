@@ -0,0 +1,377 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.6
+// 	protoc        v5.29.3
+// source: k2m.proto
+
+package k2m
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// ProcessMessage hands a consumed Kafka message to a worker actor
+type ProcessMessage struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            uint64                 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	Source        string                 `protobuf:"bytes,2,opt,name=source,proto3" json:"source,omitempty"`
+	Topic         string                 `protobuf:"bytes,3,opt,name=topic,proto3" json:"topic,omitempty"`
+	Partition     int32                  `protobuf:"varint,4,opt,name=partition,proto3" json:"partition,omitempty"`
+	Offset        int64                  `protobuf:"varint,5,opt,name=offset,proto3" json:"offset,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ProcessMessage) Reset() {
+	*x = ProcessMessage{}
+	mi := &file_k2m_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ProcessMessage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ProcessMessage) ProtoMessage() {}
+
+func (x *ProcessMessage) ProtoReflect() protoreflect.Message {
+	mi := &file_k2m_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ProcessMessage.ProtoReflect.Descriptor instead.
+func (*ProcessMessage) Descriptor() ([]byte, []int) {
+	return file_k2m_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *ProcessMessage) GetId() uint64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *ProcessMessage) GetSource() string {
+	if x != nil {
+		return x.Source
+	}
+	return ""
+}
+
+func (x *ProcessMessage) GetTopic() string {
+	if x != nil {
+		return x.Topic
+	}
+	return ""
+}
+
+func (x *ProcessMessage) GetPartition() int32 {
+	if x != nil {
+		return x.Partition
+	}
+	return 0
+}
+
+func (x *ProcessMessage) GetOffset() int64 {
+	if x != nil {
+		return x.Offset
+	}
+	return 0
+}
+
+// Processed is the reply of a worker actor, also sent if processing panicked
+type Processed struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            uint64                 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Processed) Reset() {
+	*x = Processed{}
+	mi := &file_k2m_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Processed) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Processed) ProtoMessage() {}
+
+func (x *Processed) ProtoReflect() protoreflect.Message {
+	mi := &file_k2m_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Processed.ProtoReflect.Descriptor instead.
+func (*Processed) Descriptor() ([]byte, []int) {
+	return file_k2m_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Processed) GetId() uint64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+// GetMetrics asks the broker actor for the metrics of the bridge
+type GetMetrics struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetMetrics) Reset() {
+	*x = GetMetrics{}
+	mi := &file_k2m_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetMetrics) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetMetrics) ProtoMessage() {}
+
+func (x *GetMetrics) ProtoReflect() protoreflect.Message {
+	mi := &file_k2m_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetMetrics.ProtoReflect.Descriptor instead.
+func (*GetMetrics) Descriptor() ([]byte, []int) {
+	return file_k2m_proto_rawDescGZIP(), []int{2}
+}
+
+type MetricsReply struct {
+	state             protoimpl.MessageState `protogen:"open.v1"`
+	MessagesReceived  int64                  `protobuf:"varint,1,opt,name=messagesReceived,proto3" json:"messagesReceived,omitempty"`
+	MessagesProcessed int64                  `protobuf:"varint,2,opt,name=messagesProcessed,proto3" json:"messagesProcessed,omitempty"`
+	MessagesPublished int64                  `protobuf:"varint,3,opt,name=messagesPublished,proto3" json:"messagesPublished,omitempty"`
+	MessagesFailed    int64                  `protobuf:"varint,4,opt,name=messagesFailed,proto3" json:"messagesFailed,omitempty"`
+	MessagesDropped   int64                  `protobuf:"varint,5,opt,name=messagesDropped,proto3" json:"messagesDropped,omitempty"`
+	DuplicatesSkipped int64                  `protobuf:"varint,6,opt,name=duplicatesSkipped,proto3" json:"duplicatesSkipped,omitempty"`
+	ActiveWorkers     int64                  `protobuf:"varint,7,opt,name=activeWorkers,proto3" json:"activeWorkers,omitempty"`
+	WorkerRestarts    int64                  `protobuf:"varint,8,opt,name=workerRestarts,proto3" json:"workerRestarts,omitempty"`
+	KafkaConnected    bool                   `protobuf:"varint,9,opt,name=kafkaConnected,proto3" json:"kafkaConnected,omitempty"`
+	MqttConnected     bool                   `protobuf:"varint,10,opt,name=mqttConnected,proto3" json:"mqttConnected,omitempty"`
+	unknownFields     protoimpl.UnknownFields
+	sizeCache         protoimpl.SizeCache
+}
+
+func (x *MetricsReply) Reset() {
+	*x = MetricsReply{}
+	mi := &file_k2m_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *MetricsReply) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MetricsReply) ProtoMessage() {}
+
+func (x *MetricsReply) ProtoReflect() protoreflect.Message {
+	mi := &file_k2m_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MetricsReply.ProtoReflect.Descriptor instead.
+func (*MetricsReply) Descriptor() ([]byte, []int) {
+	return file_k2m_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *MetricsReply) GetMessagesReceived() int64 {
+	if x != nil {
+		return x.MessagesReceived
+	}
+	return 0
+}
+
+func (x *MetricsReply) GetMessagesProcessed() int64 {
+	if x != nil {
+		return x.MessagesProcessed
+	}
+	return 0
+}
+
+func (x *MetricsReply) GetMessagesPublished() int64 {
+	if x != nil {
+		return x.MessagesPublished
+	}
+	return 0
+}
+
+func (x *MetricsReply) GetMessagesFailed() int64 {
+	if x != nil {
+		return x.MessagesFailed
+	}
+	return 0
+}
+
+func (x *MetricsReply) GetMessagesDropped() int64 {
+	if x != nil {
+		return x.MessagesDropped
+	}
+	return 0
+}
+
+func (x *MetricsReply) GetDuplicatesSkipped() int64 {
+	if x != nil {
+		return x.DuplicatesSkipped
+	}
+	return 0
+}
+
+func (x *MetricsReply) GetActiveWorkers() int64 {
+	if x != nil {
+		return x.ActiveWorkers
+	}
+	return 0
+}
+
+func (x *MetricsReply) GetWorkerRestarts() int64 {
+	if x != nil {
+		return x.WorkerRestarts
+	}
+	return 0
+}
+
+func (x *MetricsReply) GetKafkaConnected() bool {
+	if x != nil {
+		return x.KafkaConnected
+	}
+	return false
+}
+
+func (x *MetricsReply) GetMqttConnected() bool {
+	if x != nil {
+		return x.MqttConnected
+	}
+	return false
+}
+
+var File_k2m_proto protoreflect.FileDescriptor
+
+const file_k2m_proto_rawDesc = "" +
+	"\n" +
+	"\tk2m.proto\x12\x03k2m\"\x84\x01\n" +
+	"\x0eProcessMessage\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\x04R\x02id\x12\x16\n" +
+	"\x06source\x18\x02 \x01(\tR\x06source\x12\x14\n" +
+	"\x05topic\x18\x03 \x01(\tR\x05topic\x12\x1c\n" +
+	"\tpartition\x18\x04 \x01(\x05R\tpartition\x12\x16\n" +
+	"\x06offset\x18\x05 \x01(\x03R\x06offset\"\x1b\n" +
+	"\tProcessed\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\x04R\x02id\"\f\n" +
+	"\n" +
+	"GetMetrics\"\xb2\x03\n" +
+	"\fMetricsReply\x12*\n" +
+	"\x10messagesReceived\x18\x01 \x01(\x03R\x10messagesReceived\x12,\n" +
+	"\x11messagesProcessed\x18\x02 \x01(\x03R\x11messagesProcessed\x12,\n" +
+	"\x11messagesPublished\x18\x03 \x01(\x03R\x11messagesPublished\x12&\n" +
+	"\x0emessagesFailed\x18\x04 \x01(\x03R\x0emessagesFailed\x12(\n" +
+	"\x0fmessagesDropped\x18\x05 \x01(\x03R\x0fmessagesDropped\x12,\n" +
+	"\x11duplicatesSkipped\x18\x06 \x01(\x03R\x11duplicatesSkipped\x12$\n" +
+	"\ractiveWorkers\x18\a \x01(\x03R\ractiveWorkers\x12&\n" +
+	"\x0eworkerRestarts\x18\b \x01(\x03R\x0eworkerRestarts\x12&\n" +
+	"\x0ekafkaConnected\x18\t \x01(\bR\x0ekafkaConnected\x12$\n" +
+	"\rmqttConnected\x18\n" +
+	" \x01(\bR\rmqttConnectedB\fZ\n" +
+	"actsvr/k2mb\x06proto3"
+
+var (
+	file_k2m_proto_rawDescOnce sync.Once
+	file_k2m_proto_rawDescData []byte
+)
+
+func file_k2m_proto_rawDescGZIP() []byte {
+	file_k2m_proto_rawDescOnce.Do(func() {
+		file_k2m_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_k2m_proto_rawDesc), len(file_k2m_proto_rawDesc)))
+	})
+	return file_k2m_proto_rawDescData
+}
+
+var file_k2m_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
+var file_k2m_proto_goTypes = []any{
+	(*ProcessMessage)(nil), // 0: k2m.ProcessMessage
+	(*Processed)(nil),      // 1: k2m.Processed
+	(*GetMetrics)(nil),     // 2: k2m.GetMetrics
+	(*MetricsReply)(nil),   // 3: k2m.MetricsReply
+}
+var file_k2m_proto_depIdxs = []int32{
+	0, // [0:0] is the sub-list for method output_type
+	0, // [0:0] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_k2m_proto_init() }
+func file_k2m_proto_init() {
+	if File_k2m_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_k2m_proto_rawDesc), len(file_k2m_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   4,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_k2m_proto_goTypes,
+		DependencyIndexes: file_k2m_proto_depIdxs,
+		MessageInfos:      file_k2m_proto_msgTypes,
+	}.Build()
+	File_k2m_proto = out.File
+	file_k2m_proto_goTypes = nil
+	file_k2m_proto_depIdxs = nil
+}
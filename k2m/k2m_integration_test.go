@@ -327,7 +327,7 @@ func TestK2MBrokerWithMockClients(t *testing.T) {
 	mockKafka := NewMockSaramaConsumerGroup()
 
 	broker.mqttClient = mockMQTT
-	broker.consumerGroup = mockKafka
+	broker.sources[0].consumerGroup = mockKafka
 
 	// Set up mock expectations
 	mockKafka.On("Consume", mock.AnythingOfType("*context.cancelCtx"), config.KafkaConfig.Topics, mock.AnythingOfType("*k2m.Consumer")).Return(true)
@@ -346,8 +346,9 @@ func TestK2MBrokerWithMockClients(t *testing.T) {
 	consumer := &Consumer{
 		ready:  make(chan bool),
 		broker: broker,
+		source: broker.sources[0],
 	}
-	broker.consumer = consumer
+	broker.sources[0].consumer = consumer
 
 	// Test consumer setup
 	session := &MockConsumerGroupSession{}
@@ -505,7 +506,7 @@ func TestBrokerStop(t *testing.T) {
 	mockKafka := NewMockSaramaConsumerGroup()
 
 	broker.mqttClient = mockMQTT
-	broker.consumerGroup = mockKafka
+	broker.sources[0].consumerGroup = mockKafka
 
 	// Test stop
 	err = broker.Stop()
@@ -587,8 +588,9 @@ func TestMessageFlowIntegration(t *testing.T) {
 	consumer := &Consumer{
 		ready:  make(chan bool),
 		broker: broker,
+		source: broker.sources[0],
 	}
-	broker.consumer = consumer
+	broker.sources[0].consumer = consumer
 
 	worker := &MessageWorker{
 		id:        1,
@@ -607,11 +609,11 @@ func TestMessageFlowIntegration(t *testing.T) {
 		defer wg.Done()
 		for {
 			select {
-			case message, ok := <-worker.messageCh:
+			case consumed, ok := <-worker.messageCh:
 				if !ok {
 					return
 				}
-				worker.processMessage(message)
+				worker.processSourceMessage(consumed.source, consumed.message)
 			case <-ctx.Done():
 				return
 			}
@@ -640,7 +642,7 @@ func TestMessageFlowIntegration(t *testing.T) {
 
 	for _, msg := range testMessages {
 		select {
-		case broker.messageCh <- msg:
+		case broker.messageCh <- consumedMessage{source: broker.sources[0], message: msg}:
 		case <-time.After(100 * time.Millisecond):
 			t.Fatal("Failed to send message to worker")
 		}
@@ -0,0 +1,176 @@
+// Package k2mtest runs a k2m.K2MBroker in-process against an in-memory
+// Kafka consumer group and an embedded MQTT server, so that routing,
+// transformation and failure handling can be tested with `go test`
+// without external services.
+package k2mtest
+
+import (
+	"actsvr/k2m"
+	"actsvr/util"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// DefaultTimeout is how long the harness waits for the expected messages
+var DefaultTimeout = 5 * time.Second
+
+var clientSeq atomic.Int64
+
+// Harness is a running broker with its fake Kafka and MQTT endpoints
+type Harness struct {
+	t      testing.TB
+	Config *k2m.K2MConfig
+	Broker *k2m.K2MBroker
+	Kafka  *ConsumerGroup
+	MQTT   *MQTTServer
+}
+
+// HarnessOption configures the harness before the broker starts
+type HarnessOption func(*harnessOptions)
+
+type harnessOptions struct {
+	partitions    int32
+	logger        *util.Log
+	brokerOptions []k2m.Option
+}
+
+// WithPartitions sets the number of partitions of every topic, default 1
+func WithPartitions(n int32) HarnessOption {
+	return func(o *harnessOptions) { o.partitions = n }
+}
+
+// WithLogger sets the logger of the broker, by default nothing is logged
+func WithLogger(logger *util.Log) HarnessOption {
+	return func(o *harnessOptions) { o.logger = logger }
+}
+
+// WithBrokerOptions passes additional options to k2m.NewK2MBroker
+func WithBrokerOptions(opts ...k2m.Option) HarnessOption {
+	return func(o *harnessOptions) { o.brokerOptions = append(o.brokerOptions, opts...) }
+}
+
+// New starts an embedded MQTT server and a broker consuming from an in-memory
+// consumer group. The MQTT broker URL and client ID of the config are replaced.
+// The broker and the server are stopped when the test ends.
+func New(t testing.TB, config *k2m.K2MConfig, opts ...HarnessOption) *Harness {
+	t.Helper()
+	o := &harnessOptions{partitions: 1}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.logger == nil {
+		logConf := util.DefaultLogConfig()
+		logConf.Filename = ""
+		o.logger = util.NewLog(logConf)
+	}
+	if config == nil {
+		config = k2m.DefaultConfig()
+	}
+
+	mqttServer, err := NewMQTTServer()
+	if err != nil {
+		t.Fatalf("k2mtest: start MQTT server: %v", err)
+	}
+	t.Cleanup(func() { mqttServer.Close() })
+
+	config.MQTTConfig.Broker = mqttServer.URL()
+	config.MQTTConfig.ClientID = fmt.Sprintf("k2mtest-%d", clientSeq.Add(1))
+	config.MQTTConfig.ConnectRetry = false
+	if config.MQTTConfig.ConnectTimeout == 0 {
+		config.MQTTConfig.ConnectTimeout = k2m.Duration(3 * time.Second)
+	}
+
+	kafka := NewConsumerGroup(o.partitions)
+	brokerOpts := append([]k2m.Option{k2m.WithConsumerGroup(kafka)}, o.brokerOptions...)
+	broker, err := k2m.NewK2MBroker(config, o.logger, brokerOpts...)
+	if err != nil {
+		t.Fatalf("k2mtest: create broker: %v", err)
+	}
+	if err := broker.Start(); err != nil {
+		t.Fatalf("k2mtest: start broker: %v", err)
+	}
+
+	h := &Harness{
+		t:      t,
+		Config: config,
+		Broker: broker,
+		Kafka:  kafka,
+		MQTT:   mqttServer,
+	}
+	t.Cleanup(h.Stop)
+	return h
+}
+
+// Stop stops the broker, it is called automatically when the test ends
+func (h *Harness) Stop() {
+	if h.Broker == nil {
+		return
+	}
+	if err := h.Broker.Stop(); err != nil {
+		h.t.Errorf("k2mtest: stop broker: %v", err)
+	}
+	h.Broker = nil
+}
+
+// Send produces a message with the key and value to partition 0 of the topic
+func (h *Harness) Send(topic, key, value string) *sarama.ConsumerMessage {
+	return h.Kafka.Send(topic, 0, key, value)
+}
+
+// Produce produces the message to the in-memory Kafka
+func (h *Harness) Produce(msg *sarama.ConsumerMessage) *sarama.ConsumerMessage {
+	return h.Kafka.Produce(msg)
+}
+
+// WaitForMessages waits until n messages have been published to MQTT,
+// the test fails if they do not arrive within DefaultTimeout.
+func (h *Harness) WaitForMessages(n int) []Message {
+	h.t.Helper()
+	msgs, err := h.MQTT.WaitForMessages(n, DefaultTimeout)
+	if err != nil {
+		h.t.Fatalf("k2mtest: %v: %v", err, msgs)
+	}
+	return msgs
+}
+
+// AssertPublished waits for a message on the MQTT topic and checks its payload
+func (h *Harness) AssertPublished(topic string, payload string) Message {
+	h.t.Helper()
+	deadline := time.Now().Add(DefaultTimeout)
+	for {
+		for _, m := range h.MQTT.MessagesTo(topic) {
+			if string(m.Payload) == payload {
+				return m
+			}
+		}
+		if time.Now().After(deadline) {
+			h.t.Fatalf("k2mtest: no message %q published to %q, got %v", payload, topic, h.MQTT.Messages())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// AssertNothingPublished checks that no message arrives within the duration
+func (h *Harness) AssertNothingPublished(d time.Duration) {
+	h.t.Helper()
+	time.Sleep(d)
+	if msgs := h.MQTT.Messages(); len(msgs) > 0 {
+		h.t.Fatalf("k2mtest: unexpected messages published: %v", msgs)
+	}
+}
+
+// WaitUntil waits until cond returns true, the test fails after DefaultTimeout
+func (h *Harness) WaitUntil(cond func() bool, format string, args ...any) {
+	h.t.Helper()
+	deadline := time.Now().Add(DefaultTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			h.t.Fatalf("k2mtest: timeout waiting until "+format, args...)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,385 @@
+package k2mtest
+
+import (
+	"actsvr/k2m"
+	"actsvr/util"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testConfig(routes ...k2m.RouteConfig) *k2m.K2MConfig {
+	config := k2m.DefaultConfig()
+	config.KafkaConfig.Topics = []string{"sensors", "alerts", "other"}
+	config.TopicMappings = nil
+	config.Routes = routes
+	if len(routes) == 0 {
+		config.Routes = k2m.DefaultRouteConfig()
+	}
+	return config
+}
+
+func TestHarnessRouting(t *testing.T) {
+	h := New(t, testConfig(
+		k2m.RouteConfig{
+			Name:     "critical",
+			Priority: 10,
+			Filters: []k2m.FilterConfig{
+				{Type: "topic", Config: map[string]interface{}{"pattern": "^alerts$"}},
+				{Type: "key", Config: map[string]interface{}{"pattern": "^critical"}},
+			},
+			Mapping: k2m.TopicMapping{KafkaTopic: "alerts", MQTTTopic: "alerts/critical/{key}", Transform: "none"},
+		},
+		k2m.RouteConfig{
+			Name:     "sensors",
+			Priority: 5,
+			Filters: []k2m.FilterConfig{
+				{Type: "topic", Config: map[string]interface{}{"pattern": "^sensors$"}},
+			},
+			Mapping: k2m.TopicMapping{KafkaTopic: "sensors", MQTTTopic: "iot/{partition}/{key}", Transform: "none"},
+		},
+	))
+
+	h.Send("alerts", "critical-1", "fire")
+	h.Send("sensors", "dev-1", "21.5")
+	h.Send("alerts", "info-1", "ignored")
+
+	h.AssertPublished("alerts/critical/critical-1", "fire")
+	h.AssertPublished("iot/0/dev-1", "21.5")
+
+	h.WaitUntil(func() bool {
+		m := h.Broker.GetMetrics()
+		return m.MessagesFailed == 1
+	}, "unrouted message is counted as failed")
+	assert.Len(t, h.MQTT.Messages(), 2)
+	h.WaitUntil(func() bool {
+		return h.Kafka.Committed("alerts", 0)+h.Kafka.Committed("sensors", 0) == 3
+	}, "offsets are committed after processing")
+}
+
+func TestHarnessJSONTransform(t *testing.T) {
+	h := New(t, testConfig(k2m.RouteConfig{
+		Name:    "json",
+		Filters: []k2m.FilterConfig{},
+		Mapping: k2m.TopicMapping{KafkaTopic: "{kafkaTopic}", MQTTTopic: "json/{kafkaTopic}", Transform: "json"},
+	}))
+
+	sent := h.Send("sensors", "dev-1", `{"t":21.5}`)
+	msgs := h.WaitForMessages(1)
+	require.Equal(t, "json/sensors", msgs[0].Topic)
+
+	var envelope map[string]interface{}
+	require.NoError(t, json.Unmarshal(msgs[0].Payload, &envelope))
+	assert.Equal(t, "sensors", envelope["kafkaTopic"])
+	assert.Equal(t, float64(sent.Offset), envelope["kafkaOffset"])
+	assert.Equal(t, "dev-1", envelope["key"])
+	assert.Equal(t, `{"t":21.5}`, envelope["value"])
+}
+
+func TestHarnessOrdering(t *testing.T) {
+	config := testConfig()
+	// a single worker keeps the order of a partition
+	config.WorkerCount = 1
+	h := New(t, config, WithPartitions(2))
+
+	const n = 50
+	for i := 0; i < n; i++ {
+		h.Kafka.Send("sensors", int32(i%2), "", fmt.Sprintf("%d", i))
+	}
+	msgs := h.WaitForMessages(n)
+
+	last := map[int]int{0: -2, 1: -1}
+	for _, m := range msgs {
+		var v int
+		_, err := fmt.Sscanf(string(m.Payload), "%d", &v)
+		require.NoError(t, err)
+		assert.Greater(t, v, last[v%2], "partition %d out of order", v%2)
+		last[v%2] = v
+	}
+	h.WaitUntil(func() bool {
+		return h.Kafka.Committed("sensors", 0) == n/2 && h.Kafka.Committed("sensors", 1) == n/2
+	}, "offsets of both partitions are committed")
+}
+
+func TestHarnessKafkaErrors(t *testing.T) {
+	h := New(t, testConfig())
+
+	h.Kafka.InjectError(errors.New("broker not available"))
+	h.WaitUntil(func() bool {
+		m := h.Broker.GetMetrics()
+		return m.KafkaErrors == 1
+	}, "kafka error is counted")
+
+	// the broker keeps consuming after the error
+	h.Send("other", "", "still-flowing")
+	h.AssertPublished("mqtt/other", "still-flowing")
+}
+
+func TestHarnessTraceContextOverMQTTv5(t *testing.T) {
+	config := testConfig()
+	config.MQTTConfig.ProtocolVersion = 5
+	h := New(t, config)
+
+	traceparent := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	h.Produce(&sarama.ConsumerMessage{
+		Topic: "sensors",
+		Value: []byte("traced"),
+		Headers: []*sarama.RecordHeader{
+			{Key: []byte("traceparent"), Value: []byte(traceparent)},
+		},
+	})
+
+	msg := h.AssertPublished("mqtt/sensors", "traced")
+	// tracing is disabled, the incoming trace context is forwarded unchanged
+	assert.Equal(t, traceparent, msg.UserProperties["traceparent"])
+}
+
+func TestHarnessMQTTv5Disconnected(t *testing.T) {
+	config := testConfig()
+	config.MQTTConfig.ProtocolVersion = 5
+	h := New(t, config)
+	h.Send("sensors", "", "connected")
+	h.AssertPublished("mqtt/sensors", "connected")
+
+	// a publish fails at once while the connection is down, it does not wait for the connection
+	require.NoError(t, h.MQTT.Close())
+	h.WaitUntil(func() bool { return !h.Broker.GetMetrics().MQTTConnected }, "the connection is down")
+	h.Send("sensors", "", "disconnected")
+	start := time.Now()
+	h.WaitUntil(func() bool { return h.Broker.GetMetrics().MessagesFailed == 1 }, "the publish fails")
+	assert.Less(t, time.Since(start), time.Second, "the publish does not time out")
+}
+
+func TestConsumerGroupRedelivery(t *testing.T) {
+	g := NewConsumerGroup(1)
+	g.Send("t", 0, "", "a")
+	g.Send("t", 0, "", "b")
+
+	// the first session receives both messages but marks only the first
+	handler := &markingHandler{received: make(chan *sarama.ConsumerMessage, 10), markUpTo: 0}
+	ctx, cancel := contextWithTimeout(t)
+	go func() {
+		<-handler.received
+		<-handler.received
+		cancel()
+	}()
+	require.NoError(t, g.Consume(ctx, []string{"t"}, handler))
+	assert.Equal(t, int64(1), g.Committed("t", 0))
+
+	// the next session resumes after the last marked offset
+	handler = &markingHandler{received: make(chan *sarama.ConsumerMessage, 10), markUpTo: 10}
+	ctx, cancel = contextWithTimeout(t)
+	go func() {
+		msg := <-handler.received
+		assert.Equal(t, "b", string(msg.Value))
+		cancel()
+	}()
+	require.NoError(t, g.Consume(ctx, []string{"t"}, handler))
+
+	g.FailNextConsume(errors.New("rebalance failed"))
+	assert.Error(t, g.Consume(ctx, []string{"t"}, handler))
+
+	require.NoError(t, g.Close())
+	assert.ErrorIs(t, g.Consume(ctx, []string{"t"}, handler), sarama.ErrClosedConsumerGroup)
+	_, ok := <-g.Errors()
+	assert.False(t, ok)
+}
+
+type markingHandler struct {
+	received chan *sarama.ConsumerMessage
+	markUpTo int64
+}
+
+func (h *markingHandler) Setup(sarama.ConsumerGroupSession) error   { return nil }
+func (h *markingHandler) Cleanup(sarama.ConsumerGroupSession) error { return nil }
+func (h *markingHandler) ConsumeClaim(sess sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for msg := range claim.Messages() {
+		if msg.Offset <= h.markUpTo {
+			sess.MarkMessage(msg, "")
+		}
+		h.received <- msg
+	}
+	return nil
+}
+
+func contextWithTimeout(t *testing.T) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	t.Cleanup(cancel)
+	return ctx, cancel
+}
+
+func TestHarnessTombstoneClearsRetained(t *testing.T) {
+	config := testConfig(k2m.RouteConfig{
+		Name:       "device-state",
+		Filters:    []k2m.FilterConfig{},
+		Mapping:    k2m.TopicMapping{KafkaTopic: "sensors", MQTTTopic: "state/{key}", Transform: "none"},
+		Tombstones: k2m.TombstoneClear,
+	})
+	config.MQTTConfig.Retained = true
+	config.WorkerCount = 1
+	h := New(t, config)
+
+	h.Send("sensors", "dev-1", "online")
+	h.AssertPublished("state/dev-1", "online")
+	h.WaitUntil(func() bool {
+		_, ok := h.MQTT.Retained("state/dev-1")
+		return ok
+	}, "state/dev-1 is retained")
+
+	h.Produce(&sarama.ConsumerMessage{Topic: "sensors", Key: []byte("dev-1"), Value: nil})
+	h.WaitUntil(func() bool {
+		_, ok := h.MQTT.Retained("state/dev-1")
+		return !ok
+	}, "retained state/dev-1 is cleared")
+	h.WaitUntil(func() bool {
+		m := h.Broker.GetMetrics()
+		return m.TombstonesCleared == 1
+	}, "cleared topic is counted")
+}
+
+func TestHarnessSources(t *testing.T) {
+	config := testConfig(
+		k2m.RouteConfig{
+			Name:     "plant-a-alerts",
+			Priority: 10,
+			Filters: []k2m.FilterConfig{
+				{Type: "source", Config: map[string]interface{}{"pattern": "^plant-a$"}},
+				{Type: "topic", Config: map[string]interface{}{"pattern": "^alerts$"}},
+			},
+			Mapping: k2m.TopicMapping{KafkaTopic: "alerts", MQTTTopic: "alerts/{source}/{key}", Transform: "none"},
+		},
+		k2m.RouteConfig{
+			Name:    "plants",
+			Mapping: k2m.TopicMapping{KafkaTopic: "{kafkaTopic}", MQTTTopic: "plants/{source}/{kafkaTopic}/{key}", Transform: "none"},
+		},
+	)
+	config.Sources = []k2m.KafkaConfig{
+		{Name: "plant-a", Brokers: []string{"kafka-a:9092"}, Topics: []string{"sensors", "alerts"}},
+		{Name: "plant-b", Brokers: []string{"kafka-b:9092"}, Topics: []string{"sensors", "alerts"}, ConsumerGroup: "k2m-plant-b"},
+	}
+	plantB := NewConsumerGroup(1)
+	h := New(t, config, WithBrokerOptions(k2m.WithSourceConsumerGroup("plant-b", plantB)))
+
+	h.Send("alerts", "a-1", "fire")
+	h.Send("sensors", "a-2", "21.5")
+	plantB.Send("alerts", 0, "b-1", "smoke")
+	plantB.Send("sensors", 0, "b-2", "19.0")
+
+	h.AssertPublished("alerts/plant-a/a-1", "fire")
+	h.AssertPublished("plants/plant-a/sensors/a-2", "21.5")
+	h.AssertPublished("plants/plant-b/alerts/b-1", "smoke")
+	h.AssertPublished("plants/plant-b/sensors/b-2", "19.0")
+
+	// offsets are committed to the consumer group of each source
+	h.WaitUntil(func() bool {
+		return h.Kafka.Committed("alerts", 0) == 1 && plantB.Committed("alerts", 0) == 1
+	}, "offsets of both sources are committed")
+
+	metrics := h.Broker.GetMetrics()
+	require.Contains(t, metrics.Sources, "plant-b")
+	assert.Equal(t, int64(2), metrics.Sources["plant-a"].MessagesReceived)
+	assert.Equal(t, int64(2), metrics.Sources["plant-b"].MessagesReceived)
+	assert.True(t, metrics.Sources["plant-b"].Connected)
+
+	// errors are counted per source
+	plantB.InjectError(errors.New("broker down"))
+	h.WaitUntil(func() bool {
+		return h.Broker.GetMetrics().Sources["plant-b"].Errors == 1
+	}, "error of plant-b is counted")
+	assert.Equal(t, int64(0), h.Broker.GetMetrics().Sources["plant-a"].Errors)
+}
+
+func TestHarnessMQTTPool(t *testing.T) {
+	config := testConfig(k2m.RouteConfig{
+		Name:    "by-key",
+		Mapping: k2m.TopicMapping{KafkaTopic: "{kafkaTopic}", MQTTTopic: "sensors/{key}", Transform: "none"},
+	})
+	config.WorkerCount = 1
+	config.MQTTConfig.PoolSize = 3
+	config.MQTTConfig.MaxInFlight = 8
+	h := New(t, config)
+
+	const n = 60
+	for i := 0; i < n; i++ {
+		h.Send("sensors", fmt.Sprintf("dev-%d", i%6), fmt.Sprintf("%d", i))
+	}
+	msgs := h.WaitForMessages(n)
+
+	// the messages of a topic use one connection and keep their order
+	clients := map[string]string{}
+	last := map[string]int{}
+	for _, m := range msgs {
+		if id, ok := clients[m.Topic]; ok {
+			assert.Equal(t, id, m.ClientID, "topic %s", m.Topic)
+		}
+		clients[m.Topic] = m.ClientID
+		var v int
+		_, err := fmt.Sscanf(string(m.Payload), "%d", &v)
+		require.NoError(t, err)
+		if prev, ok := last[m.Topic]; ok {
+			assert.Greater(t, v, prev, "topic %s out of order", m.Topic)
+		}
+		last[m.Topic] = v
+	}
+	used := map[string]bool{}
+	for _, id := range clients {
+		used[id] = true
+	}
+	assert.Greater(t, len(used), 1, "topics are spread over the connections")
+
+	h.WaitUntil(func() bool {
+		return h.Kafka.Committed("sensors", 0) == n
+	}, "offsets are committed once the publishes are acknowledged")
+
+	metrics := h.Broker.GetMetrics()
+	assert.Equal(t, 3, metrics.MQTTPoolSize)
+	require.Len(t, metrics.MQTTConnections, 3)
+	for id, cm := range metrics.MQTTConnections {
+		assert.True(t, cm.Connected, id)
+		assert.Equal(t, int64(0), cm.InFlight, id)
+	}
+	assert.True(t, metrics.MQTTConnected)
+	assert.Equal(t, int64(n), metrics.MessagesPublished)
+}
+
+func TestHarnessStartFailure(t *testing.T) {
+	mqttServer, err := NewMQTTServer()
+	require.NoError(t, err)
+	defer mqttServer.Close()
+
+	config := testConfig()
+	config.MQTTConfig.Broker = mqttServer.URL()
+	config.MQTTConfig.ClientID = fmt.Sprintf("k2mtest-%d", clientSeq.Add(1))
+	config.MQTTConfig.ConnectRetry = false
+	config.Sources = []k2m.KafkaConfig{
+		{Name: "plant-a", Brokers: []string{"kafka-a:9092"}, Topics: []string{"sensors"}},
+		{Name: "plant-b", Brokers: []string{"127.0.0.1:1"}, Topics: []string{"sensors"}, ConsumerGroup: "k2m-plant-b"},
+	}
+	plantA := NewConsumerGroup(1)
+	logConf := util.DefaultLogConfig()
+	logConf.Filename = ""
+	broker, err := k2m.NewK2MBroker(config, util.NewLog(logConf), k2m.WithConsumerGroup(plantA))
+	require.NoError(t, err)
+
+	// plant-b fails after the MQTT connection and the consumer of plant-a are started
+	err = broker.Start()
+	require.ErrorContains(t, err, "source plant-b")
+
+	metrics := broker.GetMetrics()
+	assert.False(t, metrics.MQTTConnected, "the MQTT connection is closed")
+	assert.False(t, metrics.Sources["plant-a"].Connected, "the consumer group of plant-a is closed")
+	select {
+	case _, open := <-plantA.Errors():
+		assert.False(t, open)
+	case <-time.After(DefaultTimeout):
+		t.Fatal("the consumer group of plant-a is not closed")
+	}
+	assert.NoError(t, broker.Stop(), "a stopped broker can be stopped again")
+}
@@ -0,0 +1,312 @@
+package k2mtest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// ConsumerGroup is an in-memory sarama.ConsumerGroup.
+// Messages produced to it are delivered to the handler of Consume,
+// and a new session resumes from the last marked offset of each partition
+// like a Kafka consumer group does after a rebalance.
+type ConsumerGroup struct {
+	mu            sync.Mutex
+	numPartitions int32
+	partitions    map[topicPartition]*partition
+	consumeErr    error
+	errors        chan error
+	closed        bool
+	closeCh       chan struct{}
+	sessions      sync.WaitGroup
+}
+
+var _ sarama.ConsumerGroup = (*ConsumerGroup)(nil)
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// partition holds the log of a single topic partition
+type partition struct {
+	messages  []*sarama.ConsumerMessage
+	committed int64 // offset of the next message to consume
+	signal    chan struct{}
+}
+
+func (p *partition) notify() {
+	select {
+	case p.signal <- struct{}{}:
+	default:
+	}
+}
+
+// NewConsumerGroup creates an in-memory consumer group whose topics have numPartitions partitions
+func NewConsumerGroup(numPartitions int32) *ConsumerGroup {
+	if numPartitions < 1 {
+		numPartitions = 1
+	}
+	return &ConsumerGroup{
+		numPartitions: numPartitions,
+		partitions:    make(map[topicPartition]*partition),
+		errors:        make(chan error, 16),
+		closeCh:       make(chan struct{}),
+	}
+}
+
+// partitionLocked returns the partition, creating it if needed. g.mu must be held.
+func (g *ConsumerGroup) partitionLocked(topic string, part int32) *partition {
+	tp := topicPartition{topic, part}
+	p, ok := g.partitions[tp]
+	if !ok {
+		p = &partition{signal: make(chan struct{}, 1)}
+		g.partitions[tp] = p
+	}
+	return p
+}
+
+// Produce appends the message to its topic partition.
+// The offset is assigned and a zero timestamp is set to now.
+// It panics if the partition is out of range.
+func (g *ConsumerGroup) Produce(msg *sarama.ConsumerMessage) *sarama.ConsumerMessage {
+	if msg.Partition < 0 || msg.Partition >= g.numPartitions {
+		panic(fmt.Sprintf("k2mtest: partition %d out of range [0,%d)", msg.Partition, g.numPartitions))
+	}
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	p := g.partitionLocked(msg.Topic, msg.Partition)
+	msg.Offset = int64(len(p.messages))
+	p.messages = append(p.messages, msg)
+	p.notify()
+	return msg
+}
+
+// Send produces a message with the key and value to the topic partition
+func (g *ConsumerGroup) Send(topic string, part int32, key, value string) *sarama.ConsumerMessage {
+	msg := &sarama.ConsumerMessage{
+		Topic:     topic,
+		Partition: part,
+		Value:     []byte(value),
+	}
+	if key != "" {
+		msg.Key = []byte(key)
+	}
+	return g.Produce(msg)
+}
+
+// Committed returns the offset of the next message to consume of the partition,
+// that is the last marked offset + 1.
+func (g *ConsumerGroup) Committed(topic string, part int32) int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if p, ok := g.partitions[topicPartition{topic, part}]; ok {
+		return p.committed
+	}
+	return 0
+}
+
+// InjectError reports the error on the Errors channel
+func (g *ConsumerGroup) InjectError(err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return
+	}
+	select {
+	case g.errors <- err:
+	default:
+	}
+}
+
+// FailNextConsume makes the next call of Consume return the error
+func (g *ConsumerGroup) FailNextConsume(err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.consumeErr = err
+}
+
+// Consume runs a session that claims all partitions of the topics
+// until ctx is canceled or the group is closed.
+func (g *ConsumerGroup) Consume(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error {
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return sarama.ErrClosedConsumerGroup
+	}
+	if err := g.consumeErr; err != nil {
+		g.consumeErr = nil
+		g.mu.Unlock()
+		return err
+	}
+	g.sessions.Add(1)
+	defer g.sessions.Done()
+
+	sessCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-g.closeCh:
+			cancel()
+		case <-sessCtx.Done():
+		}
+	}()
+
+	sess := &session{ctx: sessCtx, group: g, claims: map[string][]int32{}}
+	var claims []*claim
+	for _, topic := range topics {
+		for i := int32(0); i < g.numPartitions; i++ {
+			p := g.partitionLocked(topic, i)
+			sess.claims[topic] = append(sess.claims[topic], i)
+			claims = append(claims, &claim{
+				group:     g,
+				topic:     topic,
+				partition: i,
+				offset:    p.committed,
+				ch:        make(chan *sarama.ConsumerMessage),
+			})
+		}
+	}
+	g.mu.Unlock()
+
+	if err := handler.Setup(sess); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range claims {
+		wg.Add(2)
+		go func(c *claim) {
+			defer wg.Done()
+			g.forward(sessCtx, c)
+		}(c)
+		go func(c *claim) {
+			defer wg.Done()
+			if err := handler.ConsumeClaim(sess, c); err != nil {
+				g.InjectError(err)
+			}
+		}(c)
+	}
+	<-sessCtx.Done()
+	wg.Wait()
+	return handler.Cleanup(sess)
+}
+
+// forward delivers the messages of the partition to the claim until ctx is done
+func (g *ConsumerGroup) forward(ctx context.Context, c *claim) {
+	defer close(c.ch)
+	g.mu.Lock()
+	p := g.partitionLocked(c.topic, c.partition)
+	g.mu.Unlock()
+
+	next := c.offset
+	for {
+		g.mu.Lock()
+		var msg *sarama.ConsumerMessage
+		if next < int64(len(p.messages)) {
+			msg = p.messages[next]
+		}
+		g.mu.Unlock()
+
+		if msg == nil {
+			select {
+			case <-p.signal:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		select {
+		case c.ch <- msg:
+			next++
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (g *ConsumerGroup) Errors() <-chan error {
+	return g.errors
+}
+
+// Close ends the running sessions and closes the Errors channel
+func (g *ConsumerGroup) Close() error {
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return nil
+	}
+	g.closed = true
+	close(g.closeCh)
+	g.mu.Unlock()
+
+	g.sessions.Wait()
+
+	g.mu.Lock()
+	close(g.errors)
+	g.mu.Unlock()
+	return nil
+}
+
+func (g *ConsumerGroup) Pause(partitions map[string][]int32)  {}
+func (g *ConsumerGroup) Resume(partitions map[string][]int32) {}
+func (g *ConsumerGroup) PauseAll()                            {}
+func (g *ConsumerGroup) ResumeAll()                           {}
+
+// session implements sarama.ConsumerGroupSession
+type session struct {
+	ctx    context.Context
+	group  *ConsumerGroup
+	claims map[string][]int32
+}
+
+func (s *session) Claims() map[string][]int32 { return s.claims }
+func (s *session) MemberID() string           { return "k2mtest" }
+func (s *session) GenerationID() int32        { return 1 }
+func (s *session) Context() context.Context   { return s.ctx }
+func (s *session) Commit()                    {}
+
+func (s *session) MarkOffset(topic string, part int32, offset int64, metadata string) {
+	s.group.mu.Lock()
+	defer s.group.mu.Unlock()
+	p := s.group.partitionLocked(topic, part)
+	if offset > p.committed {
+		p.committed = offset
+	}
+}
+
+func (s *session) ResetOffset(topic string, part int32, offset int64, metadata string) {
+	s.group.mu.Lock()
+	defer s.group.mu.Unlock()
+	s.group.partitionLocked(topic, part).committed = offset
+}
+
+func (s *session) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	s.MarkOffset(msg.Topic, msg.Partition, msg.Offset+1, metadata)
+}
+
+// claim implements sarama.ConsumerGroupClaim
+type claim struct {
+	group     *ConsumerGroup
+	topic     string
+	partition int32
+	offset    int64
+	ch        chan *sarama.ConsumerMessage
+}
+
+func (c *claim) Topic() string        { return c.topic }
+func (c *claim) Partition() int32     { return c.partition }
+func (c *claim) InitialOffset() int64 { return c.offset }
+func (c *claim) HighWaterMarkOffset() int64 {
+	c.group.mu.Lock()
+	defer c.group.mu.Unlock()
+	return int64(len(c.group.partitionLocked(c.topic, c.partition).messages))
+}
+
+func (c *claim) Messages() <-chan *sarama.ConsumerMessage { return c.ch }
@@ -0,0 +1,160 @@
+package k2mtest
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// Message is a message published to the embedded MQTT server
+type Message struct {
+	Topic          string
+	Payload        []byte
+	QoS            byte
+	Retain         bool
+	UserProperties map[string]string
+	// ClientID is the client that published the message
+	ClientID string
+}
+
+// MQTTServer is an embedded MQTT server listening on a random local port.
+// It records every message published to it.
+type MQTTServer struct {
+	server   *mqtt.Server
+	listener *listeners.TCP
+
+	mu       sync.Mutex
+	messages []Message
+	notify   chan struct{}
+
+	closeOnce sync.Once
+}
+
+// NewMQTTServer starts an embedded MQTT server that accepts any client
+func NewMQTTServer() (*MQTTServer, error) {
+	server := mqtt.New(&mqtt.Options{
+		InlineClient: true,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err := server.AddHook(new(auth.AllowHook), nil); err != nil {
+		return nil, err
+	}
+	listener := listeners.NewTCP(listeners.Config{ID: "k2mtest", Address: "127.0.0.1:0"})
+	if err := server.AddListener(listener); err != nil {
+		return nil, err
+	}
+	if err := server.Serve(); err != nil {
+		return nil, err
+	}
+
+	s := &MQTTServer{
+		server:   server,
+		listener: listener,
+		notify:   make(chan struct{}, 1),
+	}
+	if err := server.Subscribe("#", 1, s.record); err != nil {
+		server.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *MQTTServer) record(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+	msg := Message{
+		Topic:    pk.TopicName,
+		Payload:  append([]byte(nil), pk.Payload...),
+		QoS:      pk.FixedHeader.Qos,
+		Retain:   pk.FixedHeader.Retain,
+		ClientID: pk.Origin,
+	}
+	if len(pk.Properties.User) > 0 {
+		msg.UserProperties = make(map[string]string, len(pk.Properties.User))
+		for _, p := range pk.Properties.User {
+			msg.UserProperties[p.Key] = p.Val
+		}
+	}
+	s.mu.Lock()
+	s.messages = append(s.messages, msg)
+	s.mu.Unlock()
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// URL returns the broker URL for MQTTConfig.Broker, e.g. "tcp://127.0.0.1:41883"
+func (s *MQTTServer) URL() string {
+	return "tcp://" + s.listener.Address()
+}
+
+// Publish publishes a message from the server itself
+func (s *MQTTServer) Publish(topic string, payload []byte, retain bool, qos byte) error {
+	return s.server.Publish(topic, payload, retain, qos)
+}
+
+// Messages returns the messages published so far
+func (s *MQTTServer) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Message(nil), s.messages...)
+}
+
+// MessagesTo returns the messages published to the topic so far
+func (s *MQTTServer) MessagesTo(topic string) []Message {
+	var ret []Message
+	for _, m := range s.Messages() {
+		if m.Topic == topic {
+			ret = append(ret, m)
+		}
+	}
+	return ret
+}
+
+// Retained returns the payload of the retained message of the topic
+func (s *MQTTServer) Retained(topic string) ([]byte, bool) {
+	for _, pk := range s.server.Topics.Messages(topic) {
+		if pk.TopicName == topic {
+			return pk.Payload, true
+		}
+	}
+	return nil, false
+}
+
+// Reset forgets the recorded messages
+func (s *MQTTServer) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = nil
+}
+
+// WaitForMessages waits until at least n messages have been published
+// and returns all recorded messages.
+func (s *MQTTServer) WaitForMessages(n int, timeout time.Duration) ([]Message, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		msgs := s.Messages()
+		if len(msgs) >= n {
+			return msgs, nil
+		}
+		select {
+		case <-s.notify:
+		case <-timer.C:
+			return msgs, fmt.Errorf("timeout waiting for %d messages, got %d", n, len(msgs))
+		}
+	}
+}
+
+// Close stops the server, a test may close it before the harness does
+func (s *MQTTServer) Close() error {
+	var err error
+	s.closeOnce.Do(func() { err = s.server.Close() })
+	return err
+}
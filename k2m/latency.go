@@ -0,0 +1,163 @@
+package k2m
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LatencyConfig configures the end-to-end latency of the messages,
+// from the timestamp of the Kafka record to the acknowledgement of the MQTT publish
+type LatencyConfig struct {
+	// Window is the rolling window of the latency histograms, default 5m
+	Window Duration `json:"window,omitempty"`
+	// P99Target is the p99 latency objective of every route, 0 disables the SLO
+	P99Target Duration `json:"p99Target,omitempty"`
+	// MinSamples is the number of samples of a route in the window before its SLO is checked, default 100
+	MinSamples int64 `json:"minSamples,omitempty"`
+}
+
+const (
+	defaultLatencyWindow     = 5 * time.Minute
+	defaultLatencyMinSamples = 100
+
+	// latencySlots is the number of time slots of the rolling window
+	latencySlots = 10
+	// the bucket bounds grow by latencyGrowth from latencyMinBound,
+	// the quantiles are at most 20% above the true value
+	latencyMinBound = 100 * time.Microsecond
+	latencyGrowth   = 1.2
+	latencyBuckets  = 96
+)
+
+// latencyBounds are the upper bounds of the histogram buckets, the last bucket has no bound
+var latencyBounds = func() []time.Duration {
+	bounds := make([]time.Duration, latencyBuckets-1)
+	for i := range bounds {
+		bounds[i] = time.Duration(float64(latencyMinBound) * math.Pow(latencyGrowth, float64(i)))
+	}
+	return bounds
+}()
+
+// LatencyPercentiles holds the latency quantiles of a route over the window, in microseconds
+type LatencyPercentiles struct {
+	Count int64 `json:"count"`
+	P50   int64 `json:"p50Micros"`
+	P95   int64 `json:"p95Micros"`
+	P99   int64 `json:"p99Micros"`
+	Max   int64 `json:"maxMicros"`
+}
+
+func validateLatency(cfg LatencyConfig) error {
+	if cfg.Window < 0 {
+		return fmt.Errorf("latency window cannot be negative")
+	}
+	if cfg.P99Target < 0 {
+		return fmt.Errorf("latency p99Target cannot be negative")
+	}
+	if cfg.MinSamples < 0 {
+		return fmt.Errorf("latency minSamples cannot be negative")
+	}
+	return nil
+}
+
+// latencySlot holds the samples of one slot of the window
+type latencySlot struct {
+	epoch  int64 // index of the slot since the Unix epoch
+	counts [latencyBuckets]int64
+	max    time.Duration
+}
+
+// latencyHistogram is a rolling histogram of latencies.
+// The window is split in time slots, the oldest slot is reused when the window moves.
+type latencyHistogram struct {
+	slotSize time.Duration
+
+	mu    sync.Mutex
+	slots [latencySlots]latencySlot
+	now   func() time.Time
+}
+
+func newLatencyHistogram(window time.Duration) *latencyHistogram {
+	if window <= 0 {
+		window = defaultLatencyWindow
+	}
+	return &latencyHistogram{
+		slotSize: window / latencySlots,
+		now:      time.Now,
+	}
+}
+
+func (h *latencyHistogram) epoch() int64 {
+	return h.now().UnixNano() / int64(h.slotSize)
+}
+
+// Record adds a sample, negative latencies from skewed clocks count as zero
+func (h *latencyHistogram) Record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	bucket := sort.Search(len(latencyBounds), func(i int) bool { return d <= latencyBounds[i] })
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	epoch := h.epoch()
+	slot := &h.slots[epoch%latencySlots]
+	if slot.epoch != epoch {
+		*slot = latencySlot{epoch: epoch}
+	}
+	slot.counts[bucket]++
+	if d > slot.max {
+		slot.max = d
+	}
+}
+
+// Percentiles returns the quantiles of the samples in the window.
+// A quantile is the upper bound of its bucket, capped by the largest sample.
+func (h *latencyHistogram) Percentiles() *LatencyPercentiles {
+	var counts [latencyBuckets]int64
+	var total int64
+	var max time.Duration
+
+	h.mu.Lock()
+	epoch := h.epoch()
+	for i := range h.slots {
+		slot := &h.slots[i]
+		if slot.epoch <= epoch-latencySlots || slot.epoch > epoch {
+			continue
+		}
+		for b, n := range slot.counts {
+			counts[b] += n
+			total += n
+		}
+		if slot.max > max {
+			max = slot.max
+		}
+	}
+	h.mu.Unlock()
+
+	p := &LatencyPercentiles{Count: total, Max: max.Microseconds()}
+	if total == 0 {
+		return p
+	}
+	quantile := func(q float64) int64 {
+		rank := int64(math.Ceil(q * float64(total)))
+		var seen int64
+		for b, n := range counts {
+			seen += n
+			if seen >= rank {
+				if b < len(latencyBounds) && latencyBounds[b] < max {
+					return latencyBounds[b].Microseconds()
+				}
+				return max.Microseconds()
+			}
+		}
+		return max.Microseconds()
+	}
+	p.P50 = quantile(0.50)
+	p.P95 = quantile(0.95)
+	p.P99 = quantile(0.99)
+	return p
+}
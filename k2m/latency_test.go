@@ -0,0 +1,107 @@
+package k2m
+
+import (
+	"actsvr/util"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatencyHistogramPercentiles(t *testing.T) {
+	h := newLatencyHistogram(time.Minute)
+	for i := 1; i <= 1000; i++ {
+		h.Record(time.Duration(i) * time.Millisecond)
+	}
+	h.Record(-time.Second)
+
+	p := h.Percentiles()
+	assert.Equal(t, int64(1001), p.Count)
+	assert.Equal(t, int64(1000000), p.Max)
+	assert.InEpsilon(t, 500000, p.P50, 0.2)
+	assert.InEpsilon(t, 950000, p.P95, 0.2)
+	assert.InEpsilon(t, 990000, p.P99, 0.2)
+	assert.LessOrEqual(t, p.P99, p.Max)
+
+	empty := newLatencyHistogram(time.Minute).Percentiles()
+	assert.Equal(t, &LatencyPercentiles{}, empty)
+}
+
+func TestLatencyHistogramWindow(t *testing.T) {
+	now := time.Unix(1000, 0)
+	h := newLatencyHistogram(10 * time.Second)
+	h.now = func() time.Time { return now }
+
+	h.Record(time.Second)
+	now = now.Add(5 * time.Second)
+	h.Record(2 * time.Second)
+	assert.Equal(t, int64(2), h.Percentiles().Count)
+
+	// the first sample leaves the window
+	now = now.Add(6 * time.Second)
+	p := h.Percentiles()
+	assert.Equal(t, int64(1), p.Count)
+	assert.Equal(t, int64(2000000), p.Max)
+
+	now = now.Add(time.Minute)
+	assert.Equal(t, int64(0), h.Percentiles().Count)
+}
+
+func TestLatencySLOHealth(t *testing.T) {
+	config := DefaultConfig()
+	config.TopicMappings = nil
+	config.Routes = []RouteConfig{
+		{Name: "alarms", Priority: 10,
+			Filters: []FilterConfig{{Type: "topic", Config: map[string]interface{}{"pattern": "alarms"}}},
+			Mapping: TopicMapping{KafkaTopic: "alarms", MQTTTopic: "alarms/{key}", Transform: "none"}},
+		{Name: "default", Mapping: TopicMapping{KafkaTopic: "{kafkaTopic}", MQTTTopic: "events/{key}", Transform: "none"}},
+	}
+	config.Latency = LatencyConfig{P99Target: Duration(100 * time.Millisecond), MinSamples: 10}
+	broker, err := NewK2MBroker(config, util.NewLog(util.DefaultLogConfig()))
+	require.NoError(t, err)
+	broker.mqttClient = NewMockMQTTClient()
+	broker.metrics.SetKafkaConnected(true)
+	broker.metrics.SetMQTTConnected(true)
+	broker.metrics.SetActiveWorkers(config.WorkerCount)
+	worker := &MessageWorker{id: 1, broker: broker, messageCh: broker.messageCh}
+	hc := NewHealthChecker(broker, config.HttpConfig)
+
+	send := func(topic string, n int, age time.Duration) {
+		for i := 0; i < n; i++ {
+			worker.processMessage(&sarama.ConsumerMessage{
+				Topic: topic, Key: []byte("dev-1"), Offset: int64(i), Value: []byte("x"), Timestamp: time.Now().Add(-age),
+			})
+		}
+	}
+
+	// too few slow samples to judge the route
+	send("alarms", 5, time.Second)
+	send("sensors", 20, 0)
+	assert.Equal(t, "healthy", hc.GetHealthStatus().Status)
+
+	send("alarms", 5, time.Second)
+	health := hc.GetHealthStatus()
+	assert.Equal(t, "degraded", health.Status)
+	assert.Equal(t, "degraded", health.Checks["latency"].Status)
+	assert.Equal(t, []string{"alarms"}, health.Checks["latency"].Details.(map[string]interface{})["breached"])
+
+	// a degraded broker still serves
+	w := httptest.NewRecorder()
+	hc.healthHandler(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	hc.metricsHandler(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	var metrics Metrics
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &metrics))
+	require.Contains(t, metrics.RouteLatency, "alarms")
+	assert.Equal(t, int64(10), metrics.RouteLatency["alarms"].Count)
+	assert.GreaterOrEqual(t, metrics.RouteLatency["alarms"].P99, int64(time.Second/time.Microsecond))
+	assert.Equal(t, int64(20), metrics.RouteLatency["default"].Count)
+	assert.Less(t, metrics.RouteLatency["default"].P99, int64(100*time.Millisecond/time.Microsecond))
+}
@@ -20,6 +20,34 @@ type Metrics struct {
 	MQTTErrors      int64 `json:"mqttErrors"`
 	TransformErrors int64 `json:"transformErrors"`
 
+	// Schema validation counters
+	SchemaErrors int64 `json:"schemaErrors"`
+	DeadLettered int64 `json:"deadLettered"`
+	// SchemaInvalid counts invalid payloads per route and schema file
+	SchemaInvalid map[string]map[string]int64 `json:"schemaInvalid,omitempty"`
+
+	// Tombstone counters
+	TombstonesCleared int64 `json:"tombstonesCleared"`
+	TombstonesDropped int64 `json:"tombstonesDropped"`
+
+	// Sink counters
+	SinkRowsAppended int64 `json:"sinkRowsAppended"`
+	SinkRowsFailed   int64 `json:"sinkRowsFailed"`
+	SinkFlushes      int64 `json:"sinkFlushes"`
+
+	// DuplicatesSkipped counts redelivered messages skipped by deduplication
+	DuplicatesSkipped int64 `json:"duplicatesSkipped"`
+
+	// DecompressErrors counts values that could not be decompressed for their route
+	DecompressErrors int64 `json:"decompressErrors"`
+
+	// Sources holds the metrics of every Kafka source by name
+	Sources map[string]*SourceMetrics `json:"sources,omitempty"`
+
+	// MQTTPoolSize is the number of MQTT connections, MQTTConnections their metrics by client ID
+	MQTTPoolSize    int                               `json:"mqttPoolSize"`
+	MQTTConnections map[string]*MQTTConnectionMetrics `json:"mqttConnections,omitempty"`
+
 	// Throughput metrics (messages per second)
 	ReceiveRate float64 `json:"receiveRate"`
 	ProcessRate float64 `json:"processRate"`
@@ -28,6 +56,9 @@ type Metrics struct {
 	// Latency metrics (in microseconds)
 	ProcessingLatency int64 `json:"processingLatencyMicros"`
 	PublishLatency    int64 `json:"publishLatencyMicros"`
+	// RouteLatency holds the end-to-end latency of every route over the rolling window,
+	// from the Kafka record timestamp to the MQTT publish acknowledgement
+	RouteLatency map[string]*LatencyPercentiles `json:"routeLatency,omitempty"`
 
 	// Connection status
 	KafkaConnected bool `json:"kafkaConnected"`
@@ -46,9 +77,27 @@ type Metrics struct {
 	lastProcessed  int64
 	lastPublished  int64
 	lastUpdateTime time.Time
+	latencyWindow  time.Duration
+	latency        map[string]*latencyHistogram
 	mu             sync.RWMutex
 }
 
+// SourceMetrics holds the metrics of a Kafka source
+type SourceMetrics struct {
+	Connected        bool  `json:"connected"`
+	MessagesReceived int64 `json:"messagesReceived"`
+	Errors           int64 `json:"errors"`
+	// Lag is the number of messages behind the high water marks of the consumed partitions
+	Lag int64 `json:"lag"`
+}
+
+// MQTTConnectionMetrics holds the metrics of a connection of the MQTT pool
+type MQTTConnectionMetrics struct {
+	Connected bool `json:"connected"`
+	// InFlight is the number of asynchronous publishes waiting for their acknowledgement
+	InFlight int64 `json:"inFlight"`
+}
+
 // NewMetrics creates a new metrics instance
 func NewMetrics() *Metrics {
 	now := time.Now()
@@ -101,6 +150,56 @@ func (m *Metrics) IncrementTransformErrors() {
 	atomic.AddInt64(&m.TransformErrors, 1)
 }
 
+// IncrementSchemaInvalid counts an invalid payload of the route and schema
+func (m *Metrics) IncrementSchemaInvalid(route, schema string) {
+	atomic.AddInt64(&m.SchemaErrors, 1)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.SchemaInvalid == nil {
+		m.SchemaInvalid = make(map[string]map[string]int64)
+	}
+	if m.SchemaInvalid[route] == nil {
+		m.SchemaInvalid[route] = make(map[string]int64)
+	}
+	m.SchemaInvalid[route][schema]++
+}
+
+// IncrementDeadLettered atomically increments the dead-lettered message counter
+func (m *Metrics) IncrementDeadLettered() {
+	atomic.AddInt64(&m.DeadLettered, 1)
+}
+
+// IncrementTombstonesCleared atomically increments the cleared retained topic counter
+func (m *Metrics) IncrementTombstonesCleared() {
+	atomic.AddInt64(&m.TombstonesCleared, 1)
+}
+
+// IncrementTombstonesDropped atomically increments the dropped tombstone counter
+func (m *Metrics) IncrementTombstonesDropped() {
+	atomic.AddInt64(&m.TombstonesDropped, 1)
+}
+
+// AddSinkRowsAppended atomically adds rows flushed to a sink
+func (m *Metrics) AddSinkRowsAppended(n int64) {
+	atomic.AddInt64(&m.SinkRowsAppended, n)
+	atomic.AddInt64(&m.SinkFlushes, 1)
+}
+
+// AddSinkRowsFailed atomically adds rows a sink failed to write
+func (m *Metrics) AddSinkRowsFailed(n int64) {
+	atomic.AddInt64(&m.SinkRowsFailed, n)
+}
+
+// IncrementDuplicatesSkipped atomically increments the skipped duplicate counter
+func (m *Metrics) IncrementDuplicatesSkipped() {
+	atomic.AddInt64(&m.DuplicatesSkipped, 1)
+}
+
+// IncrementDecompressErrors atomically increments the decompression error counter
+func (m *Metrics) IncrementDecompressErrors() {
+	atomic.AddInt64(&m.DecompressErrors, 1)
+}
+
 // IncrementPublishTimeouts atomically increments the publish timeout counter
 func (m *Metrics) IncrementPublishTimeouts() {
 	atomic.AddInt64(&m.MessagesFailed, 1) // Track as failed messages
@@ -116,6 +215,34 @@ func (m *Metrics) RecordPublishLatency(duration time.Duration) {
 	atomic.StoreInt64(&m.PublishLatency, duration.Microseconds())
 }
 
+// SetLatencyWindow sets the rolling window of the end-to-end latency histograms
+func (m *Metrics) SetLatencyWindow(window time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.latencyWindow = window
+	m.latency = nil
+}
+
+// RecordEndToEndLatency records the latency of a message of the route,
+// from its Kafka record timestamp to the acknowledgement of its publish
+func (m *Metrics) RecordEndToEndLatency(route string, latency time.Duration) {
+	m.mu.RLock()
+	h := m.latency[route]
+	m.mu.RUnlock()
+	if h == nil {
+		m.mu.Lock()
+		if m.latency == nil {
+			m.latency = make(map[string]*latencyHistogram)
+		}
+		if h = m.latency[route]; h == nil {
+			h = newLatencyHistogram(m.latencyWindow)
+			m.latency[route] = h
+		}
+		m.mu.Unlock()
+	}
+	h.Record(latency)
+}
+
 // SetKafkaConnected sets the Kafka connection status
 func (m *Metrics) SetKafkaConnected(connected bool) {
 	m.mu.Lock()
@@ -123,6 +250,98 @@ func (m *Metrics) SetKafkaConnected(connected bool) {
 	m.KafkaConnected = connected
 }
 
+// source returns the metrics of the source, registering it on first use
+func (m *Metrics) source(name string) *SourceMetrics {
+	m.mu.RLock()
+	sm, ok := m.Sources[name]
+	m.mu.RUnlock()
+	if ok {
+		return sm
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Sources == nil {
+		m.Sources = make(map[string]*SourceMetrics)
+	}
+	if sm, ok = m.Sources[name]; !ok {
+		sm = &SourceMetrics{}
+		m.Sources[name] = sm
+	}
+	return sm
+}
+
+// SetSourceConnected sets the connection status of a source.
+// Kafka is connected when all sources are connected.
+func (m *Metrics) SetSourceConnected(name string, connected bool) {
+	sm := m.source(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sm.Connected = connected
+	m.KafkaConnected = true
+	for _, sm := range m.Sources {
+		m.KafkaConnected = m.KafkaConnected && sm.Connected
+	}
+}
+
+// IncrementSourceReceived atomically increments the received message counter of a source
+func (m *Metrics) IncrementSourceReceived(name string) {
+	atomic.AddInt64(&m.source(name).MessagesReceived, 1)
+}
+
+// IncrementSourceErrors atomically increments the error counter of a source
+func (m *Metrics) IncrementSourceErrors(name string) {
+	atomic.AddInt64(&m.source(name).Errors, 1)
+}
+
+// SetSourceLag sets the consumer lag of a source
+func (m *Metrics) SetSourceLag(name string, lag int64) {
+	atomic.StoreInt64(&m.source(name).Lag, lag)
+}
+
+func (m *Metrics) mqttConnection(clientID string) *MQTTConnectionMetrics {
+	m.mu.RLock()
+	cm, ok := m.MQTTConnections[clientID]
+	m.mu.RUnlock()
+	if ok {
+		return cm
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.MQTTConnections == nil {
+		m.MQTTConnections = make(map[string]*MQTTConnectionMetrics)
+	}
+	if cm, ok = m.MQTTConnections[clientID]; !ok {
+		cm = &MQTTConnectionMetrics{}
+		m.MQTTConnections[clientID] = cm
+	}
+	return cm
+}
+
+// SetMQTTPoolSize sets the number of MQTT connections
+func (m *Metrics) SetMQTTPoolSize(size int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.MQTTPoolSize = size
+}
+
+// SetMQTTConnectionConnected sets the status of a connection of the pool.
+// MQTT is connected when all connections are connected.
+func (m *Metrics) SetMQTTConnectionConnected(clientID string, connected bool) {
+	cm := m.mqttConnection(clientID)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cm.Connected = connected
+	m.MQTTConnected = true
+	for _, cm := range m.MQTTConnections {
+		m.MQTTConnected = m.MQTTConnected && cm.Connected
+	}
+}
+
+// AddMQTTInFlight atomically adds to the in-flight publishes of a connection
+func (m *Metrics) AddMQTTInFlight(clientID string, delta int64) {
+	atomic.AddInt64(&m.mqttConnection(clientID).InFlight, delta)
+}
+
 // SetMQTTConnected sets the MQTT connection status
 func (m *Metrics) SetMQTTConnected(connected bool) {
 	m.mu.Lock()
@@ -176,6 +395,49 @@ func (m *Metrics) GetSnapshot() Metrics {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
+	var schemaInvalid map[string]map[string]int64
+	if m.SchemaInvalid != nil {
+		schemaInvalid = make(map[string]map[string]int64, len(m.SchemaInvalid))
+		for route, counts := range m.SchemaInvalid {
+			schemaInvalid[route] = make(map[string]int64, len(counts))
+			for schema, n := range counts {
+				schemaInvalid[route][schema] = n
+			}
+		}
+	}
+
+	var sources map[string]*SourceMetrics
+	if m.Sources != nil {
+		sources = make(map[string]*SourceMetrics, len(m.Sources))
+		for name, sm := range m.Sources {
+			sources[name] = &SourceMetrics{
+				Connected:        sm.Connected,
+				MessagesReceived: atomic.LoadInt64(&sm.MessagesReceived),
+				Errors:           atomic.LoadInt64(&sm.Errors),
+				Lag:              atomic.LoadInt64(&sm.Lag),
+			}
+		}
+	}
+
+	var mqttConnections map[string]*MQTTConnectionMetrics
+	if m.MQTTConnections != nil {
+		mqttConnections = make(map[string]*MQTTConnectionMetrics, len(m.MQTTConnections))
+		for clientID, cm := range m.MQTTConnections {
+			mqttConnections[clientID] = &MQTTConnectionMetrics{
+				Connected: cm.Connected,
+				InFlight:  atomic.LoadInt64(&cm.InFlight),
+			}
+		}
+	}
+
+	var routeLatency map[string]*LatencyPercentiles
+	if m.latency != nil {
+		routeLatency = make(map[string]*LatencyPercentiles, len(m.latency))
+		for route, h := range m.latency {
+			routeLatency[route] = h.Percentiles()
+		}
+	}
+
 	return Metrics{
 		MessagesReceived:  atomic.LoadInt64(&m.MessagesReceived),
 		MessagesProcessed: atomic.LoadInt64(&m.MessagesProcessed),
@@ -185,11 +447,25 @@ func (m *Metrics) GetSnapshot() Metrics {
 		KafkaErrors:       atomic.LoadInt64(&m.KafkaErrors),
 		MQTTErrors:        atomic.LoadInt64(&m.MQTTErrors),
 		TransformErrors:   atomic.LoadInt64(&m.TransformErrors),
+		SchemaErrors:      atomic.LoadInt64(&m.SchemaErrors),
+		DeadLettered:      atomic.LoadInt64(&m.DeadLettered),
+		SchemaInvalid:     schemaInvalid,
+		TombstonesCleared: atomic.LoadInt64(&m.TombstonesCleared),
+		TombstonesDropped: atomic.LoadInt64(&m.TombstonesDropped),
+		SinkRowsAppended:  atomic.LoadInt64(&m.SinkRowsAppended),
+		SinkRowsFailed:    atomic.LoadInt64(&m.SinkRowsFailed),
+		SinkFlushes:       atomic.LoadInt64(&m.SinkFlushes),
+		DuplicatesSkipped: atomic.LoadInt64(&m.DuplicatesSkipped),
+		DecompressErrors:  atomic.LoadInt64(&m.DecompressErrors),
+		Sources:           sources,
+		MQTTPoolSize:      m.MQTTPoolSize,
+		MQTTConnections:   mqttConnections,
 		ReceiveRate:       m.ReceiveRate,
 		ProcessRate:       m.ProcessRate,
 		PublishRate:       m.PublishRate,
 		ProcessingLatency: atomic.LoadInt64(&m.ProcessingLatency),
 		PublishLatency:    atomic.LoadInt64(&m.PublishLatency),
+		RouteLatency:      routeLatency,
 		KafkaConnected:    m.KafkaConnected,
 		MQTTConnected:     m.MQTTConnected,
 		ActiveWorkers:     m.ActiveWorkers,
@@ -212,6 +488,15 @@ func (m *Metrics) Reset() {
 	atomic.StoreInt64(&m.KafkaErrors, 0)
 	atomic.StoreInt64(&m.MQTTErrors, 0)
 	atomic.StoreInt64(&m.TransformErrors, 0)
+	atomic.StoreInt64(&m.SchemaErrors, 0)
+	atomic.StoreInt64(&m.DeadLettered, 0)
+	atomic.StoreInt64(&m.TombstonesCleared, 0)
+	atomic.StoreInt64(&m.TombstonesDropped, 0)
+	atomic.StoreInt64(&m.SinkRowsAppended, 0)
+	atomic.StoreInt64(&m.SinkRowsFailed, 0)
+	atomic.StoreInt64(&m.SinkFlushes, 0)
+	atomic.StoreInt64(&m.DuplicatesSkipped, 0)
+	atomic.StoreInt64(&m.DecompressErrors, 0)
 	atomic.StoreInt64(&m.ProcessingLatency, 0)
 	atomic.StoreInt64(&m.PublishLatency, 0)
 
@@ -219,6 +504,12 @@ func (m *Metrics) Reset() {
 	m.ProcessRate = 0
 	m.PublishRate = 0
 	m.BufferUtilization = 0
+	m.SchemaInvalid = nil
+	m.latency = nil
+	for _, sm := range m.Sources {
+		atomic.StoreInt64(&sm.MessagesReceived, 0)
+		atomic.StoreInt64(&sm.Errors, 0)
+	}
 
 	now := time.Now()
 	m.StartTime = now
@@ -0,0 +1,92 @@
+package k2m
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttPool is a set of MQTT connections with distinct client IDs.
+// The messages of a topic always use the same connection, which keeps their order.
+// The first connection is the primary one, used for Sparkplug B, dead letters and tombstones.
+type mqttPool struct {
+	conns []*mqttConn
+}
+
+// mqttConn is a connection of the pool
+type mqttConn struct {
+	clientID string
+	client   mqtt.Client
+	// inflight bounds the asynchronous publishes waiting for their acknowledgement,
+	// nil if the workers wait for every publish
+	inflight chan struct{}
+}
+
+func validateMQTTPool(config MQTTConfig) error {
+	if config.PoolSize < 0 {
+		return fmt.Errorf("poolSize cannot be negative")
+	}
+	if config.MaxInFlight < 0 {
+		return fmt.Errorf("maxInFlight cannot be negative")
+	}
+	// the v5 client publishes concurrently, the order is only kept one publish at a time
+	if config.MaxInFlight > 1 && config.ProtocolVersion == 5 {
+		return fmt.Errorf("maxInFlight above 1 is not supported with MQTT v5")
+	}
+	return nil
+}
+
+// poolClientID returns the client ID of the i-th connection of the pool,
+// the primary connection keeps the configured client ID
+func poolClientID(clientID string, i int) string {
+	if i == 0 {
+		return clientID
+	}
+	return fmt.Sprintf("%s-%d", clientID, i)
+}
+
+func newMQTTConn(clientID string, client mqtt.Client, maxInFlight int) *mqttConn {
+	c := &mqttConn{clientID: clientID, client: client}
+	if maxInFlight > 0 {
+		c.inflight = make(chan struct{}, maxInFlight)
+	}
+	return c
+}
+
+// conn returns the connection of the topic, nil if there is no pool
+func (p *mqttPool) conn(topic string) *mqttConn {
+	if p == nil || len(p.conns) == 0 {
+		return nil
+	}
+	h := fnv.New32a()
+	h.Write([]byte(topic))
+	return p.conns[h.Sum32()%uint32(len(p.conns))]
+}
+
+// Async returns true if publishing on the connection does not wait for the acknowledgement
+func (c *mqttConn) Async() bool {
+	return c != nil && c.inflight != nil
+}
+
+// Acquire takes a slot of the in-flight window, waiting while it is full.
+// It returns false if the context is done first.
+func (c *mqttConn) Acquire(ctx context.Context) bool {
+	select {
+	case c.inflight <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Release frees the slot taken by Acquire
+func (c *mqttConn) Release() {
+	<-c.inflight
+}
+
+// InFlight returns the number of publishes waiting for their acknowledgement
+func (c *mqttConn) InFlight() int {
+	return len(c.inflight)
+}
@@ -0,0 +1,41 @@
+package k2m
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMQTTPool(t *testing.T) {
+	pool := &mqttPool{}
+	for i := 0; i < 4; i++ {
+		pool.conns = append(pool.conns, newMQTTConn(poolClientID("k2m", i), nil, 2))
+	}
+	assert.Equal(t, "k2m", pool.conns[0].clientID)
+	assert.Equal(t, "k2m-3", pool.conns[3].clientID)
+	assert.Same(t, pool.conn("sensors/dev-1"), pool.conn("sensors/dev-1"))
+
+	var nilPool *mqttPool
+	assert.Nil(t, nilPool.conn("sensors/dev-1"))
+	assert.False(t, nilPool.conn("sensors/dev-1").Async())
+	assert.False(t, newMQTTConn("k2m", nil, 0).Async())
+
+	// the in-flight window blocks until a publish is acknowledged
+	conn := pool.conns[0]
+	require.True(t, conn.Async())
+	require.True(t, conn.Acquire(context.Background()))
+	require.True(t, conn.Acquire(context.Background()))
+	assert.Equal(t, 2, conn.InFlight())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.False(t, conn.Acquire(ctx))
+	conn.Release()
+	assert.Equal(t, 1, conn.InFlight())
+
+	assert.NoError(t, validateMQTTPool(MQTTConfig{PoolSize: 4, MaxInFlight: 100}))
+	assert.NoError(t, validateMQTTPool(MQTTConfig{ProtocolVersion: 5, PoolSize: 4, MaxInFlight: 1}))
+	assert.ErrorContains(t, validateMQTTPool(MQTTConfig{PoolSize: -1}), "poolSize")
+	assert.ErrorContains(t, validateMQTTPool(MQTTConfig{ProtocolVersion: 5, MaxInFlight: 2}), "MQTT v5")
+}
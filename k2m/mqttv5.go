@@ -0,0 +1,371 @@
+package k2m
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// propertyPublisher is implemented by MQTT clients that can attach
+// MQTT v5 user properties to a published message.
+type propertyPublisher interface {
+	PublishWithProperties(topic string, qos byte, retained bool, payload []byte, props map[string]string) mqtt.Token
+}
+
+// mqttV5Client adapts the paho.golang MQTT v5 connection manager
+// to the mqtt.Client interface used by the broker.
+type mqttV5Client struct {
+	config   MQTTConfig
+	clientID string
+	cfg      autopaho.ClientConfig
+
+	cm        *autopaho.ConnectionManager
+	cancel    context.CancelFunc
+	connected atomic.Bool
+
+	handlersLock sync.RWMutex
+	handlers     map[string]mqtt.MessageHandler
+}
+
+var _ mqtt.Client = (*mqttV5Client)(nil)
+var _ propertyPublisher = (*mqttV5Client)(nil)
+
+// mqttV5Hooks are the connection callbacks of the v5 client
+type mqttV5Hooks struct {
+	OnConnect        func()
+	OnConnectionLost func(error)
+	// Will returns the last will of a new connection, QoS 1 and not retained
+	Will func() (topic string, payload []byte)
+}
+
+func newMQTTV5Client(config MQTTConfig, hooks mqttV5Hooks) (*mqttV5Client, error) {
+	serverURL, err := url.Parse(config.Broker)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MQTT broker URL %q: %w", config.Broker, err)
+	}
+
+	c := &mqttV5Client{
+		config:   config,
+		clientID: config.ClientID,
+		handlers: make(map[string]mqtt.MessageHandler),
+	}
+	c.cfg = autopaho.ClientConfig{
+		ServerUrls:                    []*url.URL{serverURL},
+		KeepAlive:                     uint16(time.Duration(config.KeepAlive).Seconds()),
+		CleanStartOnInitialConnection: true,
+		ConnectRetryDelay:             time.Duration(config.ConnectTimeout),
+		ConnectTimeout:                time.Duration(config.ConnectTimeout),
+		OnConnectionUp: func(cm *autopaho.ConnectionManager, connack *paho.Connack) {
+			c.connected.Store(true)
+			if hooks.OnConnect != nil {
+				hooks.OnConnect()
+			}
+		},
+		OnConnectionDown: func() bool {
+			c.connected.Store(false)
+			if hooks.OnConnectionLost != nil {
+				hooks.OnConnectionLost(fmt.Errorf("connection to %s lost", config.Broker))
+			}
+			return config.ConnectRetry
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID: config.ClientID,
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+				c.dispatch,
+			},
+		},
+	}
+	if hooks.Will != nil {
+		c.cfg.ConnectPacketBuilder = func(cp *paho.Connect, u *url.URL) (*paho.Connect, error) {
+			topic, payload := hooks.Will()
+			cp.WillMessage = &paho.WillMessage{Topic: topic, Payload: payload, QoS: 1}
+			cp.WillProperties = &paho.WillProperties{}
+			return cp, nil
+		}
+	}
+	if config.Username != "" {
+		c.cfg.ConnectUsername = config.Username
+	}
+	if config.Password != "" {
+		c.cfg.ConnectPassword = []byte(config.Password)
+	}
+	return c, nil
+}
+
+func (c *mqttV5Client) IsConnected() bool {
+	return c.connected.Load()
+}
+
+func (c *mqttV5Client) IsConnectionOpen() bool {
+	return c.connected.Load()
+}
+
+func (c *mqttV5Client) Connect() mqtt.Token {
+	token := newMQTTV5Token()
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+
+	connectErr := make(chan error, 1)
+	cfg := c.cfg
+	cfg.OnConnectError = func(err error) {
+		select {
+		case connectErr <- err:
+		default:
+		}
+	}
+
+	cm, err := autopaho.NewConnection(ctx, cfg)
+	if err != nil {
+		token.complete(err)
+		return token
+	}
+	c.cm = cm
+
+	go func() {
+		connected := make(chan error, 1)
+		go func() { connected <- cm.AwaitConnection(ctx) }()
+		for {
+			select {
+			case err := <-connected:
+				token.complete(err)
+				return
+			case err := <-connectErr:
+				if !c.config.ConnectRetry {
+					cancel()
+					token.complete(err)
+					return
+				}
+			}
+		}
+	}()
+	return token
+}
+
+func (c *mqttV5Client) Disconnect(quiesce uint) {
+	if c.cm == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(quiesce)*time.Millisecond+time.Second)
+	defer cancel()
+	c.cm.Disconnect(ctx)
+	if c.cancel != nil {
+		c.cancel()
+	}
+	c.connected.Store(false)
+}
+
+func (c *mqttV5Client) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	var data []byte
+	switch p := payload.(type) {
+	case []byte:
+		data = p
+	case string:
+		data = []byte(p)
+	default:
+		token := newMQTTV5Token()
+		token.complete(fmt.Errorf("unknown payload type %T", payload))
+		return token
+	}
+	return c.PublishWithProperties(topic, qos, retained, data, nil)
+}
+
+// PublishWithProperties publishes the message with the user properties.
+// Like the v3 client, it fails with mqtt.ErrNotConnected while the connection is down
+// instead of waiting for the connection, and a publish gives up after publishTimeout.
+func (c *mqttV5Client) PublishWithProperties(topic string, qos byte, retained bool, payload []byte, props map[string]string) mqtt.Token {
+	token := newMQTTV5Token()
+	if c.cm == nil || !c.connected.Load() {
+		token.complete(mqtt.ErrNotConnected)
+		return token
+	}
+	pub := &paho.Publish{
+		Topic:   topic,
+		QoS:     qos,
+		Retain:  retained,
+		Payload: payload,
+	}
+	if len(props) > 0 {
+		pub.Properties = &paho.PublishProperties{}
+		for k, v := range props {
+			pub.Properties.User.Add(k, v)
+		}
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+		defer cancel()
+		_, err := c.cm.Publish(ctx, pub)
+		token.complete(err)
+	}()
+	return token
+}
+
+func (c *mqttV5Client) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	return c.SubscribeMultiple(map[string]byte{topic: qos}, callback)
+}
+
+func (c *mqttV5Client) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	token := newMQTTV5Token()
+	if c.cm == nil {
+		token.complete(mqtt.ErrNotConnected)
+		return token
+	}
+	sub := &paho.Subscribe{}
+	for topic, qos := range filters {
+		sub.Subscriptions = append(sub.Subscriptions, paho.SubscribeOptions{Topic: topic, QoS: qos})
+		if callback != nil {
+			c.AddRoute(topic, callback)
+		}
+	}
+	go func() {
+		_, err := c.cm.Subscribe(context.Background(), sub)
+		token.complete(err)
+	}()
+	return token
+}
+
+func (c *mqttV5Client) Unsubscribe(topics ...string) mqtt.Token {
+	token := newMQTTV5Token()
+	if c.cm == nil {
+		token.complete(mqtt.ErrNotConnected)
+		return token
+	}
+	c.handlersLock.Lock()
+	for _, topic := range topics {
+		delete(c.handlers, topic)
+	}
+	c.handlersLock.Unlock()
+	go func() {
+		_, err := c.cm.Unsubscribe(context.Background(), &paho.Unsubscribe{Topics: topics})
+		token.complete(err)
+	}()
+	return token
+}
+
+func (c *mqttV5Client) AddRoute(topic string, callback mqtt.MessageHandler) {
+	c.handlersLock.Lock()
+	defer c.handlersLock.Unlock()
+	c.handlers[topic] = callback
+}
+
+func (c *mqttV5Client) OptionsReader() mqtt.ClientOptionsReader {
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(c.config.Broker)
+	opts.SetClientID(c.clientID)
+	opts.SetUsername(c.config.Username)
+	return mqtt.NewOptionsReader(opts)
+}
+
+// dispatch delivers a received message to the handlers whose filter matches
+func (c *mqttV5Client) dispatch(pr paho.PublishReceived) (bool, error) {
+	c.handlersLock.RLock()
+	defer c.handlersLock.RUnlock()
+	handled := false
+	for filter, handler := range c.handlers {
+		if mqttTopicMatch(filter, pr.Packet.Topic) {
+			handler(c, &mqttV5Message{packet: pr.Packet})
+			handled = true
+		}
+	}
+	return handled, nil
+}
+
+// mqttTopicMatch reports whether the topic matches the MQTT topic filter,
+// which may contain the '+' and '#' wildcards.
+func mqttTopicMatch(filter, topic string) bool {
+	if filter == topic {
+		return true
+	}
+	fs := strings.Split(filter, "/")
+	ts := strings.Split(topic, "/")
+	for i, f := range fs {
+		if f == "#" {
+			return true
+		}
+		if i >= len(ts) {
+			return false
+		}
+		if f != "+" && f != ts[i] {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
+
+// mqttV5Message adapts a paho.golang publish packet to mqtt.Message
+type mqttV5Message struct {
+	packet *paho.Publish
+}
+
+func (m *mqttV5Message) Duplicate() bool   { return false }
+func (m *mqttV5Message) Qos() byte         { return m.packet.QoS }
+func (m *mqttV5Message) Retained() bool    { return m.packet.Retain }
+func (m *mqttV5Message) Topic() string     { return m.packet.Topic }
+func (m *mqttV5Message) MessageID() uint16 { return m.packet.PacketID }
+func (m *mqttV5Message) Payload() []byte   { return m.packet.Payload }
+func (m *mqttV5Message) Ack()              {}
+
+// UserProperties returns the MQTT v5 user properties of the message
+func (m *mqttV5Message) UserProperties() map[string]string {
+	props := map[string]string{}
+	if m.packet.Properties != nil {
+		for _, p := range m.packet.Properties.User {
+			props[p.Key] = p.Value
+		}
+	}
+	return props
+}
+
+// mqttV5Token implements mqtt.Token for operations of the v5 client
+type mqttV5Token struct {
+	done chan struct{}
+	once sync.Once
+	err  error
+}
+
+func newMQTTV5Token() *mqttV5Token {
+	return &mqttV5Token{done: make(chan struct{})}
+}
+
+func (t *mqttV5Token) complete(err error) {
+	t.once.Do(func() {
+		t.err = err
+		close(t.done)
+	})
+}
+
+func (t *mqttV5Token) Wait() bool {
+	<-t.done
+	return true
+}
+
+func (t *mqttV5Token) WaitTimeout(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-t.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (t *mqttV5Token) Done() <-chan struct{} {
+	return t.done
+}
+
+func (t *mqttV5Token) Error() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
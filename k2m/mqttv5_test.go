@@ -0,0 +1,54 @@
+package k2m
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMQTTV5PublishTimeout(t *testing.T) {
+	// a server that accepts the connection and never acknowledges a publish
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 1024)
+		if _, err := conn.Read(buf); err != nil { // CONNECT
+			return
+		}
+		conn.Write([]byte{0x20, 0x03, 0x00, 0x00, 0x00}) // CONNACK, success
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	timeout := publishTimeout
+	publishTimeout = 100 * time.Millisecond
+	defer func() { publishTimeout = timeout }()
+
+	client, err := newMQTTV5Client(MQTTConfig{
+		Broker:         "mqtt://" + listener.Addr().String(),
+		ClientID:       "k2m-v5-timeout",
+		ConnectTimeout: Duration(time.Second),
+	}, mqttV5Hooks{})
+	require.NoError(t, err)
+	token := client.Connect()
+	require.True(t, token.WaitTimeout(time.Second))
+	require.NoError(t, token.Error())
+	defer client.Disconnect(0)
+
+	// the publish gives up instead of waiting for the acknowledgement
+	token = client.Publish("sensors", 1, false, "unacknowledged")
+	require.True(t, token.WaitTimeout(time.Second), "the publish is bounded by the publish timeout")
+	assert.Error(t, token.Error())
+}
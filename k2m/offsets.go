@@ -0,0 +1,100 @@
+package k2m
+
+import (
+	"sync"
+
+	"github.com/IBM/sarama"
+)
+
+// offsetTracker marks the offsets of a consumer group session only after
+// the messages have been processed. Messages of a partition may complete
+// out of order, e.g. with several workers or a batching sink, so the
+// tracker marks the highest offset below which every message is done.
+type offsetTracker struct {
+	mu         sync.Mutex
+	session    sarama.ConsumerGroupSession
+	partitions map[topicPartition]*partitionOffsets
+}
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// partitionOffsets holds the in-flight messages of a partition in the order they were consumed
+type partitionOffsets struct {
+	inflight []*trackedMessage
+	byOffset map[int64]*trackedMessage
+}
+
+type trackedMessage struct {
+	message *sarama.ConsumerMessage
+	done    bool
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{partitions: make(map[topicPartition]*partitionOffsets)}
+}
+
+// Reset starts tracking a new session, forgetting the messages of the previous one
+func (t *offsetTracker) Reset(session sarama.ConsumerGroupSession) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.session = session
+	t.partitions = make(map[topicPartition]*partitionOffsets)
+}
+
+// Add registers a consumed message that is not processed yet
+func (t *offsetTracker) Add(message *sarama.ConsumerMessage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tp := topicPartition{message.Topic, message.Partition}
+	p, ok := t.partitions[tp]
+	if !ok {
+		p = &partitionOffsets{byOffset: make(map[int64]*trackedMessage)}
+		t.partitions[tp] = p
+	}
+	tm := &trackedMessage{message: message}
+	p.inflight = append(p.inflight, tm)
+	p.byOffset[message.Offset] = tm
+}
+
+// Done records that the message is processed and marks the offset
+// of the partition up to the first message still in flight.
+// Messages that were not added in the current session are ignored.
+func (t *offsetTracker) Done(message *sarama.ConsumerMessage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.partitions[topicPartition{message.Topic, message.Partition}]
+	if !ok {
+		return
+	}
+	// compare the message itself, a redelivered message has the same offset
+	tm, ok := p.byOffset[message.Offset]
+	if !ok || tm.message != message {
+		return
+	}
+	tm.done = true
+
+	var last *sarama.ConsumerMessage
+	for len(p.inflight) > 0 && p.inflight[0].done {
+		last = p.inflight[0].message
+		delete(p.byOffset, last.Offset)
+		p.inflight[0] = nil
+		p.inflight = p.inflight[1:]
+	}
+	if last != nil && t.session != nil {
+		t.session.MarkMessage(last, "")
+	}
+}
+
+// Pending returns the number of messages in flight
+func (t *offsetTracker) Pending() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, p := range t.partitions {
+		n += len(p.inflight)
+	}
+	return n
+}
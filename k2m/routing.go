@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/IBM/sarama"
+	"github.com/santhosh-tekuri/jsonschema/v6"
 )
 
 // MessageFilter defines the interface for message filtering
@@ -20,22 +21,45 @@ type MessageFilter interface {
 
 // FilterConfig holds configuration for message filtering
 type FilterConfig struct {
-	Type   string                 `json:"type"`   // "header", "key", "value", "topic", "custom"
+	Type   string                 `json:"type"`   // "header", "key", "value", "topic", "source", "custom"
 	Config map[string]interface{} `json:"config"` // Filter-specific configuration
 }
 
 // RouteConfig defines routing rules for messages
 type RouteConfig struct {
-	Name     string         `json:"name"`     // Route name for identification
-	Filters  []FilterConfig `json:"filters"`  // Filters that must match
-	Mapping  TopicMapping   `json:"mapping"`  // Topic mapping for matched messages
-	Priority int            `json:"priority"` // Higher priority routes are checked first
+	Name     string         `json:"name"`             // Route name for identification
+	Filters  []FilterConfig `json:"filters"`          // Filters that must match
+	Mapping  TopicMapping   `json:"mapping"`          // Topic mapping for matched messages
+	Priority int            `json:"priority"`         // Higher priority routes are checked first
+	Schema   *SchemaConfig  `json:"schema,omitempty"` // Optional JSON Schema of the payload
+	// Tombstones selects how messages with a nil value are handled:
+	// "forward" (default) transforms and publishes them like other messages,
+	// "clear" publishes a zero-length retained message to clear the MQTT topic,
+	// "drop" skips them.
+	Tombstones string `json:"tombstones,omitempty"`
+	// Sink writes the matched messages to a database instead of publishing them to MQTT
+	Sink *SinkConfig `json:"sink,omitempty"`
+	// Compression decompresses the values before the value filters and the transform of the route
+	Compression *CompressionConfig `json:"compression,omitempty"`
+}
+
+// Tombstone handling modes of a route
+const (
+	TombstoneForward = "forward"
+	TombstoneClear   = "clear"
+	TombstoneDrop    = "drop"
+)
+
+// IsTombstone reports whether the message is a tombstone of a compacted topic
+func IsTombstone(message *sarama.ConsumerMessage) bool {
+	return message.Value == nil
 }
 
 // MessageRouter handles message routing based on filters
 type MessageRouter struct {
 	routes  []RouteConfig
 	filters map[string]MessageFilter
+	schemas map[string]*jsonschema.Schema // route name -> payload schema
 }
 
 // NewMessageRouter creates a new message router
@@ -43,6 +67,7 @@ func NewMessageRouter(routes []RouteConfig) (*MessageRouter, error) {
 	router := &MessageRouter{
 		routes:  routes,
 		filters: make(map[string]MessageFilter),
+		schemas: make(map[string]*jsonschema.Schema),
 	}
 
 	// Sort routes by priority (higher first)
@@ -64,36 +89,128 @@ func NewMessageRouter(routes []RouteConfig) (*MessageRouter, error) {
 			}
 			router.filters[filterKey] = filter
 		}
+		if route.Schema != nil {
+			schema, err := compileSchema(route.Schema.File)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load schema for route %s: %w", route.Name, err)
+			}
+			router.schemas[route.Name] = schema
+		}
 	}
 
 	return router, nil
 }
 
-// FindRoute finds the first matching route for a message
+// FindRoute finds the first matching route for a message of the default source
 func (mr *MessageRouter) FindRoute(message *sarama.ConsumerMessage) *RouteConfig {
-	for _, route := range mr.routes {
-		if mr.routeMatches(message, &route) {
-			return &route
+	return mr.FindSourceRoute(DefaultSourceName, message)
+}
+
+// FindSourceRoute finds the first matching route for a message consumed from the named source
+func (mr *MessageRouter) FindSourceRoute(source string, message *sarama.ConsumerMessage) *RouteConfig {
+	route, _, _, err := mr.RouteMessage(source, message, false)
+	if err != nil {
+		return nil
+	}
+	return route
+}
+
+// FindRouteExplain finds the first matching route like FindRoute and
+// also returns the result of every filter evaluated on the way.
+func (mr *MessageRouter) FindRouteExplain(message *sarama.ConsumerMessage) (*RouteConfig, []FilterResult) {
+	return mr.FindSourceRouteExplain(DefaultSourceName, message)
+}
+
+// FindSourceRouteExplain is FindRouteExplain for a message consumed from the named source
+func (mr *MessageRouter) FindSourceRouteExplain(source string, message *sarama.ConsumerMessage) (*RouteConfig, []FilterResult) {
+	route, _, results, err := mr.RouteMessage(source, message, true)
+	if err != nil {
+		return nil, results
+	}
+	return route, results
+}
+
+// RouteMessage finds the first matching route for a message consumed from the named source.
+// The filters of the message metadata run before the filters of the value, so a route
+// with compression decompresses only the values of the messages its other filters match.
+// Its value filters see the decompressed value, and the message as the route sees it
+// is returned with the route. If the value of such a route cannot be decompressed,
+// routing stops and the route is returned with the error.
+// With explain, the result of every filter evaluated on the way is returned.
+func (mr *MessageRouter) RouteMessage(source string, message *sarama.ConsumerMessage, explain bool) (*RouteConfig, *sarama.ConsumerMessage, []FilterResult, error) {
+	var results []FilterResult
+	// values decompressed by the routes, routes with the same compression decode once
+	decoded := make(map[CompressionConfig]*sarama.ConsumerMessage)
+	for i := range mr.routes {
+		route := &mr.routes[i]
+		if !mr.matchFilters(route, source, message, false, explain, &results) {
+			continue
+		}
+		routeMessage := message
+		if route.Compression != nil {
+			var ok bool
+			if routeMessage, ok = decoded[*route.Compression]; !ok {
+				var err error
+				routeMessage, err = decompressMessage(route.Compression, message)
+				if err != nil {
+					return route, nil, results, err
+				}
+				decoded[*route.Compression] = routeMessage
+			}
+		}
+		if mr.matchFilters(route, source, routeMessage, true, explain, &results) {
+			return route, routeMessage, results, nil
 		}
 	}
-	return nil
+	return nil, message, results, nil
 }
 
-// routeMatches checks if a message matches all filters for a route
-func (mr *MessageRouter) routeMatches(message *sarama.ConsumerMessage, route *RouteConfig) bool {
+// matchFilters applies the filters of the route that read the value, or the others,
+// to the message. It stops at the first filter that does not match.
+func (mr *MessageRouter) matchFilters(route *RouteConfig, source string, message *sarama.ConsumerMessage, value bool, explain bool, results *[]FilterResult) bool {
 	for _, filterConfig := range route.Filters {
+		if isValueFilter(filterConfig.Type) != value {
+			continue
+		}
 		filterKey := fmt.Sprintf("%s_%s", route.Name, filterConfig.Type)
-		filter, exists := mr.filters[filterKey]
-		if !exists {
-			return false
+		result := FilterResult{Route: route.Name, Type: filterConfig.Type}
+		if filter, exists := mr.filters[filterKey]; exists {
+			result.Filter = filter.GetName()
+			result.Matched = filterMatches(filter, source, message)
+		}
+		if explain {
+			*results = append(*results, result)
 		}
-		if !filter.ShouldProcess(message) {
+		if !result.Matched {
 			return false
 		}
 	}
 	return true
 }
 
+// isValueFilter reports whether the filter type reads the value of a message
+func isValueFilter(filterType string) bool {
+	return filterType == "value" || filterType == "size"
+}
+
+// ValidatePayload validates the message against the schema of the route.
+// It returns nil if the route has no schema.
+func (mr *MessageRouter) ValidatePayload(route *RouteConfig, message *sarama.ConsumerMessage) error {
+	schema, ok := mr.schemas[route.Name]
+	if !ok {
+		return nil
+	}
+	return validatePayload(schema, message)
+}
+
+// filterMatches applies the filter to the message, source filters match the source name
+func filterMatches(filter MessageFilter, source string, message *sarama.ConsumerMessage) bool {
+	if sf, ok := filter.(*SourceFilter); ok {
+		return sf.MatchSource(source)
+	}
+	return filter.ShouldProcess(message)
+}
+
 // createFilter creates a filter based on configuration
 func createFilter(config FilterConfig) (MessageFilter, error) {
 	switch config.Type {
@@ -109,6 +226,8 @@ func createFilter(config FilterConfig) (MessageFilter, error) {
 		return createSizeFilter(config.Config)
 	case "timestamp":
 		return createTimestampFilter(config.Config)
+	case "source":
+		return createSourceFilter(config.Config)
 	default:
 		return nil, fmt.Errorf("unknown filter type: %s", config.Type)
 	}
@@ -421,7 +540,7 @@ func ValidateRouteConfig(routes []RouteConfig) error {
 		if route.Mapping.KafkaTopic == "" {
 			return fmt.Errorf("route %s: kafkaTopic cannot be empty", route.Name)
 		}
-		if route.Mapping.MQTTTopic == "" {
+		if route.Mapping.MQTTTopic == "" && route.Sink == nil && route.Mapping.TopicMode != TopicModeSparkplug {
 			return fmt.Errorf("route %s: mqttTopic cannot be empty", route.Name)
 		}
 
@@ -434,6 +553,36 @@ func ValidateRouteConfig(routes []RouteConfig) error {
 				return fmt.Errorf("route %s: filter %d config cannot be nil", route.Name, i)
 			}
 		}
+
+		switch route.Tombstones {
+		case "", TombstoneForward, TombstoneClear, TombstoneDrop:
+		default:
+			return fmt.Errorf("route %s: unknown tombstones mode: %s", route.Name, route.Tombstones)
+		}
+
+		// Validate payload schema
+		if route.Schema != nil {
+			if err := validateSchemaConfig(route.Schema); err != nil {
+				return fmt.Errorf("route %s: %w", route.Name, err)
+			}
+		}
+
+		// Validate Sparkplug B mapping
+		if err := validateSparkplugMapping(&route.Mapping); err != nil {
+			return fmt.Errorf("route %s: %w", route.Name, err)
+		}
+
+		// Validate payload compression
+		if err := validateCompression(route.Compression, &route.Mapping); err != nil {
+			return fmt.Errorf("route %s: %w", route.Name, err)
+		}
+
+		// Validate sink
+		if route.Sink != nil {
+			if err := validateSinkConfig(route.Sink); err != nil {
+				return fmt.Errorf("route %s: %w", route.Name, err)
+			}
+		}
 	}
 
 	return nil
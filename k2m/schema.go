@@ -0,0 +1,90 @@
+package k2m
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/IBM/sarama"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+// SchemaConfig references a JSON Schema that the payloads of a route must satisfy
+type SchemaConfig struct {
+	// File is the path of the JSON Schema file
+	File string `json:"file"`
+	// OnInvalid is the action for invalid payloads: "reject" (default) or "deadletter"
+	OnInvalid string `json:"onInvalid,omitempty"`
+	// DeadLetterTopic is the MQTT topic template for invalid payloads,
+	// required when OnInvalid is "deadletter", e.g. "deadletter/{kafkaTopic}"
+	DeadLetterTopic string `json:"deadLetterTopic,omitempty"`
+}
+
+const (
+	SchemaOnInvalidReject     = "reject"
+	SchemaOnInvalidDeadLetter = "deadletter"
+)
+
+// compileSchema loads and compiles the JSON Schema file
+func compileSchema(file string) (*jsonschema.Schema, error) {
+	if _, err := os.Stat(file); err != nil {
+		return nil, fmt.Errorf("schema file: %w", err)
+	}
+	schema, err := jsonschema.NewCompiler().Compile(file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema %s: %w", file, err)
+	}
+	return schema, nil
+}
+
+// validateSchemaConfig checks the schema configuration of a route and that the schema compiles
+func validateSchemaConfig(cfg *SchemaConfig) error {
+	if cfg.File == "" {
+		return fmt.Errorf("schema file cannot be empty")
+	}
+	switch cfg.OnInvalid {
+	case "", SchemaOnInvalidReject:
+	case SchemaOnInvalidDeadLetter:
+		if cfg.DeadLetterTopic == "" {
+			return fmt.Errorf("schema deadLetterTopic is required for onInvalid %q", cfg.OnInvalid)
+		}
+	default:
+		return fmt.Errorf("unknown schema onInvalid action: %s", cfg.OnInvalid)
+	}
+	_, err := compileSchema(cfg.File)
+	return err
+}
+
+// validatePayload validates the message value against the schema
+func validatePayload(schema *jsonschema.Schema, message *sarama.ConsumerMessage) error {
+	inst, err := jsonschema.UnmarshalJSON(bytes.NewReader(message.Value))
+	if err != nil {
+		return fmt.Errorf("payload is not valid JSON: %w", err)
+	}
+	return schema.Validate(inst)
+}
+
+// deadLetter publishes an invalid message to the dead-letter topic of the route
+func (w *MessageWorker) deadLetter(source *kafkaSource, message *sarama.ConsumerMessage, route *RouteConfig, cause error) (string, error) {
+	mqttTopic := w.resolveSourceTopic(route.Schema.DeadLetterTopic, source.name, message)
+	payload, err := json.Marshal(map[string]interface{}{
+		"route":          route.Name,
+		"schema":         route.Schema.File,
+		"error":          cause.Error(),
+		"kafkaTopic":     message.Topic,
+		"kafkaPartition": message.Partition,
+		"kafkaOffset":    message.Offset,
+		"timestamp":      message.Timestamp,
+		"key":            string(message.Key),
+		"value":          string(message.Value),
+	})
+	if err != nil {
+		return mqttTopic, err
+	}
+	token := w.broker.mqttClient.Publish(mqttTopic, w.broker.config.MQTTConfig.QoS, false, payload)
+	if !token.WaitTimeout(publishTimeout) {
+		return mqttTopic, fmt.Errorf("publish timeout for topic %s", mqttTopic)
+	}
+	return mqttTopic, token.Error()
+}
@@ -0,0 +1,123 @@
+package k2m
+
+import (
+	"actsvr/util"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/IBM/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const sensorSchema = `{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "type": "object",
+  "required": ["deviceId", "temperature"],
+  "properties": {
+    "deviceId": {"type": "string"},
+    "temperature": {"type": "number"}
+  }
+}`
+
+func writeSchema(t *testing.T, content string) string {
+	filename := filepath.Join(t.TempDir(), "sensor.schema.json")
+	require.NoError(t, os.WriteFile(filename, []byte(content), 0644))
+	return filename
+}
+
+func newSchemaTestBroker(t *testing.T, schema *SchemaConfig) (*MessageWorker, *MockMQTTClient) {
+	config := DefaultConfig()
+	config.TopicMappings = nil
+	config.Routes = []RouteConfig{
+		{
+			Name:     "sensors",
+			Priority: 1,
+			Filters:  []FilterConfig{},
+			Mapping:  TopicMapping{KafkaTopic: "sensors", MQTTTopic: "iot/{key}", Transform: "none"},
+			Schema:   schema,
+		},
+	}
+	broker, err := NewK2MBroker(config, util.NewLog(util.DefaultLogConfig()))
+	require.NoError(t, err)
+	mockMQTT := NewMockMQTTClient()
+	broker.mqttClient = mockMQTT
+	return &MessageWorker{id: 1, broker: broker, messageCh: broker.messageCh}, mockMQTT
+}
+
+func TestSchemaValidationReject(t *testing.T) {
+	schemaFile := writeSchema(t, sensorSchema)
+	worker, mockMQTT := newSchemaTestBroker(t, &SchemaConfig{File: schemaFile})
+
+	worker.processMessage(&sarama.ConsumerMessage{Topic: "sensors", Key: []byte("d1"), Value: []byte(`{"deviceId":"d1","temperature":21.5}`)})
+	worker.processMessage(&sarama.ConsumerMessage{Topic: "sensors", Key: []byte("d2"), Value: []byte(`{"deviceId":"d2","temperature":"hot"}`)})
+	worker.processMessage(&sarama.ConsumerMessage{Topic: "sensors", Key: []byte("d3"), Value: []byte(`not json`)})
+
+	messages := mockMQTT.GetMessages()
+	require.Len(t, messages, 1)
+	assert.Equal(t, "iot/d1", messages[0].Topic)
+
+	metrics := worker.broker.GetMetrics()
+	assert.Equal(t, int64(2), metrics.SchemaErrors)
+	assert.Equal(t, int64(2), metrics.MessagesFailed)
+	assert.Equal(t, int64(0), metrics.DeadLettered)
+	assert.Equal(t, int64(2), metrics.SchemaInvalid["sensors"][schemaFile])
+}
+
+func TestSchemaValidationDeadLetter(t *testing.T) {
+	schemaFile := writeSchema(t, sensorSchema)
+	worker, mockMQTT := newSchemaTestBroker(t, &SchemaConfig{
+		File:            schemaFile,
+		OnInvalid:       SchemaOnInvalidDeadLetter,
+		DeadLetterTopic: "deadletter/{kafkaTopic}",
+	})
+
+	worker.processMessage(&sarama.ConsumerMessage{Topic: "sensors", Partition: 1, Offset: 9, Key: []byte("d2"), Value: []byte(`{"deviceId":"d2"}`)})
+
+	messages := mockMQTT.GetMessages()
+	require.Len(t, messages, 1)
+	assert.Equal(t, "deadletter/sensors", messages[0].Topic)
+
+	var dl map[string]interface{}
+	require.NoError(t, json.Unmarshal(messages[0].Payload, &dl))
+	assert.Equal(t, "sensors", dl["route"])
+	assert.Equal(t, schemaFile, dl["schema"])
+	assert.Equal(t, `{"deviceId":"d2"}`, dl["value"])
+	assert.Equal(t, float64(9), dl["kafkaOffset"])
+	assert.Contains(t, dl["error"], "temperature")
+
+	metrics := worker.broker.GetMetrics()
+	assert.Equal(t, int64(1), metrics.SchemaErrors)
+	assert.Equal(t, int64(1), metrics.DeadLettered)
+	assert.Equal(t, int64(0), metrics.MessagesFailed)
+}
+
+func TestValidateRouteConfigSchema(t *testing.T) {
+	schemaFile := writeSchema(t, sensorSchema)
+	route := func(schema *SchemaConfig) []RouteConfig {
+		return []RouteConfig{{
+			Name:    "sensors",
+			Mapping: TopicMapping{KafkaTopic: "sensors", MQTTTopic: "iot/{key}"},
+			Schema:  schema,
+		}}
+	}
+
+	assert.NoError(t, ValidateRouteConfig(route(&SchemaConfig{File: schemaFile})))
+
+	err := ValidateRouteConfig(route(&SchemaConfig{}))
+	assert.ErrorContains(t, err, "schema file cannot be empty")
+
+	err = ValidateRouteConfig(route(&SchemaConfig{File: "/non/existent/schema.json"}))
+	assert.ErrorContains(t, err, "route sensors: schema file")
+
+	err = ValidateRouteConfig(route(&SchemaConfig{File: writeSchema(t, `{"type": 12}`)}))
+	assert.ErrorContains(t, err, "invalid schema")
+
+	err = ValidateRouteConfig(route(&SchemaConfig{File: schemaFile, OnInvalid: SchemaOnInvalidDeadLetter}))
+	assert.ErrorContains(t, err, "deadLetterTopic is required")
+
+	err = ValidateRouteConfig(route(&SchemaConfig{File: schemaFile, OnInvalid: "drop"}))
+	assert.ErrorContains(t, err, "unknown schema onInvalid action")
+}
@@ -0,0 +1,562 @@
+package k2m
+
+import (
+	"actsvr/util"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/machbase/neo-server/v8/api"
+	"github.com/machbase/neo-server/v8/api/machcli"
+)
+
+// SinkConfig writes the messages of a route to a database instead of publishing them to MQTT
+type SinkConfig struct {
+	// Type of the sink, only "machbase" is supported
+	Type     string              `json:"type"`
+	Machbase *MachbaseSinkConfig `json:"machbase,omitempty"`
+}
+
+const SinkTypeMachbase = "machbase"
+
+// MachbaseSinkConfig appends messages into a Machbase TAG or log table
+type MachbaseSinkConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+	Table    string `json:"table"`
+	// Columns maps the fields of the JSON payload to the columns of the table.
+	// Columns of the table that are not mapped are appended as NULL.
+	Columns []SinkColumn `json:"columns"`
+	// BatchSize is the number of rows appended before the appender is flushed
+	BatchSize int `json:"batchSize,omitempty"`
+	// FlushInterval flushes a partial batch after this interval
+	FlushInterval Duration `json:"flushInterval,omitempty"`
+	// Timezone of timestamps parsed with a layout, default is local time
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// SinkColumn maps a field of the message to a table column
+type SinkColumn struct {
+	Column string `json:"column"`
+	// Field is the dotted path of a JSON field in the payload, e.g. "data.temperature",
+	// or one of $key, $topic, $partition, $offset, $timestamp (Kafka message time), $value (raw payload)
+	Field string `json:"field"`
+	// Timeformat of DATETIME columns: "s", "ms", "us", "ns" for epoch numbers or a Go time layout.
+	// Numbers default to "ns", strings to RFC3339.
+	Timeformat string `json:"timeformat,omitempty"`
+}
+
+// errSinkUnavailable is the error of a message that the sink cannot queue because the
+// database is not reachable, the message is written again once it is
+var errSinkUnavailable = errors.New("sink unavailable")
+
+const (
+	defaultSinkBatchSize     = 1000
+	defaultSinkFlushInterval = time.Second
+	maxSinkRetryBackoff      = 30 * time.Second
+)
+
+// sinkRetryBackoff is the first delay of the retries of an unavailable sink,
+// doubled after every retry up to maxSinkRetryBackoff, a variable for the tests
+var sinkRetryBackoff = time.Second
+
+// sink writes the messages of a route to a destination other than MQTT
+type sink interface {
+	Open(ctx context.Context) error
+	// Write queues the message, done is called once the message is stored.
+	// A message that fails to be stored is retried, done is not called if it is never stored.
+	Write(message *sarama.ConsumerMessage, done func()) error
+	Close() error
+}
+
+// newSink creates the sink of a route, the sink is connected by Open
+func newSink(route string, cfg *SinkConfig, logger *util.Log, metrics *Metrics) (sink, error) {
+	switch cfg.Type {
+	case SinkTypeMachbase:
+		return newMachbaseSink(route, cfg.Machbase, logger, metrics)
+	default:
+		return nil, fmt.Errorf("unknown sink type: %s", cfg.Type)
+	}
+}
+
+// validateSinkConfig checks the sink configuration of a route
+func validateSinkConfig(cfg *SinkConfig) error {
+	switch cfg.Type {
+	case SinkTypeMachbase:
+	default:
+		return fmt.Errorf("unknown sink type: %s", cfg.Type)
+	}
+	mc := cfg.Machbase
+	if mc == nil {
+		return fmt.Errorf("machbase sink configuration is missing")
+	}
+	if mc.Table == "" {
+		return fmt.Errorf("machbase sink table cannot be empty")
+	}
+	if len(mc.Columns) == 0 {
+		return fmt.Errorf("machbase sink requires at least one column mapping")
+	}
+	for i, c := range mc.Columns {
+		if c.Column == "" || c.Field == "" {
+			return fmt.Errorf("machbase sink column %d: column and field are required", i)
+		}
+	}
+	if mc.Timezone != "" {
+		if _, err := time.LoadLocation(mc.Timezone); err != nil {
+			return fmt.Errorf("machbase sink timezone: %w", err)
+		}
+	}
+	return nil
+}
+
+// machbaseSink appends messages into a Machbase table in batches.
+// The done callbacks of a batch are called after the batch is flushed,
+// so the Kafka offsets are committed only after the rows are appended.
+// The rows of a batch that fails to flush are appended again to a new appender by the next flush.
+type machbaseSink struct {
+	route   string
+	config  *MachbaseSinkConfig
+	logger  *util.Log
+	metrics *Metrics
+	tz      *time.Location
+
+	// dial opens the appender of the table and returns the function releasing the connection
+	dial func(ctx context.Context) (api.Appender, func(), error)
+
+	mu         sync.Mutex
+	appender   api.Appender
+	release    func()
+	converters []func(message *sarama.ConsumerMessage, doc any) (any, error)
+	parseJSON  bool
+	pending    []sinkRow
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// sinkRow is a row appended but not flushed yet
+type sinkRow struct {
+	values []any
+	done   func()
+}
+
+func newMachbaseSink(route string, cfg *MachbaseSinkConfig, logger *util.Log, metrics *Metrics) (*machbaseSink, error) {
+	tz := time.Local
+	if cfg.Timezone != "" {
+		loc, err := time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return nil, err
+		}
+		tz = loc
+	}
+	s := &machbaseSink{
+		route:   route,
+		config:  cfg,
+		logger:  logger,
+		metrics: metrics,
+		tz:      tz,
+	}
+	s.dial = s.dialMachbase
+	return s, nil
+}
+
+// dialMachbase connects to the Machbase server and opens the appender of the table
+func (s *machbaseSink) dialMachbase(ctx context.Context) (api.Appender, func(), error) {
+	db, err := machcli.NewDatabase(&machcli.Config{
+		Host:         s.config.Host,
+		Port:         s.config.Port,
+		TrustUsers:   map[string]string{s.config.User: s.config.Password},
+		MaxOpenConn:  -1,
+		MaxOpenQuery: -1,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := db.Connect(ctx, api.WithPassword(s.config.User, s.config.Password))
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	appender, err := conn.Appender(ctx, s.config.Table)
+	if err != nil {
+		conn.Close()
+		db.Close()
+		return nil, nil, err
+	}
+	return appender, func() {
+		conn.Close()
+		db.Close()
+	}, nil
+}
+
+// Open opens the appender and starts the flush loop
+func (s *machbaseSink) Open(ctx context.Context) error {
+	s.mu.Lock()
+	err := s.openLocked(ctx)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	interval := time.Duration(s.config.FlushInterval)
+	if interval <= 0 {
+		interval = defaultSinkFlushInterval
+	}
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.mu.Lock()
+				s.flushLocked()
+				s.mu.Unlock()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (s *machbaseSink) openLocked(ctx context.Context) error {
+	appender, release, err := s.dial(ctx)
+	if err != nil {
+		return fmt.Errorf("machbase sink %s: %w", s.config.Table, err)
+	}
+	cols, err := appender.Columns()
+	if err == nil && s.converters == nil {
+		err = s.buildConverters(cols)
+	}
+	if err != nil {
+		appender.Close()
+		release()
+		return fmt.Errorf("machbase sink %s: %w", s.config.Table, err)
+	}
+	s.appender = appender
+	s.release = release
+	return nil
+}
+
+// reopenLocked opens a new appender and appends the rows of the failed batch again
+func (s *machbaseSink) reopenLocked(ctx context.Context) error {
+	if err := s.openLocked(ctx); err != nil {
+		return err
+	}
+	for _, row := range s.pending {
+		if err := s.appender.Append(row.values...); err != nil {
+			s.closeLocked()
+			return fmt.Errorf("machbase sink %s: %w", s.config.Table, err)
+		}
+	}
+	return nil
+}
+
+// buildConverters maps the table columns to the configured fields
+func (s *machbaseSink) buildConverters(cols api.Columns) error {
+	mapped := make(map[string]SinkColumn, len(s.config.Columns))
+	for _, c := range s.config.Columns {
+		mapped[strings.ToUpper(c.Column)] = c
+	}
+	if len(cols) > 0 && cols[0].Name == "_ARRIVAL_TIME" {
+		if _, ok := mapped["_ARRIVAL_TIME"]; !ok {
+			cols = cols[1:] // skip _ARRIVAL_TIME column of log tables
+		}
+	}
+
+	converters := make([]func(*sarama.ConsumerMessage, any) (any, error), len(cols))
+	for i, col := range cols {
+		mc, ok := mapped[col.Name]
+		if !ok {
+			converters[i] = func(*sarama.ConsumerMessage, any) (any, error) { return nil, nil }
+			continue
+		}
+		delete(mapped, col.Name)
+		if !strings.HasPrefix(mc.Field, "$") {
+			s.parseJSON = true
+		}
+		convert := s.columnConverter(col, mc.Timeformat)
+		field := mc.Field
+		converters[i] = func(message *sarama.ConsumerMessage, doc any) (any, error) {
+			v, err := sinkFieldValue(message, doc, field)
+			if err != nil || v == nil {
+				return nil, err
+			}
+			ret, err := convert(v)
+			if err != nil {
+				return nil, fmt.Errorf("column %s: %w", col.Name, err)
+			}
+			return ret, nil
+		}
+	}
+	for name := range mapped {
+		return fmt.Errorf("column %s not found in table", name)
+	}
+	s.converters = converters
+	return nil
+}
+
+// sinkFieldValue returns the value of the field, nil if the payload does not have it
+func sinkFieldValue(message *sarama.ConsumerMessage, doc any, field string) (any, error) {
+	switch field {
+	case "$key":
+		return string(message.Key), nil
+	case "$topic":
+		return message.Topic, nil
+	case "$partition":
+		return json.Number(strconv.Itoa(int(message.Partition))), nil
+	case "$offset":
+		return json.Number(strconv.FormatInt(message.Offset, 10)), nil
+	case "$timestamp":
+		return message.Timestamp, nil
+	case "$value":
+		return string(message.Value), nil
+	}
+	if strings.HasPrefix(field, "$") {
+		return nil, fmt.Errorf("unknown field %s", field)
+	}
+	v := doc
+	for _, name := range strings.Split(field, ".") {
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return nil, nil
+		}
+		v = obj[name]
+	}
+	return v, nil
+}
+
+// columnConverter converts a JSON value to the value of the column type
+func (s *machbaseSink) columnConverter(col *api.Column, timeformat string) func(any) (any, error) {
+	switch col.Type {
+	case api.ColumnTypeShort, api.ColumnTypeUShort, api.ColumnTypeInteger, api.ColumnTypeUInteger,
+		api.ColumnTypeLong, api.ColumnTypeULong:
+		return func(v any) (any, error) {
+			f, err := sinkNumber(v)
+			if err != nil {
+				return nil, err
+			}
+			if n, err := f.Int64(); err == nil {
+				return n, nil
+			}
+			x, err := f.Float64()
+			return int64(x), err
+		}
+	case api.ColumnTypeFloat, api.ColumnTypeDouble:
+		return func(v any) (any, error) {
+			f, err := sinkNumber(v)
+			if err != nil {
+				return nil, err
+			}
+			return f.Float64()
+		}
+	case api.ColumnTypeDatetime:
+		return func(v any) (any, error) {
+			return s.convertTime(v, timeformat)
+		}
+	default:
+		// VARCHAR, TEXT, JSON, IPv4, IPv6
+		return func(v any) (any, error) {
+			switch x := v.(type) {
+			case string:
+				return x, nil
+			case json.Number:
+				return x.String(), nil
+			case time.Time:
+				return x.Format(time.RFC3339Nano), nil
+			default:
+				b, err := json.Marshal(x)
+				return string(b), err
+			}
+		}
+	}
+}
+
+// sinkNumber returns the JSON value as a number
+func sinkNumber(v any) (json.Number, error) {
+	switch x := v.(type) {
+	case json.Number:
+		return x, nil
+	case string:
+		if _, err := strconv.ParseFloat(x, 64); err != nil {
+			return "", fmt.Errorf("not a number: %q", x)
+		}
+		return json.Number(x), nil
+	case bool:
+		if x {
+			return "1", nil
+		}
+		return "0", nil
+	default:
+		return "", fmt.Errorf("not a number: %v", v)
+	}
+}
+
+// convertTime converts an epoch number or a time string to nanoseconds
+func (s *machbaseSink) convertTime(v any, timeformat string) (any, error) {
+	if t, ok := v.(time.Time); ok {
+		return t.UnixNano(), nil
+	}
+	var unit time.Duration
+	switch timeformat {
+	case "s":
+		unit = time.Second
+	case "ms":
+		unit = time.Millisecond
+	case "us":
+		unit = time.Microsecond
+	case "ns", "":
+		unit = time.Nanosecond
+	}
+	if str, ok := v.(string); ok {
+		switch {
+		case timeformat == "":
+			t, err := time.Parse(time.RFC3339Nano, str)
+			if err != nil {
+				return nil, err
+			}
+			return t.UnixNano(), nil
+		case unit == 0:
+			t, err := time.ParseInLocation(timeformat, str, s.tz)
+			if err != nil {
+				return nil, err
+			}
+			return t.UnixNano(), nil
+		}
+	}
+	if unit == 0 {
+		return nil, fmt.Errorf("time layout %q requires a string, got %v", timeformat, v)
+	}
+	f, err := sinkNumber(v)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := f.Int64(); err == nil {
+		return n * int64(unit), nil
+	}
+	x, err := f.Float64()
+	if err != nil {
+		return nil, err
+	}
+	return int64(x * float64(unit)), nil
+}
+
+// Write converts the message to a row and appends it.
+// done is called when the batch of the row is flushed.
+// The error is errSinkUnavailable if the appender cannot be opened.
+func (s *machbaseSink) Write(message *sarama.ConsumerMessage, done func()) error {
+	var doc any
+	if s.parseJSON {
+		dec := json.NewDecoder(bytes.NewReader(message.Value))
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil {
+			return fmt.Errorf("payload is not valid JSON: %w", err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.appender == nil {
+		if err := s.reopenLocked(context.Background()); err != nil {
+			return fmt.Errorf("%w: %v", errSinkUnavailable, err)
+		}
+	}
+
+	values := make([]any, len(s.converters))
+	for i, convert := range s.converters {
+		v, err := convert(message, doc)
+		if err != nil {
+			return err
+		}
+		values[i] = v
+	}
+	if err := s.appender.Append(values...); err != nil {
+		return err
+	}
+	s.pending = append(s.pending, sinkRow{values: values, done: done})
+
+	batchSize := s.config.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultSinkBatchSize
+	}
+	if len(s.pending) >= batchSize {
+		s.flushLocked()
+	}
+	return nil
+}
+
+// flushLocked flushes the appended rows and completes their messages.
+// If the flush fails the rows stay pending, they are appended again to a new appender
+// by the next flush or Write, so their offsets are not marked before they are stored.
+func (s *machbaseSink) flushLocked() {
+	if len(s.pending) == 0 {
+		return
+	}
+	var err error
+	if s.appender == nil {
+		err = s.reopenLocked(context.Background())
+	}
+	if err == nil {
+		if flusher, ok := s.appender.(api.Flusher); ok {
+			err = flusher.Flush()
+		} else {
+			err = s.closeLocked()
+		}
+	}
+	if err != nil {
+		s.logger.Errorf("Failed to flush %d rows of route %s to %s, retrying: %v", len(s.pending), s.route, s.config.Table, err)
+		s.metrics.AddSinkRowsFailed(int64(len(s.pending)))
+		if s.appender != nil {
+			s.closeLocked()
+		}
+		return
+	}
+	s.metrics.AddSinkRowsAppended(int64(len(s.pending)))
+	for _, row := range s.pending {
+		row.done()
+	}
+	s.pending = nil
+}
+
+func (s *machbaseSink) closeLocked() error {
+	_, fail, err := s.appender.Close()
+	s.release()
+	s.appender, s.release = nil, nil
+	if err == nil && fail > 0 {
+		err = fmt.Errorf("%d rows failed", fail)
+	}
+	return err
+}
+
+// Close flushes the pending rows and closes the appender
+func (s *machbaseSink) Close() error {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flushLocked()
+	if n := len(s.pending); n > 0 {
+		// the offsets are not marked, the messages are redelivered after the restart
+		s.pending = nil
+		return fmt.Errorf("machbase sink %s: %d rows are not stored", s.config.Table, n)
+	}
+	if s.appender == nil {
+		return nil
+	}
+	return s.closeLocked()
+}
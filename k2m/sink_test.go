@@ -0,0 +1,371 @@
+package k2m
+
+import (
+	"actsvr/util"
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/machbase/neo-server/v8/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAppender records the appended and flushed rows
+type fakeAppender struct {
+	mu       sync.Mutex
+	columns  api.Columns
+	rows     [][]any
+	flushed  [][]any
+	flushErr error
+	closed   bool
+}
+
+func (a *fakeAppender) TableName() string { return "TAG" }
+func (a *fakeAppender) Append(values ...any) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rows = append(a.rows, values)
+	return nil
+}
+func (a *fakeAppender) AppendLogTime(ts time.Time, values ...any) error { return a.Append(values...) }
+func (a *fakeAppender) Close() (int64, int64, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.closed = true
+	return int64(len(a.flushed)), 0, nil
+}
+func (a *fakeAppender) Columns() (api.Columns, error)                   { return a.columns, nil }
+func (a *fakeAppender) TableType() api.TableType                        { return api.TableTypeTag }
+func (a *fakeAppender) WithInputColumns(columns ...string) api.Appender { return a }
+func (a *fakeAppender) Flush() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.flushErr != nil {
+		a.rows = nil
+		return a.flushErr
+	}
+	a.flushed = append(a.flushed, a.rows...)
+	a.rows = nil
+	return nil
+}
+
+func (a *fakeAppender) Flushed() [][]any {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([][]any(nil), a.flushed...)
+}
+
+func tagColumns() api.Columns {
+	return api.Columns{
+		{Name: "NAME", Type: api.ColumnTypeVarchar},
+		{Name: "TIME", Type: api.ColumnTypeDatetime},
+		{Name: "VALUE", Type: api.ColumnTypeDouble},
+		{Name: "SEQ", Type: api.ColumnTypeLong},
+	}
+}
+
+func sinkRoute(batchSize int) RouteConfig {
+	return RouteConfig{
+		Name:    "tags",
+		Filters: []FilterConfig{},
+		Mapping: TopicMapping{KafkaTopic: "sensors"},
+		Sink: &SinkConfig{
+			Type: SinkTypeMachbase,
+			Machbase: &MachbaseSinkConfig{
+				Table: "TAG",
+				Columns: []SinkColumn{
+					{Column: "name", Field: "$key"},
+					{Column: "time", Field: "ts", Timeformat: "ms"},
+					{Column: "value", Field: "data.temperature"},
+				},
+				BatchSize:     batchSize,
+				FlushInterval: Duration(time.Hour),
+			},
+		},
+	}
+}
+
+// newSinkTestBroker creates a broker whose sink appends to the returned fake appender
+func newSinkTestBroker(t *testing.T, route RouteConfig) (*K2MBroker, *fakeAppender) {
+	config := DefaultConfig()
+	config.TopicMappings = nil
+	config.Routes = []RouteConfig{route}
+	broker, err := NewK2MBroker(config, util.NewLog(util.DefaultLogConfig()))
+	require.NoError(t, err)
+
+	appender := &fakeAppender{columns: tagColumns()}
+	s := broker.sinks[route.Name].(*machbaseSink)
+	s.dial = func(ctx context.Context) (api.Appender, func(), error) {
+		return appender, func() {}, nil
+	}
+	require.NoError(t, s.Open(context.Background()))
+	t.Cleanup(func() { s.Close() })
+	return broker, appender
+}
+
+func TestMachbaseSinkColumnMapping(t *testing.T) {
+	broker, appender := newSinkTestBroker(t, sinkRoute(1))
+	s := broker.sinks["tags"]
+
+	done := make(chan struct{})
+	err := s.Write(&sarama.ConsumerMessage{
+		Topic: "sensors",
+		Key:   []byte("dev-1"),
+		Value: []byte(`{"ts":1700000000123,"data":{"temperature":21.5}}`),
+	}, func() { close(done) })
+	require.NoError(t, err)
+	<-done
+
+	rows := appender.Flushed()
+	require.Len(t, rows, 1)
+	assert.Equal(t, []any{"dev-1", int64(1700000000123) * int64(time.Millisecond), 21.5, nil}, rows[0])
+
+	err = s.Write(&sarama.ConsumerMessage{Topic: "sensors", Value: []byte(`not json`)}, func() {})
+	assert.ErrorContains(t, err, "payload is not valid JSON")
+
+	err = s.Write(&sarama.ConsumerMessage{Topic: "sensors", Value: []byte(`{"ts":"yesterday"}`)}, func() {})
+	assert.ErrorContains(t, err, "column TIME")
+}
+
+func TestMachbaseSinkTimeformat(t *testing.T) {
+	s, err := newMachbaseSink("tags", &MachbaseSinkConfig{Timezone: "UTC"}, nil, nil)
+	require.NoError(t, err)
+
+	tests := []struct {
+		value      any
+		timeformat string
+		expected   int64
+	}{
+		{json.Number("1700000000"), "s", 1700000000 * int64(time.Second)},
+		{"1700000000000000", "us", 1700000000000000 * int64(time.Microsecond)},
+		{json.Number("1700000000000000000"), "", 1700000000000000000},
+		{"2023-11-14T22:13:20Z", "", 1700000000 * int64(time.Second)},
+		{"2023-11-14 22:13:20", "2006-01-02 15:04:05", 1700000000 * int64(time.Second)},
+		{time.Unix(1700000000, 0), "ms", 1700000000 * int64(time.Second)},
+	}
+	for _, tt := range tests {
+		ts, err := s.convertTime(tt.value, tt.timeformat)
+		require.NoError(t, err, "%v %s", tt.value, tt.timeformat)
+		assert.Equal(t, tt.expected, ts, "%v %s", tt.value, tt.timeformat)
+	}
+}
+
+// markingSession records the offsets marked by the broker
+type markingSession struct {
+	MockConsumerGroupSession
+	mu     sync.Mutex
+	marked map[int32]int64
+}
+
+func (m *markingSession) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.marked == nil {
+		m.marked = make(map[int32]int64)
+	}
+	m.marked[msg.Partition] = msg.Offset + 1
+}
+
+func (m *markingSession) Marked(partition int32) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.marked[partition]
+}
+
+func TestSinkCommitAfterAppend(t *testing.T) {
+	broker, appender := newSinkTestBroker(t, sinkRoute(2))
+	session := &markingSession{}
+	consumer := &Consumer{ready: make(chan bool), broker: broker, source: broker.sources[0]}
+	require.NoError(t, consumer.Setup(session))
+	worker := &MessageWorker{id: 1, broker: broker, messageCh: broker.messageCh}
+
+	send := func(offset int64) {
+		msg := &sarama.ConsumerMessage{Topic: "sensors", Offset: offset, Key: []byte("dev-1"), Value: []byte(`{"ts":1,"data":{"temperature":1}}`)}
+		broker.sources[0].offsets.Add(msg)
+		worker.processMessage(msg)
+	}
+
+	send(0)
+	assert.Empty(t, appender.Flushed())
+	assert.Equal(t, int64(0), session.Marked(0), "offset is not marked before the batch is appended")
+
+	send(1)
+	assert.Len(t, appender.Flushed(), 2)
+	assert.Equal(t, int64(2), session.Marked(0))
+	assert.Equal(t, 0, broker.sources[0].offsets.Pending())
+
+	metrics := broker.GetMetrics()
+	assert.Equal(t, int64(2), metrics.SinkRowsAppended)
+	assert.Equal(t, int64(1), metrics.SinkFlushes)
+	assert.Equal(t, int64(0), metrics.MessagesPublished)
+}
+
+func TestSinkFlushError(t *testing.T) {
+	broker, appender := newSinkTestBroker(t, sinkRoute(1))
+	appender.mu.Lock()
+	appender.flushErr = errors.New("disk full")
+	appender.mu.Unlock()
+	session := &markingSession{}
+	broker.sources[0].offsets.Reset(session)
+	worker := &MessageWorker{id: 1, broker: broker, messageCh: broker.messageCh}
+
+	msg := &sarama.ConsumerMessage{Topic: "sensors", Offset: 7, Key: []byte("dev-1"), Value: []byte(`{"ts":1}`)}
+	broker.sources[0].offsets.Add(msg)
+	worker.processMessage(msg)
+
+	metrics := broker.GetMetrics()
+	assert.Equal(t, int64(1), metrics.SinkRowsFailed)
+	assert.Empty(t, appender.Flushed())
+	assert.Equal(t, int64(0), session.Marked(0), "the offset of a row that is not stored is not marked")
+	assert.Equal(t, 1, broker.sources[0].offsets.Pending())
+
+	// the next flush appends the row again to a new appender
+	appender.mu.Lock()
+	appender.flushErr = nil
+	appender.mu.Unlock()
+	s := broker.sinks["tags"].(*machbaseSink)
+	s.mu.Lock()
+	s.flushLocked()
+	s.mu.Unlock()
+	rows := appender.Flushed()
+	require.Len(t, rows, 1)
+	assert.Equal(t, "dev-1", rows[0][0])
+	assert.Equal(t, int64(8), session.Marked(0))
+	assert.Equal(t, 0, broker.sources[0].offsets.Pending())
+}
+
+// pausingGroup records the partitions paused by the broker
+type pausingGroup struct {
+	sarama.ConsumerGroup
+	mu     sync.Mutex
+	paused map[string][]int32
+}
+
+func (g *pausingGroup) Pause(partitions map[string][]int32) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.paused = partitions
+}
+
+func (g *pausingGroup) Resume(partitions map[string][]int32) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.paused = nil
+}
+
+func (g *pausingGroup) Paused() map[string][]int32 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.paused
+}
+
+func TestSinkUnavailable(t *testing.T) {
+	backoff := sinkRetryBackoff
+	sinkRetryBackoff = 10 * time.Millisecond
+	defer func() { sinkRetryBackoff = backoff }()
+
+	broker, appender := newSinkTestBroker(t, sinkRoute(1))
+	t.Cleanup(broker.cancel)
+	group := &pausingGroup{}
+	broker.sources[0].consumerGroup = group
+	session := &markingSession{}
+	broker.sources[0].offsets.Reset(session)
+	worker := &MessageWorker{id: 1, broker: broker, messageCh: broker.messageCh}
+
+	var down atomic.Bool
+	down.Store(true)
+	s := broker.sinks["tags"].(*machbaseSink)
+	s.mu.Lock()
+	s.closeLocked()
+	s.dial = func(ctx context.Context) (api.Appender, func(), error) {
+		if down.Load() {
+			return nil, nil, errors.New("connection refused")
+		}
+		return appender, func() {}, nil
+	}
+	s.mu.Unlock()
+
+	for offset := int64(3); offset < 5; offset++ {
+		msg := &sarama.ConsumerMessage{Topic: "sensors", Offset: offset, Key: []byte("dev-1"), Value: []byte(`{"ts":1}`)}
+		broker.sources[0].offsets.Add(msg)
+		worker.processMessage(msg)
+	}
+
+	// nothing is committed during the outage, and the partition is paused
+	assert.Equal(t, int64(2), broker.GetMetrics().MessagesFailed)
+	assert.Equal(t, map[string][]int32{"sensors": {0}}, group.Paused())
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int64(0), session.Marked(0), "the offsets are not committed while the sink is unavailable")
+	assert.Equal(t, 2, broker.sources[0].offsets.Pending())
+
+	// the retries store the messages once the database is back, then the partition is resumed
+	down.Store(false)
+	assert.Eventually(t, func() bool { return session.Marked(0) == 5 }, time.Second, 10*time.Millisecond)
+	assert.Len(t, appender.Flushed(), 2)
+	assert.Eventually(t, func() bool { return group.Paused() == nil }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 0, broker.sources[0].offsets.Pending())
+}
+
+func TestOffsetTrackerOutOfOrder(t *testing.T) {
+	session := &markingSession{}
+	tracker := newOffsetTracker()
+	tracker.Reset(session)
+
+	msgs := make([]*sarama.ConsumerMessage, 4)
+	for i := range msgs {
+		msgs[i] = &sarama.ConsumerMessage{Topic: "t", Partition: 1, Offset: int64(10 + i)}
+		tracker.Add(msgs[i])
+	}
+
+	tracker.Done(msgs[1])
+	tracker.Done(msgs[3])
+	assert.Equal(t, int64(0), session.Marked(1), "the first message is still in flight")
+
+	tracker.Done(msgs[0])
+	assert.Equal(t, int64(12), session.Marked(1))
+
+	// a redelivered message of a new session does not complete the old one
+	tracker.Done(&sarama.ConsumerMessage{Topic: "t", Partition: 1, Offset: 12})
+	assert.Equal(t, int64(12), session.Marked(1))
+
+	tracker.Done(msgs[2])
+	assert.Equal(t, int64(14), session.Marked(1))
+	assert.Equal(t, 0, tracker.Pending())
+}
+
+func TestValidateRouteConfigSink(t *testing.T) {
+	route := sinkRoute(0)
+	assert.NoError(t, ValidateRouteConfig([]RouteConfig{route}))
+
+	route.Sink = &SinkConfig{Type: "postgres"}
+	assert.ErrorContains(t, ValidateRouteConfig([]RouteConfig{route}), "unknown sink type")
+
+	route.Sink = &SinkConfig{Type: SinkTypeMachbase, Machbase: &MachbaseSinkConfig{Columns: []SinkColumn{{Column: "NAME", Field: "$key"}}}}
+	assert.ErrorContains(t, ValidateRouteConfig([]RouteConfig{route}), "table cannot be empty")
+
+	route.Sink.Machbase.Table = "TAG"
+	route.Sink.Machbase.Columns = []SinkColumn{{Column: "NAME"}}
+	assert.ErrorContains(t, ValidateRouteConfig([]RouteConfig{route}), "column and field are required")
+}
+
+func TestMachbaseSinkUnknownColumn(t *testing.T) {
+	route := sinkRoute(1)
+	route.Sink.Machbase.Columns = append(route.Sink.Machbase.Columns, SinkColumn{Column: "missing", Field: "x"})
+	config := DefaultConfig()
+	config.TopicMappings = nil
+	config.Routes = []RouteConfig{route}
+	broker, err := NewK2MBroker(config, util.NewLog(util.DefaultLogConfig()))
+	require.NoError(t, err)
+
+	s := broker.sinks["tags"].(*machbaseSink)
+	s.dial = func(ctx context.Context) (api.Appender, func(), error) {
+		return &fakeAppender{columns: tagColumns()}, func() {}, nil
+	}
+	assert.ErrorContains(t, s.Open(context.Background()), "column MISSING not found")
+}
@@ -0,0 +1,257 @@
+package k2m
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// KafkaSecurityConfig holds the TLS and SASL settings of a Kafka cluster
+type KafkaSecurityConfig struct {
+	TLS  *KafkaTLSConfig  `json:"tls,omitempty"`
+	SASL *KafkaSASLConfig `json:"sasl,omitempty"`
+}
+
+// KafkaTLSConfig enables TLS to the Kafka brokers
+type KafkaTLSConfig struct {
+	CAFile             string `json:"caFile,omitempty"`
+	CertFile           string `json:"certFile,omitempty"`
+	KeyFile            string `json:"keyFile,omitempty"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty"`
+}
+
+// KafkaSASLConfig enables SASL authentication, only the PLAIN mechanism is supported
+type KafkaSASLConfig struct {
+	Mechanism string `json:"mechanism,omitempty"` // "PLAIN" (default)
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+}
+
+// DefaultSourceName is the name of the source of the top-level kafka configuration
+const DefaultSourceName = "default"
+
+// kafkaSource is a Kafka cluster the broker consumes from
+type kafkaSource struct {
+	name          string
+	config        KafkaConfig
+	consumerGroup sarama.ConsumerGroup
+	consumer      *Consumer
+	offsets       *offsetTracker
+
+	lagMu sync.Mutex
+	lag   map[topicPartition]int64
+
+	pauseMu sync.Mutex
+	paused  map[topicPartition]int // number of the pause calls of a partition not resumed yet
+}
+
+func newKafkaSource(name string, config KafkaConfig) *kafkaSource {
+	return &kafkaSource{
+		name:    name,
+		config:  config,
+		offsets: newOffsetTracker(),
+		lag:     make(map[topicPartition]int64),
+		paused:  make(map[topicPartition]int),
+	}
+}
+
+// newKafkaSources returns the sources of the configuration: the named sources,
+// or the top-level kafka configuration as the default source.
+// Durations and flags left unset in a source are taken from the top-level configuration.
+func newKafkaSources(config *K2MConfig) ([]*kafkaSource, error) {
+	if len(config.Sources) == 0 {
+		name := config.KafkaConfig.Name
+		if name == "" {
+			name = DefaultSourceName
+		}
+		return []*kafkaSource{newKafkaSource(name, config.KafkaConfig)}, nil
+	}
+
+	sources := make([]*kafkaSource, 0, len(config.Sources))
+	names := make(map[string]bool)
+	for i, cfg := range config.Sources {
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("source %d: name cannot be empty", i)
+		}
+		if names[cfg.Name] {
+			return nil, fmt.Errorf("duplicate source name: %s", cfg.Name)
+		}
+		names[cfg.Name] = true
+		if len(cfg.Brokers) == 0 {
+			return nil, fmt.Errorf("source %s: brokers cannot be empty", cfg.Name)
+		}
+		if len(cfg.Topics) == 0 {
+			return nil, fmt.Errorf("source %s: topics cannot be empty", cfg.Name)
+		}
+		if cfg.ConsumerGroup == "" {
+			cfg.ConsumerGroup = config.KafkaConfig.ConsumerGroup
+		}
+		if cfg.SessionTimeout == 0 {
+			cfg.SessionTimeout = config.KafkaConfig.SessionTimeout
+		}
+		if cfg.HeartbeatInterval == 0 {
+			cfg.HeartbeatInterval = config.KafkaConfig.HeartbeatInterval
+		}
+		if err := validateKafkaSecurity(cfg.Security); err != nil {
+			return nil, fmt.Errorf("source %s: %w", cfg.Name, err)
+		}
+		sources = append(sources, newKafkaSource(cfg.Name, cfg))
+	}
+	return sources, nil
+}
+
+func validateKafkaSecurity(cfg *KafkaSecurityConfig) error {
+	if cfg == nil || cfg.SASL == nil {
+		return nil
+	}
+	switch cfg.SASL.Mechanism {
+	case "", sarama.SASLTypePlaintext:
+	default:
+		return fmt.Errorf("unsupported sasl mechanism: %s", cfg.SASL.Mechanism)
+	}
+	if cfg.SASL.Username == "" {
+		return fmt.Errorf("sasl username cannot be empty")
+	}
+	return nil
+}
+
+// saramaConfig returns the consumer group configuration of the source
+func (s *kafkaSource) saramaConfig() (*sarama.Config, error) {
+	config := sarama.NewConfig()
+	config.Version = sarama.V2_6_0_0
+	config.ClientID = "k2m-" + s.name
+	config.Consumer.Group.Session.Timeout = time.Duration(s.config.SessionTimeout)
+	config.Consumer.Group.Heartbeat.Interval = time.Duration(s.config.HeartbeatInterval)
+	config.Consumer.Return.Errors = s.config.ReturnErrors
+
+	if s.config.OffsetOldest {
+		config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	}
+
+	security := s.config.Security
+	if security == nil {
+		return config, nil
+	}
+	if security.TLS != nil {
+		tlsConfig, err := kafkaTLSConfig(security.TLS)
+		if err != nil {
+			return nil, err
+		}
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsConfig
+	}
+	if security.SASL != nil {
+		config.Net.SASL.Enable = true
+		config.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+		config.Net.SASL.User = security.SASL.Username
+		config.Net.SASL.Password = security.SASL.Password
+	}
+	return config, nil
+}
+
+func kafkaTLSConfig(cfg *KafkaTLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+	if cfg.CAFile != "" {
+		ca, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read kafka CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("invalid kafka CA file %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load kafka client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// recordLag updates the lag of the partition of the message and returns the lag of the source
+func (s *kafkaSource) recordLag(message *sarama.ConsumerMessage, highWaterMark int64) int64 {
+	s.lagMu.Lock()
+	defer s.lagMu.Unlock()
+	lag := highWaterMark - message.Offset - 1
+	if lag < 0 {
+		lag = 0
+	}
+	s.lag[topicPartition{message.Topic, message.Partition}] = lag
+	var total int64
+	for _, n := range s.lag {
+		total += n
+	}
+	return total
+}
+
+// pause stops fetching the partition of the message until every pause of the partition is resumed
+func (s *kafkaSource) pause(message *sarama.ConsumerMessage) {
+	s.pauseMu.Lock()
+	defer s.pauseMu.Unlock()
+	tp := topicPartition{message.Topic, message.Partition}
+	s.paused[tp]++
+	if s.paused[tp] == 1 && s.consumerGroup != nil {
+		s.consumerGroup.Pause(map[string][]int32{tp.topic: {tp.partition}})
+	}
+}
+
+// resume undoes a pause of the partition of the message
+func (s *kafkaSource) resume(message *sarama.ConsumerMessage) {
+	s.pauseMu.Lock()
+	defer s.pauseMu.Unlock()
+	tp := topicPartition{message.Topic, message.Partition}
+	if s.paused[tp]--; s.paused[tp] > 0 {
+		return
+	}
+	delete(s.paused, tp)
+	if s.consumerGroup != nil {
+		s.consumerGroup.Resume(map[string][]int32{tp.topic: {tp.partition}})
+	}
+}
+
+// SourceFilter filters messages based on the name of the Kafka source they were consumed from
+type SourceFilter struct {
+	name    string
+	pattern *regexp.Regexp
+}
+
+func createSourceFilter(config map[string]interface{}) (*SourceFilter, error) {
+	patternStr, ok := config["pattern"].(string)
+	if !ok {
+		return nil, fmt.Errorf("source filter requires 'pattern' field")
+	}
+
+	pattern, err := regexp.Compile(patternStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern in source filter: %w", err)
+	}
+
+	return &SourceFilter{
+		name:    "source_filter",
+		pattern: pattern,
+	}, nil
+}
+
+// ShouldProcess matches messages of the default source, the router uses MatchSource
+func (sf *SourceFilter) ShouldProcess(message *sarama.ConsumerMessage) bool {
+	return sf.MatchSource(DefaultSourceName)
+}
+
+// MatchSource returns true if the source name matches the pattern
+func (sf *SourceFilter) MatchSource(source string) bool {
+	return sf.pattern.MatchString(source)
+}
+
+func (sf *SourceFilter) GetName() string {
+	return sf.name
+}
@@ -0,0 +1,122 @@
+package k2m
+
+import (
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKafkaSources(t *testing.T) {
+	config := DefaultConfig()
+	sources, err := newKafkaSources(config)
+	require.NoError(t, err)
+	require.Len(t, sources, 1)
+	assert.Equal(t, DefaultSourceName, sources[0].name)
+	assert.Equal(t, config.KafkaConfig.Topics, sources[0].config.Topics)
+
+	config.Sources = []KafkaConfig{
+		{Name: "plant-a", Brokers: []string{"a:9092"}, Topics: []string{"sensors"}},
+		{
+			Name:           "plant-b",
+			Brokers:        []string{"b:9093"},
+			Topics:         []string{"sensors"},
+			ConsumerGroup:  "plant-b",
+			SessionTimeout: Duration(30 * time.Second),
+			Security: &KafkaSecurityConfig{
+				TLS:  &KafkaTLSConfig{InsecureSkipVerify: true},
+				SASL: &KafkaSASLConfig{Username: "k2m", Password: "secret"},
+			},
+		},
+	}
+	sources, err = newKafkaSources(config)
+	require.NoError(t, err)
+	require.Len(t, sources, 2)
+	// unset settings are taken from the kafka configuration
+	assert.Equal(t, config.KafkaConfig.ConsumerGroup, sources[0].config.ConsumerGroup)
+	assert.Equal(t, config.KafkaConfig.SessionTimeout, sources[0].config.SessionTimeout)
+	assert.Equal(t, "plant-b", sources[1].config.ConsumerGroup)
+	assert.Equal(t, Duration(30*time.Second), sources[1].config.SessionTimeout)
+
+	saramaConfig, err := sources[1].saramaConfig()
+	require.NoError(t, err)
+	assert.True(t, saramaConfig.Net.TLS.Enable)
+	assert.True(t, saramaConfig.Net.TLS.Config.InsecureSkipVerify)
+	assert.True(t, saramaConfig.Net.SASL.Enable)
+	assert.Equal(t, "k2m", saramaConfig.Net.SASL.User)
+	assert.Equal(t, "k2m-plant-b", saramaConfig.ClientID)
+
+	invalid := []struct {
+		source KafkaConfig
+		err    string
+	}{
+		{KafkaConfig{Brokers: []string{"a:9092"}, Topics: []string{"t"}}, "name cannot be empty"},
+		{KafkaConfig{Name: "plant-a", Topics: []string{"t"}}, "brokers cannot be empty"},
+		{KafkaConfig{Name: "plant-a", Brokers: []string{"a:9092"}}, "topics cannot be empty"},
+		{KafkaConfig{Name: "plant-a", Brokers: []string{"a:9092"}, Topics: []string{"t"},
+			Security: &KafkaSecurityConfig{SASL: &KafkaSASLConfig{Mechanism: "GSSAPI", Username: "k2m"}}}, "unsupported sasl mechanism"},
+	}
+	for _, tt := range invalid {
+		config.Sources = []KafkaConfig{tt.source}
+		_, err := newKafkaSources(config)
+		assert.ErrorContains(t, err, tt.err)
+	}
+	config.Sources = []KafkaConfig{config.Sources[0], config.Sources[0]}
+	config.Sources[0].Name, config.Sources[1].Name = "plant-a", "plant-a"
+	config.Sources[0].Security, config.Sources[1].Security = nil, nil
+	_, err = newKafkaSources(config)
+	assert.ErrorContains(t, err, "duplicate source name")
+}
+
+func TestSourceRouting(t *testing.T) {
+	router, err := NewMessageRouter([]RouteConfig{
+		{
+			Name:     "plant-a",
+			Priority: 10,
+			Filters:  []FilterConfig{{Type: "source", Config: map[string]interface{}{"pattern": "^plant-a$"}}},
+			Mapping:  TopicMapping{KafkaTopic: "{kafkaTopic}", MQTTTopic: "a/{key}"},
+		},
+		{
+			Name:    "others",
+			Mapping: TopicMapping{KafkaTopic: "{kafkaTopic}", MQTTTopic: "{source}/{key}"},
+		},
+	})
+	require.NoError(t, err)
+
+	message := &sarama.ConsumerMessage{Topic: "sensors", Key: []byte("dev-1")}
+	assert.Equal(t, "plant-a", router.FindSourceRoute("plant-a", message).Name)
+	assert.Equal(t, "others", router.FindSourceRoute("plant-b", message).Name)
+	assert.Equal(t, "others", router.FindRoute(message).Name)
+
+	route, results := router.FindSourceRouteExplain("plant-b", message)
+	assert.Equal(t, "others", route.Name)
+	require.Len(t, results, 1)
+	assert.Equal(t, FilterResult{Route: "plant-a", Filter: "source_filter", Type: "source", Matched: false}, results[0])
+
+	worker := &MessageWorker{}
+	assert.Equal(t, "plant-b/dev-1", worker.resolveSourceTopic(route.Mapping.MQTTTopic, "plant-b", message))
+
+	_, err = NewMessageRouter([]RouteConfig{{
+		Name:    "invalid",
+		Filters: []FilterConfig{{Type: "source", Config: map[string]interface{}{}}},
+	}})
+	assert.ErrorContains(t, err, "source filter requires 'pattern' field")
+}
+
+func TestSourceLag(t *testing.T) {
+	src := newKafkaSource("plant-a", KafkaConfig{})
+	assert.Equal(t, int64(9), src.recordLag(&sarama.ConsumerMessage{Topic: "t", Partition: 0, Offset: 0}, 10))
+	assert.Equal(t, int64(14), src.recordLag(&sarama.ConsumerMessage{Topic: "t", Partition: 1, Offset: 4}, 10))
+	assert.Equal(t, int64(5), src.recordLag(&sarama.ConsumerMessage{Topic: "t", Partition: 0, Offset: 9}, 10))
+
+	metrics := NewMetrics()
+	metrics.SetSourceConnected("plant-a", true)
+	metrics.SetSourceConnected("plant-b", true)
+	assert.True(t, metrics.KafkaConnected)
+	metrics.SetSourceConnected("plant-b", false)
+	assert.False(t, metrics.KafkaConnected, "kafka is connected when all sources are")
+	metrics.SetSourceLag("plant-a", 5)
+	assert.Equal(t, int64(5), metrics.GetSnapshot().Sources["plant-a"].Lag)
+}
@@ -0,0 +1,525 @@
+package k2m
+
+import (
+	"actsvr/k2m/sparkplug"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"google.golang.org/protobuf/proto"
+)
+
+// SparkplugConfig is the Sparkplug B edge node identity of the broker
+type SparkplugConfig struct {
+	GroupID    string `json:"groupId"`
+	EdgeNodeID string `json:"edgeNodeId"`
+}
+
+// SparkplugMapping maps JSON Kafka records to the Sparkplug B metrics of a device
+type SparkplugMapping struct {
+	// DeviceID is the device of the messages, supports the topic templates, e.g. "{key}"
+	DeviceID string `json:"deviceId"`
+	// Metrics maps JSON fields to metrics. When empty, every scalar field of the payload
+	// is a metric, nested objects are flattened to "parent/child" metric names.
+	Metrics []SparkplugMetric `json:"metrics,omitempty"`
+}
+
+// SparkplugMetric maps a JSON field to a Sparkplug B metric
+type SparkplugMetric struct {
+	Name string `json:"name"`
+	// Field is the dotted path of the JSON field, the metric name by default
+	Field string `json:"field,omitempty"`
+	// DataType is a Sparkplug B data type, e.g. "Int32", "Double", "Boolean", "String".
+	// It is inferred from the JSON value by default.
+	DataType string `json:"dataType,omitempty"`
+}
+
+const (
+	TransformSparkplug = "sparkplug"
+
+	TopicModeTemplate  = "template"
+	TopicModeSparkplug = "sparkplug"
+
+	sparkplugNamespace = "spBv1.0"
+	sparkplugRebirth   = "Node Control/Rebirth"
+)
+
+// validateSparkplugMapping checks the Sparkplug B settings of a topic mapping
+func validateSparkplugMapping(mapping *TopicMapping) error {
+	switch mapping.TopicMode {
+	case "", TopicModeTemplate:
+	case TopicModeSparkplug:
+		if mapping.Transform != TransformSparkplug {
+			return fmt.Errorf("topicMode %q requires transform %q", TopicModeSparkplug, TransformSparkplug)
+		}
+	default:
+		return fmt.Errorf("unknown topicMode: %s", mapping.TopicMode)
+	}
+	if mapping.Transform != TransformSparkplug {
+		return nil
+	}
+	if mapping.Sparkplug == nil || mapping.Sparkplug.DeviceID == "" {
+		return fmt.Errorf("sparkplug deviceId is required")
+	}
+	for _, m := range mapping.Sparkplug.Metrics {
+		if m.Name == "" {
+			return fmt.Errorf("sparkplug metric name cannot be empty")
+		}
+		if m.DataType == "" {
+			continue
+		}
+		if _, ok := sparkplug.DataType_value[m.DataType]; !ok {
+			return fmt.Errorf("sparkplug metric %s: unknown dataType %s", m.Name, m.DataType)
+		}
+	}
+	return nil
+}
+
+// sparkplugNode is the Sparkplug B edge node session of the broker.
+// It publishes the birth certificates, keeps the sequence numbers
+// and provides the death certificate used as MQTT last will.
+type sparkplugNode struct {
+	groupID    string
+	edgeNodeID string
+	now        func() time.Time
+
+	mu        sync.Mutex
+	bdSeq     int64 // birth/death sequence of the current connection
+	nextBdSeq int64
+	seq       uint64
+	online    bool // NBIRTH is published in the current session
+	// last metrics of every device, published again in DBIRTH on rebirth
+	devices map[string]map[string]*sparkplug.Payload_Metric
+	born    map[string]bool
+}
+
+func newSparkplugNode(cfg *SparkplugConfig) (*sparkplugNode, error) {
+	if cfg == nil || cfg.GroupID == "" || cfg.EdgeNodeID == "" {
+		return nil, fmt.Errorf("sparkplug groupId and edgeNodeId are required")
+	}
+	for _, id := range []string{cfg.GroupID, cfg.EdgeNodeID} {
+		if strings.ContainsAny(id, "/+#") {
+			return nil, fmt.Errorf("invalid sparkplug id %q", id)
+		}
+	}
+	return &sparkplugNode{
+		groupID:    cfg.GroupID,
+		edgeNodeID: cfg.EdgeNodeID,
+		now:        time.Now,
+		devices:    make(map[string]map[string]*sparkplug.Payload_Metric),
+		born:       make(map[string]bool),
+	}, nil
+}
+
+// topic returns the topic of the message type, e.g. spBv1.0/group/DDATA/edge/device
+func (n *sparkplugNode) topic(messageType, deviceID string) string {
+	topic := fmt.Sprintf("%s/%s/%s/%s", sparkplugNamespace, n.groupID, messageType, n.edgeNodeID)
+	if deviceID != "" {
+		topic += "/" + deviceID
+	}
+	return topic
+}
+
+// Will starts a new session and returns its NDEATH certificate,
+// which must be the last will of the MQTT connection.
+func (n *sparkplugNode) Will() (string, []byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.bdSeq = n.nextBdSeq
+	n.nextBdSeq = (n.nextBdSeq + 1) % 256
+	n.online = false
+	return n.topic("NDEATH", ""), n.deathLocked()
+}
+
+// Death publishes the NDEATH certificate of the current session before a clean disconnect,
+// the broker does not send the last will in that case.
+func (n *sparkplugNode) Death(client mqtt.Client) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.online = false
+	token := client.Publish(n.topic("NDEATH", ""), 1, false, n.deathLocked())
+	if !token.WaitTimeout(publishTimeout) {
+		return fmt.Errorf("publish timeout for NDEATH")
+	}
+	return token.Error()
+}
+
+func (n *sparkplugNode) deathLocked() []byte {
+	payload := &sparkplug.Payload{
+		Timestamp: proto.Uint64(n.timestamp()),
+		Metrics:   []*sparkplug.Payload_Metric{n.bdSeqMetric()},
+	}
+	b, _ := proto.Marshal(payload)
+	return b
+}
+
+func (n *sparkplugNode) bdSeqMetric() *sparkplug.Payload_Metric {
+	return &sparkplug.Payload_Metric{
+		Name:     proto.String("bdSeq"),
+		Datatype: proto.Uint32(uint32(sparkplug.DataType_Int64)),
+		Value:    &sparkplug.Payload_Metric_LongValue{LongValue: uint64(n.bdSeq)},
+	}
+}
+
+func (n *sparkplugNode) timestamp() uint64 {
+	return uint64(n.now().UnixMilli())
+}
+
+// Birth publishes the NBIRTH certificate, which resets the sequence number,
+// followed by the DBIRTH certificates of the known devices.
+// It does nothing if the node is already born in the current session.
+func (n *sparkplugNode) Birth(client mqtt.Client) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.online {
+		return nil
+	}
+	return n.birthLocked(client)
+}
+
+func (n *sparkplugNode) birthLocked(client mqtt.Client) error {
+	n.seq = 0
+	n.born = make(map[string]bool)
+	nbirth := &sparkplug.Payload{
+		Timestamp: proto.Uint64(n.timestamp()),
+		Seq:       proto.Uint64(0),
+		Metrics: []*sparkplug.Payload_Metric{
+			n.bdSeqMetric(),
+			{
+				Name:     proto.String(sparkplugRebirth),
+				Datatype: proto.Uint32(uint32(sparkplug.DataType_Boolean)),
+				Value:    &sparkplug.Payload_Metric_BooleanValue{BooleanValue: false},
+			},
+		},
+	}
+	if err := n.publishLocked(client, "NBIRTH", "", nbirth); err != nil {
+		return err
+	}
+	n.online = true
+
+	devices := make([]string, 0, len(n.devices))
+	for device := range n.devices {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+	for _, device := range devices {
+		if err := n.deviceBirthLocked(client, device); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HandleCommand publishes the birth certificates again when the host application
+// requests a rebirth with an NCMD message.
+func (n *sparkplugNode) HandleCommand(client mqtt.Client, msg mqtt.Message) error {
+	var payload sparkplug.Payload
+	if err := proto.Unmarshal(msg.Payload(), &payload); err != nil {
+		return fmt.Errorf("invalid NCMD payload: %w", err)
+	}
+	for _, m := range payload.GetMetrics() {
+		if m.GetName() == sparkplugRebirth && m.GetBooleanValue() {
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			return n.birthLocked(client)
+		}
+	}
+	return nil
+}
+
+// CommandTopic is the NCMD topic of the edge node
+func (n *sparkplugNode) CommandTopic() string {
+	return n.topic("NCMD", "")
+}
+
+// deviceBirthLocked publishes the DBIRTH certificate of the device with its last metrics
+func (n *sparkplugNode) deviceBirthLocked(client mqtt.Client, device string) error {
+	known := n.devices[device]
+	names := make([]string, 0, len(known))
+	for name := range known {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	dbirth := &sparkplug.Payload{Timestamp: proto.Uint64(n.timestamp())}
+	for _, name := range names {
+		dbirth.Metrics = append(dbirth.Metrics, known[name])
+	}
+	if err := n.publishLocked(client, "DBIRTH", device, dbirth); err != nil {
+		return err
+	}
+	n.born[device] = true
+	return nil
+}
+
+// DataTopic is the DDATA topic of the device
+func (n *sparkplugNode) DataTopic(device string) string {
+	return n.topic("DDATA", device)
+}
+
+// PublishData publishes the metrics as DDATA of the device to the topic, preceded by
+// the NBIRTH if the node is not born yet and by a DBIRTH if the device is not born
+// in this session or reports a new metric.
+// It returns the encoded payload and the token of the DDATA message.
+func (n *sparkplugNode) PublishData(client mqtt.Client, topic, device string, metrics []*sparkplug.Payload_Metric) ([]byte, mqtt.Token, error) {
+	if device == "" || strings.ContainsAny(device, "/+#") {
+		return nil, nil, fmt.Errorf("invalid sparkplug device id %q", device)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.online {
+		if err := n.birthLocked(client); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	known, ok := n.devices[device]
+	if !ok {
+		known = make(map[string]*sparkplug.Payload_Metric)
+		n.devices[device] = known
+	}
+	rebirth := !n.born[device]
+	for _, m := range metrics {
+		if _, ok := known[m.GetName()]; !ok {
+			rebirth = true
+		}
+		known[m.GetName()] = m
+	}
+	if rebirth {
+		if err := n.deviceBirthLocked(client, device); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	ddata := &sparkplug.Payload{
+		Timestamp: proto.Uint64(n.timestamp()),
+		Metrics:   metrics,
+	}
+	return n.publishTopicLocked(client, topic, ddata)
+}
+
+// publishLocked publishes a message of the edge node with the next sequence number
+func (n *sparkplugNode) publishLocked(client mqtt.Client, messageType, device string, payload *sparkplug.Payload) error {
+	_, token, err := n.publishTopicLocked(client, n.topic(messageType, device), payload)
+	if err != nil {
+		return err
+	}
+	if !token.WaitTimeout(publishTimeout) {
+		return fmt.Errorf("publish timeout for %s", messageType)
+	}
+	return token.Error()
+}
+
+func (n *sparkplugNode) publishTopicLocked(client mqtt.Client, topic string, payload *sparkplug.Payload) ([]byte, mqtt.Token, error) {
+	if payload.Seq == nil {
+		n.seq = (n.seq + 1) % 256
+		payload.Seq = proto.Uint64(n.seq)
+	}
+	b, err := proto.Marshal(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	// birth and data messages are QoS 0 and not retained
+	return b, client.Publish(topic, 0, false, b), nil
+}
+
+// sparkplugMetrics converts the JSON payload of the message to Sparkplug B metrics
+func sparkplugMetrics(message *sarama.ConsumerMessage, mapping *SparkplugMapping) ([]*sparkplug.Payload_Metric, error) {
+	dec := json.NewDecoder(bytes.NewReader(message.Value))
+	dec.UseNumber()
+	var doc map[string]any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("sparkplug payload must be a JSON object: %w", err)
+	}
+
+	ts := uint64(message.Timestamp.UnixMilli())
+	if message.Timestamp.IsZero() {
+		ts = uint64(time.Now().UnixMilli())
+	}
+
+	var metrics []*sparkplug.Payload_Metric
+	add := func(name string, value any, dataType string) error {
+		m, err := newSparkplugMetric(name, value, dataType)
+		if err != nil {
+			return fmt.Errorf("metric %s: %w", name, err)
+		}
+		m.Timestamp = proto.Uint64(ts)
+		metrics = append(metrics, m)
+		return nil
+	}
+
+	if len(mapping.Metrics) > 0 {
+		for _, mc := range mapping.Metrics {
+			field := mc.Field
+			if field == "" {
+				field = mc.Name
+			}
+			var v any = doc
+			for _, name := range strings.Split(field, ".") {
+				obj, _ := v.(map[string]any)
+				v = obj[name]
+			}
+			if err := add(mc.Name, v, mc.DataType); err != nil {
+				return nil, err
+			}
+		}
+		return metrics, nil
+	}
+
+	// every scalar field is a metric, nested objects are folders
+	var flatten func(prefix string, obj map[string]any) error
+	flatten = func(prefix string, obj map[string]any) error {
+		names := make([]string, 0, len(obj))
+		for name := range obj {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			v := obj[name]
+			if child, ok := v.(map[string]any); ok {
+				if err := flatten(prefix+name+"/", child); err != nil {
+					return err
+				}
+				continue
+			}
+			if _, ok := v.([]any); ok {
+				continue // arrays are not mapped
+			}
+			if err := add(prefix+name, v, ""); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := flatten("", doc); err != nil {
+		return nil, err
+	}
+	return metrics, nil
+}
+
+// newSparkplugMetric creates the metric of a JSON value, inferring the data type if not given
+func newSparkplugMetric(name string, value any, dataType string) (*sparkplug.Payload_Metric, error) {
+	dt := sparkplug.DataType_Unknown
+	if dataType != "" {
+		dt = sparkplug.DataType(sparkplug.DataType_value[dataType])
+	} else {
+		switch v := value.(type) {
+		case json.Number:
+			if _, err := v.Int64(); err == nil {
+				dt = sparkplug.DataType_Int64
+			} else {
+				dt = sparkplug.DataType_Double
+			}
+		case bool:
+			dt = sparkplug.DataType_Boolean
+		case string:
+			dt = sparkplug.DataType_String
+		case nil:
+			dt = sparkplug.DataType_String
+		default:
+			return nil, fmt.Errorf("unsupported value %v", v)
+		}
+	}
+
+	m := &sparkplug.Payload_Metric{
+		Name:     proto.String(name),
+		Datatype: proto.Uint32(uint32(dt)),
+	}
+	if value == nil {
+		m.IsNull = proto.Bool(true)
+		return m, nil
+	}
+
+	switch dt {
+	case sparkplug.DataType_Int8, sparkplug.DataType_Int16, sparkplug.DataType_Int32,
+		sparkplug.DataType_UInt8, sparkplug.DataType_UInt16, sparkplug.DataType_UInt32:
+		n, err := sparkplugInt(value)
+		if err != nil {
+			return nil, err
+		}
+		m.Value = &sparkplug.Payload_Metric_IntValue{IntValue: uint32(n)}
+	case sparkplug.DataType_Int64, sparkplug.DataType_UInt64, sparkplug.DataType_DateTime:
+		n, err := sparkplugInt(value)
+		if err != nil {
+			return nil, err
+		}
+		m.Value = &sparkplug.Payload_Metric_LongValue{LongValue: uint64(n)}
+	case sparkplug.DataType_Float:
+		f, err := sparkplugFloat(value)
+		if err != nil {
+			return nil, err
+		}
+		m.Value = &sparkplug.Payload_Metric_FloatValue{FloatValue: float32(f)}
+	case sparkplug.DataType_Double:
+		f, err := sparkplugFloat(value)
+		if err != nil {
+			return nil, err
+		}
+		m.Value = &sparkplug.Payload_Metric_DoubleValue{DoubleValue: f}
+	case sparkplug.DataType_Boolean:
+		switch v := value.(type) {
+		case bool:
+			m.Value = &sparkplug.Payload_Metric_BooleanValue{BooleanValue: v}
+		case string:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, err
+			}
+			m.Value = &sparkplug.Payload_Metric_BooleanValue{BooleanValue: b}
+		default:
+			return nil, fmt.Errorf("not a boolean: %v", value)
+		}
+	case sparkplug.DataType_String, sparkplug.DataType_Text, sparkplug.DataType_UUID:
+		switch v := value.(type) {
+		case string:
+			m.Value = &sparkplug.Payload_Metric_StringValue{StringValue: v}
+		case json.Number:
+			m.Value = &sparkplug.Payload_Metric_StringValue{StringValue: v.String()}
+		default:
+			b, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			m.Value = &sparkplug.Payload_Metric_StringValue{StringValue: string(b)}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported dataType %s", dt)
+	}
+	return m, nil
+}
+
+func sparkplugInt(value any) (int64, error) {
+	switch v := value.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n, nil
+		}
+		f, err := v.Float64()
+		return int64(f), err
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, fmt.Errorf("not an integer: %v", value)
+}
+
+func sparkplugFloat(value any) (float64, error) {
+	switch v := value.(type) {
+	case json.Number:
+		return v.Float64()
+	case string:
+		return strconv.ParseFloat(v, 64)
+	}
+	return 0, fmt.Errorf("not a number: %v", value)
+}
@@ -0,0 +1,213 @@
+package k2m
+
+import (
+	"actsvr/k2m/sparkplug"
+	"actsvr/util"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+// sparkplugCommand is an NCMD message received from a host application
+type sparkplugCommand struct {
+	mqtt.Message
+	payload []byte
+}
+
+func (c *sparkplugCommand) Payload() []byte { return c.payload }
+
+func newSparkplugTestBroker(t *testing.T) (*K2MBroker, *MockMQTTClient, *MessageWorker) {
+	config := DefaultConfig()
+	config.TopicMappings = nil
+	config.Sparkplug = &SparkplugConfig{GroupID: "plant1", EdgeNodeID: "k2m"}
+	config.Routes = []RouteConfig{{
+		Name: "sparkplug",
+		Mapping: TopicMapping{
+			KafkaTopic: "sensors",
+			Transform:  TransformSparkplug,
+			TopicMode:  TopicModeSparkplug,
+			Sparkplug:  &SparkplugMapping{DeviceID: "{key}"},
+		},
+	}}
+	broker, err := NewK2MBroker(config, util.NewLog(util.DefaultLogConfig()))
+	require.NoError(t, err)
+	client := NewMockMQTTClient()
+	broker.mqttClient = client
+	worker := &MessageWorker{id: 1, broker: broker, messageCh: broker.messageCh}
+	return broker, client, worker
+}
+
+func decodeSparkplug(t *testing.T, msg MockMessage) *sparkplug.Payload {
+	var payload sparkplug.Payload
+	require.NoError(t, proto.Unmarshal(msg.Payload, &payload))
+	return &payload
+}
+
+func sparkplugMetricNames(payload *sparkplug.Payload) []string {
+	var names []string
+	for _, m := range payload.GetMetrics() {
+		names = append(names, m.GetName())
+	}
+	return names
+}
+
+func TestSparkplugMetrics(t *testing.T) {
+	ts := time.UnixMilli(1700000000123)
+	message := &sarama.ConsumerMessage{
+		Topic:     "sensors",
+		Timestamp: ts,
+		Value:     []byte(`{"temp":21.5,"count":3,"on":true,"name":"pump","motor":{"rpm":1200},"tags":[1]}`),
+	}
+
+	metrics, err := sparkplugMetrics(message, &SparkplugMapping{DeviceID: "d"})
+	require.NoError(t, err)
+	require.Len(t, metrics, 5, "arrays are not mapped")
+	byName := map[string]*sparkplug.Payload_Metric{}
+	for _, m := range metrics {
+		byName[m.GetName()] = m
+		assert.Equal(t, uint64(ts.UnixMilli()), m.GetTimestamp())
+	}
+	assert.Equal(t, uint32(sparkplug.DataType_Double), byName["temp"].GetDatatype())
+	assert.Equal(t, 21.5, byName["temp"].GetDoubleValue())
+	assert.Equal(t, uint32(sparkplug.DataType_Int64), byName["count"].GetDatatype())
+	assert.Equal(t, uint64(3), byName["count"].GetLongValue())
+	assert.True(t, byName["on"].GetBooleanValue())
+	assert.Equal(t, "pump", byName["name"].GetStringValue())
+	assert.Equal(t, uint64(1200), byName["motor/rpm"].GetLongValue())
+
+	// configured metrics select fields and data types
+	metrics, err = sparkplugMetrics(message, &SparkplugMapping{
+		DeviceID: "d",
+		Metrics: []SparkplugMetric{
+			{Name: "Temperature", Field: "temp", DataType: "Float"},
+			{Name: "RPM", Field: "motor.rpm", DataType: "Int32"},
+			{Name: "missing"},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, metrics, 3)
+	assert.Equal(t, float32(21.5), metrics[0].GetFloatValue())
+	assert.Equal(t, uint32(1200), metrics[1].GetIntValue())
+	assert.True(t, metrics[2].GetIsNull())
+
+	_, err = sparkplugMetrics(&sarama.ConsumerMessage{Value: []byte(`[1,2]`)}, &SparkplugMapping{DeviceID: "d"})
+	assert.ErrorContains(t, err, "JSON object")
+	_, err = sparkplugMetrics(message, &SparkplugMapping{
+		DeviceID: "d",
+		Metrics:  []SparkplugMetric{{Name: "name", DataType: "Double"}},
+	})
+	assert.Error(t, err)
+}
+
+func TestSparkplugSession(t *testing.T) {
+	broker, client, worker := newSparkplugTestBroker(t)
+	node := broker.sparkplug
+	require.NotNil(t, node)
+
+	willTopic, will := node.Will()
+	assert.Equal(t, "spBv1.0/plant1/NDEATH/k2m", willTopic)
+	var death sparkplug.Payload
+	require.NoError(t, proto.Unmarshal(will, &death))
+	assert.Equal(t, "bdSeq", death.GetMetrics()[0].GetName())
+	assert.Equal(t, uint64(0), death.GetMetrics()[0].GetLongValue())
+
+	require.NoError(t, node.Birth(client))
+	worker.processMessage(&sarama.ConsumerMessage{Topic: "sensors", Key: []byte("pump-1"), Value: []byte(`{"temp":20}`)})
+	worker.processMessage(&sarama.ConsumerMessage{Topic: "sensors", Key: []byte("pump-1"), Value: []byte(`{"temp":21}`)})
+	worker.processMessage(&sarama.ConsumerMessage{Topic: "sensors", Key: []byte("pump-1"), Value: []byte(`{"temp":22,"rpm":900}`)})
+
+	messages := client.GetMessages()
+	require.Len(t, messages, 6)
+	expected := []struct {
+		topic   string
+		seq     uint64
+		metrics []string
+	}{
+		{"spBv1.0/plant1/NBIRTH/k2m", 0, []string{"bdSeq", sparkplugRebirth}},
+		{"spBv1.0/plant1/DBIRTH/k2m/pump-1", 1, []string{"temp"}},
+		{"spBv1.0/plant1/DDATA/k2m/pump-1", 2, []string{"temp"}},
+		{"spBv1.0/plant1/DDATA/k2m/pump-1", 3, []string{"temp"}},
+		{"spBv1.0/plant1/DBIRTH/k2m/pump-1", 4, []string{"rpm", "temp"}},
+		{"spBv1.0/plant1/DDATA/k2m/pump-1", 5, []string{"rpm", "temp"}},
+	}
+	for i, e := range expected {
+		assert.Equal(t, e.topic, messages[i].Topic)
+		assert.Equal(t, byte(0), messages[i].QoS)
+		assert.False(t, messages[i].Retained)
+		payload := decodeSparkplug(t, messages[i])
+		assert.Equal(t, e.seq, payload.GetSeq(), messages[i].Topic)
+		assert.Equal(t, e.metrics, sparkplugMetricNames(payload), messages[i].Topic)
+	}
+
+	// a rebirth request publishes the births again with the last values
+	client.ClearMessages()
+	cmd, err := proto.Marshal(&sparkplug.Payload{Metrics: []*sparkplug.Payload_Metric{{
+		Name:  proto.String(sparkplugRebirth),
+		Value: &sparkplug.Payload_Metric_BooleanValue{BooleanValue: true},
+	}}})
+	require.NoError(t, err)
+	require.NoError(t, node.HandleCommand(client, &sparkplugCommand{payload: cmd}))
+	messages = client.GetMessages()
+	require.Len(t, messages, 2)
+	assert.Equal(t, "spBv1.0/plant1/NBIRTH/k2m", messages[0].Topic)
+	dbirth := decodeSparkplug(t, messages[1])
+	assert.Equal(t, uint64(1), dbirth.GetSeq())
+	assert.Equal(t, int64(22), int64(dbirth.GetMetrics()[1].GetLongValue()))
+
+	// a clean disconnect publishes the NDEATH, a new connection advances bdSeq
+	client.ClearMessages()
+	require.NoError(t, node.Death(client))
+	messages = client.GetMessages()
+	require.Len(t, messages, 1)
+	assert.Equal(t, "spBv1.0/plant1/NDEATH/k2m", messages[0].Topic)
+	assert.Equal(t, byte(1), messages[0].QoS)
+
+	_, will = node.Will()
+	require.NoError(t, proto.Unmarshal(will, &death))
+	assert.Equal(t, uint64(1), death.GetMetrics()[0].GetLongValue())
+
+	// the first data of the new session is preceded by the births
+	client.ClearMessages()
+	worker.processMessage(&sarama.ConsumerMessage{Topic: "sensors", Key: []byte("pump-1"), Value: []byte(`{"temp":23}`)})
+	messages = client.GetMessages()
+	require.Len(t, messages, 3)
+	nbirth := decodeSparkplug(t, messages[0])
+	assert.Equal(t, uint64(1), nbirth.GetMetrics()[0].GetLongValue())
+	assert.Equal(t, "spBv1.0/plant1/DDATA/k2m/pump-1", messages[2].Topic)
+}
+
+func TestSparkplugValidation(t *testing.T) {
+	route := func(mapping TopicMapping) []RouteConfig {
+		mapping.KafkaTopic = "sensors"
+		return []RouteConfig{{Name: "r", Mapping: mapping}}
+	}
+
+	err := ValidateRouteConfig(route(TopicMapping{TopicMode: TopicModeSparkplug, Transform: "json"}))
+	assert.ErrorContains(t, err, "requires transform")
+	err = ValidateRouteConfig(route(TopicMapping{TopicMode: TopicModeSparkplug, Transform: TransformSparkplug}))
+	assert.ErrorContains(t, err, "deviceId is required")
+	err = ValidateRouteConfig(route(TopicMapping{
+		TopicMode: TopicModeSparkplug,
+		Transform: TransformSparkplug,
+		Sparkplug: &SparkplugMapping{DeviceID: "{key}", Metrics: []SparkplugMetric{{Name: "t", DataType: "Real"}}},
+	}))
+	assert.ErrorContains(t, err, "unknown dataType")
+	err = ValidateRouteConfig(route(TopicMapping{
+		TopicMode: TopicModeSparkplug,
+		Transform: TransformSparkplug,
+		Sparkplug: &SparkplugMapping{DeviceID: "{key}"},
+	}))
+	assert.NoError(t, err)
+
+	// the edge node identity is required
+	config := DefaultConfig()
+	config.TopicMappings = nil
+	config.Routes = route(TopicMapping{Transform: TransformSparkplug, MQTTTopic: "iot/{key}", Sparkplug: &SparkplugMapping{DeviceID: "{key}"}})
+	_, err = NewK2MBroker(config, util.NewLog(util.DefaultLogConfig()))
+	assert.ErrorContains(t, err, "groupId and edgeNodeId are required")
+}
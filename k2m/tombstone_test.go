@@ -0,0 +1,81 @@
+package k2m
+
+import (
+	"actsvr/util"
+	"testing"
+
+	"github.com/IBM/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTombstoneTestWorker(t *testing.T, mode string) (*MessageWorker, *MockMQTTClient) {
+	config := DefaultConfig()
+	config.TopicMappings = nil
+	config.Routes = []RouteConfig{
+		{
+			Name:       "device-state",
+			Priority:   1,
+			Filters:    []FilterConfig{},
+			Mapping:    TopicMapping{KafkaTopic: "devices", MQTTTopic: "state/{key}", Transform: "json"},
+			Tombstones: mode,
+		},
+	}
+	broker, err := NewK2MBroker(config, util.NewLog(util.DefaultLogConfig()))
+	require.NoError(t, err)
+	mockMQTT := NewMockMQTTClient()
+	broker.mqttClient = mockMQTT
+	return &MessageWorker{id: 1, broker: broker, messageCh: broker.messageCh}, mockMQTT
+}
+
+func TestTombstoneClear(t *testing.T) {
+	worker, mockMQTT := newTombstoneTestWorker(t, TombstoneClear)
+
+	worker.processMessage(&sarama.ConsumerMessage{Topic: "devices", Key: []byte("dev-1"), Value: nil})
+	// an empty but non-nil value is not a tombstone
+	worker.processMessage(&sarama.ConsumerMessage{Topic: "devices", Key: []byte("dev-2"), Value: []byte{}})
+
+	messages := mockMQTT.GetMessages()
+	require.Len(t, messages, 2)
+	assert.Equal(t, "state/dev-1", messages[0].Topic)
+	assert.Empty(t, messages[0].Payload)
+	assert.True(t, messages[0].Retained)
+	assert.Equal(t, "state/dev-2", messages[1].Topic)
+	assert.NotEmpty(t, messages[1].Payload, "json transform applies to non-tombstones")
+
+	metrics := worker.broker.GetMetrics()
+	assert.Equal(t, int64(1), metrics.TombstonesCleared)
+	assert.Equal(t, int64(2), metrics.MessagesPublished)
+}
+
+func TestTombstoneDrop(t *testing.T) {
+	worker, mockMQTT := newTombstoneTestWorker(t, TombstoneDrop)
+
+	worker.processMessage(&sarama.ConsumerMessage{Topic: "devices", Key: []byte("dev-1"), Value: nil})
+
+	assert.Empty(t, mockMQTT.GetMessages())
+	metrics := worker.broker.GetMetrics()
+	assert.Equal(t, int64(1), metrics.TombstonesDropped)
+	assert.Equal(t, int64(0), metrics.MessagesFailed)
+}
+
+func TestTombstoneForward(t *testing.T) {
+	worker, mockMQTT := newTombstoneTestWorker(t, "")
+
+	worker.processMessage(&sarama.ConsumerMessage{Topic: "devices", Key: []byte("dev-1"), Value: nil})
+
+	messages := mockMQTT.GetMessages()
+	require.Len(t, messages, 1)
+	assert.NotEmpty(t, messages[0].Payload)
+	assert.False(t, messages[0].Retained)
+	assert.Equal(t, int64(0), worker.broker.GetMetrics().TombstonesCleared)
+}
+
+func TestValidateRouteConfigTombstones(t *testing.T) {
+	routes := []RouteConfig{{
+		Name:       "device-state",
+		Mapping:    TopicMapping{KafkaTopic: "devices", MQTTTopic: "state/{key}"},
+		Tombstones: "delete",
+	}}
+	assert.ErrorContains(t, ValidateRouteConfig(routes), "unknown tombstones mode")
+}
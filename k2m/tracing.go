@@ -0,0 +1,237 @@
+package k2m
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/IBM/sarama"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// TracingConfig holds OpenTelemetry tracing settings
+type TracingConfig struct {
+	Enabled bool `json:"enabled"`
+	// Exporter selects the span exporter: "otlp-grpc" (default), "otlp-http" or "stdout"
+	Exporter string `json:"exporter,omitempty"`
+	// Endpoint of the OTLP collector, e.g. "localhost:4317" (grpc) or "localhost:4318" (http)
+	Endpoint string            `json:"endpoint,omitempty"`
+	Insecure bool              `json:"insecure,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	// ServiceName is reported as the service.name resource attribute
+	ServiceName string `json:"serviceName,omitempty"`
+	// SampleRatio is the fraction of new traces to sample (0.0 to 1.0).
+	// Messages that already carry a sampled trace context are always traced.
+	SampleRatio *float64 `json:"sampleRatio,omitempty"`
+}
+
+const (
+	TracingExporterOTLPGRPC = "otlp-grpc"
+	TracingExporterOTLPHTTP = "otlp-http"
+	TracingExporterStdout   = "stdout"
+
+	tracerName = "actsvr/k2m"
+)
+
+// Tracer creates spans for the message processing stages and
+// propagates W3C trace context from Kafka headers to MQTT messages.
+type Tracer struct {
+	tracer     trace.Tracer
+	provider   *sdktrace.TracerProvider // nil when tracing is disabled
+	propagator propagation.TextMapPropagator
+}
+
+// NewTracer creates a tracer according to the configuration.
+// When tracing is disabled, a no-op tracer is returned that still
+// forwards an incoming trace context to the outgoing messages.
+func NewTracer(ctx context.Context, config TracingConfig) (*Tracer, error) {
+	propagator := propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+	if !config.Enabled {
+		return &Tracer{
+			tracer:     noop.NewTracerProvider().Tracer(tracerName),
+			propagator: propagator,
+		}, nil
+	}
+
+	exporter, err := newSpanExporter(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceName := config.ServiceName
+	if serviceName == "" {
+		serviceName = "k2m-broker"
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(serviceName),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tracing resource: %w", err)
+	}
+
+	sampler := sdktrace.AlwaysSample()
+	if config.SampleRatio != nil {
+		sampler = sdktrace.TraceIDRatioBased(*config.SampleRatio)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+	)
+	return newTracerWithProvider(provider, propagator), nil
+}
+
+func newTracerWithProvider(provider *sdktrace.TracerProvider, propagator propagation.TextMapPropagator) *Tracer {
+	return &Tracer{
+		tracer:     provider.Tracer(tracerName),
+		provider:   provider,
+		propagator: propagator,
+	}
+}
+
+// newSpanExporter creates the span exporter selected by the configuration
+func newSpanExporter(ctx context.Context, config TracingConfig) (sdktrace.SpanExporter, error) {
+	switch config.Exporter {
+	case "", TracingExporterOTLPGRPC:
+		opts := []otlptracegrpc.Option{}
+		if config.Endpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(config.Endpoint))
+		}
+		if config.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		if len(config.Headers) > 0 {
+			opts = append(opts, otlptracegrpc.WithHeaders(config.Headers))
+		}
+		return otlptracegrpc.New(ctx, opts...)
+	case TracingExporterOTLPHTTP:
+		opts := []otlptracehttp.Option{}
+		if config.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(config.Endpoint))
+		}
+		if config.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		if len(config.Headers) > 0 {
+			opts = append(opts, otlptracehttp.WithHeaders(config.Headers))
+		}
+		return otlptracehttp.New(ctx, opts...)
+	case TracingExporterStdout:
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout), stdouttrace.WithPrettyPrint())
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter: %s", config.Exporter)
+	}
+}
+
+// Shutdown flushes pending spans and stops the exporter
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t.provider == nil {
+		return nil
+	}
+	return t.provider.Shutdown(ctx)
+}
+
+// StartConsume extracts the trace context from the Kafka headers and starts
+// the consumer span that parents all other spans of the message.
+func (t *Tracer) StartConsume(ctx context.Context, message *sarama.ConsumerMessage) (context.Context, trace.Span) {
+	ctx = t.propagator.Extract(ctx, kafkaHeaderCarrier{message: message})
+	return t.tracer.Start(ctx, "k2m.consume",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			semconv.MessagingSystemKafka,
+			semconv.MessagingOperationName("consume"),
+			semconv.MessagingDestinationName(message.Topic),
+			semconv.MessagingDestinationPartitionID(strconv.Itoa(int(message.Partition))),
+			semconv.MessagingKafkaOffset(int(message.Offset)),
+			semconv.MessagingMessageBodySize(len(message.Value)),
+		),
+	)
+}
+
+// Start starts a child span of the given stage, e.g. "route" or "transform"
+func (t *Tracer) Start(ctx context.Context, stage string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return t.tracer.Start(ctx, "k2m."+stage, trace.WithAttributes(attrs...))
+}
+
+// StartPublish starts the producer span of the MQTT publish
+func (t *Tracer) StartPublish(ctx context.Context, mqttTopic string, payloadSize int) (context.Context, trace.Span) {
+	return t.tracer.Start(ctx, "k2m.publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			semconv.MessagingSystemKey.String("mqtt"),
+			semconv.MessagingOperationName("publish"),
+			semconv.MessagingDestinationName(mqttTopic),
+			semconv.MessagingMessageBodySize(payloadSize),
+		),
+	)
+}
+
+// Inject returns the W3C trace context of ctx as key-value pairs,
+// e.g. {"traceparent": "00-...", "tracestate": "..."}.
+// It returns nil if ctx does not carry a valid span context.
+func (t *Tracer) Inject(ctx context.Context) map[string]string {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return nil
+	}
+	carrier := propagation.MapCarrier{}
+	t.propagator.Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// recordError marks the span as failed
+func recordError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// kafkaHeaderCarrier adapts Kafka record headers to propagation.TextMapCarrier
+type kafkaHeaderCarrier struct {
+	message *sarama.ConsumerMessage
+}
+
+var _ propagation.TextMapCarrier = kafkaHeaderCarrier{}
+
+func (c kafkaHeaderCarrier) Get(key string) string {
+	for _, h := range c.message.Headers {
+		if h != nil && string(h.Key) == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+func (c kafkaHeaderCarrier) Set(key string, value string) {
+	for _, h := range c.message.Headers {
+		if h != nil && string(h.Key) == key {
+			h.Value = []byte(value)
+			return
+		}
+	}
+	c.message.Headers = append(c.message.Headers, &sarama.RecordHeader{Key: []byte(key), Value: []byte(value)})
+}
+
+func (c kafkaHeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(c.message.Headers))
+	for _, h := range c.message.Headers {
+		if h != nil {
+			keys = append(keys, string(h.Key))
+		}
+	}
+	return keys
+}
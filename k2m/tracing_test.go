@@ -0,0 +1,160 @@
+package k2m
+
+import (
+	"actsvr/util"
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// MockV5MQTTClient records the user properties of published messages
+type MockV5MQTTClient struct {
+	*MockMQTTClient
+	mu    sync.Mutex
+	props []map[string]string
+}
+
+func (m *MockV5MQTTClient) PublishWithProperties(topic string, qos byte, retained bool, payload []byte, props map[string]string) mqtt.Token {
+	m.mu.Lock()
+	m.props = append(m.props, props)
+	m.mu.Unlock()
+	return m.Publish(topic, qos, retained, payload)
+}
+
+const testTraceParent = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+
+func newTracingTestBroker(t *testing.T, transform string) (*K2MBroker, *tracetest.InMemoryExporter) {
+	config := DefaultConfig()
+	config.TopicMappings = nil
+	config.Routes = []RouteConfig{
+		{
+			Name:     "traced",
+			Priority: 1,
+			Filters:  []FilterConfig{},
+			Mapping: TopicMapping{
+				KafkaTopic: "{kafkaTopic}",
+				MQTTTopic:  "traced/{kafkaTopic}",
+				Transform:  transform,
+			},
+		},
+	}
+	broker, err := NewK2MBroker(config, util.NewLog(util.DefaultLogConfig()))
+	require.NoError(t, err)
+
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	broker.tracer = newTracerWithProvider(provider, propagation.TraceContext{})
+	return broker, exporter
+}
+
+func TestTracingSpansFollowKafkaContext(t *testing.T) {
+	broker, exporter := newTracingTestBroker(t, "none")
+	mockMQTT := &MockV5MQTTClient{MockMQTTClient: NewMockMQTTClient()}
+	broker.mqttClient = mockMQTT
+
+	worker := &MessageWorker{id: 1, broker: broker, messageCh: broker.messageCh}
+	worker.processMessage(&sarama.ConsumerMessage{
+		Topic:     "sensor",
+		Partition: 2,
+		Offset:    42,
+		Value:     []byte("payload"),
+		Timestamp: time.Now(),
+		Headers: []*sarama.RecordHeader{
+			{Key: []byte("traceparent"), Value: []byte(testTraceParent)},
+		},
+	})
+
+	spans := exporter.GetSpans()
+	names := map[string]tracetest.SpanStub{}
+	for _, s := range spans {
+		names[s.Name] = s
+	}
+	require.Len(t, names, 4)
+	consume, ok := names["k2m.consume"]
+	require.True(t, ok)
+	assert.Equal(t, trace.SpanKindConsumer, consume.SpanKind)
+	assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", consume.SpanContext.TraceID().String())
+	assert.Equal(t, "b7ad6b7169203331", consume.Parent.SpanID().String())
+	for _, name := range []string{"k2m.route", "k2m.transform", "k2m.publish"} {
+		s, ok := names[name]
+		require.True(t, ok, name)
+		assert.Equal(t, consume.SpanContext.SpanID(), s.Parent.SpanID(), name)
+	}
+	assert.Equal(t, trace.SpanKindProducer, names["k2m.publish"].SpanKind)
+
+	// Trace context is forwarded as MQTT v5 user properties
+	require.Len(t, mockMQTT.props, 1)
+	traceparent := mockMQTT.props[0]["traceparent"]
+	assert.Contains(t, traceparent, "0af7651916cd43dd8448eb211c80319c")
+	assert.Contains(t, traceparent, consume.SpanContext.SpanID().String())
+	require.Len(t, mockMQTT.GetMessages(), 1)
+	assert.Equal(t, "traced/sensor", mockMQTT.GetMessages()[0].Topic)
+}
+
+func TestTracingJSONEnvelope(t *testing.T) {
+	broker, exporter := newTracingTestBroker(t, "json")
+	mockMQTT := NewMockMQTTClient()
+	broker.mqttClient = mockMQTT
+
+	worker := &MessageWorker{id: 1, broker: broker, messageCh: broker.messageCh}
+	worker.processMessage(&sarama.ConsumerMessage{
+		Topic: "sensor",
+		Value: []byte("payload"),
+		Headers: []*sarama.RecordHeader{
+			{Key: []byte("traceparent"), Value: []byte(testTraceParent)},
+		},
+	})
+
+	require.NotEmpty(t, exporter.GetSpans())
+	messages := mockMQTT.GetMessages()
+	require.Len(t, messages, 1)
+	var envelope map[string]interface{}
+	require.NoError(t, json.Unmarshal(messages[0].Payload, &envelope))
+	traceContext, ok := envelope["traceContext"].(map[string]interface{})
+	require.True(t, ok)
+	assert.Contains(t, traceContext["traceparent"], "0af7651916cd43dd8448eb211c80319c")
+}
+
+func TestTracingDisabledPropagates(t *testing.T) {
+	tracer, err := NewTracer(context.Background(), TracingConfig{})
+	require.NoError(t, err)
+
+	msg := &sarama.ConsumerMessage{
+		Headers: []*sarama.RecordHeader{
+			{Key: []byte("traceparent"), Value: []byte(testTraceParent)},
+		},
+	}
+	ctx, span := tracer.StartConsume(context.Background(), msg)
+	defer span.End()
+	assert.Equal(t, testTraceParent, tracer.Inject(ctx)["traceparent"])
+
+	// Without an incoming trace context nothing is injected
+	ctx, span = tracer.StartConsume(context.Background(), &sarama.ConsumerMessage{})
+	defer span.End()
+	assert.Nil(t, tracer.Inject(ctx))
+	assert.NoError(t, tracer.Shutdown(context.Background()))
+}
+
+func TestTracingUnknownExporter(t *testing.T) {
+	_, err := NewTracer(context.Background(), TracingConfig{Enabled: true, Exporter: "zipkin"})
+	assert.Error(t, err)
+}
+
+func TestMQTTTopicMatch(t *testing.T) {
+	assert.True(t, mqttTopicMatch("a/b", "a/b"))
+	assert.True(t, mqttTopicMatch("a/+/c", "a/b/c"))
+	assert.True(t, mqttTopicMatch("a/#", "a/b/c"))
+	assert.False(t, mqttTopicMatch("a/+", "a/b/c"))
+	assert.False(t, mqttTopicMatch("a/b/c", "a/b"))
+}
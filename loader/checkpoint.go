@@ -0,0 +1,95 @@
+package loader
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Checkpoint is the import state of a file.
+// Offset and Rows never run ahead of the rows flushed to the database.
+type Checkpoint struct {
+	Path       string    `json:"path"`
+	Size       int64     `json:"size"`       // fingerprint of the file, with ModTime
+	ModTime    time.Time `json:"modTime"`    //
+	Offset     int64     `json:"offset"`     // byte offset of the row after the last flushed one
+	Rows       int64     `json:"rows"`       // number of rows read up to Offset
+	Lines      int64     `json:"lines"`      // number of lines read up to Offset
+	Rejected   int64     `json:"rejected"`   // number of rows rejected up to Offset
+	RejectSize int64     `json:"rejectSize"` // size of the reject file up to Offset
+	Done       bool      `json:"done"`       // the file is imported completely
+}
+
+// Checkpoints is the checkpoint file shared by the workers
+type Checkpoints struct {
+	path  string
+	mu    sync.Mutex
+	files map[string]*Checkpoint
+}
+
+// LoadCheckpoints reads the checkpoint file, a missing file has no checkpoints
+func LoadCheckpoints(path string) (*Checkpoints, error) {
+	c := &Checkpoints{path: path, files: make(map[string]*Checkpoint)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var list []*Checkpoint
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	for _, cp := range list {
+		c.files[cp.Path] = cp
+	}
+	return c, nil
+}
+
+// checkpointKey returns the absolute path of the file, the checkpoints do not depend on the working directory
+func checkpointKey(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// Get returns the checkpoint of the file, nil if there is none or if the file changed since
+func (c *Checkpoints) Get(path string, info os.FileInfo) *Checkpoint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cp, ok := c.files[checkpointKey(path)]
+	if !ok || cp.Size != info.Size() || !cp.ModTime.Equal(info.ModTime()) {
+		return nil
+	}
+	ret := *cp
+	return &ret
+}
+
+// Save records the checkpoint and rewrites the checkpoint file
+func (c *Checkpoints) Save(cp Checkpoint) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cp.Path = checkpointKey(cp.Path)
+	c.files[cp.Path] = &cp
+
+	list := make([]*Checkpoint, 0, len(c.files))
+	for _, f := range c.files {
+		list = append(list, f)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	// replace the file at once, a crash never leaves a partial checkpoint file
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
@@ -0,0 +1,195 @@
+package loader
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"fortio.org/progressbar"
+)
+
+// chunkName is the name of a chunk of a file in the log, the checkpoints and the reject files,
+// e.g. "data.csv@268435456-536870912"
+func chunkName(path string, start, end int64) string {
+	return fmt.Sprintf("%s@%d-%d", path, start, end)
+}
+
+// splitFiles returns the requests of the files to import.
+// A plain file larger than ChunkSize is split into chunks, every chunk is a request.
+func (c *Config) splitFiles(files []string) []*Request {
+	var requests []*Request
+	for _, path := range files {
+		chunks, err := c.splitFile(path)
+		if err != nil {
+			chunks = []*Request{{Src: path}} // the worker reports the error of the file
+		}
+		requests = append(requests, chunks...)
+	}
+	return requests
+}
+
+// splitFile splits the file into byte ranges of about ChunkSize that start at a record,
+// a line break in a quoted CSV field is not a record boundary.
+// The file is a single request if it is not split.
+func (c *Config) splitFile(path string) ([]*Request, error) {
+	whole := []*Request{{Src: path}}
+	if c.ChunkSize <= 0 {
+		return whole, nil
+	}
+	if _, _, ok := splitZipEntry(path); ok {
+		return whole, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() <= c.ChunkSize || detectCodec(path, file) != codecNone {
+		return whole, nil
+	}
+
+	quoted := c.Format != FormatJSONL // a JSON string has no line breaks
+	var requests []*Request
+	var start, startLine, pos, line int64
+	// a quote opens a quoted field only at the start of the field, a quote in a quoted field
+	// closes it unless it is followed by another one, e.g. "a ""b"" c"
+	var inQuote, closing bool
+	fieldStart := true
+	buf := make([]byte, 1024*1024)
+	for {
+		n, err := file.Read(buf)
+		for _, b := range buf[:n] {
+			pos++
+			if closing {
+				closing = false
+				inQuote = b == '"' // an escaped quote
+			} else if b == '"' && quoted {
+				if inQuote {
+					inQuote, closing = false, true
+				} else if fieldStart {
+					inQuote = true
+				}
+			}
+			fieldStart = !inQuote && (b == ',' || b == '\n')
+			if b != '\n' {
+				continue
+			}
+			line++
+			if !inQuote && pos-start >= c.ChunkSize && pos < info.Size() {
+				requests = append(requests, &Request{Src: path, Start: start, End: pos, Line: startLine})
+				start, startLine = pos, line
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if len(requests) == 0 {
+		return whole, nil
+	}
+	requests = append(requests, &Request{Src: path, Start: start, End: info.Size(), Line: startLine})
+	return requests, nil
+}
+
+// sizeFlag sets dst to the size of the flag, e.g. "256MB", "1GB" or bytes
+func sizeFlag(dst *int64) func(string) error {
+	return func(s string) error {
+		units := []struct {
+			suffix string
+			size   int64
+		}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+		s = strings.ToUpper(strings.TrimSpace(s))
+		unit := int64(1)
+		for _, u := range units {
+			if strings.HasSuffix(s, u.suffix) {
+				s, unit = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.size
+				break
+			}
+		}
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid size %q", s)
+		}
+		*dst = v * unit
+		return nil
+	}
+}
+
+// fileProgress combines the progress, the dry run reports and the reject files of the chunks of a file
+type fileProgress struct {
+	size     int64            // of the file
+	done     map[string]int64 // bytes imported of every chunk, by chunk name
+	bar      *progressbar.Bar
+	chunks   []*Request         // in the order of the file
+	finished int                // chunks done or failed
+	failed   bool               // a chunk failed
+	dryRuns  map[string]*DryRun // dry runs of the chunks, by chunk name
+}
+
+// chunkProgress updates the progress of the file of the chunk, if the input of the message is a chunk
+func (r *Runner) chunkProgress(name string, progress float64) {
+	req, ok := r.chunks[name]
+	if !ok {
+		return
+	}
+	fp := r.fileProgress[req.Src]
+	fp.done[name] = int64(progress * float64(req.End-req.Start))
+	var done int64
+	for _, n := range fp.done {
+		done += n
+	}
+	pct := float64(done) / float64(fp.size) * 100
+	if r.silent {
+		r.log.Printf("%s progress: %.2f%%", req.Src, pct)
+	} else {
+		fp.bar.Progress(pct)
+	}
+}
+
+// chunkDone records the end of the chunk of the message, it returns false if the input of the message is not a chunk.
+// Once every chunk of the file is done, the dry runs of the chunks are merged into the report of the file
+// and the reject files of the chunks into the reject file of the file.
+func (r *Runner) chunkDone(msg *Progress) bool {
+	req, ok := r.chunks[msg.Src]
+	if !ok {
+		return false
+	}
+	fp := r.fileProgress[req.Src]
+	fp.finished++
+	if State(msg.State) == WorkStateError {
+		fp.failed = true
+	}
+	if msg.DryRun != nil {
+		fp.dryRuns[msg.Src] = msg.DryRun
+	}
+	if fp.finished < len(fp.chunks) {
+		return true
+	}
+
+	if r.Conf.DryRun {
+		var dryRuns []*DryRun
+		for _, chunk := range fp.chunks {
+			if dryRun, ok := fp.dryRuns[chunkName(chunk.Src, chunk.Start, chunk.End)]; ok {
+				dryRuns = append(dryRuns, dryRun)
+			}
+		}
+		r.addReport(req.Src, dryRuns...)
+		return true
+	}
+	if fp.failed {
+		r.log.Printf("%s: the reject files of the chunks are kept to resume the import", req.Src)
+		return true
+	}
+	if err := r.Conf.mergeRejects(req.Src, fp.chunks); err != nil {
+		r.log.Printf("%s: merge the reject files of the chunks: %v", req.Src, err)
+	}
+	return true
+}
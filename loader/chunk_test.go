@@ -0,0 +1,91 @@
+package loader
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitFile(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("TIME,NAME,VALUE,SVAL,IVAL,DVAL\n")
+	for i := 0; i < 200; i++ {
+		// a quoted field with line breaks is not split
+		fmt.Fprintf(&buf, "2025-03-19 10:56:19,work-1,%d,\"a\nb\n\"\"c\"\"\",%d,1.1\n", i, i)
+	}
+	file := filepath.Join(t.TempDir(), "big.csv")
+	require.NoError(t, os.WriteFile(file, buf.Bytes(), 0644))
+
+	conf := NewConfig()
+	requests, err := conf.splitFile(file)
+	require.NoError(t, err)
+	assert.Equal(t, []*Request{{Src: file}}, requests, "no chunk size")
+
+	conf.ChunkSize = 1024
+	requests, err = conf.splitFile(file)
+	require.NoError(t, err)
+	require.Greater(t, len(requests), 4)
+
+	data := buf.Bytes()
+	var end, rows int64
+	for _, req := range requests {
+		assert.Equal(t, end, req.Start)
+		assert.Equal(t, int64(bytes.Count(data[:req.Start], []byte("\n"))), req.Line)
+		records, err := csv.NewReader(bytes.NewReader(data[req.Start:req.End])).ReadAll()
+		require.NoError(t, err, "chunk %d-%d", req.Start, req.End)
+		rows += int64(len(records))
+		end = req.End
+	}
+	assert.Equal(t, int64(len(data)), end)
+	assert.Equal(t, int64(201), rows)
+
+	assert.Equal(t, len(requests), len(conf.splitFiles([]string{file})))
+	assert.Equal(t, []*Request{{Src: "missing.csv"}}, conf.splitFiles([]string{"missing.csv"}))
+}
+
+func TestSplitFileBareQuote(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("TIME,NAME,VALUE,SVAL,IVAL,DVAL\n")
+	// a bare quote in an unquoted field does not open a quoted field
+	buf.WriteString("2025-03-19 10:56:19,work-1,0,12\" pipe,0,1.1\n")
+	for i := 1; i < 200; i++ {
+		fmt.Fprintf(&buf, "2025-03-19 10:56:19,work-1,%d,\"a\nb\",%d,1.1\n", i, i)
+	}
+	file := filepath.Join(t.TempDir(), "bare.csv")
+	require.NoError(t, os.WriteFile(file, buf.Bytes(), 0644))
+
+	conf := NewConfig()
+	conf.ChunkSize = 1024
+	requests, err := conf.splitFile(file)
+	require.NoError(t, err)
+	require.Greater(t, len(requests), 4)
+
+	data := buf.Bytes()
+	var rows int
+	for _, req := range requests {
+		reader := csv.NewReader(bytes.NewReader(data[req.Start:req.End]))
+		reader.LazyQuotes = true
+		records, err := reader.ReadAll()
+		require.NoError(t, err, "chunk %d-%d", req.Start, req.End)
+		for _, rec := range records {
+			require.Len(t, rec, 6, "chunk %d-%d splits a record", req.Start, req.End)
+		}
+		rows += len(records)
+	}
+	assert.Equal(t, 201, rows)
+}
+
+func TestSizeFlag(t *testing.T) {
+	var size int64
+	for s, expect := range map[string]int64{"1024": 1024, "256MB": 256 << 20, "1gb": 1 << 30, "4 KB": 4096} {
+		require.NoError(t, sizeFlag(&size)(s))
+		assert.Equal(t, expect, size, s)
+	}
+	assert.Error(t, sizeFlag(&size)("big"))
+}
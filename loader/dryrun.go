@@ -0,0 +1,142 @@
+package loader
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/machbase/neo-server/v8/api"
+)
+
+// dryRunSamples is the number of rejected rows in the report of a dry run
+const dryRunSamples = 10
+
+// dryRunReport is the result of a dry run of a file, the rows are converted but not appended.
+// The counts are in DryRun, so that the reports of the chunks of a file are merged by the runner.
+type dryRunReport struct {
+	name string
+	cols api.Columns // of the rows added, nil for the report merged from chunks
+	tz   *time.Location
+	*DryRun
+}
+
+func newDryRunReport(name string, cols api.Columns, tz *time.Location) *dryRunReport {
+	return &dryRunReport{
+		name: name,
+		cols: cols,
+		tz:   tz,
+		DryRun: &DryRun{
+			Failures: make(map[string]int64),
+			Columns:  cols.Names(),
+			Nulls:    make([]int64, len(cols)),
+			Min:      make([]int64, len(cols)),
+			Max:      make([]int64, len(cols)),
+			HasTime:  make([]bool, len(cols)),
+		},
+	}
+}
+
+// add counts the row, its values or the reason it is rejected
+func (r *dryRunReport) add(rec *record) {
+	r.Rows++
+	if rec.err != nil {
+		r.Rejected++
+		var colErr *columnError
+		if errors.As(rec.err, &colErr) {
+			r.Failures[colErr.column]++
+		} else {
+			r.Failures[""]++
+		}
+		if len(r.Samples) < dryRunSamples {
+			r.Samples = append(r.Samples, fmt.Sprintf("line %d: %v", rec.line, rec.err))
+		}
+		return
+	}
+	for i, value := range rec.values {
+		if value == nil {
+			r.Nulls[i]++
+			continue
+		}
+		ts, ok := value.(int64)
+		if !ok || r.cols[i].Type != api.ColumnTypeDatetime {
+			continue
+		}
+		r.addTime(i, ts, ts)
+	}
+}
+
+func (r *dryRunReport) addTime(i int, minTime, maxTime int64) {
+	if !r.HasTime[i] || minTime < r.Min[i] {
+		r.Min[i] = minTime
+	}
+	if !r.HasTime[i] || maxTime > r.Max[i] {
+		r.Max[i] = maxTime
+	}
+	r.HasTime[i] = true
+}
+
+// merge adds the counts of the dry run of a chunk, the chunks are merged in the order of the file
+func (r *dryRunReport) merge(chunk *DryRun) {
+	if len(r.Columns) == 0 {
+		n := len(chunk.Columns)
+		r.Columns = chunk.Columns
+		r.Nulls, r.Min, r.Max, r.HasTime = make([]int64, n), make([]int64, n), make([]int64, n), make([]bool, n)
+	}
+	r.Rows += chunk.Rows
+	r.Rejected += chunk.Rejected
+	for name, n := range chunk.Failures {
+		r.Failures[name] += n
+	}
+	for i := range min(len(r.Columns), len(chunk.Columns)) {
+		r.Nulls[i] += chunk.Nulls[i]
+		if chunk.HasTime[i] {
+			r.addTime(i, chunk.Min[i], chunk.Max[i])
+		}
+	}
+	for _, sample := range chunk.Samples {
+		if len(r.Samples) < dryRunSamples {
+			r.Samples = append(r.Samples, sample)
+		}
+	}
+}
+
+func (r *dryRunReport) String() string {
+	sb := &strings.Builder{}
+	fmt.Fprintf(sb, "dry run of %s: %d rows, %d rejected\n", r.name, r.Rows, r.Rejected)
+	tw := tabwriter.NewWriter(sb, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "  COLUMN\tFAILURES\tNULLS\tMIN\tMAX")
+	for i, name := range r.Columns {
+		var minTime, maxTime string
+		if r.HasTime[i] {
+			minTime = time.Unix(0, r.Min[i]).In(r.tz).Format(time.RFC3339Nano)
+			maxTime = time.Unix(0, r.Max[i]).In(r.tz).Format(time.RFC3339Nano)
+		}
+		fmt.Fprintf(tw, "  %s\t%d\t%d\t%s\t%s\n", name, r.Failures[name], r.Nulls[i], minTime, maxTime)
+	}
+	// the failures of the fields of a wide row
+	var fields []string
+	for name := range r.Failures {
+		if name != "" && !slices.Contains(r.Columns, name) {
+			fields = append(fields, name)
+		}
+	}
+	sort.Strings(fields)
+	for _, name := range fields {
+		fmt.Fprintf(tw, "  %s\t%d\t\t\t\n", name, r.Failures[name])
+	}
+	if n := r.Failures[""]; n > 0 {
+		fmt.Fprintf(tw, "  (row)\t%d\t\t\t\n", n)
+	}
+	tw.Flush()
+	if len(r.Samples) > 0 {
+		fmt.Fprintf(sb, "  rejected rows:\n")
+		for _, s := range r.Samples {
+			fmt.Fprintf(sb, "    %s\n", s)
+		}
+	}
+	return sb.String()
+}
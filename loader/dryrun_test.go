@@ -0,0 +1,64 @@
+package loader
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/machbase/neo-server/v8/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDryRunReport(t *testing.T) {
+	cols := api.Columns{
+		{Name: "TIME", Type: api.ColumnTypeDatetime},
+		{Name: "VALUE", Type: api.ColumnTypeDouble},
+	}
+	report := newDryRunReport("data.csv", cols, time.UTC)
+	report.add(&record{line: 2, values: []any{int64(2e9), 1.5}})
+	report.add(&record{line: 3, values: []any{int64(1e9), nil}})
+	report.add(&record{line: 4, values: []any{nil, 2.5}})
+	report.add(&record{line: 5, err: &columnError{column: "VALUE", err: errors.New("invalid")}})
+	report.add(&record{line: 6, err: &columnError{column: "temp", err: errors.New("invalid")}})
+	report.add(&record{line: 7, err: errors.New("wrong number of fields")})
+
+	assert.Equal(t, int64(6), report.Rows)
+	assert.Equal(t, int64(3), report.Rejected)
+	assert.Equal(t, []int64{1, 1}, report.Nulls)
+	assert.Equal(t, int64(1e9), report.Min[0])
+	assert.Equal(t, int64(2e9), report.Max[0])
+
+	lines := strings.Split(report.String(), "\n")
+	assert.Equal(t, "dry run of data.csv: 6 rows, 3 rejected", lines[0])
+	assert.Equal(t, "  TIME    0         1      1970-01-01T00:00:01Z  1970-01-01T00:00:02Z", lines[2])
+	assert.Equal(t, "  VALUE   1         1", strings.TrimRight(lines[3], " "))
+	assert.Equal(t, "  temp    1", strings.TrimRight(lines[4], " "))
+	assert.Equal(t, "  (row)   1", strings.TrimRight(lines[5], " "))
+	assert.Equal(t, "    line 5: column VALUE: invalid", lines[7])
+}
+
+func TestDryRunReportMerge(t *testing.T) {
+	cols := api.Columns{
+		{Name: "TIME", Type: api.ColumnTypeDatetime},
+		{Name: "VALUE", Type: api.ColumnTypeDouble},
+	}
+	first := newDryRunReport("data.csv@0-100", cols, time.UTC)
+	first.add(&record{line: 2, values: []any{int64(2e9), nil}})
+	first.add(&record{line: 3, err: &columnError{column: "VALUE", err: errors.New("invalid")}})
+	second := newDryRunReport("data.csv@100-200", cols, time.UTC)
+	second.add(&record{line: 9, values: []any{int64(1e9), 1.5}})
+	second.add(&record{line: 10, err: errors.New("wrong number of fields")})
+
+	report := newDryRunReport("data.csv", nil, time.UTC)
+	report.merge(first.DryRun)
+	report.merge(second.DryRun)
+	assert.Equal(t, int64(4), report.Rows)
+	assert.Equal(t, int64(2), report.Rejected)
+	assert.Equal(t, map[string]int64{"VALUE": 1, "": 1}, report.Failures)
+	assert.Equal(t, []int64{0, 1}, report.Nulls)
+	assert.Equal(t, int64(1e9), report.Min[0])
+	assert.Equal(t, int64(2e9), report.Max[0])
+	assert.Equal(t, []string{"line 3: column VALUE: invalid", "line 10: wrong number of fields"}, report.Samples)
+	assert.True(t, strings.HasPrefix(report.String(), "dry run of data.csv: 4 rows, 2 rejected\n"))
+}
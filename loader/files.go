@@ -0,0 +1,189 @@
+package loader
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	OrderByName  = "name"  // sort the files of a directory or a glob by path
+	OrderByMtime = "mtime" // sort the files of a directory or a glob by modification time, oldest first
+)
+
+// inputFile is a file found in a directory or by a glob pattern
+type inputFile struct {
+	path    string
+	modTime time.Time
+}
+
+// InputFiles returns the files to import of the command line arguments.
+// A directory is walked recursively and a glob pattern is expanded, the files found
+// are filtered by the include and exclude patterns and sorted by OrderBy.
+// A file given by name is always imported, a file is imported only once.
+// A zip archive is replaced by its entries, filtered and sorted like the files of a directory.
+func (c *Config) InputFiles(args []string) ([]string, error) {
+	switch c.OrderBy {
+	case "", OrderByName, OrderByMtime:
+	default:
+		return nil, fmt.Errorf("invalid order %q, use %q or %q", c.OrderBy, OrderByName, OrderByMtime)
+	}
+	for _, pattern := range append(append([]string{}, c.Include...), c.Exclude...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+
+	files := make([]string, 0, len(args))
+	seen := make(map[string]bool)
+	add := func(path string) error {
+		if seen[path] {
+			return nil
+		}
+		seen[path] = true
+		if !isZip(path) {
+			files = append(files, path)
+			return nil
+		}
+		entries, err := c.zipEntries(path)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			files = append(files, e.path)
+		}
+		return nil
+	}
+	for _, arg := range args {
+		stat, err := os.Stat(arg)
+		if err == nil && !stat.IsDir() {
+			if err := add(arg); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		var found []inputFile
+		switch {
+		case err == nil:
+			found, err = c.walkDir(arg, nil)
+		case isGlob(arg):
+			found, err = c.glob(arg)
+		}
+		if err != nil {
+			return nil, err
+		}
+		c.sortFiles(found)
+		for _, f := range found {
+			if err := add(f.path); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return files, nil
+}
+
+// isGlob returns true if the argument has glob meta characters
+func isGlob(arg string) bool {
+	return strings.ContainsAny(arg, "*?[")
+}
+
+func (c *Config) glob(pattern string) ([]inputFile, error) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid glob %q: %w", pattern, err)
+	}
+	var found []inputFile
+	for _, path := range matches {
+		stat, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if stat.IsDir() {
+			if found, err = c.walkDir(path, found); err != nil {
+				return nil, err
+			}
+		} else if c.matchesFile(path, filepath.Base(path)) {
+			found = append(found, inputFile{path: path, modTime: stat.ModTime()})
+		}
+	}
+	return found, nil
+}
+
+// walkDir appends the regular files under the directory to found
+func (c *Config) walkDir(root string, found []inputFile) ([]inputFile, error) {
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != root && c.excluded(filepath.ToSlash(rel)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || !c.matchesFile(path, filepath.ToSlash(rel)) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		found = append(found, inputFile{path: path, modTime: info.ModTime()})
+		return nil
+	})
+	return found, err
+}
+
+// matches returns true if the file is included and not excluded.
+// rel is the slash separated path of the file relative to the directory or the glob.
+func (c *Config) matches(rel string) bool {
+	if c.excluded(rel) {
+		return false
+	}
+	if len(c.Include) == 0 {
+		return true
+	}
+	// a compressed file is included as the file it contains, e.g. a.csv.gz by *.csv
+	return matchAny(c.Include, rel) || matchAny(c.Include, trimCompressionExt(rel))
+}
+
+// matchesFile is matches for a file found in a directory or by a glob,
+// a zip archive that is not excluded is kept, its entries are filtered
+func (c *Config) matchesFile(path string, rel string) bool {
+	return c.matches(rel) || (!c.excluded(rel) && isZip(path))
+}
+
+func (c *Config) excluded(rel string) bool {
+	return matchAny(c.Exclude, rel)
+}
+
+// matchAny returns true if a pattern matches the base name or the relative path
+func matchAny(patterns []string, rel string) bool {
+	base := rel[strings.LastIndex(rel, "/")+1:]
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, base); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, rel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) sortFiles(files []inputFile) {
+	sort.SliceStable(files, func(i, j int) bool {
+		if c.OrderBy == OrderByMtime && !files[i].modTime.Equal(files[j].modTime) {
+			return files[i].modTime.Before(files[j].modTime)
+		}
+		return files[i].path < files[j].path
+	})
+}
@@ -0,0 +1,66 @@
+package loader
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInputFiles(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	for i, name := range []string{"b.csv", "a.csv", "notes.txt", "2025/c.csv", "2025/d.csv.tmp", "archive/old.csv"} {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte("x"), 0644))
+		// the first file is the newest
+		mtime := now.Add(-time.Duration(i) * time.Minute)
+		require.NoError(t, os.Chtimes(path, mtime, mtime))
+	}
+	rel := func(files []string) []string {
+		for i, f := range files {
+			files[i], _ = filepath.Rel(dir, f)
+			files[i] = filepath.ToSlash(files[i])
+		}
+		return files
+	}
+
+	conf := NewConfig()
+	files, err := conf.InputFiles([]string{dir})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2025/c.csv", "2025/d.csv.tmp", "a.csv", "archive/old.csv", "b.csv", "notes.txt"}, rel(files))
+
+	conf.Include = []string{"*.csv"}
+	conf.Exclude = []string{"archive"}
+	files, err = conf.InputFiles([]string{dir})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2025/c.csv", "a.csv", "b.csv"}, rel(files))
+
+	conf.OrderBy = OrderByMtime
+	files, err = conf.InputFiles([]string{dir})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2025/c.csv", "a.csv", "b.csv"}, rel(files))
+	conf.Exclude = []string{"2025/*"}
+	files, err = conf.InputFiles([]string{dir})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"archive/old.csv", "a.csv", "b.csv"}, rel(files))
+
+	// globs are filtered too, files given by name are always imported once
+	conf = NewConfig()
+	conf.Exclude = []string{"b.*"}
+	files, err = conf.InputFiles([]string{filepath.Join(dir, "notes.txt"), filepath.Join(dir, "*.csv"), filepath.Join(dir, "a.csv")})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"notes.txt", "a.csv"}, rel(files))
+
+	conf.OrderBy = "size"
+	_, err = conf.InputFiles([]string{dir})
+	assert.ErrorContains(t, err, "invalid order")
+	conf = NewConfig()
+	conf.Include = []string{"[a-"}
+	_, err = conf.InputFiles([]string{dir})
+	assert.ErrorContains(t, err, "invalid pattern")
+}
@@ -0,0 +1,106 @@
+package loader
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/machbase/neo-server/v8/api"
+)
+
+// headerColumns reads the header of the input and returns the column of every header field,
+// "" for a field that no column takes, like the names of a column names file.
+func (c *Config) headerColumns(input string, cols api.Columns) ([]string, error) {
+	header, err := readHeader(input)
+	if err != nil {
+		return nil, err
+	}
+	names, err := c.mapHeader(header, cols)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", input, err)
+	}
+	return names, nil
+}
+
+// readHeader returns the fields of the first row of the input,
+// it is read apart from the import so that a resumed import has it too
+func readHeader(input string) ([]string, error) {
+	r, err := openInput(input)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	header, err := csv.NewReader(r).Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("%s: no header", input)
+	} else if err != nil {
+		return nil, fmt.Errorf("%s: header: %w", input, err)
+	}
+	return trimBOM(header), nil
+}
+
+// trimBOM removes the byte order mark of the first header field, before the fields are looked up by name
+func trimBOM(header []string) []string {
+	if len(header) > 0 {
+		header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	}
+	return header
+}
+
+// mapHeader matches the header fields to the columns by name or by the alias names of HeaderAliases,
+// case and whitespace insensitive. The fields that no column takes are ignored.
+// The tag name, the base time and the HeaderRequired columns must be in the header.
+func (c *Config) mapHeader(header []string, cols api.Columns) ([]string, error) {
+	fields := make(map[string]int, len(header))
+	for i, name := range header {
+		if key := headerKey(name); key != "" {
+			if _, dup := fields[key]; !dup {
+				fields[key] = i
+			}
+		}
+	}
+	required := make(map[string]bool)
+	for _, name := range c.HeaderRequired {
+		required[strings.ToUpper(name)] = true
+	}
+
+	names := make([]string, len(header))
+	var missing []string
+	for _, col := range cols {
+		if col.Name == "_ARRIVAL_TIME" {
+			continue // set by the database
+		}
+		idx := -1
+		for _, name := range append([]string{col.Name}, c.HeaderAliases[col.Name]...) {
+			if i, ok := fields[headerKey(name)]; ok {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			if required[col.Name] || col.IsTagName() || col.IsBaseTime() {
+				missing = append(missing, col.Name)
+			}
+			continue
+		}
+		if names[idx] != "" {
+			return nil, fmt.Errorf("header field %q matches the columns %s and %s", header[idx], names[idx], col.Name)
+		}
+		names[idx] = col.Name
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("required columns %s are not in the header %q", strings.Join(missing, ", "), header)
+	}
+	for _, name := range names {
+		if name != "" {
+			return names, nil
+		}
+	}
+	return nil, fmt.Errorf("no column of the table is in the header %q", header)
+}
+
+// headerKey is the name without case and whitespace, e.g. "Sensor Value" is "sensorvalue"
+func headerKey(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), ""))
+}
@@ -0,0 +1,50 @@
+package loader
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/machbase/neo-server/v8/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMapHeader(t *testing.T) {
+	cols := api.Columns{
+		{Name: "NAME", Flag: api.ColumnFlagTagName},
+		{Name: "TIME", Flag: api.ColumnFlagBasetime},
+		{Name: "VALUE"},
+		{Name: "SVAL"},
+	}
+	conf := NewConfig()
+	conf.HeaderAliases = map[string][]string{"TIME": {"ts", "timestamp"}}
+
+	names, err := conf.mapHeader([]string{"Timestamp", " Value ", "unit", "na me"}, cols)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"TIME", "VALUE", "", "NAME"}, names)
+
+	_, err = conf.mapHeader([]string{"value", "time"}, cols)
+	assert.EqualError(t, err, `required columns NAME are not in the header ["value" "time"]`)
+
+	conf.HeaderRequired = []string{"sval"}
+	_, err = conf.mapHeader([]string{"name", "time", "value"}, cols)
+	assert.ErrorContains(t, err, "required columns SVAL")
+
+	conf.HeaderAliases["SVAL"] = []string{"time"}
+	_, err = conf.mapHeader([]string{"name", "time", "sval"}, cols)
+	require.NoError(t, err, "the column name is matched before the aliases")
+	_, err = conf.mapHeader([]string{"name", "time"}, cols)
+	assert.EqualError(t, err, `header field "time" matches the columns TIME and SVAL`)
+
+	_, err = NewConfig().mapHeader([]string{"a", "b"}, api.Columns{{Name: "VALUE"}})
+	assert.EqualError(t, err, `no column of the table is in the header ["a" "b"]`)
+}
+
+func TestReadHeader(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "bom.csv")
+	require.NoError(t, os.WriteFile(file, []byte("\ufeffTimestamp,value\n1,2\n"), 0644))
+	header, err := readHeader(file)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Timestamp", "value"}, header, "the byte order mark is removed")
+}
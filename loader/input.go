@@ -0,0 +1,238 @@
+package loader
+
+import (
+	"actsvr/util"
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// zipEntrySep separates an archive and its entry in the input of a zip entry, e.g. "data.zip!/2025/a.csv"
+const zipEntrySep = "!/"
+
+// Compression codecs of the input files
+const (
+	codecNone  = ""
+	codecGzip  = "gzip"
+	codecZstd  = "zstd"
+	codecBzip2 = "bzip2"
+	codecZip   = "zip"
+)
+
+var (
+	magicGzip  = []byte{0x1f, 0x8b}
+	magicZstd  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	magicBzip2 = []byte("BZh")
+	magicZip   = []byte("PK\x03\x04")
+)
+
+// detectCodec returns the codec of the file by its extension, or by its magic bytes
+func detectCodec(name string, file io.ReaderAt) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".gz", ".gzip":
+		return codecGzip
+	case ".zst", ".zstd":
+		return codecZstd
+	case ".bz2":
+		return codecBzip2
+	case ".zip":
+		return codecZip
+	}
+	magic := make([]byte, 4)
+	n, _ := file.ReadAt(magic, 0)
+	magic = magic[:n]
+	switch {
+	case bytes.HasPrefix(magic, magicGzip):
+		return codecGzip
+	case bytes.HasPrefix(magic, magicZstd):
+		return codecZstd
+	case bytes.HasPrefix(magic, magicBzip2):
+		return codecBzip2
+	case bytes.HasPrefix(magic, magicZip):
+		return codecZip
+	}
+	return codecNone
+}
+
+// trimCompressionExt removes the extension of a compressed file
+func trimCompressionExt(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".gz", ".gzip", ".zst", ".zstd", ".bz2":
+		return strings.TrimSuffix(name, filepath.Ext(name))
+	}
+	return name
+}
+
+// isZip returns true if the file is a zip archive
+func isZip(name string) bool {
+	f, err := os.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	return detectCodec(name, f) == codecZip
+}
+
+// splitZipEntry returns the archive and the entry of the input of a zip entry
+func splitZipEntry(input string) (archive string, entry string, ok bool) {
+	return strings.Cut(input, zipEntrySep)
+}
+
+// zipEntries returns the files of the archive, filtered and sorted like the files of a directory
+func (c *Config) zipEntries(archive string) ([]inputFile, error) {
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", archive, err)
+	}
+	defer zr.Close()
+	var found []inputFile
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() || !c.matches(f.Name) {
+			continue
+		}
+		found = append(found, inputFile{path: archive + zipEntrySep + f.Name, modTime: f.Modified})
+	}
+	c.sortFiles(found)
+	return found, nil
+}
+
+// inputReader reads the decompressed content of an input file.
+// Its progress is the progress of the compressed bytes read from the file.
+type inputReader struct {
+	io.Reader
+	progress *util.ProgressReader
+	info     os.FileInfo // of the file, or of the archive of a zip entry
+	file     *os.File    // the file if it is not compressed
+	closers  []io.Closer
+}
+
+// openInput opens the input file or zip entry and decompresses it
+func openInput(input string) (*inputReader, error) {
+	name, entry, isEntry := splitZipEntry(input)
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	r := &inputReader{closers: []io.Closer{file}}
+	if r.info, err = file.Stat(); err != nil {
+		r.Close()
+		return nil, err
+	}
+	if isEntry {
+		if err := r.openZipEntry(file, entry); err != nil {
+			r.Close()
+			return nil, fmt.Errorf("%s: %w", input, err)
+		}
+		return r, nil
+	}
+
+	codec := detectCodec(name, file)
+	r.progress = util.NewProgressReader(file, r.info.Size())
+	switch codec {
+	case codecNone:
+		r.Reader = r.progress
+		r.file = file
+	case codecGzip:
+		zr, err := gzip.NewReader(r.progress)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("%s: %w", input, err)
+		}
+		r.Reader = zr
+		r.closers = append(r.closers, zr)
+	case codecZstd:
+		zr, err := zstd.NewReader(r.progress)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("%s: %w", input, err)
+		}
+		r.Reader = zr
+		r.closers = append(r.closers, zr.IOReadCloser())
+	case codecBzip2:
+		r.Reader = bzip2.NewReader(r.progress)
+	case codecZip:
+		r.Close()
+		return nil, fmt.Errorf("%s is a zip archive, its entries are imported one by one", input)
+	}
+	return r, nil
+}
+
+// openZipEntry reads the raw entry, so the progress counts its compressed bytes
+func (r *inputReader) openZipEntry(file *os.File, entry string) error {
+	zr, err := zip.NewReader(file, r.info.Size())
+	if err != nil {
+		return err
+	}
+	var f *zip.File
+	for _, zf := range zr.File {
+		if zf.Name == entry {
+			f = zf
+			break
+		}
+	}
+	if f == nil {
+		return fmt.Errorf("no entry %s", entry)
+	}
+	raw, err := f.OpenRaw()
+	if err != nil {
+		return err
+	}
+	r.progress = util.NewProgressReader(raw, int64(f.CompressedSize64))
+	switch f.Method {
+	case zip.Store:
+		r.Reader = r.progress
+	case zip.Deflate:
+		fr := flate.NewReader(r.progress)
+		r.Reader = fr
+		r.closers = append(r.closers, fr)
+	default:
+		return fmt.Errorf("unsupported compression method %d of %s", f.Method, path.Base(entry))
+	}
+	return nil
+}
+
+// Info returns the file info of the file, or of the archive of a zip entry
+func (r *inputReader) Info() os.FileInfo {
+	return r.info
+}
+
+// Progress returns the progress of the compressed bytes read
+func (r *inputReader) Progress() float64 {
+	return r.progress.Progress()
+}
+
+// SkipTo moves to the offset of the decompressed content, the compressed content is read up to it
+func (r *inputReader) SkipTo(offset int64) error {
+	if offset == 0 {
+		return nil
+	}
+	if r.file != nil {
+		if _, err := r.file.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		r.progress.Skip(offset)
+		return nil
+	}
+	_, err := io.CopyN(io.Discard, r.Reader, offset)
+	return err
+}
+
+func (r *inputReader) Close() error {
+	var err error
+	for i := len(r.closers) - 1; i >= 0; i-- {
+		if e := r.closers[i].Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,96 @@
+package loader
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeCompressed writes the sample CSV compressed as gzip, zstd and zip into the directory
+func writeCompressed(t *testing.T, dir string, sample []byte) {
+	t.Helper()
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(sample)
+	require.NoError(t, gw.Close())
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "sample.csv.gz"), gz.Bytes(), 0644))
+	// without extension, detected by its magic bytes
+	var zst bytes.Buffer
+	zw, err := zstd.NewWriter(&zst)
+	require.NoError(t, err)
+	zw.Write(sample)
+	require.NoError(t, zw.Close())
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "sample-zstd"), zst.Bytes(), 0644))
+
+	var zipped bytes.Buffer
+	w := zip.NewWriter(&zipped)
+	for _, h := range []*zip.FileHeader{
+		{Name: "2025/deflated.csv", Method: zip.Deflate},
+		{Name: "2025/stored.csv", Method: zip.Store},
+		{Name: "README.txt", Method: zip.Deflate},
+	} {
+		f, err := w.CreateHeader(h)
+		require.NoError(t, err)
+		f.Write(sample)
+	}
+	require.NoError(t, w.Close())
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "bundle.zip"), zipped.Bytes(), 0644))
+}
+
+func TestOpenInput(t *testing.T) {
+	sample, err := os.ReadFile("./test_data/sample.csv")
+	require.NoError(t, err)
+	dir := t.TempDir()
+	writeCompressed(t, dir, sample)
+
+	inputs := []string{
+		"./test_data/sample.csv",
+		"./test_data/sample.csv.bz2",
+		filepath.Join(dir, "sample.csv.gz"),
+		filepath.Join(dir, "sample-zstd"),
+		filepath.Join(dir, "bundle.zip") + zipEntrySep + "2025/deflated.csv",
+		filepath.Join(dir, "bundle.zip") + zipEntrySep + "2025/stored.csv",
+	}
+	for _, input := range inputs {
+		r, err := openInput(input)
+		require.NoError(t, err, input)
+		data, err := io.ReadAll(r)
+		require.NoError(t, err, input)
+		assert.Equal(t, sample, data, input)
+		assert.Equal(t, 1.0, r.Progress(), input)
+		require.NoError(t, r.Close())
+
+		// resume in the middle of the content
+		r, err = openInput(input)
+		require.NoError(t, err, input)
+		require.NoError(t, r.SkipTo(100), input)
+		data, err = io.ReadAll(r)
+		require.NoError(t, err, input)
+		assert.Equal(t, sample[100:], data, input)
+		require.NoError(t, r.Close())
+	}
+
+	_, err = openInput(filepath.Join(dir, "bundle.zip"))
+	assert.ErrorContains(t, err, "zip archive")
+	_, err = openInput(filepath.Join(dir, "bundle.zip") + zipEntrySep + "missing.csv")
+	assert.ErrorContains(t, err, "no entry")
+
+	conf := NewConfig()
+	conf.Include = []string{"*.csv"}
+	files, err := conf.InputFiles([]string{dir})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(dir, "bundle.zip") + zipEntrySep + "2025/deflated.csv",
+		filepath.Join(dir, "bundle.zip") + zipEntrySep + "2025/stored.csv",
+		filepath.Join(dir, "sample.csv.gz"),
+	}, files)
+	assert.Equal(t, filepath.Join(dir, "bundle.zip.2025_stored.csv.rej"), conf.RejectPath(files[1]))
+}
@@ -0,0 +1,190 @@
+package loader
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/machbase/neo-server/v8/api"
+)
+
+// jsonRecords reads the rows of a JSON Lines file, one JSON object per line.
+// A column takes the field of its name, case-insensitive, or the dotted path
+// of the column names file, e.g. "NAME=device.name".
+// The fields that no column takes are packed into the JSONExtraColumn, if any.
+type jsonRecords struct {
+	r          *bufio.Reader
+	offset     int64 // of the input after the last line read
+	lines      int64
+	cols       api.Columns
+	converters []func(string) (any, error)
+	paths      [][]string      // the path of the field of each column, nil for the extra column
+	extra      int             // index of the extra column, -1 if none
+	mapped     map[string]bool // the lower case names of the fields taken by a column
+}
+
+func (w *Worker) newJSONRecords(input io.Reader, cols api.Columns, columnNames []string, offset, lines int64) (*jsonRecords, error) {
+	paths := make(map[string][]string)
+	for _, name := range columnNames {
+		col, path, _ := strings.Cut(name, "=")
+		if path == "" {
+			path = col
+		}
+		paths[strings.ToUpper(col)] = strings.Split(path, ".")
+	}
+	if _, ok := paths["_ARRIVAL_TIME"]; len(cols) > 0 && cols[0].Name == "_ARRIVAL_TIME" && !ok {
+		cols = cols[1:] // skip _ARRIVAL_TIME column
+	}
+
+	r := &jsonRecords{
+		r:          bufio.NewReader(input),
+		offset:     offset,
+		lines:      lines,
+		cols:       cols,
+		converters: w.buildConverters(cols),
+		paths:      make([][]string, len(cols)),
+		extra:      -1,
+		mapped:     make(map[string]bool),
+	}
+	for i, col := range cols {
+		if w.conf.JSONExtraColumn != "" && strings.EqualFold(col.Name, w.conf.JSONExtraColumn) {
+			r.extra = i
+			continue
+		}
+		path, ok := paths[col.Name]
+		if !ok {
+			path = []string{col.Name}
+		}
+		r.paths[i] = path
+		r.mapped[strings.ToLower(path[0])] = true
+	}
+	if w.conf.JSONExtraColumn != "" && r.extra < 0 {
+		return nil, fmt.Errorf("json-extra-column %s is not a column of %s", w.conf.JSONExtraColumn, w.conf.DstTable)
+	}
+	return r, nil
+}
+
+func (r *jsonRecords) Read() (*record, error) {
+	for {
+		data, err := r.r.ReadBytes('\n')
+		if err != nil && (err != io.EOF || len(data) == 0) {
+			return nil, err
+		}
+		r.offset += int64(len(data))
+		r.lines++
+		line := bytes.TrimSpace(data)
+		if len(line) == 0 {
+			continue // skip empty lines
+		}
+		rec := &record{line: r.lines, fields: []string{string(line)}}
+		rec.values, rec.err = r.convertLine(line)
+		return rec, nil
+	}
+}
+
+func (r *jsonRecords) Offset() int64 {
+	return r.offset
+}
+
+func (r *jsonRecords) Lines() int64 {
+	return r.lines
+}
+
+func (r *jsonRecords) Columns() api.Columns {
+	return r.cols
+}
+
+// convertLine converts the JSON object of a line to the values of the columns
+func (r *jsonRecords) convertLine(line []byte) ([]any, error) {
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("invalid data after the JSON object")
+	}
+	obj, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("not a JSON object")
+	}
+
+	values := make([]any, len(r.cols))
+	for i, path := range r.paths {
+		if path == nil {
+			continue
+		}
+		value := lookupPath(obj, path)
+		if value == nil {
+			continue // NULL
+		}
+		field, err := jsonField(value)
+		if err != nil {
+			return nil, &columnError{column: r.cols[i].Name, err: err}
+		}
+		if values[i], err = r.converters[i](field); err != nil {
+			return nil, &columnError{column: r.cols[i].Name, err: err}
+		}
+	}
+	if r.extra >= 0 {
+		unmapped := make(map[string]any)
+		for key, value := range obj {
+			if !r.mapped[strings.ToLower(key)] {
+				unmapped[key] = value
+			}
+		}
+		if len(unmapped) > 0 {
+			b, err := json.Marshal(unmapped)
+			if err != nil {
+				return nil, &columnError{column: r.cols[r.extra].Name, err: err}
+			}
+			values[r.extra] = string(b)
+		}
+	}
+	return values, nil
+}
+
+// lookupPath returns the value of the path of nested objects, nil if there is none.
+// The names of the path are matched exactly, or else case-insensitive.
+func lookupPath(obj map[string]any, path []string) any {
+	var value any = obj
+	for _, name := range path {
+		m, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		if value, ok = m[name]; ok {
+			continue
+		}
+		for key, v := range m {
+			if strings.EqualFold(key, name) {
+				value, ok = v, true
+				break
+			}
+		}
+		if !ok {
+			return nil
+		}
+	}
+	return value
+}
+
+// jsonField returns the value as a field for the converters, an object or an array is its JSON
+func jsonField(value any) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	default:
+		b, err := json.Marshal(v)
+		return string(b), err
+	}
+}
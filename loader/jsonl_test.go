@@ -0,0 +1,68 @@
+package loader
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/machbase/neo-server/v8/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONRecords(t *testing.T) {
+	conf := NewConfig()
+	conf.Format = FormatJSONL
+	conf.Timeformat = "s"
+	conf.JSONExtraColumn = "extra"
+	w := conf.NewWorker("test.jsonl")
+
+	cols := api.Columns{
+		{Name: "_ARRIVAL_TIME", Type: api.ColumnTypeDatetime},
+		{Name: "NAME", Type: api.ColumnTypeVarchar},
+		{Name: "TIME", Type: api.ColumnTypeDatetime},
+		{Name: "VALUE", Type: api.ColumnTypeDouble},
+		{Name: "TAGS", Type: api.ColumnTypeJSON},
+		{Name: "EXTRA", Type: api.ColumnTypeJSON},
+	}
+	input := `{"Name":"a","time":1742349379,"value":0.5,"tags":["x"],"site":"A"}
+
+{"name":"b","value":"x"}
+[1,2]
+{"name":"c"} {}
+{"device":{"name":"d"},"time":1742349380,"value":null}
+`
+	records, err := w.newRecordReader(strings.NewReader(input), cols, []string{"name=device.name"}, 0, 0)
+	require.NoError(t, err)
+
+	var got []*record
+	for {
+		rec, err := records.Read()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		got = append(got, rec)
+	}
+	require.Len(t, got, 5)
+	assert.Equal(t, int64(len(input)), records.Offset())
+	assert.Equal(t, int64(6), records.Lines())
+
+	// the name is taken by the path of the column names file
+	assert.NoError(t, got[0].err)
+	assert.Equal(t, []any{nil, int64(1742349379000000000), 0.5, `["x"]`, `{"Name":"a","site":"A"}`}, got[0].values)
+
+	assert.Equal(t, int64(3), got[1].line)
+	assert.ErrorContains(t, got[1].err, "column VALUE")
+	assert.Equal(t, []string{`{"name":"b","value":"x"}`}, got[1].fields)
+	assert.ErrorContains(t, got[2].err, "not a JSON object")
+	assert.ErrorContains(t, got[3].err, "invalid data after the JSON object")
+
+	assert.NoError(t, got[4].err)
+	assert.Equal(t, int64(6), got[4].line)
+	assert.Equal(t, []any{"d", int64(1742349380000000000), nil, nil, nil}, got[4].values)
+
+	conf.JSONExtraColumn = "missing"
+	_, err = w.newRecordReader(strings.NewReader(input), cols, nil, 0, 0)
+	assert.ErrorContains(t, err, "json-extra-column missing is not a column")
+}
@@ -8,6 +8,9 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	sync "sync"
 
 	"fortio.org/progressbar"
@@ -15,7 +18,7 @@ import (
 	"github.com/tochemey/goakt/v3/goaktpb"
 )
 
-// Loader is a tool to import CSV files into Machbase.
+// Loader is a tool to import CSV or JSON Lines files into Machbase.
 //
 // Usage:
 //
@@ -46,6 +49,9 @@ func Main() int {
 	if err := svr.Shutdown(ctx); err != nil {
 		panic(err)
 	}
+	if runner.Failed() {
+		return 1
+	}
 	return 0
 }
 
@@ -53,12 +59,21 @@ type Runner struct {
 	Conf   *Config
 	silent bool // if true, suppresses progress output
 
-	files    []string
-	workerWg sync.WaitGroup
-	startWg  chan struct{}
-	log      *util.Log
-	bars     map[string]*progressbar.Bar
-	multiBar *progressbar.MultiBar
+	files        []string
+	requests     []*Request               // the files and the chunks of the files to import
+	nextRequest  int                      // index of the next request to hand to a worker
+	chunks       map[string]*Request      // by chunk name
+	fileProgress map[string]*fileProgress // of the files split into chunks, by file
+	workerWg     sync.WaitGroup
+	startWg      chan struct{}
+	log          *util.Log
+	bars         map[string]*progressbar.Bar // by worker name
+	multiBar     *progressbar.MultiBar
+
+	prefixWidth int // length of the longest file name
+
+	reports  map[string]string // dry run reports, by file
+	failures int               // files that failed, or files of a dry run with rejected rows
 }
 
 func NewRunner() *Runner {
@@ -82,28 +97,143 @@ func NewRunner() *Runner {
 	flag.DurationVar(&conf.DelayForTest, "delay", 0, "Delay for testing purposes")
 	flag.BoolVar(&r.silent, "silent", false, "If true, suppresses progress output")
 	flag.StringVar(&conf.ColumnNamesFile, "column-names-file", "", "File containing column names for the CSV file (optional)")
+	flag.Func("include", "Comma separated patterns of the files to import from directories and globs, e.g. '*.csv'", patternsFlag(&conf.Include))
+	flag.Func("exclude", "Comma separated patterns of the files and directories to skip, e.g. '*.tmp,archive'", patternsFlag(&conf.Exclude))
+	flag.StringVar(&conf.OrderBy, "order", conf.OrderBy, "Import order of the files of a directory or a glob, 'name' or 'mtime'")
+	flag.IntVar(&conf.MaxWorkers, "max-workers", conf.MaxWorkers, "Maximum number of files imported at the same time")
+	flag.StringVar(&conf.CheckpointFile, "checkpoint-file", "", "File of the import checkpoints, required by -resume")
+	flag.DurationVar(&conf.CheckpointInterval, "checkpoint-interval", conf.CheckpointInterval, "Interval of the checkpoints of a file")
+	flag.BoolVar(&conf.Resume, "resume", false, "Skip the imported files and resume the others from their last checkpoint")
+	flag.StringVar(&conf.RejectDir, "reject-dir", "", "Directory of the reject files, next to the input files if empty")
+	flag.Int64Var(&conf.MaxErrors, "max-errors", conf.MaxErrors, "Maximum number of rejected rows of a file before it is aborted, 0 aborts at the first one, no limit if negative")
+	flag.Float64Var(&conf.MaxErrorRate, "max-error-rate", conf.MaxErrorRate, "Maximum rate of rejected rows of a file before it is aborted, e.g. 0.01, no limit if 0")
+	flag.StringVar(&conf.Format, "format", conf.Format, "Format of the input files, 'csv' or 'jsonl' (JSON Lines, NDJSON)")
+	flag.StringVar(&conf.JSONExtraColumn, "json-extra-column", "", "JSON column of the fields of a JSON line that no column takes, the fields are dropped if empty")
+	flag.BoolVar(&conf.HeaderMapping, "header-mapping", false, "Map the fields of the CSV header to the table columns by name, case and whitespace insensitive")
+	flag.Func("header-alias", "Other header names of a column, e.g. 'TIME=timestamp,ts', the flag can be repeated", aliasFlag(&conf.HeaderAliases))
+	flag.Func("header-required", "Comma separated columns that must be in the header, besides the tag name and the base time", patternsFlag(&conf.HeaderRequired))
+	flag.BoolVar(&conf.Pivot, "pivot", false, "Import every cell of a wide CSV row as a row of the tag name, the time and the value of a TAG table")
+	flag.StringVar(&conf.PivotTimeColumn, "pivot-time-column", "", "Header name of the timestamp field of a wide row, the first field if empty")
+	flag.StringVar(&conf.PivotTagTemplate, "pivot-tag-template", conf.PivotTagTemplate, "Tag name of a cell, {header} is replaced by the header name of its field, e.g. 'plc1.{header}'")
+	flag.Func("pivot-scale", "Factor of the values of a field, e.g. 'temp=0.1', the flag can be repeated", scaleFlag(&conf.PivotScales))
+	flag.BoolVar(&conf.DryRun, "dry-run", false, "Convert the rows and report them without appending, exit non-zero if a row is rejected")
+	flag.Func("chunk-size", "Split a file larger than the size into chunks imported in parallel, e.g. '256MB', no split if 0", sizeFlag(&conf.ChunkSize))
+	flag.BoolVar(&conf.CreateTable, "create-table", false, "Print the DDL of the table inferred from the sample rows of the first file if db-table does not exist")
+	flag.BoolVar(&conf.CreateTableYes, "yes", false, "Create the table of create-table and import the files, instead of printing the DDL")
+	flag.IntVar(&conf.SampleRows, "sample-rows", conf.SampleRows, "Number of rows sampled to infer the table of create-table")
 
 	return r
 }
 
+// patternsFlag appends the comma separated patterns of the flag to dst,
+// the flag can be repeated
+func patternsFlag(dst *[]string) func(string) error {
+	return func(s string) error {
+		for _, p := range strings.Split(s, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				*dst = append(*dst, p)
+			}
+		}
+		return nil
+	}
+}
+
+// aliasFlag adds the alias names of a column, e.g. "TIME=timestamp,ts", to dst,
+// the flag can be repeated
+func aliasFlag(dst *map[string][]string) func(string) error {
+	return func(s string) error {
+		col, names, ok := strings.Cut(s, "=")
+		if col = strings.ToUpper(strings.TrimSpace(col)); !ok || col == "" {
+			return fmt.Errorf("invalid alias %q, use COLUMN=name,name", s)
+		}
+		if *dst == nil {
+			*dst = make(map[string][]string)
+		}
+		for _, name := range strings.Split(names, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				(*dst)[col] = append((*dst)[col], name)
+			}
+		}
+		return nil
+	}
+}
+
+// scaleFlag adds the factor of a field, e.g. "temp=0.1", to dst,
+// the flag can be repeated
+func scaleFlag(dst *map[string]float64) func(string) error {
+	return func(s string) error {
+		name, factor, ok := strings.Cut(s, "=")
+		if name = strings.TrimSpace(name); !ok || name == "" {
+			return fmt.Errorf("invalid scale %q, use NAME=factor", s)
+		}
+		f, err := strconv.ParseFloat(strings.TrimSpace(factor), 64)
+		if err != nil {
+			return fmt.Errorf("invalid scale %q: %w", s, err)
+		}
+		if *dst == nil {
+			*dst = make(map[string]float64)
+		}
+		(*dst)[name] = f
+		return nil
+	}
+}
+
 func (r *Runner) Start(ctx context.Context, actorSystem actor.ActorSystem) {
 	if r.Conf.DstTable == "" {
 		flag.Usage()
 		panic("db-table is required")
 	}
 
-	for _, a := range flag.Args() {
-		stat, err := os.Stat(a)
+	switch strings.ToLower(r.Conf.Format) {
+	case "", FormatCSV:
+		r.Conf.Format = FormatCSV
+	case FormatJSONL, "ndjson":
+		r.Conf.Format = FormatJSONL
+	default:
+		flag.Usage()
+		panic("invalid format " + r.Conf.Format)
+	}
+
+	if r.Conf.HeaderMapping && (r.Conf.ColumnNamesFile != "" || r.Conf.Format != FormatCSV) {
+		flag.Usage()
+		panic("header-mapping is for CSV files without column-names-file")
+	}
+	if r.Conf.Pivot && (r.Conf.HeaderMapping || r.Conf.ColumnNamesFile != "" || r.Conf.Format != FormatCSV) {
+		flag.Usage()
+		panic("pivot is for CSV files without header-mapping and column-names-file")
+	}
+
+	files, err := r.Conf.InputFiles(flag.Args())
+	if err != nil {
+		panic(err)
+	}
+	r.files = files
+
+	if r.Conf.CreateTable {
+		if len(files) == 0 {
+			panic("create-table requires an input file")
+		}
+		ready, err := r.Conf.createTable(ctx, files[0], os.Stdout)
 		if err != nil {
 			panic(err)
 		}
-		if stat.IsDir() {
-			panic("directory is not supported: " + a)
+		if !ready {
+			r.files = nil // the DDL is printed for review
 		}
-		r.files = append(r.files, a)
 	}
 
-	_, err := actorSystem.Spawn(ctx, "runner", r, actor.WithLongLived())
+	if r.Conf.Resume && r.Conf.CheckpointFile == "" {
+		flag.Usage()
+		panic("resume requires checkpoint-file")
+	}
+	if r.Conf.CheckpointFile != "" {
+		r.Conf.checkpoints, err = LoadCheckpoints(r.Conf.CheckpointFile)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	_, err = actorSystem.Spawn(ctx, "runner", r, actor.WithLongLived())
 	if err != nil {
 		panic(err)
 	}
@@ -113,6 +243,20 @@ func (r *Runner) Wait() {
 	<-r.startWg
 	r.workerWg.Wait()
 	r.log.Println("End")
+
+	names := make([]string, 0, len(r.reports))
+	for name := range r.reports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprint(os.Stdout, r.reports[name])
+	}
+}
+
+// Failed returns true if a dry run found rejected rows or a file failed
+func (r *Runner) Failed() bool {
+	return r.failures > 0
 }
 
 func (r *Runner) PreStart(ctx *actor.Context) error {
@@ -136,22 +280,49 @@ func (r *Runner) Receive(ctx *actor.ReceiveContext) {
 			r.multiBar = &progressbar.MultiBar{Config: cfg}
 		}
 
-		for i, file := range r.files {
-			workerId := fmt.Sprintf("worker-%d", i+1)
-			r.log.Println("Importing ", workerId, " ", file)
+		r.requests = r.Conf.splitFiles(r.files)
+		r.chunks = make(map[string]*Request)
+		r.fileProgress = make(map[string]*fileProgress)
+		for _, req := range r.requests {
+			if req.End == 0 {
+				continue
+			}
+			r.chunks[chunkName(req.Src, req.Start, req.End)] = req
+			fp, ok := r.fileProgress[req.Src]
+			if !ok {
+				fp = &fileProgress{done: make(map[string]int64), dryRuns: make(map[string]*DryRun)}
+				r.fileProgress[req.Src] = fp
+				if !r.silent {
+					// a single bar of all the chunks of the file
+					cfg.Prefix = r.barPrefix(req.Src)
+					fp.bar = cfg.NewBar()
+					r.multiBar.Add(fp.bar)
+				}
+			}
+			fp.size = max(fp.size, req.End)
+			fp.chunks = append(fp.chunks, req)
+		}
 
+		workers := len(r.requests)
+		if r.Conf.MaxWorkers > 0 && r.Conf.MaxWorkers < workers {
+			workers = r.Conf.MaxWorkers
+		}
+		r.workerWg.Add(len(r.requests))
+		for i := 0; i < workers; i++ {
+			workerId := fmt.Sprintf("worker-%d", i+1)
 			if !r.silent {
-				cfg.Prefix = filepath.Base(file)
+				cfg.Prefix = r.barPrefix("")
 				bar := cfg.NewBar()
 				r.multiBar.Add(bar)
-				r.bars[file] = bar
+				r.bars[workerId] = bar
 			}
 
-			worker := r.Conf.NewWorker(file)
-			wpid := ctx.Spawn(workerId, worker, actor.WithLongLived())
+			// a worker that fails a file resumes with the next one
+			worker := r.Conf.NewWorker("")
+			wpid := ctx.Spawn(workerId, worker, actor.WithLongLived(),
+				actor.WithSupervisor(actor.NewSupervisor(actor.WithAnyErrorDirective(actor.ResumeDirective))))
 			ctx.Watch(wpid)
-			ctx.Tell(wpid, &Request{})
-			r.workerWg.Add(1)
+			r.next(ctx, wpid)
 		}
 		if !r.silent {
 			r.multiBar.PrefixesAlign()
@@ -171,20 +342,81 @@ func (r *Runner) Receive(ctx *actor.ReceiveContext) {
 			if r.silent {
 				r.log.Printf("%s progress: %.2f%%", msg.Src, pct)
 			} else {
-				r.bars[msg.Src].Progress(pct)
+				r.bars[ctx.Sender().Name()].Progress(pct)
 			}
+			r.chunkProgress(msg.Src, msg.Progress)
 		case WorkStateDone:
 			if r.silent {
-				r.log.Println(msg.Src, " done.", " success:", msg.Success, ", fail:", msg.Fail)
+				r.log.Println(msg.Src, " done.", " success:", msg.Success, ", fail:", msg.Fail, ", rejected:", msg.Rejected)
 			} else {
-				r.bars[msg.Src].Progress(100)
+				r.bars[ctx.Sender().Name()].Progress(100)
+			}
+			r.chunkProgress(msg.Src, 1)
+			if !r.chunkDone(msg) && r.Conf.DryRun {
+				r.addReport(msg.Src, msg.DryRun)
 			}
 			r.workerWg.Done()
+			r.next(ctx, ctx.Sender())
 		case WorkStateError:
 			r.log.Println(msg.Src, " ERROR: ", msg.Message)
+			r.failures++
+			r.chunkDone(msg)
 			r.workerWg.Done()
+			r.next(ctx, ctx.Sender())
 		}
 	default:
 		ctx.Unhandled()
 	}
 }
+
+// addReport keeps the dry run report of the file, merged from the dry runs of its chunks
+func (r *Runner) addReport(path string, dryRuns ...*DryRun) {
+	report := newDryRunReport(path, nil, r.Conf.tz)
+	for _, dryRun := range dryRuns {
+		if dryRun != nil {
+			report.merge(dryRun)
+		}
+	}
+	if r.reports == nil {
+		r.reports = make(map[string]string)
+	}
+	r.reports[path] = report.String()
+	if report.Rejected > 0 {
+		r.failures++
+	}
+}
+
+// next hands the next file or chunk to the worker, if any is left
+func (r *Runner) next(ctx *actor.ReceiveContext, worker *actor.PID) {
+	if r.nextRequest >= len(r.requests) {
+		return
+	}
+	req := r.requests[r.nextRequest]
+	r.nextRequest++
+	if req.End > 0 {
+		r.log.Println("Importing ", worker.Name(), " ", chunkName(req.Src, req.Start, req.End))
+	} else {
+		r.log.Println("Importing ", worker.Name(), " ", req.Src)
+	}
+
+	if bar, ok := r.bars[worker.Name()]; ok {
+		bar.UpdatePrefix(r.barPrefix(req.Src))
+		bar.Progress(0)
+	}
+	ctx.Tell(worker, req)
+}
+
+// barPrefix returns the base name of the file padded to the longest one,
+// so the bars of the workers stay aligned when they move to the next file
+func (r *Runner) barPrefix(file string) string {
+	if r.prefixWidth == 0 {
+		for _, f := range r.files {
+			r.prefixWidth = max(r.prefixWidth, len(filepath.Base(f)))
+		}
+	}
+	name := ""
+	if file != "" {
+		name = filepath.Base(file)
+	}
+	return fmt.Sprintf("%-*s", r.prefixWidth, name)
+}
@@ -24,6 +24,10 @@ const (
 type Request struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Cmd           string                 `protobuf:"bytes,1,opt,name=cmd,proto3" json:"cmd,omitempty"`
+	Src           string                 `protobuf:"bytes,2,opt,name=src,proto3" json:"src,omitempty"`      // file to import, the input of the worker if empty
+	Start         int64                  `protobuf:"varint,3,opt,name=start,proto3" json:"start,omitempty"` // offset of the chunk of the file to import
+	End           int64                  `protobuf:"varint,4,opt,name=end,proto3" json:"end,omitempty"`     // end offset of the chunk, the whole file if 0
+	Line          int64                  `protobuf:"varint,5,opt,name=line,proto3" json:"line,omitempty"`   // number of lines before the chunk
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -65,14 +69,44 @@ func (x *Request) GetCmd() string {
 	return ""
 }
 
+func (x *Request) GetSrc() string {
+	if x != nil {
+		return x.Src
+	}
+	return ""
+}
+
+func (x *Request) GetStart() int64 {
+	if x != nil {
+		return x.Start
+	}
+	return 0
+}
+
+func (x *Request) GetEnd() int64 {
+	if x != nil {
+		return x.End
+	}
+	return 0
+}
+
+func (x *Request) GetLine() int64 {
+	if x != nil {
+		return x.Line
+	}
+	return 0
+}
+
 type Progress struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Src           string                 `protobuf:"bytes,1,opt,name=src,proto3" json:"src,omitempty"`
-	State         int32                  `protobuf:"varint,3,opt,name=state,proto3" json:"state,omitempty"`        // WorkerState
-	Message       string                 `protobuf:"bytes,4,opt,name=message,proto3" json:"message,omitempty"`     // error message if state is "error"
-	Progress      float64                `protobuf:"fixed64,5,opt,name=progress,proto3" json:"progress,omitempty"` // 0.0 to 1.0
-	Success       int64                  `protobuf:"varint,6,opt,name=success,proto3" json:"success,omitempty"`    // number of successful imports
-	Fail          int64                  `protobuf:"varint,7,opt,name=fail,proto3" json:"fail,omitempty"`          // number of failed imports
+	State         int32                  `protobuf:"varint,3,opt,name=state,proto3" json:"state,omitempty"`                // WorkerState
+	Message       string                 `protobuf:"bytes,4,opt,name=message,proto3" json:"message,omitempty"`             // error message if state is "error"
+	Progress      float64                `protobuf:"fixed64,5,opt,name=progress,proto3" json:"progress,omitempty"`         // 0.0 to 1.0
+	Success       int64                  `protobuf:"varint,6,opt,name=success,proto3" json:"success,omitempty"`            // number of successful imports
+	Fail          int64                  `protobuf:"varint,7,opt,name=fail,proto3" json:"fail,omitempty"`                  // number of failed imports
+	Rejected      int64                  `protobuf:"varint,8,opt,name=rejected,proto3" json:"rejected,omitempty"`          // number of rows rejected by the loader, written to the reject file
+	DryRun        *DryRun                `protobuf:"bytes,9,opt,name=dry_run,json=dryRun,proto3" json:"dry_run,omitempty"` // counts of a dry run, with state "done"
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -149,20 +183,162 @@ func (x *Progress) GetFail() int64 {
 	return 0
 }
 
+func (x *Progress) GetRejected() int64 {
+	if x != nil {
+		return x.Rejected
+	}
+	return 0
+}
+
+func (x *Progress) GetDryRun() *DryRun {
+	if x != nil {
+		return x.DryRun
+	}
+	return nil
+}
+
+// DryRun is the result of a dry run of a file or a chunk of a file
+type DryRun struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Rows          int64                  `protobuf:"varint,1,opt,name=rows,proto3" json:"rows,omitempty"`
+	Rejected      int64                  `protobuf:"varint,2,opt,name=rejected,proto3" json:"rejected,omitempty"`
+	Failures      map[string]int64       `protobuf:"bytes,3,rep,name=failures,proto3" json:"failures,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"varint,2,opt,name=value"` // rejected rows by column, "" for the rows that are not valid as a whole
+	Columns       []string               `protobuf:"bytes,4,rep,name=columns,proto3" json:"columns,omitempty"`
+	Nulls         []int64                `protobuf:"varint,5,rep,packed,name=nulls,proto3" json:"nulls,omitempty"` // NULL values of every column
+	Min           []int64                `protobuf:"varint,6,rep,packed,name=min,proto3" json:"min,omitempty"`     // of the datetime columns, in nanoseconds
+	Max           []int64                `protobuf:"varint,7,rep,packed,name=max,proto3" json:"max,omitempty"`
+	HasTime       []bool                 `protobuf:"varint,8,rep,packed,name=has_time,json=hasTime,proto3" json:"has_time,omitempty"` // a datetime column has a value
+	Samples       []string               `protobuf:"bytes,9,rep,name=samples,proto3" json:"samples,omitempty"`                        // the first rejected rows
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DryRun) Reset() {
+	*x = DryRun{}
+	mi := &file_loader_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DryRun) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DryRun) ProtoMessage() {}
+
+func (x *DryRun) ProtoReflect() protoreflect.Message {
+	mi := &file_loader_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DryRun.ProtoReflect.Descriptor instead.
+func (*DryRun) Descriptor() ([]byte, []int) {
+	return file_loader_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *DryRun) GetRows() int64 {
+	if x != nil {
+		return x.Rows
+	}
+	return 0
+}
+
+func (x *DryRun) GetRejected() int64 {
+	if x != nil {
+		return x.Rejected
+	}
+	return 0
+}
+
+func (x *DryRun) GetFailures() map[string]int64 {
+	if x != nil {
+		return x.Failures
+	}
+	return nil
+}
+
+func (x *DryRun) GetColumns() []string {
+	if x != nil {
+		return x.Columns
+	}
+	return nil
+}
+
+func (x *DryRun) GetNulls() []int64 {
+	if x != nil {
+		return x.Nulls
+	}
+	return nil
+}
+
+func (x *DryRun) GetMin() []int64 {
+	if x != nil {
+		return x.Min
+	}
+	return nil
+}
+
+func (x *DryRun) GetMax() []int64 {
+	if x != nil {
+		return x.Max
+	}
+	return nil
+}
+
+func (x *DryRun) GetHasTime() []bool {
+	if x != nil {
+		return x.HasTime
+	}
+	return nil
+}
+
+func (x *DryRun) GetSamples() []string {
+	if x != nil {
+		return x.Samples
+	}
+	return nil
+}
+
 var File_loader_proto protoreflect.FileDescriptor
 
 const file_loader_proto_rawDesc = "" +
 	"\n" +
-	"\floader.proto\x12\x06loader\"\x1b\n" +
+	"\floader.proto\x12\x06loader\"i\n" +
 	"\aRequest\x12\x10\n" +
-	"\x03cmd\x18\x01 \x01(\tR\x03cmd\"\x96\x01\n" +
+	"\x03cmd\x18\x01 \x01(\tR\x03cmd\x12\x10\n" +
+	"\x03src\x18\x02 \x01(\tR\x03src\x12\x14\n" +
+	"\x05start\x18\x03 \x01(\x03R\x05start\x12\x10\n" +
+	"\x03end\x18\x04 \x01(\x03R\x03end\x12\x12\n" +
+	"\x04line\x18\x05 \x01(\x03R\x04line\"\xdb\x01\n" +
 	"\bProgress\x12\x10\n" +
 	"\x03src\x18\x01 \x01(\tR\x03src\x12\x14\n" +
 	"\x05state\x18\x03 \x01(\x05R\x05state\x12\x18\n" +
 	"\amessage\x18\x04 \x01(\tR\amessage\x12\x1a\n" +
 	"\bprogress\x18\x05 \x01(\x01R\bprogress\x12\x18\n" +
 	"\asuccess\x18\x06 \x01(\x03R\asuccess\x12\x12\n" +
-	"\x04fail\x18\a \x01(\x03R\x04failB\x0fZ\ractsvr/loaderb\x06proto3"
+	"\x04fail\x18\a \x01(\x03R\x04fail\x12\x1a\n" +
+	"\brejected\x18\b \x01(\x03R\brejected\x12'\n" +
+	"\adry_run\x18\t \x01(\v2\x0e.loader.DryRunR\x06dryRun\"\xb8\x02\n" +
+	"\x06DryRun\x12\x12\n" +
+	"\x04rows\x18\x01 \x01(\x03R\x04rows\x12\x1a\n" +
+	"\brejected\x18\x02 \x01(\x03R\brejected\x128\n" +
+	"\bfailures\x18\x03 \x03(\v2\x1c.loader.DryRun.FailuresEntryR\bfailures\x12\x18\n" +
+	"\acolumns\x18\x04 \x03(\tR\acolumns\x12\x14\n" +
+	"\x05nulls\x18\x05 \x03(\x03R\x05nulls\x12\x10\n" +
+	"\x03min\x18\x06 \x03(\x03R\x03min\x12\x10\n" +
+	"\x03max\x18\a \x03(\x03R\x03max\x12\x19\n" +
+	"\bhas_time\x18\b \x03(\bR\ahasTime\x12\x18\n" +
+	"\asamples\x18\t \x03(\tR\asamples\x1a;\n" +
+	"\rFailuresEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\x03R\x05value:\x028\x01B\x0fZ\ractsvr/loaderb\x06proto3"
 
 var (
 	file_loader_proto_rawDescOnce sync.Once
@@ -176,17 +352,21 @@ func file_loader_proto_rawDescGZIP() []byte {
 	return file_loader_proto_rawDescData
 }
 
-var file_loader_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_loader_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
 var file_loader_proto_goTypes = []any{
 	(*Request)(nil),  // 0: loader.Request
 	(*Progress)(nil), // 1: loader.Progress
+	(*DryRun)(nil),   // 2: loader.DryRun
+	nil,              // 3: loader.DryRun.FailuresEntry
 }
 var file_loader_proto_depIdxs = []int32{
-	0, // [0:0] is the sub-list for method output_type
-	0, // [0:0] is the sub-list for method input_type
-	0, // [0:0] is the sub-list for extension type_name
-	0, // [0:0] is the sub-list for extension extendee
-	0, // [0:0] is the sub-list for field type_name
+	2, // 0: loader.Progress.dry_run:type_name -> loader.DryRun
+	3, // 1: loader.DryRun.failures:type_name -> loader.DryRun.FailuresEntry
+	2, // [2:2] is the sub-list for method output_type
+	2, // [2:2] is the sub-list for method input_type
+	2, // [2:2] is the sub-list for extension type_name
+	2, // [2:2] is the sub-list for extension extendee
+	0, // [0:2] is the sub-list for field type_name
 }
 
 func init() { file_loader_proto_init() }
@@ -200,7 +380,7 @@ func file_loader_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_loader_proto_rawDesc), len(file_loader_proto_rawDesc)),
 			NumEnums:      0,
-			NumMessages:   2,
+			NumMessages:   4,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
@@ -1,14 +1,26 @@
 package loader
 
 import (
+	"actsvr/util"
+	"bytes"
 	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"fortio.org/progressbar"
 	"github.com/machbase/neo-server/v8/api"
 	"github.com/machbase/neo-server/v8/api/testsuite"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tochemey/goakt/v3/actor"
 )
 
 var testServer *testsuite.Server
@@ -114,3 +126,511 @@ func TestLoader(t *testing.T) {
 		conn.Exec(ctx, "DROP TABLE tag")
 	})
 }
+
+// runLoader imports the files with a runner of the configuration in its own actor system
+func runLoader(t *testing.T, conf *Config, files []string) *Runner {
+	t.Helper()
+	ctx := context.Background()
+	actorSystem, err := actor.NewActorSystem("loader-test", actor.WithLogger(util.NewLog(util.DefaultLogConfig())))
+	require.NoError(t, err)
+	require.NoError(t, actorSystem.Start(ctx))
+	defer actorSystem.Stop(ctx)
+
+	runner := &Runner{
+		Conf:    conf,
+		silent:  true,
+		files:   files,
+		startWg: make(chan struct{}),
+		bars:    make(map[string]*progressbar.Bar),
+	}
+	_, err = actorSystem.Spawn(ctx, "runner", runner, actor.WithLongLived())
+	require.NoError(t, err)
+	runner.Wait()
+	return runner
+}
+
+// testConfig returns the configuration to import the sample files into the table
+func testConfig(t *testing.T, table string) *Config {
+	t.Helper()
+	ctx := context.Background()
+	conn, err := testServer.DatabaseSVR().Connect(ctx, api.WithTrustUser("sys"))
+	require.NoError(t, err)
+	defer conn.Close()
+	result := conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS `+table+` (
+			NAME VARCHAR(200),
+			TIME DATETIME,
+			VALUE DOUBLE,
+			SVAL VARCHAR(200),
+			IVAL INT64,
+			DVAL DOUBLE
+		)`)
+	require.NoError(t, result.Err())
+
+	conf := NewConfig()
+	conf.DstPort = testServer.MachPort()
+	conf.DstTable = table
+	conf.ColumnNamesFile = "./test_data/sample-cols.txt"
+	conf.SkipHeader = true
+	conf.Timeformat = "2006-01-02 15:04:05"
+	conf.Timezone = "Asia/Seoul"
+	return conf
+}
+
+// countRows returns the number of rows of the table
+func countRows(t *testing.T, table string) int64 {
+	t.Helper()
+	ctx := context.Background()
+	conn, err := testServer.DatabaseSVR().Connect(ctx, api.WithTrustUser("sys"))
+	require.NoError(t, err)
+	defer conn.Close()
+	var count int64
+	require.NoError(t, conn.QueryRow(ctx, "SELECT COUNT(*) FROM "+table).Scan(&count))
+	return count
+}
+
+func TestLoaderDirectory(t *testing.T) {
+	sample, err := os.ReadFile("./test_data/sample.csv")
+	require.NoError(t, err)
+	dir := t.TempDir()
+	for _, name := range []string{"a.csv", "b.csv", "sub/c.csv", "sub/d.csv", "skip.txt"} {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, sample, 0644))
+	}
+
+	conf := testConfig(t, "LOG_DIR")
+	conf.Include = []string{"*.csv"}
+	conf.MaxWorkers = 2
+	files, err := conf.InputFiles([]string{dir})
+	require.NoError(t, err)
+	require.Len(t, files, 4)
+
+	// the workers that fail a file go on with the next ones
+	missing := []string{filepath.Join(dir, "missing-1.csv"), filepath.Join(dir, "missing-2.csv")}
+	runLoader(t, conf, append(missing, files...))
+	assert.Equal(t, int64(4*6), countRows(t, "LOG_DIR"))
+}
+
+func TestLoaderResume(t *testing.T) {
+	dir := t.TempDir()
+	sample, err := os.ReadFile("./test_data/sample.csv")
+	require.NoError(t, err)
+	file := filepath.Join(dir, "sample.csv")
+	require.NoError(t, os.WriteFile(file, sample, 0644))
+	info, err := os.Stat(file)
+	require.NoError(t, err)
+
+	// the import died after the header and 3 rows were flushed
+	reader := csv.NewReader(bytes.NewReader(sample))
+	for i := 0; i < 4; i++ {
+		_, err := reader.Read()
+		require.NoError(t, err)
+	}
+	conf := testConfig(t, "LOG_RESUME")
+	conf.CheckpointFile = filepath.Join(dir, "loader.checkpoint")
+	conf.CheckpointInterval = time.Nanosecond // flush and checkpoint after every row
+	conf.Resume = true
+	checkpoints, err := LoadCheckpoints(conf.CheckpointFile)
+	require.NoError(t, err)
+	require.NoError(t, checkpoints.Save(Checkpoint{
+		Path: file, Size: info.Size(), ModTime: info.ModTime(), Offset: reader.InputOffset(), Rows: 3,
+	}))
+
+	conf.checkpoints, err = LoadCheckpoints(conf.CheckpointFile)
+	require.NoError(t, err)
+	runLoader(t, conf, []string{file})
+	assert.Equal(t, int64(3), countRows(t, "LOG_RESUME"))
+
+	checkpoints, err = LoadCheckpoints(conf.CheckpointFile)
+	require.NoError(t, err)
+	cp := checkpoints.Get(file, info)
+	require.NotNil(t, cp)
+	assert.True(t, cp.Done)
+	assert.Equal(t, int64(6), cp.Rows)
+	assert.Equal(t, info.Size(), cp.Offset)
+
+	// a done file is skipped
+	runLoader(t, conf, []string{file})
+	assert.Equal(t, int64(3), countRows(t, "LOG_RESUME"))
+
+	// a changed file is imported again from the start
+	mtime := info.ModTime().Add(time.Minute)
+	require.NoError(t, os.Chtimes(file, mtime, mtime))
+	runLoader(t, conf, []string{file})
+	assert.Equal(t, int64(9), countRows(t, "LOG_RESUME"))
+}
+
+func TestLoaderRejects(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "rejects.csv")
+	require.NoError(t, os.WriteFile(file, []byte(`TIME,NAME,VALUE,SVAL,IVAL,DVAL
+2025-03-19 10:56:19,work-1,0.1,"multi
+line",0,1.1
+2025-03-19 10:56:20,work-1,abc,x,1,2.2
+2025-03-19 10:56:21,work-1,0.3,x,,3.3
+yesterday,work-1,0.4,x,3,4.4
+2025-03-19 10:56:23,work-1,0.5,x
+2025-03-19 10:56:24,work-1,0.6,x,5,6.6
+`), 0644))
+
+	conf := testConfig(t, "LOG_REJECTS")
+	conf.MaxErrors = -1
+	runner := runLoader(t, conf, []string{file})
+	assert.False(t, runner.Failed(), "the rejected rows are within the budget")
+	assert.Equal(t, int64(3), countRows(t, "LOG_REJECTS"))
+
+	rej, err := os.Open(conf.RejectPath(file))
+	require.NoError(t, err)
+	defer rej.Close()
+	reader := csv.NewReader(rej)
+	reader.FieldsPerRecord = -1
+	rejected, err := reader.ReadAll()
+	require.NoError(t, err)
+	require.Len(t, rejected, 3)
+	assert.Equal(t, []string{"4", `column VALUE: strconv.ParseFloat: parsing "abc": invalid syntax`,
+		"2025-03-19 10:56:20", "work-1", "abc", "x", "1", "2.2"}, rejected[0])
+	assert.Equal(t, "6", rejected[1][0])
+	assert.Contains(t, rejected[1][1], "column TIME")
+	assert.Equal(t, "7", rejected[2][0])
+	assert.Contains(t, rejected[2][1], "wrong number of fields")
+
+	// the file is aborted when the budget is exceeded, the rows appended before stay
+	conf = testConfig(t, "LOG_REJECTS_BUDGET")
+	conf.RejectDir = t.TempDir()
+	conf.MaxErrors = 1
+	runner = runLoader(t, conf, []string{file})
+	assert.True(t, runner.Failed(), "the aborted file fails the import")
+	assert.Equal(t, int64(2), countRows(t, "LOG_REJECTS_BUDGET"))
+	data, err := os.ReadFile(filepath.Join(conf.RejectDir, "rejects.csv.rej"))
+	require.NoError(t, err)
+	assert.Equal(t, 2, bytes.Count(data, []byte("\n")))
+}
+
+func TestErrorBudget(t *testing.T) {
+	conf := NewConfig()
+	assert.NoError(t, conf.checkErrorBudget(0, 10, false))
+	assert.ErrorContains(t, conf.checkErrorBudget(1, 10, false), "max-errors is 0", "the first rejected row aborts by default")
+
+	conf.MaxErrors = -1
+	assert.NoError(t, conf.checkErrorBudget(1000, 1000, true))
+
+	conf.MaxErrorRate = 0.1
+	assert.NoError(t, conf.checkErrorBudget(5, 10, false), "too few rows to check the rate")
+	assert.ErrorContains(t, conf.checkErrorBudget(5, 10, true), "max-error-rate is 10.00%")
+	assert.NoError(t, conf.checkErrorBudget(10, 100, false))
+	assert.Error(t, conf.checkErrorBudget(11, 100, false))
+}
+
+func TestRejectWriterResume(t *testing.T) {
+	conf := NewConfig()
+	input := filepath.Join(t.TempDir(), "data.csv")
+	rejectRows := func(resumed bool, rejected, size int64, lines ...int64) *rejectWriter {
+		rejects, err := conf.newRejectWriter(input, resumed, rejected, size)
+		require.NoError(t, err)
+		for _, line := range lines {
+			require.NoError(t, rejects.Reject(line, errors.New("bad"), []string{"x"}))
+		}
+		require.NoError(t, rejects.Flush())
+		return rejects
+	}
+	lines := func() int {
+		data, err := os.ReadFile(conf.RejectPath(input))
+		require.NoError(t, err)
+		return bytes.Count(data, []byte("\n"))
+	}
+
+	// the checkpoint is after line 2, line 5 is flushed before the import dies
+	rejects := rejectRows(false, 0, 0, 2)
+	size := rejects.Size()
+	require.NoError(t, rejects.Reject(5, errors.New("bad"), []string{"x"}))
+	require.NoError(t, rejects.Close())
+	assert.Equal(t, 2, lines())
+
+	// the resumed import rejects line 5 again
+	rejects = rejectRows(true, 1, size, 5, 7)
+	require.NoError(t, rejects.Close())
+	assert.Equal(t, 3, lines(), "line 5 is not written twice")
+	assert.Equal(t, int64(3), rejects.Count())
+
+	// a checkpoint without the size keeps the reject file
+	require.NoError(t, rejectRows(true, 3, 0).Close())
+	assert.Equal(t, 3, lines())
+	// a fresh import removes it
+	require.NoError(t, rejectRows(false, 0, 0).Close())
+	assert.NoFileExists(t, conf.RejectPath(input))
+}
+
+func TestLoaderCompressed(t *testing.T) {
+	sample, err := os.ReadFile("./test_data/sample.csv")
+	require.NoError(t, err)
+	dir := t.TempDir()
+	writeCompressed(t, dir, sample)
+
+	conf := testConfig(t, "LOG_COMPRESSED")
+	conf.Include = []string{"*.csv"}
+	files, err := conf.InputFiles([]string{dir, "./test_data/sample.csv.bz2"})
+	require.NoError(t, err)
+	require.Len(t, files, 4)
+
+	runLoader(t, conf, files)
+	assert.Equal(t, int64(4*6), countRows(t, "LOG_COMPRESSED"))
+}
+
+func TestLoaderJSONL(t *testing.T) {
+	ctx := context.Background()
+	conn, err := testServer.DatabaseSVR().Connect(ctx, api.WithTrustUser("sys"))
+	require.NoError(t, err)
+	defer conn.Close()
+	result := conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS LOG_JSONL (
+			NAME VARCHAR(200),
+			TIME DATETIME,
+			VALUE DOUBLE,
+			EXTRA JSON
+		)`)
+	require.NoError(t, result.Err())
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "events.jsonl")
+	require.NoError(t, os.WriteFile(file, []byte(`{"time":"2025-03-19 10:56:19","device":{"name":"work-1"},"value":0.1,"site":"A"}
+{"TIME":"2025-03-19 10:56:20","device":{"name":"work-1"},"value":0.2}
+{"time":"2025-03-19 10:56:21","device":{"name":"work-1"},"value":"abc"}
+not json
+`), 0644))
+	cols := filepath.Join(dir, "cols.txt")
+	require.NoError(t, os.WriteFile(cols, []byte("NAME=device.name\n"), 0644))
+
+	conf := NewConfig()
+	conf.DstPort = testServer.MachPort()
+	conf.DstTable = "LOG_JSONL"
+	conf.Format = FormatJSONL
+	conf.ColumnNamesFile = cols
+	conf.JSONExtraColumn = "extra"
+	conf.Timeformat = "2006-01-02 15:04:05"
+	conf.Timezone = "Asia/Seoul"
+	conf.MaxErrors = -1
+	runLoader(t, conf, []string{file})
+	assert.Equal(t, int64(2), countRows(t, "LOG_JSONL"))
+
+	var name, extra string
+	require.NoError(t, conn.QueryRow(ctx, "SELECT NAME, EXTRA FROM LOG_JSONL WHERE VALUE = 0.1").Scan(&name, &extra))
+	assert.Equal(t, "work-1", name)
+	assert.JSONEq(t, `{"site":"A"}`, extra)
+
+	data, err := os.ReadFile(conf.RejectPath(file))
+	require.NoError(t, err)
+	assert.Equal(t, 2, bytes.Count(data, []byte("\n")))
+	assert.True(t, bytes.HasPrefix(data, []byte("3,")))
+}
+
+func TestLoaderHeaderMapping(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "header.csv")
+	require.NoError(t, os.WriteFile(file, []byte(`Sensor Name,Timestamp,unit, value ,dval
+work-1,2025-03-19 10:56:19,C,0.1,1.1
+work-1,2025-03-19 10:56:20,C,0.2,2.2
+`), 0644))
+
+	conf := testConfig(t, "LOG_HEADER")
+	conf.ColumnNamesFile = ""
+	conf.SkipHeader = false
+	conf.HeaderMapping = true
+	conf.HeaderAliases = map[string][]string{"NAME": {"sensor name"}, "TIME": {"timestamp"}}
+	runLoader(t, conf, []string{file})
+	assert.Equal(t, int64(2), countRows(t, "LOG_HEADER"))
+
+	ctx := context.Background()
+	conn, err := testServer.DatabaseSVR().Connect(ctx, api.WithTrustUser("sys"))
+	require.NoError(t, err)
+	defer conn.Close()
+	var name string
+	var dval float64
+	require.NoError(t, conn.QueryRow(ctx, "SELECT NAME, DVAL FROM LOG_HEADER WHERE VALUE = 0.2").Scan(&name, &dval))
+	assert.Equal(t, "work-1", name)
+	assert.Equal(t, 2.2, dval)
+
+	// the file fails when a required column is not in the header
+	conf = testConfig(t, "LOG_HEADER_REQUIRED")
+	conf.ColumnNamesFile = ""
+	conf.HeaderMapping = true
+	conf.HeaderRequired = []string{"name"}
+	runLoader(t, conf, []string{file})
+	assert.Equal(t, int64(0), countRows(t, "LOG_HEADER_REQUIRED"))
+}
+
+func TestLoaderPivot(t *testing.T) {
+	ctx := context.Background()
+	conn, err := testServer.DatabaseSVR().Connect(ctx, api.WithTrustUser("sys"))
+	require.NoError(t, err)
+	defer conn.Close()
+	result := conn.Exec(ctx, `CREATE TAG TABLE IF NOT EXISTS TAG_PIVOT (
+			NAME VARCHAR(200) PRIMARY KEY,
+			TIME DATETIME BASETIME,
+			VALUE DOUBLE
+		)`)
+	require.NoError(t, result.Err())
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "wide.csv")
+	require.NoError(t, os.WriteFile(file, []byte(`time,temp_x10,pressure
+2025-03-19 10:56:19,215,1.5
+2025-03-19 10:56:20,,1.6
+2025-03-19 10:56:21,217,abc
+`), 0644))
+
+	conf := NewConfig()
+	conf.DstPort = testServer.MachPort()
+	conf.DstTable = "TAG_PIVOT"
+	conf.Pivot = true
+	conf.PivotTagTemplate = "line1.{header}"
+	conf.PivotScales = map[string]float64{"temp_x10": 0.1}
+	conf.Timeformat = "2006-01-02 15:04:05"
+	conf.Timezone = "Asia/Seoul"
+	runLoader(t, conf, []string{file})
+	assert.Equal(t, int64(4), countRows(t, "TAG_PIVOT"))
+
+	// the rows are summed here, a query by tag name may not see the rows just appended
+	rows, err := conn.Query(ctx, "SELECT NAME, VALUE FROM TAG_PIVOT")
+	require.NoError(t, err)
+	defer rows.Close()
+	values := make(map[string]float64)
+	for rows.Next() {
+		var name string
+		var value float64
+		require.NoError(t, rows.Scan(&name, &value))
+		values[name] += value
+	}
+	require.Len(t, values, 2)
+	assert.InDelta(t, 43.2, values["line1.temp_x10"], 1e-9)
+	assert.InDelta(t, 1.5+1.6, values["line1.pressure"], 1e-9)
+
+	data, err := os.ReadFile(conf.RejectPath(file))
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "pressure:")
+}
+
+func TestLoaderChunks(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("TIME,NAME,VALUE,SVAL,IVAL,DVAL\n")
+	for i := 0; i < 500; i++ {
+		ts := time.Date(2025, 3, 19, 10, 0, 0, 0, time.UTC).Add(time.Duration(i) * time.Second)
+		value := strconv.Itoa(i)
+		if i == 100 || i == 400 {
+			value = "abc"
+		}
+		fmt.Fprintf(&buf, "%s,work-1,%s,\"multi\nline\",%d,1.1\n", ts.Format("2006-01-02 15:04:05"), value, i)
+	}
+	dir := t.TempDir()
+	file := filepath.Join(dir, "big.csv")
+	require.NoError(t, os.WriteFile(file, buf.Bytes(), 0644))
+
+	conf := testConfig(t, "LOG_CHUNKS")
+	conf.ChunkSize = 4096
+	conf.RejectDir = dir
+	conf.MaxErrors = -1
+	runLoader(t, conf, []string{file})
+	assert.Equal(t, int64(498), countRows(t, "LOG_CHUNKS"))
+
+	// the reject files of the chunks are merged in the order of the file,
+	// the line of a rejected row counts the lines of the chunks before
+	rejects, err := filepath.Glob(filepath.Join(dir, "big.csv@*.rej"))
+	require.NoError(t, err)
+	assert.Empty(t, rejects)
+	rej, err := os.Open(conf.RejectPath(file))
+	require.NoError(t, err)
+	defer rej.Close()
+	reader := csv.NewReader(rej)
+	reader.FieldsPerRecord = -1
+	rejected, err := reader.ReadAll()
+	require.NoError(t, err)
+	require.Len(t, rejected, 2)
+	assert.Equal(t, "202", rejected[0][0])
+	assert.Equal(t, "802", rejected[1][0])
+
+	// a dry run reports the file, not its chunks
+	conf.DryRun = true
+	runner := runLoader(t, conf, []string{file})
+	require.Len(t, runner.reports, 1)
+	assert.Contains(t, runner.reports[file], "dry run of "+file+": 500 rows, 2 rejected")
+	assert.Contains(t, runner.reports[file], "line 202: column VALUE")
+	assert.Equal(t, 1, runner.failures)
+}
+
+func TestLoaderDryRun(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "dryrun.csv")
+	require.NoError(t, os.WriteFile(file, []byte(`TIME,NAME,VALUE,SVAL,IVAL,DVAL
+2025-03-19 10:56:19,work-1,0.1,x,0,1.1
+2025-03-19 10:56:20,work-1,abc,x,1,2.2
+2025-03-19 10:56:21,work-1,0.3,,,3.3
+2025-03-19 10:56:22,work-1,0.4
+`), 0644))
+
+	conf := testConfig(t, "LOG_DRYRUN")
+	conf.DryRun = true
+	runner := runLoader(t, conf, []string{file})
+	assert.True(t, runner.Failed())
+	assert.Equal(t, int64(0), countRows(t, "LOG_DRYRUN"))
+	assert.NoFileExists(t, conf.RejectPath(file))
+
+	report := runner.reports[file]
+	assert.Contains(t, report, "4 rows, 2 rejected")
+	assert.Contains(t, report, "2025-03-19T10:56:19+09:00")
+	assert.Contains(t, report, "2025-03-19T10:56:21+09:00")
+	assert.Contains(t, report, "line 3: column VALUE")
+	assert.Contains(t, report, "line 5: record on line 5: wrong number of fields")
+
+	// a valid file passes
+	file = filepath.Join(dir, "valid.csv")
+	require.NoError(t, os.WriteFile(file, []byte("TIME,NAME,VALUE,SVAL,IVAL,DVAL\n2025-03-19 10:56:19,work-1,0.1,x,0,1.1\n"), 0644))
+	runner = runLoader(t, conf, []string{file})
+	assert.False(t, runner.Failed())
+	assert.Contains(t, runner.reports[file], "1 rows, 0 rejected")
+}
+
+func TestLoaderCreateTable(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "created.csv")
+	require.NoError(t, os.WriteFile(file, []byte(`name,time,value,note
+work-1,2025-03-19 10:56:19,0.1,x
+work-2,2025-03-19 10:56:20,0.2,
+`), 0644))
+
+	ctx := context.Background()
+	conf := NewConfig()
+	conf.DstPort = testServer.MachPort()
+	conf.DstTable = "TAG_CREATED"
+	conf.SkipHeader = true
+	conf.Timezone = "Asia/Seoul"
+
+	// the DDL is printed for review
+	out := &strings.Builder{}
+	ready, err := conf.createTable(ctx, file, out)
+	require.NoError(t, err)
+	assert.False(t, ready)
+	assert.Contains(t, out.String(), "CREATE TAG TABLE TAG_CREATED (\n    NAME VARCHAR(32) PRIMARY KEY,\n    TIME DATETIME BASETIME,")
+	assert.Contains(t, out.String(), "-- run with -yes")
+
+	// a dry run does not create the table
+	conf.CreateTableYes = true
+	conf.DryRun = true
+	out.Reset()
+	ready, err = conf.createTable(ctx, file, out)
+	require.NoError(t, err)
+	assert.False(t, ready)
+	assert.Contains(t, out.String(), "-- a dry run does not create the table")
+
+	conf.DryRun = false
+	ready, err = conf.createTable(ctx, file, io.Discard)
+	require.NoError(t, err)
+	assert.True(t, ready)
+	assert.Equal(t, "2006-01-02 15:04:05.999999999", conf.Timeformat)
+
+	// the table exists
+	out.Reset()
+	ready, err = conf.createTable(ctx, file, out)
+	require.NoError(t, err)
+	assert.True(t, ready)
+	assert.Empty(t, out.String())
+
+	runLoader(t, conf, []string{file})
+	assert.Equal(t, int64(2), countRows(t, "TAG_CREATED"))
+}
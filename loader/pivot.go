@@ -0,0 +1,153 @@
+package loader
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/machbase/neo-server/v8/api"
+)
+
+// pivotRecords reads a wide CSV file, a timestamp field and a field per tag in every row,
+// as the narrow rows of a TAG table, a row of the tag name, the time and the value of every cell.
+// The first row is the header, the tag name of a cell is PivotTagTemplate of the header name of its field.
+// An empty cell has no row.
+type pivotRecords struct {
+	*csvRecords
+	cols      api.Columns
+	header    []string
+	nameIdx   int // index of the tag name column
+	timeIdx   int // index of the base time column
+	valueIdx  int // index of the value column
+	timeField int // index of the timestamp field
+	tags      []string
+	scales    []float64 // factor of the values of every field, 0 if none
+	timeConv  func(string) (any, error)
+	valueConv func(string) (any, error)
+	pending   []*record // the rows of the cells of the last wide row
+}
+
+func (w *Worker) newPivotRecords(input io.Reader, cols api.Columns, offset, lines int64) (*pivotRecords, error) {
+	p := &pivotRecords{
+		csvRecords: &csvRecords{
+			r:          csv.NewReader(input),
+			offset:     offset,
+			lineBase:   lines,
+			lines:      lines,
+			skipHeader: offset == 0, // the header is before any checkpoint
+		},
+		cols:     cols,
+		nameIdx:  -1,
+		timeIdx:  -1,
+		valueIdx: -1,
+	}
+	for i, col := range cols {
+		switch {
+		case col.IsTagName():
+			p.nameIdx = i
+		case col.IsBaseTime():
+			p.timeIdx = i
+		case p.valueIdx < 0:
+			p.valueIdx = i
+		}
+	}
+	if p.nameIdx < 0 || p.timeIdx < 0 || p.valueIdx < 0 {
+		return nil, fmt.Errorf("pivot needs a TAG table, %s has no tag name, base time and value columns", w.conf.DstTable)
+	}
+	converters := w.buildConverters(api.Columns{cols[p.timeIdx], cols[p.valueIdx]})
+	p.timeConv, p.valueConv = converters[0], converters[1]
+
+	header, err := readHeader(w.input)
+	if err != nil {
+		return nil, err
+	}
+	p.header = header
+	p.r.FieldsPerRecord = len(header) // also on resume, when the header is not read
+	if w.conf.PivotTimeColumn != "" {
+		p.timeField = -1
+		for i, name := range header {
+			if headerKey(name) == headerKey(w.conf.PivotTimeColumn) {
+				p.timeField = i
+				break
+			}
+		}
+		if p.timeField < 0 {
+			return nil, fmt.Errorf("%s: pivot-time-column %s is not in the header %q", w.input, w.conf.PivotTimeColumn, header)
+		}
+	}
+
+	scales := make(map[string]float64, len(w.conf.PivotScales))
+	for name, scale := range w.conf.PivotScales {
+		scales[headerKey(name)] = scale
+	}
+	valueType := cols[p.valueIdx].Type
+	p.tags = make([]string, len(header))
+	p.scales = make([]float64, len(header))
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		p.tags[i] = strings.ReplaceAll(w.conf.PivotTagTemplate, "{header}", name)
+		if scale, ok := scales[headerKey(name)]; ok {
+			if valueType != api.ColumnTypeFloat && valueType != api.ColumnTypeDouble {
+				return nil, fmt.Errorf("pivot-scale needs a float or double value column, %s is %s", cols[p.valueIdx].Name, valueType)
+			}
+			p.scales[i] = scale
+		}
+	}
+	return p, nil
+}
+
+func (p *pivotRecords) Read() (*record, error) {
+	for len(p.pending) == 0 {
+		row, err := p.readRow()
+		if err != nil {
+			return nil, err
+		}
+		if row.err != nil {
+			return row, nil
+		}
+		p.pending = p.pivot(row)
+	}
+	rec := p.pending[0]
+	p.pending = p.pending[1:]
+	rec.more = len(p.pending) > 0
+	return rec, nil
+}
+
+func (p *pivotRecords) Columns() api.Columns {
+	return p.cols
+}
+
+// pivot returns a row of every cell of the wide row, a row is rejected as a whole if its timestamp is not valid
+func (p *pivotRecords) pivot(row *record) []*record {
+	ts, err := p.timeConv(row.fields[p.timeField])
+	if err == nil && ts == nil {
+		err = fmt.Errorf("no timestamp")
+	}
+	if err != nil {
+		row.err = &columnError{column: p.header[p.timeField], err: err}
+		return []*record{row}
+	}
+	var records []*record
+	for i, cell := range row.fields {
+		if i == p.timeField || strings.TrimSpace(cell) == "" {
+			continue
+		}
+		rec := &record{line: row.line, fields: row.fields}
+		value, err := p.valueConv(cell)
+		if err != nil {
+			rec.err = &columnError{column: p.header[i], err: err}
+			records = append(records, rec)
+			continue
+		}
+		if v, ok := value.(float64); ok && p.scales[i] != 0 {
+			value = v * p.scales[i]
+		}
+		rec.values = make([]any, len(p.cols))
+		rec.values[p.nameIdx] = p.tags[i]
+		rec.values[p.timeIdx] = ts
+		rec.values[p.valueIdx] = value
+		records = append(records, rec)
+	}
+	return records
+}
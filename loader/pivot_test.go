@@ -0,0 +1,85 @@
+package loader
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/machbase/neo-server/v8/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPivotRecords(t *testing.T) {
+	content := `pressure,ts,Temp x10
+1.5,1742349379,215
+1.6,1742349380,
+1.7,yesterday,216
+1.8,1742349382,abc
+`
+	file := filepath.Join(t.TempDir(), "wide.csv")
+	require.NoError(t, os.WriteFile(file, []byte(content), 0644))
+
+	conf := NewConfig()
+	conf.Pivot = true
+	conf.Timeformat = "s"
+	conf.PivotTimeColumn = "TS"
+	conf.PivotTagTemplate = "plc1.{header}"
+	conf.PivotScales = map[string]float64{"temp x10": 0.1}
+	w := conf.NewWorker(file)
+	cols := api.Columns{
+		{Name: "NAME", Type: api.ColumnTypeVarchar, Flag: api.ColumnFlagTagName},
+		{Name: "TIME", Type: api.ColumnTypeDatetime, Flag: api.ColumnFlagBasetime},
+		{Name: "VALUE", Type: api.ColumnTypeDouble},
+		{Name: "SVAL", Type: api.ColumnTypeVarchar},
+	}
+	records, err := w.newRecordReader(strings.NewReader(content), cols, nil, 0, 0)
+	require.NoError(t, err)
+
+	var got []*record
+	for {
+		rec, err := records.Read()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		got = append(got, rec)
+	}
+	require.Len(t, got, 6)
+	ts := int64(1742349379000000000)
+
+	assert.Equal(t, []any{"plc1.pressure", ts, 1.5, nil}, got[0].values)
+	assert.True(t, got[0].more)
+	assert.Equal(t, "plc1.Temp x10", got[1].values[0])
+	assert.InDelta(t, 21.5, got[1].values[2], 1e-9)
+	assert.False(t, got[1].more)
+
+	// the empty cell has no row
+	assert.Equal(t, []any{"plc1.pressure", ts + 1e9, 1.6, nil}, got[2].values)
+	assert.False(t, got[2].more)
+
+	// a wide row with no valid timestamp is rejected once
+	assert.Equal(t, int64(4), got[3].line)
+	assert.ErrorContains(t, got[3].err, "ts:")
+	assert.False(t, got[3].more)
+
+	// a cell that is not a value is rejected, the other cells of the row are imported
+	assert.NoError(t, got[4].err)
+	assert.Equal(t, int64(5), got[5].line)
+	assert.ErrorContains(t, got[5].err, "Temp x10:")
+	assert.Equal(t, []string{"1.8", "1742349382", "abc"}, got[5].fields)
+
+	_, err = w.newRecordReader(strings.NewReader(content), cols[1:], nil, 0, 0)
+	assert.ErrorContains(t, err, "pivot needs a TAG table")
+
+	// the time column is the first field of a header with a byte order mark
+	content = "\ufeffts,pressure\n1742349379,1.5\n"
+	require.NoError(t, os.WriteFile(file, []byte(content), 0644))
+	records, err = w.newRecordReader(strings.NewReader(content), cols, nil, 0, 0)
+	require.NoError(t, err)
+	rec, err := records.Read()
+	require.NoError(t, err)
+	assert.Equal(t, []any{"plc1.pressure", ts, 1.5, nil}, rec.values)
+}
@@ -0,0 +1,220 @@
+package loader
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/machbase/neo-server/v8/api"
+)
+
+// Formats of the input files
+const (
+	FormatCSV   = "csv"
+	FormatJSONL = "jsonl" // JSON Lines, a.k.a. NDJSON
+)
+
+// record is a row read from an input file
+type record struct {
+	line   int64    // the first line of the row
+	fields []string // the fields of the row, written to the reject file
+	values []any    // the values of the columns
+	err    error    // the reason the row is rejected
+	more   bool     // more records of the same row follow, the row is not done
+}
+
+// recordReader reads the rows of an input file as the values of the table columns
+type recordReader interface {
+	// Read returns the next row, a row that is not valid has its err set.
+	// It returns io.EOF at the end of the file, any other error fails the file.
+	Read() (*record, error)
+	// Offset returns the offset of the input after the last row read
+	Offset() int64
+	// Lines returns the number of lines read
+	Lines() int64
+	// Columns returns the columns of the values of a row
+	Columns() api.Columns
+}
+
+// columnError is the error of a field that is not a valid value of its column
+type columnError struct {
+	column string
+	err    error
+}
+
+func (e *columnError) Error() string {
+	return fmt.Sprintf("column %s: %v", e.column, e.err)
+}
+
+func (e *columnError) Unwrap() error {
+	return e.err
+}
+
+// newRecordReader returns the reader of the rows of the input in the format of the config.
+// offset and lines are where the input resumes.
+func (w *Worker) newRecordReader(input io.Reader, cols api.Columns, columnNames []string, offset, lines int64) (recordReader, error) {
+	switch w.conf.Format {
+	case FormatJSONL:
+		return w.newJSONRecords(input, cols, columnNames, offset, lines)
+	case FormatCSV, "":
+		if w.conf.Pivot {
+			return w.newPivotRecords(input, cols, offset, lines)
+		}
+		return w.newCSVRecords(input, cols, columnNames, offset, lines), nil
+	default:
+		return nil, fmt.Errorf("invalid format %q", w.conf.Format)
+	}
+}
+
+// readColumnNames returns the first word of every line of the column names file
+func readColumnNames(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	names := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue // skip empty lines
+		}
+		names = append(names, fields[0])
+	}
+	return names, scanner.Err()
+}
+
+// csvRecords reads the rows of a CSV file.
+// The column names file or the header mapping gives the column of every field of a row, in order.
+type csvRecords struct {
+	r                  *csv.Reader
+	offset             int64 // of the input where the csv reader starts
+	lineBase           int64 // the lines of the csv reader start at the offset
+	lines              int64
+	skipHeader         bool
+	cols               api.Columns
+	converters         []func(string) (any, error)
+	columnOrderIndexes []int
+}
+
+func (w *Worker) newCSVRecords(input io.Reader, cols api.Columns, columnNames []string, offset, lines int64) *csvRecords {
+	columnOrder := make([]string, len(columnNames))
+	for i, name := range columnNames {
+		columnOrder[i] = strings.ToUpper(name)
+	}
+	if len(cols) > 0 && cols[0].Name == "_ARRIVAL_TIME" &&
+		len(columnOrder) > 0 && columnOrder[0] != "_ARRIVAL_TIME" {
+		cols = cols[1:] // skip _ARRIVAL_TIME column
+	}
+
+	var columnOrderIndexes []int
+	if len(columnOrder) > 0 {
+		columnOrderIndexes = make([]int, len(cols))
+		for i, col := range cols {
+			idx := -1
+			for j, name := range columnOrder {
+				if name == col.Name {
+					idx = j
+					break
+				}
+			}
+			columnOrderIndexes[i] = idx
+		}
+	}
+	return &csvRecords{
+		r:                  csv.NewReader(input),
+		offset:             offset,
+		lineBase:           lines,
+		lines:              lines,
+		skipHeader:         (w.conf.SkipHeader || w.conf.HeaderMapping) && offset == 0, // the header is before any checkpoint
+		cols:               cols,
+		converters:         w.buildConverters(cols),
+		columnOrderIndexes: columnOrderIndexes,
+	}
+}
+
+func (c *csvRecords) Read() (*record, error) {
+	rec, err := c.readRow()
+	if err != nil {
+		return nil, err
+	}
+	if rec.err == nil {
+		rec.values, rec.err = c.convertRow(rec.fields)
+	}
+	return rec, nil
+}
+
+// readRow returns the next row with its fields, not converted
+func (c *csvRecords) readRow() (*record, error) {
+	for {
+		fields, err := c.r.Read()
+		if err == io.EOF {
+			return nil, err // end of file
+		}
+		rec := &record{fields: fields}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			rec.line = c.lineBase + int64(parseErr.StartLine)
+			rec.err = err
+			c.lines = c.lineBase + int64(parseErr.Line)
+		} else if err != nil {
+			return nil, err
+		} else {
+			first, _ := c.r.FieldPos(0)
+			last, _ := c.r.FieldPos(len(fields) - 1)
+			rec.line = c.lineBase + int64(first)
+			// a quoted field keeps its line breaks
+			c.lines = c.lineBase + int64(last+strings.Count(fields[len(fields)-1], "\n"))
+		}
+		if c.skipHeader {
+			c.skipHeader = false
+			continue // skip header line
+		}
+		return rec, nil
+	}
+}
+
+func (c *csvRecords) Offset() int64 {
+	return c.offset + c.r.InputOffset()
+}
+
+func (c *csvRecords) Lines() int64 {
+	return c.lines
+}
+
+func (c *csvRecords) Columns() api.Columns {
+	return c.cols
+}
+
+// convertRow converts the fields of a row to the values of the columns
+func (c *csvRecords) convertRow(fields []string) ([]any, error) {
+	var values []any
+	var err error
+	if len(c.columnOrderIndexes) > 0 {
+		values = make([]any, len(c.columnOrderIndexes))
+		for i, idx := range c.columnOrderIndexes {
+			if idx < 0 || idx >= len(fields) {
+				continue
+			}
+			if values[i], err = c.converters[i](fields[idx]); err != nil {
+				return nil, &columnError{column: c.cols[i].Name, err: err}
+			}
+		}
+		return values, nil
+	}
+	if len(fields) != len(c.converters) {
+		return nil, fmt.Errorf("%d fields, the table has %d columns", len(fields), len(c.converters))
+	}
+	values = make([]any, len(fields))
+	for i, field := range fields {
+		if values[i], err = c.converters[i](field); err != nil {
+			return nil, &columnError{column: c.cols[i].Name, err: err}
+		}
+	}
+	return values, nil
+}
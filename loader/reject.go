@@ -0,0 +1,187 @@
+package loader
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// minErrorRateRows is the number of rows read before the error rate is checked,
+// the rate of the first rows says little about the file
+const minErrorRateRows = 100
+
+// rejectWriter writes the rejected rows of a file to its reject file.
+// Every row of the reject file is a CSV record of the line number, the reason and the fields of the rejected row.
+// The reject file is created with the first rejected row.
+type rejectWriter struct {
+	path   string
+	append bool // append to the reject file of a resumed import
+	file   *os.File
+	w      *csv.Writer
+	count  int64
+	size   int64 // size of the reject file after the last flush
+}
+
+// RejectPath returns the reject file of the input file.
+// The reject file of a zip entry is next to the archive, e.g. "data.zip.2025_a.csv.rej".
+func (c *Config) RejectPath(input string) string {
+	if archive, entry, ok := splitZipEntry(input); ok {
+		input = archive + "." + strings.ReplaceAll(entry, "/", "_")
+	}
+	if c.RejectDir != "" {
+		return filepath.Join(c.RejectDir, filepath.Base(input)+".rej")
+	}
+	return input + ".rej"
+}
+
+// newRejectWriter returns the reject writer of the input file.
+// A fresh import removes the reject file of a previous one. A resumed import truncates it
+// to the size of the checkpoint, the rows rejected after the checkpoint are rejected again.
+// A negative size keeps the reject file as it is, and so does a size of 0 with rejected rows,
+// the checkpoints of older versions have no size.
+func (c *Config) newRejectWriter(input string, resumed bool, rejected, size int64) (*rejectWriter, error) {
+	r := &rejectWriter{path: c.RejectPath(input), append: resumed, count: rejected, size: size}
+	if !resumed {
+		if err := os.Remove(r.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		r.size = 0
+	} else if size > 0 || (size == 0 && rejected == 0) {
+		if err := os.Truncate(r.path, size); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Reject writes the row starting at the line
+func (r *rejectWriter) Reject(line int64, reason error, fields []string) error {
+	if r.w == nil {
+		flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		if r.append {
+			flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		}
+		file, err := os.OpenFile(r.path, flags, 0644)
+		if err != nil {
+			return err
+		}
+		r.file = file
+		r.w = csv.NewWriter(file)
+	}
+	r.count++
+	record := append([]string{strconv.FormatInt(line, 10), reason.Error()}, fields...)
+	return r.w.Write(record)
+}
+
+// Count returns the number of rejected rows of the file
+func (r *rejectWriter) Count() int64 {
+	return r.count
+}
+
+// Size returns the size of the reject file after the last flush
+func (r *rejectWriter) Size() int64 {
+	return r.size
+}
+
+// Flush writes the buffered rows to the reject file
+func (r *rejectWriter) Flush() error {
+	if r.w == nil {
+		return nil
+	}
+	r.w.Flush()
+	if err := r.w.Error(); err != nil {
+		return err
+	}
+	if err := r.file.Sync(); err != nil {
+		return err
+	}
+	info, err := r.file.Stat()
+	if err != nil {
+		return err
+	}
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rejectWriter) Close() error {
+	if r.w == nil {
+		return nil
+	}
+	err := r.Flush()
+	if errClose := r.file.Close(); err == nil {
+		err = errClose
+	}
+	r.w = nil
+	return err
+}
+
+// checkErrorBudget returns an error if the rejected rows of the rows read exceed the budget.
+// The error rate is checked from minErrorRateRows rows, and at the end of the file.
+func (c *Config) checkErrorBudget(rejected, rows int64, end bool) error {
+	if c.MaxErrors >= 0 && rejected > c.MaxErrors {
+		return fmt.Errorf("error budget exceeded: %d rows rejected, max-errors is %d", rejected, c.MaxErrors)
+	}
+	if c.MaxErrorRate > 0 && rows > 0 && (end || rows >= minErrorRateRows) {
+		if rate := float64(rejected) / float64(rows); rate > c.MaxErrorRate {
+			return fmt.Errorf("error budget exceeded: %d of %d rows rejected (%.2f%%), max-error-rate is %.2f%%",
+				rejected, rows, rate*100, c.MaxErrorRate*100)
+		}
+	}
+	return nil
+}
+
+// mergeRejects writes the reject files of the chunks of the file into the reject file of the file,
+// in the order of the chunks, and removes them.
+// A resumed import keeps the reject file of the file if no chunk has one, e.g. every chunk was imported before.
+func (c *Config) mergeRejects(path string, chunks []*Request) error {
+	var files []string
+	for _, chunk := range chunks {
+		name := c.RejectPath(chunkName(path, chunk.Start, chunk.End))
+		if _, err := os.Stat(name); err == nil {
+			files = append(files, name)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if len(files) == 0 && c.Resume {
+		return nil
+	}
+	dst := c.RejectPath(path)
+	if err := os.Remove(dst); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	for _, name := range files {
+		in, err := os.Open(name)
+		if err != nil {
+			out.Close()
+			return err
+		}
+		_, err = io.Copy(out, in)
+		in.Close()
+		if err != nil {
+			out.Close()
+			return err
+		}
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	for _, name := range files {
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,472 @@
+package loader
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/machbase/neo-server/v8/api"
+)
+
+// timeLayouts are the formats of the datetime fields of the sample rows, besides the -timeformat layout.
+// A layout with fractional seconds also parses the times without them.
+var timeLayouts = []string{
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05.999999999",
+	"2006/01/02 15:04:05.999999999",
+	"2006-01-02",
+}
+
+// tableSchema is the table inferred from the sample rows of a file
+type tableSchema struct {
+	table      string
+	tag        bool // a TAG table of the tag name, the time and the value columns, then the others
+	columns    []schemaColumn
+	timeformat string // -timeformat of the datetime columns, a layout or an epoch unit, "" if none
+}
+
+type schemaColumn struct {
+	name string
+	typ  string // SQL type
+}
+
+// DDL returns the CREATE TABLE statement of the schema
+func (s *tableSchema) DDL() string {
+	sb := &strings.Builder{}
+	if s.tag {
+		fmt.Fprintf(sb, "CREATE TAG TABLE %s (\n", s.table)
+	} else {
+		fmt.Fprintf(sb, "CREATE TABLE %s (\n", s.table)
+	}
+	for i, col := range s.columns {
+		fmt.Fprintf(sb, "    %s %s", col.name, col.typ)
+		if s.tag && i == 0 {
+			sb.WriteString(" PRIMARY KEY")
+		} else if s.tag && i == 1 {
+			sb.WriteString(" BASETIME")
+		}
+		if i < len(s.columns)-1 {
+			sb.WriteString(",")
+		}
+		sb.WriteString("\n")
+	}
+	sb.WriteString(")")
+	return sb.String()
+}
+
+// columnGuess counts the sample values of a column that are valid values of every type
+type columnGuess struct {
+	values int // non-empty values
+	ints   int
+	floats int
+	jsons  int
+	times  []int // by layout
+	maxLen int
+	minInt int64 // of the integer values
+	maxInt int64
+}
+
+func (g *columnGuess) add(s string, layouts []string) {
+	if s = strings.TrimSpace(s); s == "" {
+		return
+	}
+	g.values++
+	g.maxLen = max(g.maxLen, len(s))
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if g.ints == 0 || n < g.minInt {
+			g.minInt = n
+		}
+		if g.ints == 0 || n > g.maxInt {
+			g.maxInt = n
+		}
+		g.ints++
+	}
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		g.floats++
+	}
+	if (s[0] == '{' || s[0] == '[') && json.Valid([]byte(s)) {
+		g.jsons++
+	}
+	if g.times == nil {
+		g.times = make([]int, len(layouts))
+	}
+	for i, layout := range layouts {
+		if _, err := time.Parse(layout, s); err == nil {
+			g.times[i]++
+		}
+	}
+}
+
+// sqlType returns the type that all the values of the column are valid for,
+// and the layout of a datetime column
+func (g *columnGuess) sqlType(layouts []string) (string, string) {
+	switch {
+	case g.values == 0:
+		return varcharType(0), ""
+	case g.ints == g.values:
+		return "LONG", ""
+	case g.floats == g.values:
+		return "DOUBLE", ""
+	case g.jsons == g.values:
+		return "JSON", ""
+	}
+	for i, n := range g.times {
+		if n == g.values {
+			return "DATETIME", layouts[i]
+		}
+	}
+	return varcharType(g.maxLen), ""
+}
+
+// isEpoch returns true if all the values are integer times of the epoch unit after 1971,
+// e.g. not the sequence numbers of the rows
+func (g *columnGuess) isEpoch(unit string) bool {
+	scale := int64(1)
+	switch unit {
+	case "s":
+		scale = int64(time.Second)
+	case "ms":
+		scale = int64(time.Millisecond)
+	case "us":
+		scale = int64(time.Microsecond)
+	}
+	return g.values > 0 && g.ints == g.values &&
+		g.minInt > int64(365*24*time.Hour)/scale && g.maxInt <= math.MaxInt64/scale
+}
+
+// commonLayout returns the first layout that parses the values of all the datetime columns,
+// the import parses them with a single -timeformat
+func commonLayout(cols []schemaColumn, guesses []*columnGuess, timeCols []int, layouts []string) (string, error) {
+	for l, layout := range layouts {
+		all := true
+		for _, i := range timeCols {
+			all = all && guesses[i].times[l] == guesses[i].values
+		}
+		if all {
+			return layout, nil
+		}
+	}
+	var formats []string
+	for _, i := range timeCols {
+		_, layout := guesses[i].sqlType(layouts)
+		formats = append(formats, fmt.Sprintf("%s is like %q", cols[i].name, layout))
+	}
+	return "", fmt.Errorf("the datetime columns have different formats, %s, but the import has a single -timeformat",
+		strings.Join(formats, ", "))
+}
+
+// varcharType returns a VARCHAR twice as long as the longest sample value, TEXT if it is too long
+func varcharType(maxLen int) string {
+	size := 32
+	for size < maxLen*2 {
+		size *= 2
+	}
+	if size > 32768 {
+		return "TEXT"
+	}
+	return fmt.Sprintf("VARCHAR(%d)", size)
+}
+
+// columnName returns the name as a column name, e.g. "Sensor Value" is "SENSOR_VALUE"
+func columnName(name string, i int) string {
+	sb := &strings.Builder{}
+	for _, r := range strings.TrimSpace(name) {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			sb.WriteRune(unicode.ToUpper(r))
+		} else {
+			sb.WriteByte('_')
+		}
+	}
+	s := strings.Trim(sb.String(), "_")
+	if s == "" {
+		return fmt.Sprintf("COL%d", i+1)
+	}
+	if unicode.IsDigit(rune(s[0])) {
+		s = "C_" + s
+	}
+	return s
+}
+
+// inferSchema samples the first SampleRows rows of the input and infers the types of their fields.
+// The names of the columns are the header fields with -skip-header, the names of the column names file,
+// the keys of the JSON objects, or else COL1, COL2...
+// The table is a TAG table if its first columns are a name, a time and a number, or if it is pivoted.
+// The time of a TAG table is an integer of the -timeformat unit or a datetime text, all the datetime columns
+// must have the same format.
+func (c *Config) inferSchema(input string) (*tableSchema, error) {
+	r, err := openInput(input)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	layouts := timeLayouts
+	if !isTimeUnit(c.Timeformat) {
+		layouts = append([]string{c.Timeformat}, timeLayouts...)
+	}
+	var names []string
+	var guesses []*columnGuess
+	if c.Format == FormatJSONL {
+		names, guesses, err = c.sampleJSON(r, layouts)
+	} else {
+		names, guesses, err = c.sampleCSV(r, layouts)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", input, err)
+	}
+	if len(guesses) == 0 {
+		return nil, fmt.Errorf("%s: no rows to sample", input)
+	}
+
+	schema := &tableSchema{table: strings.ToUpper(c.DstTable)}
+	if c.Pivot {
+		return c.pivotSchema(schema, names, guesses, layouts)
+	}
+	seen := make(map[string]int)
+	var timeCols []int // the datetime columns of texts
+	for i, g := range guesses {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		name = columnName(name, i)
+		if seen[name]++; seen[name] > 1 {
+			name = fmt.Sprintf("%s_%d", name, seen[name])
+		}
+		typ, _ := g.sqlType(layouts)
+		if typ == "DATETIME" {
+			timeCols = append(timeCols, i)
+		}
+		schema.columns = append(schema.columns, schemaColumn{name: name, typ: typ})
+	}
+	cols := schema.columns
+	isNumber := func(typ string) bool { return typ == "LONG" || typ == "DOUBLE" }
+	tagShape := len(cols) >= 3 && strings.HasPrefix(cols[0].typ, "VARCHAR") && isNumber(cols[2].typ)
+
+	// an integer in the time position is an epoch time, like the import reads it with a -timeformat unit
+	if tagShape && cols[1].typ == "LONG" && isTimeUnit(c.Timeformat) && guesses[1].isEpoch(c.Timeformat) {
+		if len(timeCols) > 0 {
+			return nil, fmt.Errorf("%s: %s is an epoch time but %s is a datetime text, the import has a single -timeformat",
+				input, cols[1].name, cols[timeCols[0]].name)
+		}
+		cols[1].typ = "DATETIME"
+		schema.timeformat = c.Timeformat
+		if schema.timeformat == "" {
+			schema.timeformat = "ns"
+		}
+	}
+	if len(timeCols) > 0 {
+		if schema.timeformat, err = commonLayout(cols, guesses, timeCols, layouts); err != nil {
+			return nil, fmt.Errorf("%s: %w", input, err)
+		}
+	}
+	schema.tag = tagShape && cols[1].typ == "DATETIME"
+	return schema, nil
+}
+
+// pivotSchema is the TAG table of the rows of the cells of a wide file
+func (c *Config) pivotSchema(schema *tableSchema, header []string, guesses []*columnGuess, layouts []string) (*tableSchema, error) {
+	timeField := 0
+	if c.PivotTimeColumn != "" {
+		timeField = -1
+		for i, name := range header {
+			if headerKey(name) == headerKey(c.PivotTimeColumn) {
+				timeField = i
+			}
+		}
+		if timeField < 0 || timeField >= len(guesses) {
+			return nil, fmt.Errorf("pivot-time-column %s is not in the header %q", c.PivotTimeColumn, header)
+		}
+	}
+	var maxLen int
+	for i, name := range header {
+		if i != timeField {
+			maxLen = max(maxLen, len(strings.ReplaceAll(c.PivotTagTemplate, "{header}", strings.TrimSpace(name))))
+		}
+	}
+	_, schema.timeformat = guesses[timeField].sqlType(layouts)
+	schema.tag = true
+	schema.columns = []schemaColumn{
+		{name: "NAME", typ: varcharType(maxLen)},
+		{name: "TIME", typ: "DATETIME"},
+		{name: "VALUE", typ: "DOUBLE"},
+	}
+	return schema, nil
+}
+
+// sampleCSV returns the names of the columns and the guesses of the fields of the sample rows
+func (c *Config) sampleCSV(r io.Reader, layouts []string) ([]string, []*columnGuess, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	var names []string
+	var err error
+	switch {
+	case c.SkipHeader || c.HeaderMapping || c.Pivot:
+		if names, err = cr.Read(); err != nil {
+			return nil, nil, fmt.Errorf("header: %w", err)
+		}
+		trimBOM(names)
+	case c.ColumnNamesFile != "":
+		if names, err = readColumnNames(c.ColumnNamesFile); err != nil {
+			return nil, nil, err
+		}
+	}
+	var guesses []*columnGuess
+	for n := 0; n < c.SampleRows; n++ {
+		fields, err := cr.Read()
+		var parseErr *csv.ParseError
+		if err == io.EOF {
+			break
+		} else if errors.As(err, &parseErr) {
+			continue // rejected by the import
+		} else if err != nil {
+			return nil, nil, err
+		}
+		for len(guesses) < max(len(fields), len(names)) {
+			guesses = append(guesses, &columnGuess{})
+		}
+		for i, field := range fields {
+			guesses[i].add(field, layouts)
+		}
+	}
+	return names, guesses, nil
+}
+
+// sampleJSON returns the keys of the JSON objects of the sample rows, in the order they are found,
+// and the guesses of their values
+func (c *Config) sampleJSON(r io.Reader, layouts []string) ([]string, []*columnGuess, error) {
+	var names []string
+	var guesses []*columnGuess
+	index := make(map[string]int)
+	br := bufio.NewReader(r)
+	for n := 0; n < c.SampleRows; {
+		line, err := br.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			n++
+			keys, values, ok := decodeObject(line)
+			for i, key := range keys {
+				if !ok {
+					break // rejected by the import
+				}
+				idx, found := index[strings.ToLower(key)]
+				if !found {
+					idx = len(names)
+					index[strings.ToLower(key)] = idx
+					names = append(names, key)
+					guesses = append(guesses, &columnGuess{})
+				}
+				if values[i] == nil {
+					continue
+				}
+				field, err := jsonField(values[i])
+				if err == nil {
+					guesses[idx].add(field, layouts)
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+	}
+	return names, guesses, nil
+}
+
+// decodeObject returns the keys and the values of the JSON object in the order of the object
+func decodeObject(line []byte) ([]string, []any, bool) {
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.UseNumber()
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, nil, false
+	}
+	var keys []string
+	var values []any
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, nil, false
+		}
+		key, _ := tok.(string)
+		var value any
+		if err := dec.Decode(&value); err != nil {
+			return nil, nil, false
+		}
+		keys = append(keys, key)
+		values = append(values, value)
+	}
+	return keys, values, true
+}
+
+// isTimeUnit returns true if the time format is a unit of epoch times, not a layout
+func isTimeUnit(format string) bool {
+	switch format {
+	case "", "s", "ms", "us", "ns":
+		return true
+	}
+	return false
+}
+
+// tableExists returns true if the table is in the database
+func tableExists(ctx context.Context, conn api.Conn, table string) (bool, error) {
+	table = strings.ToUpper(table[strings.LastIndex(table, ".")+1:])
+	var count int64
+	if err := conn.QueryRow(ctx, "SELECT COUNT(*) FROM M$SYS_TABLES WHERE NAME = ?", table).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// createTable creates the table inferred from the sample rows of the input, if it does not exist.
+// The DDL is printed to out and executed only with CreateTableYes, a dry run only prints it.
+// It returns true if the table exists or is created, so the input can be imported.
+func (c *Config) createTable(ctx context.Context, input string, out io.Writer) (bool, error) {
+	db, err := c.openDatabase()
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+	conn, err := db.Connect(ctx, api.WithPassword(c.DstUser, c.DstPass))
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if exists, err := tableExists(ctx, conn, c.DstTable); err != nil || exists {
+		return exists, err
+	}
+	schema, err := c.inferSchema(input)
+	if err != nil {
+		return false, err
+	}
+	fmt.Fprintf(out, "%s;\n", schema.DDL())
+	if schema.timeformat != "" {
+		fmt.Fprintf(out, "-- the datetime fields are like -timeformat '%s'\n", schema.timeformat)
+	}
+	if c.DryRun {
+		fmt.Fprintln(out, "-- a dry run does not create the table")
+		return false, nil
+	}
+	if !c.CreateTableYes {
+		fmt.Fprintln(out, "-- run with -yes to create the table and import the files")
+		return false, nil
+	}
+	if result := conn.Exec(ctx, schema.DDL()); result.Err() != nil {
+		return false, result.Err()
+	}
+	if schema.timeformat != "" && isTimeUnit(c.Timeformat) {
+		c.Timeformat = schema.timeformat // the import parses the inferred datetime fields
+	}
+	return true, nil
+}
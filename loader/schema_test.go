@@ -0,0 +1,118 @@
+package loader
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInferSchema(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		file := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(file, []byte(content), 0644))
+		return file
+	}
+
+	conf := NewConfig()
+	conf.DstTable = "sensors"
+	conf.SkipHeader = true
+	schema, err := conf.inferSchema(write("tag.csv", `Sensor Name,ts,Value,count,payload,count
+work-1,2025-03-19 10:56:19,0.1,1,"{""a"":1}",
+work-2,2025-03-19 10:56:20.5,2,3,[1],7
+`))
+	require.NoError(t, err)
+	assert.True(t, schema.tag)
+	assert.Equal(t, "2006-01-02 15:04:05.999999999", schema.timeformat)
+	assert.Equal(t, `CREATE TAG TABLE SENSORS (
+    SENSOR_NAME VARCHAR(32) PRIMARY KEY,
+    TS DATETIME BASETIME,
+    VALUE DOUBLE,
+    COUNT LONG,
+    PAYLOAD JSON,
+    COUNT_2 LONG
+)`, schema.DDL())
+
+	// no header, the time is not in the known formats
+	conf.SkipHeader = false
+	schema, err = conf.inferSchema(write("log.csv", "19/03/2025,1,x\n20/03/2025,2,1\n"))
+	require.NoError(t, err)
+	assert.False(t, schema.tag)
+	assert.Equal(t, []schemaColumn{{"COL1", "VARCHAR(32)"}, {"COL2", "LONG"}, {"COL3", "VARCHAR(32)"}}, schema.columns)
+
+	// the -timeformat layout is tried first
+	conf.Timeformat = "02/01/2006"
+	schema, err = conf.inferSchema(write("log.csv", "19/03/2025,1,x\n20/03/2025,2,1\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "DATETIME", schema.columns[0].typ)
+	assert.Equal(t, "02/01/2006", schema.timeformat)
+
+	// an integer in the time position is an epoch time of the -timeformat unit
+	conf = NewConfig()
+	conf.DstTable = "sensors"
+	conf.SkipHeader = true
+	conf.Timeformat = "ms"
+	schema, err = conf.inferSchema(write("epoch.csv", "name,ts,value\nwork-1,1742349379000,0.1\n"))
+	require.NoError(t, err)
+	assert.True(t, schema.tag)
+	assert.Equal(t, "ms", schema.timeformat)
+	assert.Equal(t, []schemaColumn{{"NAME", "VARCHAR(32)"}, {"TS", "DATETIME"}, {"VALUE", "DOUBLE"}}, schema.columns)
+
+	// but not a sequence number
+	schema, err = conf.inferSchema(write("seq.csv", "name,seq,value\nwork-1,1,0.1\nwork-1,2,0.2\n"))
+	require.NoError(t, err)
+	assert.False(t, schema.tag)
+	assert.Equal(t, "LONG", schema.columns[1].typ)
+	assert.Empty(t, schema.timeformat)
+
+	// the import has a single -timeformat for all the datetime columns
+	_, err = conf.inferSchema(write("mixed.csv", "name,ts,value,day\nwork-1,2025-03-19 10:56:19,0.1,2025-03-19\n"))
+	assert.ErrorContains(t, err, `the datetime columns have different formats, TS is like "2006-01-02 15:04:05.999999999", DAY is like "2006-01-02"`)
+	_, err = conf.inferSchema(write("mixed.csv", "name,ts,value,day\nwork-1,1742349379000,0.1,2025-03-19\n"))
+	assert.ErrorContains(t, err, "TS is an epoch time but DAY is a datetime text")
+	schema, err = conf.inferSchema(write("same.csv", "name,ts,value,day\nwork-1,2025-03-19 10:56:19,0.1,2025-03-19 00:00:00\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "DATETIME", schema.columns[3].typ)
+	assert.Equal(t, "2006-01-02 15:04:05.999999999", schema.timeformat, "the layout parses both columns")
+
+	conf = NewConfig()
+	conf.DstTable = "events"
+	conf.Format = FormatJSONL
+	schema, err = conf.inferSchema(write("events.jsonl", `{"name":"a","time":"2025-03-19T10:56:19Z","user":{"id":1}}
+
+{"time":"2025-03-19T10:56:20+09:00","value":1.5,"Name":"b"}
+not json
+`))
+	require.NoError(t, err)
+	assert.False(t, schema.tag)
+	assert.Equal(t, "2006-01-02T15:04:05.999999999Z07:00", schema.timeformat)
+	assert.Equal(t, []schemaColumn{{"NAME", "VARCHAR(32)"}, {"TIME", "DATETIME"}, {"USER", "JSON"}, {"VALUE", "DOUBLE"}}, schema.columns)
+
+	conf = NewConfig()
+	conf.DstTable = "plc"
+	conf.Pivot = true
+	conf.PivotTimeColumn = "ts"
+	conf.PivotTagTemplate = "plc1.{header}"
+	schema, err = conf.inferSchema(write("wide.csv", "temp,ts,pressure\n21.5,2025-03-19,1.5\n"))
+	require.NoError(t, err)
+	assert.True(t, schema.tag)
+	assert.Equal(t, "2006-01-02", schema.timeformat)
+	assert.Equal(t, []schemaColumn{{"NAME", "VARCHAR(32)"}, {"TIME", "DATETIME"}, {"VALUE", "DOUBLE"}}, schema.columns)
+
+	// the time column is the first field of a header with a byte order mark
+	schema, err = conf.inferSchema(write("bom.csv", "\ufeffts,temp\n2025-03-19,21.5\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "2006-01-02", schema.timeformat)
+
+	_, err = conf.inferSchema(write("empty.csv", "temp,ts\n"))
+	assert.ErrorContains(t, err, "no rows to sample")
+}
+
+func TestVarcharType(t *testing.T) {
+	assert.Equal(t, "VARCHAR(32)", varcharType(0))
+	assert.Equal(t, "VARCHAR(64)", varcharType(17))
+	assert.Equal(t, "TEXT", varcharType(20000))
+}
@@ -2,10 +2,8 @@ package loader
 
 import (
 	"actsvr/util"
-	"bufio"
-	"encoding/csv"
+	"fmt"
 	"io"
-	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -25,31 +23,73 @@ const (
 )
 
 type Config struct {
-	DstHost          string
-	DstPort          int
-	DstUser          string
-	DstPass          string
-	DstTable         string
-	ColumnNamesFile  string         // file containing column names for the CSV file
-	ProgressInterval time.Duration  //
-	Timeformat       string         // e.g., "ns", "us", "ms", "s", "2006-01-02 15:04:05"
-	Timezone         string         // e.g., "UTC",
-	SkipHeader       bool           // whether to skip the first line (header) in CSV files
-	DelayForTest     time.Duration  // for testing purposes, in nanoseconds
-	tz               *time.Location // Timezone for parsing datetime fields
+	DstHost            string
+	DstPort            int
+	DstUser            string
+	DstPass            string
+	DstTable           string
+	ColumnNamesFile    string              // file containing column names for the CSV file
+	ProgressInterval   time.Duration       //
+	Timeformat         string              // e.g., "ns", "us", "ms", "s", "2006-01-02 15:04:05"
+	Timezone           string              // e.g., "UTC",
+	SkipHeader         bool                // whether to skip the first line (header) in CSV files
+	DelayForTest       time.Duration       // for testing purposes, in nanoseconds
+	Include            []string            // patterns of the files to import from directories and globs
+	Exclude            []string            // patterns of the files and directories to skip
+	OrderBy            string              // "name" or "mtime", the import order of the files of a directory
+	MaxWorkers         int                 // maximum number of files imported at the same time
+	CheckpointFile     string              // file of the checkpoints of the imported files, no checkpoints if empty
+	CheckpointInterval time.Duration       // interval of the checkpoints of a file
+	Resume             bool                // skip the imported files and resume the others from their checkpoint
+	RejectDir          string              // directory of the reject files, next to the input files if empty
+	MaxErrors          int64               // maximum number of rejected rows of a file, 0 stops at the first one, no limit if negative
+	MaxErrorRate       float64             // maximum rate of rejected rows of a file, 0.0 to 1.0, no limit if 0
+	Format             string              // "csv" or "jsonl", the format of the input files
+	JSONExtraColumn    string              // JSON column of the fields of a JSON line that no column takes, dropped if empty
+	HeaderMapping      bool                // map the fields of the CSV header to the columns by name
+	HeaderAliases      map[string][]string // other header names of a column, by column name
+	HeaderRequired     []string            // columns that must be in the header, besides the tag name and the base time
+	Pivot              bool                // import every cell of a wide CSV row as a row of a TAG table
+	PivotTimeColumn    string              // header name of the timestamp field of a wide row, the first field if empty
+	PivotTagTemplate   string              // tag name of a cell, "{header}" is replaced by the header name of its field
+	PivotScales        map[string]float64  // factor of the values of a field, by header name
+	ChunkSize          int64               // split a file larger than it into chunks imported in parallel, no split if 0
+	DryRun             bool                // convert the rows and report them without appending
+	CreateTable        bool                // create the table inferred from the sample rows of the first file if it does not exist
+	CreateTableYes     bool                // execute the DDL of CreateTable, it is only printed if false
+	SampleRows         int                 // number of rows sampled to infer the table
+	tz                 *time.Location      // Timezone for parsing datetime fields
+	checkpoints        *Checkpoints        // loaded from CheckpointFile
 }
 
 func NewConfig() *Config {
 	return &Config{
-		DstHost:          "127.0.0.1",
-		DstPort:          5656,
-		DstUser:          "sys",
-		DstPass:          "manager",
-		DstTable:         "",
-		ProgressInterval: 1 * time.Second,
+		DstHost:            "127.0.0.1",
+		DstPort:            5656,
+		DstUser:            "sys",
+		DstPass:            "manager",
+		DstTable:           "",
+		ProgressInterval:   1 * time.Second,
+		OrderBy:            OrderByName,
+		MaxWorkers:         4,
+		CheckpointInterval: 10 * time.Second,
+		Format:             FormatCSV,
+		PivotTagTemplate:   "{header}",
+		SampleRows:         1000,
 	}
 }
 
+// openDatabase returns the machcli database of the destination table
+func (c *Config) openDatabase() (*machcli.Database, error) {
+	return machcli.NewDatabase(&machcli.Config{
+		Host:         c.DstHost,
+		Port:         int(c.DstPort),
+		TrustUsers:   map[string]string{c.DstUser: c.DstPass},
+		MaxOpenConn:  -1,
+		MaxOpenQuery: -1,
+	})
+}
+
 func (c *Config) NewWorker(input string) *Worker {
 	var err error
 	c.tz = time.Local
@@ -69,6 +109,9 @@ type Worker struct {
 	log   *util.Log
 	conf  *Config
 	input string
+	start int64 // offset of the chunk of the input
+	end   int64 // end offset of the chunk of the input, the whole input if 0
+	line  int64 // number of lines before the chunk
 }
 
 func (w *Worker) PreStart(ctx *actor.Context) error {
@@ -79,69 +122,81 @@ func (w *Worker) PreStart(ctx *actor.Context) error {
 func (w *Worker) PostStop(ctx *actor.Context) error { return nil }
 
 func (w *Worker) Receive(ctx *actor.ReceiveContext) {
-	switch ctx.Message().(type) {
+	switch msg := ctx.Message().(type) {
 	case *Request:
+		if msg.Src != "" {
+			w.input = msg.Src
+		}
+		w.start, w.end, w.line = msg.Start, msg.End, msg.Line
 		w.doImport(ctx)
 	default:
 		ctx.Unhandled()
 	}
 }
 
+// name is the input, or the chunk of the input, in the log, the checkpoints and the reject files
+func (w *Worker) name() string {
+	if w.end > 0 {
+		return chunkName(w.input, w.start, w.end)
+	}
+	return w.input
+}
+
 func (w *Worker) doImport(ctx *actor.ReceiveContext) {
+	name := w.name()
 	replyError := func(err error) {
 		w.log.Errorf("Worker %s error: %v", ctx.Self().Name(), err)
-		prog := &Progress{Src: w.input, State: int32(WorkStateError), Message: err.Error()}
+		prog := &Progress{Src: name, State: int32(WorkStateError), Message: err.Error()}
 		ctx.Tell(ctx.Sender(), prog)
 		ctx.Err(err)
 	}
 
-	data, err := os.Open(w.input)
+	input, err := openInput(w.input)
 	if err != nil {
 		replyError(err)
 		return
 	}
-	defer data.Close()
+	defer input.Close()
 
-	fileInfo, _ := data.Stat()
+	fileInfo := input.Info()
 	fileSize := fileInfo.Size()
-	progReader := util.NewProgressReader(data, fileSize)
-	defer progReader.Close()
 
-	// column names file, it contains the column names for the CSV file, one name per line
-	columnOrder := make([]string, 0)
-	if w.conf.ColumnNamesFile != "" {
-		columnNamesFile, err := os.Open(w.conf.ColumnNamesFile)
-		if err != nil {
-			replyError(err)
-			return
-		}
-		scanner := bufio.NewScanner(columnNamesFile)
-		for scanner.Scan() {
-			line := scanner.Text()
-			if line == "" {
-				continue // skip empty lines
+	// resume from the checkpoint of the file, unless the file changed since
+	offset, lines := w.start, w.line
+	var rows, rejected, rejectSize int64
+	var resumed bool
+	if w.conf.checkpoints != nil && w.conf.Resume && !w.conf.DryRun {
+		if cp := w.conf.checkpoints.Get(name, fileInfo); cp != nil {
+			if cp.Done {
+				w.log.Printf("%s is already imported, %d rows", name, cp.Rows)
+				ctx.Tell(ctx.Sender(), &Progress{Src: name, State: int32(WorkStateDone), Message: "already imported"})
+				return
 			}
-			fields := strings.Fields(line)
-			if len(fields) == 0 {
-				continue // skip empty lines
-			}
-			columnOrder = append(columnOrder, strings.ToUpper(fields[0]))
+			offset, rows, lines, rejected, rejectSize = cp.Offset, cp.Rows, cp.Lines, cp.Rejected, cp.RejectSize
+			resumed = true
+			w.log.Printf("%s resumes at offset %d, %d rows", name, offset, rows)
 		}
-		if err := scanner.Err(); err != nil {
+	}
+	if err := input.SkipTo(offset); err != nil {
+		replyError(err)
+		return
+	}
+	var src io.Reader = input
+	if w.end > 0 {
+		src = io.LimitReader(input, w.end-offset)
+	}
+
+	// column names file, the column of every field of a CSV row or the field of a JSON column, one per line
+	var columnNames []string
+	if w.conf.ColumnNamesFile != "" {
+		if columnNames, err = readColumnNames(w.conf.ColumnNamesFile); err != nil {
 			replyError(err)
 			return
 		}
-		columnNamesFile.Close()
 	}
 
 	// machcli database
-	db, err := machcli.NewDatabase(&machcli.Config{
-		Host:         w.conf.DstHost,
-		Port:         int(w.conf.DstPort),
-		TrustUsers:   map[string]string{w.conf.DstUser: w.conf.DstPass},
-		MaxOpenConn:  -1,
-		MaxOpenQuery: -1,
-	})
+	db, err := w.conf.openDatabase()
 	if err != nil {
 		replyError(err)
 		return
@@ -166,80 +221,98 @@ func (w *Worker) doImport(ctx *actor.ReceiveContext) {
 		replyError(err)
 		return
 	}
-	if len(cols) > 0 && cols[0].Name == "_ARRIVAL_TIME" &&
-		len(columnOrder) > 0 && columnOrder[0] != "_ARRIVAL_TIME" {
-		cols = cols[1:] // skip _ARRIVAL_TIME column
-	}
-	converters := w.buildConverters(cols)
-
-	var columnOrderIndexes []int
-	if len(columnOrder) > 0 {
-		columnOrderIndexes = make([]int, len(cols))
-		for i, col := range cols {
-			idx := -1
-			for j, name := range columnOrder {
-				if name == col.Name {
-					idx = j
-					break
-				}
-			}
-			columnOrderIndexes[i] = idx
+	if w.conf.HeaderMapping {
+		if columnNames, err = w.conf.headerColumns(w.input, cols); err != nil {
+			appender.Close()
+			replyError(err)
+			return
 		}
 	}
+	records, err := w.newRecordReader(src, cols, columnNames, offset, lines)
+	if err != nil {
+		appender.Close()
+		replyError(err)
+		return
+	}
 
-	prog := &Progress{Src: w.input, State: int32(WorkStateIdle)}
+	// a dry run reports the rejected rows, the reject file of an import stays
+	if w.conf.DryRun {
+		resumed, rejectSize = true, -1
+	}
+	rejects, err := w.conf.newRejectWriter(name, resumed, rejected, rejectSize)
+	if err != nil {
+		appender.Close()
+		replyError(err)
+		return
+	}
+	defer rejects.Close()
+	var report *dryRunReport
+	if w.conf.DryRun {
+		report = newDryRunReport(name, records.Columns(), w.conf.tz)
+	}
+
+	prog := &Progress{Src: name, State: int32(WorkStateIdle)}
 	ctx.Tell(ctx.Sender(), prog)
 
 	now := time.Now()
-	csvReader := csv.NewReader(progReader)
-	shouleSkipHeader := w.conf.SkipHeader
 	progressInterval := w.conf.ProgressInterval
 	if progressInterval <= 0 {
 		progressInterval = 1 * time.Second // default progress interval
 	}
-	for {
-		fields, err := csvReader.Read()
-		if err != nil {
-			if err == io.EOF {
-				break // end of file
-			}
-			appender.Close()
-			replyError(err)
-			break
+	lastCheckpoint := now
+	checkpoint := func(done bool) error {
+		if w.conf.checkpoints == nil || report != nil {
+			return nil
 		}
-		if shouleSkipHeader {
-			shouleSkipHeader = false
-			continue // skip header line
+		if err := rejects.Flush(); err != nil {
+			return err
 		}
-		var values []any
-		if len(columnOrderIndexes) > 0 {
-			values = make([]any, len(columnOrderIndexes))
-			for i, idx := range columnOrderIndexes {
-				if idx < 0 || idx >= len(fields) {
-					continue
-				}
-				values[i], err = converters[i](fields[idx])
-				if err != nil {
-					appender.Close()
-					replyError(err)
-					return
-				}
+		return w.saveCheckpoint(appender, Checkpoint{
+			Path:       name,
+			Size:       fileSize,
+			ModTime:    fileInfo.ModTime(),
+			Offset:     records.Offset(),
+			Rows:       rows,
+			Lines:      records.Lines(),
+			Rejected:   rejects.Count(),
+			RejectSize: rejects.Size(),
+			Done:       done,
+		})
+	}
+	// abort fails the file, the rows appended so far stay in the table
+	abort := func(err error) {
+		appender.Close()
+		w.log.Errorf("Worker %s error: %v", ctx.Self().Name(), err)
+		prog := &Progress{Src: name, State: int32(WorkStateError), Message: err.Error(), Rejected: rejects.Count()}
+		ctx.Tell(ctx.Sender(), prog)
+		ctx.Err(err)
+	}
+	for {
+		rec, err := records.Read()
+		if err == io.EOF {
+			break // end of file
+		} else if err != nil {
+			abort(err)
+			return
+		}
+		rows++
+
+		switch {
+		case report != nil:
+			report.add(rec) // a dry run appends no row and checks every row
+		case rec.err != nil:
+			if err := rejects.Reject(rec.line, rec.err, rec.fields); err != nil {
+				abort(err)
+				return
 			}
-		} else {
-			values = make([]any, len(fields))
-			for i, field := range fields {
-				values[i], err = converters[i](field)
-				if err != nil {
-					appender.Close()
-					replyError(err)
-					return
-				}
+		default:
+			if err := appender.Append(rec.values...); err != nil {
+				abort(err)
+				return
 			}
 		}
-
-		if err := appender.Append(values...); err != nil {
-			appender.Close()
-			replyError(err)
+		if err := w.conf.checkErrorBudget(rejects.Count(), rows, false); err != nil {
+			abort(err)
 			return
 		}
 		// simulate some processing delay
@@ -247,36 +320,97 @@ func (w *Worker) doImport(ctx *actor.ReceiveContext) {
 			time.Sleep(w.conf.DelayForTest)
 		}
 
+		// a checkpoint is between the rows of the file
+		if !rec.more && w.conf.CheckpointInterval > 0 && time.Since(lastCheckpoint) > w.conf.CheckpointInterval {
+			lastCheckpoint = time.Now()
+			if err := checkpoint(false); err != nil {
+				abort(err)
+				return
+			}
+		}
+
 		if ts := time.Now(); ts.Sub(now) > progressInterval {
 			now = ts
 			prog = &Progress{
-				Src:      w.input,
+				Src:      name,
 				State:    int32(WorkStateProgress),
-				Progress: progReader.Progress(),
+				Progress: input.Progress(),
+			}
+			if w.end > 0 {
+				prog.Progress = float64(records.Offset()-w.start) / float64(w.end-w.start)
 			}
 			ctx.Tell(ctx.Sender(), prog)
 		}
 	}
+	if report != nil {
+		appender.Close()
+		prog = &Progress{Src: name, State: int32(WorkStateDone), Success: report.Rows - report.Rejected, Rejected: report.Rejected,
+			Message: report.String(), DryRun: report.DryRun}
+		ctx.Tell(ctx.Sender(), prog)
+		return
+	}
+	if err := w.conf.checkErrorBudget(rejects.Count(), rows, true); err != nil {
+		abort(err)
+		return
+	}
 
 	succ, fail, err := appender.Close()
 	if err != nil {
 		replyError(err)
 		return
 	}
-	prog = &Progress{Src: w.input, State: int32(WorkStateDone), Success: succ, Fail: fail}
+	if err := checkpoint(true); err != nil {
+		replyError(err)
+		return
+	}
+	if rejects.Count() > 0 {
+		w.log.Printf("%s: %d rows rejected, see %s", name, rejects.Count(), rejects.path)
+	}
+	prog = &Progress{Src: name, State: int32(WorkStateDone), Success: succ, Fail: fail, Rejected: rejects.Count()}
 	ctx.Tell(ctx.Sender(), prog)
 }
 
+// saveCheckpoint flushes the appended rows before it records the checkpoint,
+// so the checkpoint never runs ahead of the rows in the database.
+// The checkpoint of a done file is saved after the appender is closed.
+func (w *Worker) saveCheckpoint(appender api.Appender, cp Checkpoint) error {
+	if !cp.Done {
+		flusher, ok := appender.(api.Flusher)
+		if !ok {
+			return nil // the rows in the database are unknown
+		}
+		if err := flusher.Flush(); err != nil {
+			return err
+		}
+	}
+	return w.conf.checkpoints.Save(cp)
+}
+
+// buildConverters returns the converters of the fields to the column values.
+// An empty field is NULL, a field that is not a valid value of its column is an error.
 func (w *Worker) buildConverters(cols api.Columns) []func(string) (any, error) {
 	converters := make([]func(string) (any, error), len(cols))
 	for i, col := range cols {
 		switch col.Type {
-		case api.ColumnTypeShort, api.ColumnTypeUShort, api.ColumnTypeInteger, api.ColumnTypeUInteger:
-			converters[i] = func(s string) (any, error) { v, _ := strconv.Atoi(s); return v, nil }
-		case api.ColumnTypeLong, api.ColumnTypeULong:
-			converters[i] = func(s string) (any, error) { v, _ := strconv.ParseInt(s, 10, 64); return v, nil }
+		case api.ColumnTypeShort:
+			converters[i] = parseInt(16)
+		case api.ColumnTypeUShort:
+			converters[i] = parseUint(16)
+		case api.ColumnTypeInteger:
+			converters[i] = parseInt(32)
+		case api.ColumnTypeUInteger:
+			converters[i] = parseUint(32)
+		case api.ColumnTypeLong:
+			converters[i] = parseInt64(false)
+		case api.ColumnTypeULong:
+			converters[i] = parseInt64(true)
 		case api.ColumnTypeFloat, api.ColumnTypeDouble:
-			converters[i] = func(s string) (any, error) { v, _ := strconv.ParseFloat(s, 64); return v, nil }
+			converters[i] = func(s string) (any, error) {
+				if s = strings.TrimSpace(s); s == "" {
+					return nil, nil
+				}
+				return strconv.ParseFloat(s, 64)
+			}
 		case api.ColumnTypeVarchar, api.ColumnTypeText:
 			converters[i] = func(s string) (any, error) {
 				if s == "" {
@@ -286,31 +420,31 @@ func (w *Worker) buildConverters(cols api.Columns) []func(string) (any, error) {
 			}
 		case api.ColumnTypeDatetime:
 			converters[i] = func(s string) (any, error) {
+				if s = strings.TrimSpace(s); s == "" {
+					return nil, nil
+				}
+				var unit int64
 				switch w.conf.Timeformat {
 				case "s":
-					v, _ := strconv.ParseInt(s, 10, 64)
-					return v * int64(time.Second), nil
+					unit = int64(time.Second)
 				case "ms":
-					v, _ := strconv.ParseInt(s, 10, 64)
-					return v * int64(time.Millisecond), nil
+					unit = int64(time.Millisecond)
 				case "us":
-					v, _ := strconv.ParseInt(s, 10, 64)
-					return v * int64(time.Microsecond), nil
-				case "ns":
-					v, _ := strconv.ParseInt(s, 10, 64)
-					return v, nil
+					unit = int64(time.Microsecond)
+				case "ns", "":
+					unit = 1
 				default:
-					if w.conf.Timeformat != "" {
-						t, err := time.ParseInLocation(w.conf.Timeformat, s, w.conf.tz)
-						if err != nil {
-							return nil, err
-						}
-						return t.UnixNano(), nil
-					} else {
-						v, _ := strconv.ParseInt(s, 10, 64)
-						return v, nil
+					t, err := time.ParseInLocation(w.conf.Timeformat, s, w.conf.tz)
+					if err != nil {
+						return nil, err
 					}
+					return t.UnixNano(), nil
+				}
+				v, err := strconv.ParseInt(s, 10, 64)
+				if err != nil {
+					return nil, err
 				}
+				return v * unit, nil
 			}
 		case api.ColumnTypeIPv4:
 			converters[i] = func(s string) (any, error) { return s, nil }
@@ -318,9 +452,54 @@ func (w *Worker) buildConverters(cols api.Columns) []func(string) (any, error) {
 			converters[i] = func(s string) (any, error) { return s, nil }
 		case api.ColumnTypeJSON:
 			converters[i] = func(s string) (any, error) { return s, nil }
-		case api.ColumnTypeUnknown:
+		default:
 			converters[i] = func(s string) (any, error) { return s, nil }
 		}
 	}
 	return converters
 }
+
+// parseInt returns the converter of a signed integer of the bit size
+func parseInt(bitSize int) func(string) (any, error) {
+	return func(s string) (any, error) {
+		if s = strings.TrimSpace(s); s == "" {
+			return nil, nil
+		}
+		v, err := strconv.ParseInt(s, 10, bitSize)
+		if err != nil {
+			return nil, err
+		}
+		return int(v), nil
+	}
+}
+
+// parseUint returns the converter of an unsigned integer of the bit size
+func parseUint(bitSize int) func(string) (any, error) {
+	return func(s string) (any, error) {
+		if s = strings.TrimSpace(s); s == "" {
+			return nil, nil
+		}
+		v, err := strconv.ParseUint(s, 10, bitSize)
+		if err != nil {
+			return nil, err
+		}
+		return int(v), nil
+	}
+}
+
+// parseInt64 returns the converter of a long, the values of an unsigned long are the non negative int64
+func parseInt64(unsigned bool) func(string) (any, error) {
+	return func(s string) (any, error) {
+		if s = strings.TrimSpace(s); s == "" {
+			return nil, nil
+		}
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if unsigned && v < 0 {
+			return nil, fmt.Errorf("negative value %d", v)
+		}
+		return v, nil
+	}
+}
@@ -49,6 +49,8 @@ func Protoc() error {
 		{srcDir: "./greetings", proto: "greetings.proto", dstDir: "./greetings"},
 		{srcDir: "./trjd", proto: "trjd.proto", dstDir: "./trjd"},
 		{srcDir: "./loader", proto: "loader.proto", dstDir: "./loader"},
+		{srcDir: "./k2m/sparkplug", proto: "sparkplug_b.proto", dstDir: "./k2m/sparkplug"},
+		{srcDir: "./k2m", proto: "k2m.proto", dstDir: "./k2m"},
 	}
 
 	for _, file := range protoFiles {
@@ -35,6 +35,17 @@ func (pr *ProgressReader) Read(p []byte) (n int, err error) {
 	return n, err
 }
 
+// Skip counts n bytes as read without reading them,
+// for a reader that starts in the middle of its input
+func (pr *ProgressReader) Skip(n int64) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	pr.current += n
+	if pr.total > 0 {
+		pr.progress = float64(pr.current) / float64(pr.total)
+	}
+}
+
 func (pr *ProgressReader) Progress() float64 {
 	return pr.progress
 }